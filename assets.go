@@ -0,0 +1,8 @@
+// Package gonote holds the templates and static assets, embedded so the
+// server binary can run from any directory.
+package gonote
+
+import "embed"
+
+//go:embed html css img js
+var FS embed.FS
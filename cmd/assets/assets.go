@@ -0,0 +1,104 @@
+package assets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Dirs are the directories served as static assets, each mounted at
+// /<dir>/.
+var Dirs = []string{"css", "img", "js"}
+
+// Static serves the files under Dirs. Outside of dev mode each file is
+// hashed once at startup so URL can hand out cache-busting links that
+// are safe to cache forever.
+type Static struct {
+	FS     fs.FS
+	Dev    bool
+	hashes map[string]string
+}
+
+func New(fsys fs.FS, dev bool) (*Static, error) {
+	static := &Static{
+		FS:     fsys,
+		Dev:    dev,
+		hashes: map[string]string{},
+	}
+	if dev {
+		return static, nil
+	}
+
+	for _, dir := range Dirs {
+		err := fs.WalkDir(fsys, dir, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			contents, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(contents)
+			static.hashes[name] = hex.EncodeToString(sum[:])[:12]
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return static, nil
+}
+
+// URL returns the public URL of an asset, e.g. "css/index.css" becomes
+// "/css/index.css?v=3f2a1c9b0d4e".
+func (static *Static) URL(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if hash, ok := static.hashes[name]; ok {
+		return "/" + name + "?v=" + hash
+	}
+	return "/" + name
+}
+
+// Register mounts every directory in Dirs on e.
+func (static *Static) Register(e *echo.Echo) {
+	for _, dir := range Dirs {
+		e.Match([]string{http.MethodGet, http.MethodHead}, "/"+dir+"/*", static.Serve)
+	}
+}
+
+func (static *Static) Serve(c echo.Context) error {
+	name := strings.TrimPrefix(path.Clean(c.Request().URL.Path), "/")
+	if !inDirs(name) {
+		return echo.ErrNotFound
+	}
+
+	header := c.Response().Header()
+	switch hash, ok := static.hashes[name]; {
+	case static.Dev:
+		header.Set("Cache-Control", "no-cache")
+	case !ok:
+		return echo.ErrNotFound
+	case c.QueryParam("v") == hash:
+		header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		header.Set("Cache-Control", "public, max-age=300")
+	}
+
+	http.ServeFileFS(c.Response(), c.Request(), static.FS, name)
+	return nil
+}
+
+func inDirs(name string) bool {
+	for _, dir := range Dirs {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package assets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/labstack/echo/v4"
+)
+
+var testFS = fstest.MapFS{
+	"css/index.css":   {Data: []byte("body { margin: 0; }")},
+	"js/index.js":     {Data: []byte("console.log(1)")},
+	"img/logo.svg":    {Data: []byte("<svg></svg>")},
+	"html/index.html": {Data: []byte("<!DOCTYPE html>")},
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func newStatic(t *testing.T, dev bool) (*Static, *echo.Echo) {
+	t.Helper()
+
+	static, err := New(testFS, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	static.Register(e)
+	return static, e
+}
+
+func TestURL(t *testing.T) {
+	static, _ := newStatic(t, false)
+	hash := hashOf(testFS["css/index.css"].Data)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"css/index.css", "/css/index.css?v=" + hash},
+		{"/css/index.css", "/css/index.css?v=" + hash},
+		{"js/index.js", "/js/index.js?v=" + hashOf(testFS["js/index.js"].Data)},
+		{"css/missing.css", "/css/missing.css"},
+		// Only files under Dirs are served, so only they are hashed
+		{"html/index.html", "/html/index.html"},
+	}
+	for _, tt := range tests {
+		if got := static.URL(tt.name); got != tt.want {
+			t.Errorf("URL(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// The hash follows the content
+	changed := fstest.MapFS{}
+	for name, file := range testFS {
+		changed[name] = file
+	}
+	changed["css/index.css"] = &fstest.MapFile{Data: []byte("body { margin: 1em; }")}
+	other, err := New(changed, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := other.URL("css/index.css"); got == static.URL("css/index.css") {
+		t.Errorf("URL = %q for different content", got)
+	}
+
+	dev, _ := newStatic(t, true)
+	if got := dev.URL("css/index.css"); got != "/css/index.css" {
+		t.Errorf("dev URL = %q, want it unhashed", got)
+	}
+}
+
+func TestServe(t *testing.T) {
+	hash := hashOf(testFS["css/index.css"].Data)
+
+	tests := []struct {
+		name   string
+		dev    bool
+		method string
+		target string
+		status int
+		cache  string
+	}{
+		{"hashed", false, http.MethodGet, "/css/index.css?v=" + hash, 200, "public, max-age=31536000, immutable"},
+		{"head", false, http.MethodHead, "/css/index.css?v=" + hash, 200, "public, max-age=31536000, immutable"},
+		{"unhashed", false, http.MethodGet, "/css/index.css", 200, "public, max-age=300"},
+		{"stale hash", false, http.MethodGet, "/css/index.css?v=000000000000", 200, "public, max-age=300"},
+		{"dev", true, http.MethodGet, "/css/index.css?v=" + hash, 200, "no-cache"},
+		{"missing", false, http.MethodGet, "/css/missing.css", 404, ""},
+		{"outside dirs", false, http.MethodGet, "/css/../html/index.html", 404, ""},
+		{"outside dirs in dev", true, http.MethodGet, "/js/../html/index.html", 404, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, e := newStatic(t, tt.dev)
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != tt.cache {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.cache)
+			}
+			if tt.status == 200 && tt.method == http.MethodGet && rec.Body.String() != "body { margin: 0; }" {
+				t.Errorf("body = %q", rec.Body.String())
+			}
+		})
+	}
+}
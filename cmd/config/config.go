@@ -0,0 +1,360 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Prefix is prepended to every environment variable read by Load,
+// e.g. GONOTE_LISTEN or GONOTE_FEATURES_SEARCH.
+const Prefix = "GONOTE_"
+
+// DefaultFile is read when no -config flag or GONOTE_CONFIG is given.
+// A missing default file is not an error.
+const DefaultFile = "gonote.toml"
+
+type Config struct {
+	Listen       string   `toml:"listen"`
+	DBPath       string   `toml:"db_path"`
+	DataDir      string   `toml:"data_dir"`
+	ArchiveLimit int      `toml:"archive_limit"`
+	LogLevel     string   `toml:"log_level"`
+	Dev          bool     `toml:"dev"`
+	Features     Features `toml:"features"`
+	// ShutdownTimeout bounds how long in-flight requests get to finish
+	// after SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout"`
+	// MaxUploadSize is the largest attachment accepted, in bytes.
+	MaxUploadSize int `toml:"max_upload_size"`
+	// KeyFile holds the key the database is encrypted at rest with.
+	// GONOTE_KEY can give the key itself instead; it is never read from
+	// the config file.
+	KeyFile string `toml:"key_file"`
+	Key     string `toml:"-"`
+}
+
+// Features toggle parts of the app. Signup lets anyone reaching the
+// server create an account; with it off, only the first account can be
+// created.
+type Features struct {
+	Archive bool `toml:"archive"`
+	Search  bool `toml:"search"`
+	Signup  bool `toml:"signup"`
+}
+
+var LogLevels = []string{"debug", "info", "warn", "error", "off"}
+
+func Default() Config {
+	return Config{
+		Listen:        ":1337",
+		DBPath:        "notes.db",
+		DataDir:       "./db",
+		ArchiveLimit:  20,
+		MaxUploadSize: 10 << 20,
+		LogLevel:      "info",
+		Features: Features{
+			Archive: true,
+			Search:  true,
+			Signup:  true,
+		},
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+// KeySize is the length of the key the database is encrypted at rest
+// with, before base64 encoding.
+const KeySize = 32
+
+// Load builds the config from, in increasing order of precedence:
+// defaults, the config file, GONOTE_* environment variables and
+// command line flags.
+func Load(args []string) (Config, error) {
+	cfg, _, err := LoadArgs(args)
+	return cfg, err
+}
+
+// LoadArgs is Load for commands, also returning the arguments left after
+// the flags.
+func LoadArgs(args []string) (Config, []string, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("go-note", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	file := fs.String("config", "", "path to a TOML config file")
+	listen := fs.String("listen", "", "address to listen on, e.g. :1337")
+	db_path := fs.String("db", "", "path to the sqlite database, relative to -data-dir")
+	data_dir := fs.String("data-dir", "", "directory holding the database and other data")
+	archive_limit := fs.Int("archive-limit", 0, "number of notes kept before the oldest is archived")
+	max_upload_size := fs.Int("max-upload-size", 0, "largest attachment accepted, in bytes")
+	log_level := fs.String("log-level", "", "one of "+strings.Join(LogLevels, ", "))
+	dev := fs.Bool("dev", false, "read templates and assets from disk instead of the binary")
+	archive := fs.Bool("archive", false, "enable the archive")
+	search := fs.Bool("search", false, "enable quick search")
+	signup := fs.Bool("signup", false, "let anyone create an account")
+	shutdown_timeout := fs.Duration("shutdown-timeout", 0, "how long in-flight requests get to finish on shutdown")
+	key_file := fs.String("key-file", "", "file holding the key the database is encrypted at rest with")
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, fmt.Errorf("config: %w", err)
+	}
+
+	path := *file
+	if path == "" {
+		path = os.Getenv(Prefix + "CONFIG")
+	}
+	if err := cfg.loadFile(path); err != nil {
+		return cfg, nil, err
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return cfg, nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = *listen
+		case "db":
+			cfg.DBPath = *db_path
+		case "data-dir":
+			cfg.DataDir = *data_dir
+		case "archive-limit":
+			cfg.ArchiveLimit = *archive_limit
+		case "max-upload-size":
+			cfg.MaxUploadSize = *max_upload_size
+		case "log-level":
+			cfg.LogLevel = *log_level
+		case "dev":
+			cfg.Dev = *dev
+		case "archive":
+			cfg.Features.Archive = *archive
+		case "search":
+			cfg.Features.Search = *search
+		case "signup":
+			cfg.Features.Signup = *signup
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = *shutdown_timeout
+		case "key-file":
+			cfg.KeyFile = *key_file
+		}
+	})
+
+	return cfg, fs.Args(), cfg.Validate()
+}
+
+func (cfg *Config) loadFile(path string) error {
+	explicit := path != ""
+	if !explicit {
+		path = DefaultFile
+	}
+	meta, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("config: reading %s: %w", path, err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("config: unknown key %q in %s", undecoded[0].String(), path)
+	}
+
+	return nil
+}
+
+func (cfg *Config) loadEnv() error {
+	var errs []error
+
+	str := func(name string, dst *string) {
+		if v, ok := os.LookupEnv(Prefix + name); ok {
+			*dst = v
+		}
+	}
+	num := func(name string, dst *int) {
+		if v, ok := os.LookupEnv(Prefix + name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("config: %s%s must be an integer, got %q", Prefix, name, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	duration := func(name string, dst *time.Duration) {
+		if v, ok := os.LookupEnv(Prefix + name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("config: %s%s must be a duration like 10s, got %q", Prefix, name, v))
+				return
+			}
+			*dst = d
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v, ok := os.LookupEnv(Prefix + name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("config: %s%s must be true or false, got %q", Prefix, name, v))
+				return
+			}
+			*dst = b
+		}
+	}
+
+	str("LISTEN", &cfg.Listen)
+	str("DB_PATH", &cfg.DBPath)
+	str("DATA_DIR", &cfg.DataDir)
+	num("ARCHIVE_LIMIT", &cfg.ArchiveLimit)
+	num("MAX_UPLOAD_SIZE", &cfg.MaxUploadSize)
+	str("LOG_LEVEL", &cfg.LogLevel)
+	boolean("DEV", &cfg.Dev)
+	boolean("FEATURES_ARCHIVE", &cfg.Features.Archive)
+	boolean("FEATURES_SEARCH", &cfg.Features.Search)
+	boolean("FEATURES_SIGNUP", &cfg.Features.Signup)
+	duration("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout)
+	str("KEY_FILE", &cfg.KeyFile)
+	str("KEY", &cfg.Key)
+
+	return errors.Join(errs...)
+}
+
+func (cfg Config) Validate() error {
+	var errs []error
+
+	if _, port, err := net.SplitHostPort(cfg.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("config: listen must be host:port, got %q", cfg.Listen))
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		errs = append(errs, fmt.Errorf("config: listen has an invalid port %q", port))
+	}
+	if cfg.DBPath == "" {
+		errs = append(errs, errors.New("config: db_path cannot be empty"))
+	}
+	if cfg.DataDir == "" {
+		errs = append(errs, errors.New("config: data_dir cannot be empty"))
+	} else if info, err := os.Stat(cfg.DataDir); err == nil && !info.IsDir() {
+		errs = append(errs, fmt.Errorf("config: data_dir %q is not a directory", cfg.DataDir))
+	}
+	if cfg.ArchiveLimit < 1 {
+		errs = append(errs, fmt.Errorf("config: archive_limit must be at least 1, got %d", cfg.ArchiveLimit))
+	}
+	if cfg.MaxUploadSize < 1 {
+		errs = append(errs, fmt.Errorf("config: max_upload_size must be at least 1, got %d", cfg.MaxUploadSize))
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("config: shutdown_timeout must be positive, got %s", cfg.ShutdownTimeout))
+	}
+	if cfg.KeyFile != "" && cfg.Key != "" {
+		errs = append(errs, fmt.Errorf("config: set key_file or %sKEY, not both", Prefix))
+	} else if cfg.Key != "" {
+		if _, err := DecodeKey(cfg.Key); err != nil {
+			errs = append(errs, fmt.Errorf("config: %sKEY: %w", Prefix, err))
+		}
+	} else if cfg.KeyFile != "" {
+		if _, err := ReadKeyFile(cfg.KeyFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if !isLogLevel(cfg.LogLevel) {
+		errs = append(errs, fmt.Errorf(
+			"config: log_level must be one of %s, got %q",
+			strings.Join(LogLevels, ", "),
+			cfg.LogLevel,
+		))
+	}
+
+	return errors.Join(errs...)
+}
+
+// DBFile is the database path with relative paths resolved against
+// DataDir.
+func (cfg Config) DBFile() string {
+	if filepath.IsAbs(cfg.DBPath) {
+		return cfg.DBPath
+	}
+	return filepath.Join(cfg.DataDir, cfg.DBPath)
+}
+
+// StoreKey is the key the database is encrypted at rest with, read from
+// KeyFile or Key, or nil when neither is set.
+func (cfg Config) StoreKey() ([]byte, error) {
+	if cfg.Key != "" {
+		return DecodeKey(cfg.Key)
+	}
+	if cfg.KeyFile == "" {
+		return nil, nil
+	}
+	return ReadKeyFile(cfg.KeyFile)
+}
+
+// ReadKeyFile reads a key written by NewKeyFile.
+func ReadKeyFile(path string) ([]byte, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: reading key: %w", err)
+	}
+	key, err := DecodeKey(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("config: %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// NewKeyFile writes a new random key to path, readable only by its
+// owner, failing if the file already exists.
+func NewKeyFile(path string) ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("config: writing key: %w", err)
+	}
+	_, err = fmt.Fprintln(file, base64.StdEncoding.EncodeToString(key))
+	if err = errors.Join(err, file.Close()); err != nil {
+		return nil, fmt.Errorf("config: writing key: %w", err)
+	}
+	return key, nil
+}
+
+// DecodeKey decodes a base64 key of KeySize bytes, ignoring surrounding
+// whitespace.
+func DecodeKey(text string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, base64 encoded", KeySize)
+	}
+	return key, nil
+}
+
+// Enabled reports whether the named feature toggle is on. Unknown
+// names are always off.
+func (f Features) Enabled(name string) bool {
+	switch name {
+	case "archive":
+		return f.Archive
+	case "search":
+		return f.Search
+	case "signup":
+		return f.Signup
+	}
+	return false
+}
+
+func isLogLevel(level string) bool {
+	for _, l := range LogLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes text to name in a temporary directory, returning its
+// path.
+func writeFile(t *testing.T, name string, text string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "gonote.toml", `
+listen = ":2000"
+archive_limit = 30
+log_level = "warn"
+
+[features]
+search = false
+`)
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		listen  string
+		limit   int
+		level   string
+		search  bool
+		archive bool
+	}{
+		{"defaults", nil, nil, ":1337", 20, "info", true, true},
+		{"file over defaults", map[string]string{"CONFIG": file}, nil, ":2000", 30, "warn", false, true},
+		{
+			"env over file",
+			map[string]string{"CONFIG": file, "LISTEN": ":3000", "ARCHIVE_LIMIT": "40", "FEATURES_SEARCH": "true"},
+			nil,
+			":3000", 40, "warn", true, true,
+		},
+		{
+			"flags over env",
+			map[string]string{"LISTEN": ":3000", "ARCHIVE_LIMIT": "40", "FEATURES_ARCHIVE": "false"},
+			[]string{"-config", file, "-archive-limit", "50", "-archive", "-log-level", "debug"},
+			":3000", 50, "debug", false, true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(Prefix+name, value)
+			}
+
+			cfg, err := Load(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Listen != tt.listen || cfg.ArchiveLimit != tt.limit || cfg.LogLevel != tt.level {
+				t.Errorf("listen, archive_limit, log_level = %q, %d, %q, want %q, %d, %q",
+					cfg.Listen, cfg.ArchiveLimit, cfg.LogLevel, tt.listen, tt.limit, tt.level)
+			}
+			if cfg.Features.Search != tt.search || cfg.Features.Archive != tt.archive {
+				t.Errorf("features = %+v, want search %t, archive %t", cfg.Features, tt.search, tt.archive)
+			}
+		})
+	}
+}
+
+func TestLoadArgs(t *testing.T) {
+	_, rest, err := LoadArgs([]string{"-listen", ":4000", "new.key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 1 || rest[0] != "new.key" {
+		t.Errorf("rest = %q, want [new.key]", rest)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	key_file := filepath.Join(t.TempDir(), "gonote.key")
+	if _, err := NewKeyFile(key_file); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"bad port", nil, []string{"-listen", ":99999"}, `listen has an invalid port "99999"`},
+		{"no port", nil, []string{"-listen", "localhost"}, `listen must be host:port, got "localhost"`},
+		{"negative archive limit", nil, []string{"-archive-limit", "-1"}, "archive_limit must be at least 1, got -1"},
+		{"archive limit not a number", map[string]string{"ARCHIVE_LIMIT": "many"}, nil, `GONOTE_ARCHIVE_LIMIT must be an integer, got "many"`},
+		{"bad duration", map[string]string{"SHUTDOWN_TIMEOUT": "10"}, nil, `GONOTE_SHUTDOWN_TIMEOUT must be a duration like 10s, got "10"`},
+		{"unknown log level", nil, []string{"-log-level", "loud"}, `log_level must be one of debug, info, warn, error, off, got "loud"`},
+		{"unknown flag", nil, []string{"-port", "1337"}, "flag provided but not defined: -port"},
+		{"missing config file", nil, []string{"-config", "missing.toml"}, "reading missing.toml"},
+		{"unknown key", map[string]string{"CONFIG": writeFile(t, "gonote.toml", "port = 1337\n")}, nil, `unknown key "port"`},
+		{"data dir is a file", nil, []string{"-data-dir", key_file}, "is not a directory"},
+		{"unreadable key file", nil, []string{"-key-file", "missing.key"}, "reading key"},
+		{"malformed key file", nil, []string{"-key-file", writeFile(t, "short.key", "c2hvcnQ=\n")}, "key must be 32 bytes, base64 encoded"},
+		{"malformed key", map[string]string{"KEY": "short"}, nil, "GONOTE_KEY: key must be 32 bytes"},
+		{"key and key file", map[string]string{"KEY": "short"}, []string{"-key-file", key_file}, "set key_file or GONOTE_KEY, not both"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(Prefix+name, value)
+			}
+
+			_, err := Load(tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gonote.key")
+	key, err := NewKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != KeySize {
+		t.Errorf("key is %d bytes, want %d", len(key), KeySize)
+	}
+	if _, err = NewKeyFile(path); err == nil {
+		t.Error("overwrote the key file")
+	}
+
+	cfg, err := Load([]string{"-key-file", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := cfg.StoreKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read) != string(key) {
+		t.Error("read a different key")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("key file mode = %v, want 0600", info.Mode().Perm())
+	}
+}
@@ -1,65 +1,138 @@
 package main
 
 import (
-	"html/template"
-	"io"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	gonote "github.com/jadenrose/go-note"
+	"github.com/jadenrose/go-note/cmd/assets"
+	"github.com/jadenrose/go-note/cmd/config"
 	"github.com/jadenrose/go-note/cmd/routes"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
 )
 
-type Templates struct {
-	Templates *template.Template
+var logLevels = map[string]log.Lvl{
+	"debug": log.DEBUG,
+	"info":  log.INFO,
+	"warn":  log.WARN,
+	"error": log.ERROR,
+	"off":   log.OFF,
 }
 
-func (t *Templates) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
-	return t.Templates.ExecuteTemplate(w, name, data)
-}
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rotate-key" {
+		os.Exit(rotateKey(os.Args[2:]))
+	}
 
-func newTemplate() *Templates {
-	return &Templates{
-		Templates: template.Must(template.ParseGlob("html/*.html")),
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err = os.MkdirAll(cfg.DataDir, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "config: creating data_dir: %v\n", err)
+		os.Exit(1)
+	}
+	routes.Configure(cfg)
+	if err = routes.Open(); err != nil {
+		fmt.Fprintf(os.Stderr, "db: opening %s: %v\n", cfg.DBFile(), err)
+		os.Exit(1)
+	}
+
+	var fsys fs.FS = gonote.FS
+	if cfg.Dev {
+		fsys = os.DirFS(".")
+	}
+	static, err := assets.New(fsys, cfg.Dev)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "assets: %v\n", err)
+		os.Exit(1)
 	}
-}
 
-func main() {
 	e := echo.New()
-	e.Use(middleware.Logger())
-	e.Renderer = newTemplate()
+	e.HideBanner = true
+	e.Logger.SetLevel(logLevels[cfg.LogLevel])
+	if cfg.LogLevel != "off" {
+		e.Use(middleware.Logger())
+	}
+	e.Renderer = routes.NewTemplates(cfg, fsys, static)
+	e.HTTPErrorHandler = routes.HandleError
+	e.Use(middleware.Recover())
+	e.Use(routes.Serialize)
 
-	e.Static("/css", "css")
-	e.Static("/img", "img")
-	e.Static("/js", "js")
+	static.Register(e)
 
-	e.GET("/", routes.Index)
+	routes.Register(e)
+	// Event streams only end when told to, so shutting down ends them
+	e.Server.RegisterOnShutdown(routes.CloseEvents)
 
-	e.GET("/preview-links", routes.GetPreviewLinks)
-	e.GET("/more-options/show", routes.ShowMoreOptions)
-	e.GET("/more-options/hide", routes.HideMoreOptions)
-	e.DELETE("/notes/:note_id", routes.DeleteNote)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	e.GET("/notes/new", routes.GetNewNote)
-	e.POST("/notes", routes.PostNote)
-	e.GET("/notes/:note_id", routes.GetNoteContent)
-	e.GET("/notes/:note_id/edit", routes.GetTitleEditor)
-	e.PUT("/notes/:note_id", routes.PutTitle)
+	go func() {
+		if err := e.Start(cfg.Listen); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
 
-	e.GET("/blocks/new", routes.GetNewBlock)
-	e.GET("/blocks/:block_id/edit", routes.GetBlockEditor)
-	e.GET("/blocks/:block_id/move", routes.GetBlockMover)
-	e.GET("/blocks/:block_id/move/cancel", routes.CancelBlockMover)
-	e.POST("/blocks", routes.PostBlock)
-	e.PUT("/blocks/:block_id", routes.PutBlock)
-	e.PUT("/blocks/:block_id/move", routes.MoveBlock)
-	e.DELETE("/blocks/:block_id", routes.DeleteBlock)
+	<-ctx.Done()
+	stop()
+	e.Logger.Info("shutting down")
 
-	e.GET("/archive", routes.GetArchiveList)
-	e.GET("/archive/:archived_note_id", routes.GetArchivedNote)
-	e.POST("/archive/:archived_note_id", routes.RestoreArchivedNote)
-	e.DELETE("/archive/all", routes.ClearArchive)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err = e.Shutdown(ctx); err != nil {
+		e.Logger.Error("draining requests: ", err)
+		e.Close()
+	}
+	// Draining may have used up its time, and the database still needs
+	// its own to close cleanly
+	db_ctx, db_cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer db_cancel()
+	if err = routes.Shutdown(db_ctx); err != nil {
+		e.Logger.Error("closing db: ", err)
+		db_cancel()
+		cancel()
+		os.Exit(1)
+	}
+}
 
-	e.POST("/search", routes.QuickSearch)
+// rotateKey seals the database under the key in a new key file, writing a
+// new key there first if the file does not exist yet. The server must be
+// stopped while it runs, and started again with key_file set to the new
+// file. A database that was not encrypted at rest is encrypted.
+func rotateKey(args []string) int {
+	cfg, rest, err := config.LoadArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(rest) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: go-note rotate-key [flags] NEW_KEY_FILE")
+		return 2
+	}
+	key, err := config.ReadKeyFile(rest[0])
+	if errors.Is(err, os.ErrNotExist) {
+		key, err = config.NewKeyFile(rest[0])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
 
-	e.Logger.Fatal(e.Start(":1337"))
+	routes.Configure(cfg)
+	if err = routes.RotateKey(key); err != nil {
+		fmt.Fprintf(os.Stderr, "db: rotating the key of %s: %v\n", cfg.DBFile(), err)
+		return 1
+	}
+	fmt.Printf("%s is encrypted with the key in %s; set key_file to it before starting the server\n", cfg.DBFile(), rest[0])
+	return 0
 }
@@ -0,0 +1,395 @@
+package routes
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User is an account notes belong to.
+type User struct {
+	ID       int
+	Username string
+}
+
+// AccountForm is the login or signup page. Signup is whether new
+// accounts can be created.
+type AccountForm struct {
+	Action string
+	Signup bool
+}
+
+// SessionCookie holds the token of a signed in browser. Only a hash of
+// the token is stored, in sessions.
+const SessionCookie = "session"
+
+// SessionLifetime is how long a login lasts.
+const SessionLifetime = 30 * 24 * time.Hour
+
+const MinPasswordLength = 8
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+// dummyHash is compared against when a username does not exist, so a
+// failed login takes as long either way.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// Authenticate is middleware for the routes that need a signed in user,
+// by session cookie or API token. It sets agent.UserID for the rest of
+// the request; without a valid session, pages redirect to /login and
+// everything else gets a 401.
+func Authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var user User
+		var err error
+		if header := c.Request().Header.Get(echo.HeaderAuthorization); header != "" {
+			user, err = getTokenUser(c, header)
+		} else {
+			user, err = getSessionUser(c)
+		}
+		if err != nil {
+			return err
+		}
+		if user.ID == 0 {
+			return loginRequired(c)
+		}
+		agent.UserID = user.ID
+		agent.Tab = c.Request().Header.Get(TabHeader)
+		if cookie, err := c.Cookie(SessionCookie); err == nil && c.Get("api_token") == nil {
+			agent.Session = hashToken(cookie.Value)
+		}
+		defer func() {
+			agent.UserID = 0
+			agent.Tab = ""
+			agent.Session = ""
+		}()
+		c.Set("user", user)
+
+		return next(c)
+	}
+}
+
+func loginRequired(c echo.Context) error {
+	req := c.Request()
+	if req.Header.Get("HX-Request") == "true" {
+		c.Response().Header().Set("HX-Redirect", "/login")
+	} else if req.Method == http.MethodGet && strings.Contains(req.Header.Get("Accept"), "text/html") {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	return echo.NewHTTPError(401, "Log in to continue")
+}
+
+func GetLogin(c echo.Context) error {
+	signup, err := signupOpen()
+	if err != nil {
+		return err
+	}
+	return c.Render(200, "account-page", AccountForm{Action: "login", Signup: signup})
+}
+
+func GetSignup(c echo.Context) error {
+	signup, err := signupOpen()
+	if err != nil {
+		return err
+	}
+	if !signup {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	return c.Render(200, "account-page", AccountForm{Action: "signup", Signup: signup})
+}
+
+// PostLogin checks a username and password and starts a session.
+func PostLogin(c echo.Context) error {
+	var err error
+
+	username := c.FormValue("username")
+	password := c.FormValue("password")
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	var user_id int
+	var password_hash string
+	row := agent.QueryRow("SELECT id, password_hash FROM users WHERE username = ?", username)
+	if err = row.Scan(&user_id, &password_hash); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return handleError()
+		}
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		agent.Rollback()
+		return echo.NewHTTPError(401, "Wrong username or password")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(password_hash), []byte(password)) != nil {
+		agent.Rollback()
+		return echo.NewHTTPError(401, "Wrong username or password")
+	}
+	if err = startSession(c, user_id); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return redirect(c, "/")
+}
+
+// PostSignup creates an account and signs it in. The first account
+// takes over any notes from before there were accounts.
+func PostSignup(c echo.Context) error {
+	var err error
+
+	username := c.FormValue("username")
+	password := c.FormValue("password")
+	if !usernamePattern.MatchString(username) {
+		return Invalid("Usernames are 3 to 32 letters, digits, dots, dashes or underscores")
+	}
+	if len(password) < MinPasswordLength {
+		return Invalid("Passwords need at least %d characters", MinPasswordLength)
+	}
+	signup, err := signupOpen()
+	if err != nil {
+		return err
+	}
+	if !signup {
+		return echo.NewHTTPError(403, "Signing up is turned off")
+	}
+	password_hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	var taken int
+	row := agent.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username)
+	if err = row.Scan(&taken); err != nil {
+		return handleError()
+	}
+	if taken > 0 {
+		err = Conflict("Username %s is taken", username)
+		return handleError()
+	}
+	res, err := agent.Exec(
+		`
+            INSERT INTO users (username, password_hash)
+            VALUES (?, ?);
+        `,
+		username,
+		string(password_hash),
+	)
+	if err != nil {
+		return handleError()
+	}
+	user_id, err := res.LastInsertId()
+	if err != nil {
+		return handleError()
+	}
+	if _, err = agent.Exec(
+		`
+            UPDATE notes
+            SET owner_id = $1
+            WHERE owner_id IS NULL;
+
+            UPDATE notes_archive
+            SET owner_id = $1
+            WHERE owner_id IS NULL;
+        `,
+		user_id,
+	); err != nil {
+		return handleError()
+	}
+	if err = startSession(c, int(user_id)); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return redirect(c, "/")
+}
+
+// PostLogout ends the browser's session.
+func PostLogout(c echo.Context) error {
+	var err error
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if cookie, cerr := c.Cookie(SessionCookie); cerr == nil {
+		if _, err = agent.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(cookie.Value)); err != nil {
+			return handleError()
+		}
+		forgetKeys(hashToken(cookie.Value))
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     SessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return redirect(c, "/login")
+}
+
+// redirect sends the browser to path, through htmx for HTMX requests.
+func redirect(c echo.Context, path string) error {
+	if c.Request().Header.Get("HX-Request") == "true" {
+		c.Response().Header().Set("HX-Redirect", path)
+		return c.NoContent(200)
+	}
+	return c.Redirect(http.StatusSeeOther, path)
+}
+
+// signupOpen reports whether accounts can be created: always while
+// there are none, and otherwise only with the signup feature on.
+func signupOpen() (bool, error) {
+	var err error
+
+	if settings.Features.Signup {
+		return true, nil
+	}
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() (bool, error) {
+		agent.Rollback()
+		return false, err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	var users int
+	if err = agent.QueryRow("SELECT COUNT(*) FROM users").Scan(&users); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return users == 0, nil
+}
+
+// startSession stores a new session for user_id and hands its token to
+// the browser. Expired sessions are cleared out along the way.
+// SameSite keeps other sites from sending the cookie with their forms.
+func startSession(c echo.Context, user_id int) error {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	value := base64.RawURLEncoding.EncodeToString(token)
+	expires := time.Now().UTC().Add(SessionLifetime)
+	if _, err := agent.Exec(
+		`
+            DELETE FROM sessions
+            WHERE expires_at <= CURRENT_TIMESTAMP;
+
+            INSERT INTO sessions (token_hash, user_id, expires_at)
+            VALUES (?, ?, ?);
+        `,
+		hashToken(value),
+		user_id,
+		expires.Format(time.DateTime),
+	); err != nil {
+		return err
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     SessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// getSessionUser looks up the user signed in with the request's session
+// cookie. Without a valid session the User is zero.
+func getSessionUser(c echo.Context) (User, error) {
+	var err error
+
+	user := User{}
+	cookie, err := c.Cookie(SessionCookie)
+	if err != nil {
+		return user, nil
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() (User, error) {
+		agent.Rollback()
+		return user, err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	row := agent.QueryRow(
+		`
+            SELECT u.id, u.username
+            FROM sessions s
+            JOIN users u
+            ON u.id = s.user_id
+            WHERE s.token_hash = ?
+            AND s.expires_at > CURRENT_TIMESTAMP;
+        `,
+		hashToken(cookie.Value),
+	)
+	if err = row.Scan(&user.ID, &user.Username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			agent.Rollback()
+			return User{}, nil
+		}
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return user, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,196 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sessionCookie finds the session cookie a response set.
+func sessionCookie(t *testing.T, rec *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == SessionCookie {
+			return cookie
+		}
+	}
+	t.Fatal("no session cookie was set")
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	app := newTestApp(t)
+	app.session = ""
+
+	rec := app.do(http.MethodPost, "/login", url.Values{"username": {"demo"}, "password": {"wrong password"}})
+	assertStatus(t, rec, 401)
+	assertContains(t, rec, "Wrong username or password")
+
+	rec = app.do(http.MethodPost, "/login", url.Values{"username": {"nobody"}, "password": {"gonote-demo"}})
+	assertStatus(t, rec, 401)
+	assertContains(t, rec, "Wrong username or password")
+
+	rec = app.do(http.MethodPost, "/login", url.Values{"username": {"DEMO"}, "password": {"gonote-demo"}})
+	assertStatus(t, rec, 200)
+	if got := rec.Header().Get("HX-Redirect"); got != "/" {
+		t.Errorf("HX-Redirect = %q, want /", got)
+	}
+	cookie := sessionCookie(t, rec)
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("session cookie = %v", cookie)
+	}
+	if got := app.queryInt("SELECT COUNT(*) FROM sessions WHERE token_hash = ?", cookie.Value); got != 0 {
+		t.Error("the session token was stored unhashed")
+	}
+
+	app.session = cookie.Value
+	assertStatus(t, app.do(http.MethodGet, "/notes/2", nil), 200)
+
+	rec = app.do(http.MethodPost, "/logout", nil)
+	assertStatus(t, rec, 200)
+	if got := rec.Header().Get("HX-Redirect"); got != "/login" {
+		t.Errorf("HX-Redirect = %q, want /login", got)
+	}
+	if got := app.queryInt("SELECT COUNT(*) FROM sessions WHERE token_hash = ?", hashToken(cookie.Value)); got != 0 {
+		t.Error("the session outlived logging out")
+	}
+	assertStatus(t, app.do(http.MethodGet, "/notes/2", nil), 401)
+
+	// A session that could not be ended is not reported as ended
+	app.session = "test-session"
+	app.exec("CREATE TRIGGER keep_sessions BEFORE DELETE ON sessions BEGIN SELECT RAISE(ABORT, 'kept'); END;")
+	rec = app.do(http.MethodPost, "/logout", nil)
+	assertStatus(t, rec, 500)
+	if rec.Header().Get("Set-Cookie") != "" {
+		t.Error("the session cookie was cleared anyway")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("INSERT INTO sessions (token_hash, user_id, expires_at) VALUES (?, 1, '2000-01-01 00:00:00')", hashToken("expired"))
+
+	for _, session := range []string{"", "unknown", "expired"} {
+		t.Run("session "+session, func(t *testing.T) {
+			app.session = session
+
+			rec := app.do(http.MethodGet, "/notes/2", nil)
+			assertStatus(t, rec, 401)
+			if got := rec.Header().Get("HX-Redirect"); got != "/login" {
+				t.Errorf("HX-Redirect = %q, want /login", got)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept", "text/html")
+			rec = app.serve(req)
+			assertStatus(t, rec, 303)
+			if got := rec.Header().Get("Location"); got != "/login" {
+				t.Errorf("Location = %q, want /login", got)
+			}
+
+			rec = app.serve(httptest.NewRequest(http.MethodGet, "/notes/2", nil))
+			assertStatus(t, rec, 401)
+			assertContains(t, rec, `{"status":401,"error":"Log in to continue"}`)
+		})
+	}
+
+	app.session = ""
+	rec := app.serve(httptest.NewRequest(http.MethodGet, "/login", nil))
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `hx-post="/login"`, `href="/signup"`)
+}
+
+func TestSignup(t *testing.T) {
+	app := newTestApp(t)
+	file := []byte("demo's file")
+	assertStatus(t, app.upload("/attachments?note_id=2", nil, map[string][]byte{"notes.txt": file}), 200)
+	demo := app.session
+	app.session = ""
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		status   int
+		want     string
+	}{
+		{"short username", "al", "long enough", 422, "Usernames are 3 to 32"},
+		{"odd username", "al ice", "long enough", 422, "Usernames are 3 to 32"},
+		{"short password", "alice", "short", 422, "Passwords need at least 8 characters"},
+		{"taken", "Demo", "long enough", 409, "Username Demo is taken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := app.do(http.MethodPost, "/signup", url.Values{"username": {tt.username}, "password": {tt.password}})
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+		})
+	}
+
+	rec := app.do(http.MethodPost, "/signup", url.Values{"username": {"alice"}, "password": {"long enough"}})
+	assertStatus(t, rec, 200)
+	app.session = sessionCookie(t, rec).Value
+
+	// Alice starts with nothing of demo's
+	rec = app.do(http.MethodGet, "/preview-links", nil)
+	assertStatus(t, rec, 200)
+	if strings.Contains(rec.Body.String(), `class="preview"`) {
+		t.Errorf("alice sees notes before making any\n%s", rec.Body.String())
+	}
+	for _, target := range []string{"/notes/2", "/blocks/3/edit", "/archive/2", "/attachments/" + hashOf(file)} {
+		assertStatus(t, app.do(http.MethodGet, target, nil), 404)
+	}
+	assertStatus(t, app.do(http.MethodPut, "/notes/2", url.Values{"title": {"mine"}, "version": {"1"}}), 404)
+	assertStatus(t, app.do(http.MethodDelete, "/blocks?block_id=3", nil), 404)
+	rec = app.do(http.MethodPost, "/search", url.Values{"search-term": {"API"}})
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "No results")
+
+	rec = app.do(http.MethodPost, "/notes", url.Values{"title": {"Alice's note"}})
+	assertStatus(t, rec, 200)
+	note_id := app.queryInt("SELECT id FROM notes WHERE title = ?", "Alice's note")
+	if got := app.queryString("SELECT username FROM users u JOIN notes n ON n.owner_id = u.id WHERE n.id = ?", note_id); got != "alice" {
+		t.Errorf("new note belongs to %q", got)
+	}
+	if got := app.queryInt("SELECT COUNT(*) FROM notes WHERE owner_id = 1"); got != 20 {
+		t.Errorf("demo has %d notes, want 20", got)
+	}
+
+	app.session = demo
+	assertStatus(t, app.do(http.MethodGet, "/notes/"+strconv.Itoa(note_id), nil), 404)
+
+	settings.Features.Signup = false
+	app.session = ""
+	rec = app.do(http.MethodPost, "/signup", url.Values{"username": {"bob"}, "password": {"long enough"}})
+	assertStatus(t, rec, 403)
+	assertContains(t, rec, "Signing up is turned off")
+	rec = app.serve(httptest.NewRequest(http.MethodGet, "/signup", nil))
+	assertStatus(t, rec, 303)
+}
+
+func TestFirstUserClaimsNotes(t *testing.T) {
+	app := newTestApp(t)
+	app.session = ""
+	app.exec("UPDATE notes SET owner_id = NULL")
+	app.exec("UPDATE notes_archive SET owner_id = NULL")
+	app.exec("DELETE FROM sessions")
+	app.exec("DELETE FROM users")
+	settings.Features.Signup = false
+
+	rec := app.do(http.MethodPost, "/signup", url.Values{"username": {"owner"}, "password": {"long enough"}})
+	assertStatus(t, rec, 200)
+	app.session = sessionCookie(t, rec).Value
+
+	if got := app.queryInt("SELECT COUNT(*) FROM notes WHERE owner_id IS NULL"); got != 0 {
+		t.Errorf("%d notes were left without an owner", got)
+	}
+	if got := app.queryInt("SELECT COUNT(*) FROM notes_archive WHERE owner_id IS NULL"); got != 0 {
+		t.Errorf("%d archived notes were left without an owner", got)
+	}
+	assertStatus(t, app.do(http.MethodGet, "/notes/2", nil), 200)
+	assertStatus(t, app.do(http.MethodGet, "/archive/2", nil), 200)
+}
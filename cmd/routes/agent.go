@@ -1,31 +1,129 @@
 package routes
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"strings"
+	"sync"
 
+	"github.com/jadenrose/go-note/cmd/config"
+	"github.com/labstack/echo/v4"
 	_ "modernc.org/sqlite"
 )
 
 var agent *DBAgent
 
+var settings = config.Default()
+
+// Configure sets the config shared by every route. Call it before the
+// server starts handling requests.
+func Configure(cfg config.Config) {
+	settings = cfg
+}
+
 type DBAgent struct {
+	sync.Mutex
 	Path string
 	DB   *sql.DB
 	Tx   *sql.Tx
+	// UserID is the user the request holding the agent acts for, set by
+	// Authenticate. Queries only ever see that user's notes.
+	UserID int
+	// Tab is the browser tab the request came from, if it said so.
+	Tab string
+	// Session is the hash of the browser session the request came from,
+	// empty for API tokens. Encrypted notes are unlocked per session.
+	Session string
+	// Action is what the audit log calls the changes the request makes,
+	// set with auditAs. Empty, each is a create, update, move or delete.
+	Action string
+	// events wait for the transaction to commit before going out.
+	events []Event
 }
 
 func NewDBAgent() *DBAgent {
 	return &DBAgent{}
 }
 
+// Open opens the shared agent. The server calls it once at startup and
+// Shutdown closes it again; calling it while already open does nothing.
+func Open() error {
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	return agent.Open()
+}
+
+// Shutdown saves the blocks being edited live, waits for the request
+// holding the agent to finish, rolls back anything it left open,
+// checkpoints the WAL and closes the database.
+func Shutdown(ctx context.Context) error {
+	if agent == nil {
+		return nil
+	}
+	saveLive()
+	return agent.Shutdown(ctx)
+}
+
+// Serialize is middleware that gives each request sole use of the shared
+// agent, rolling back any transaction the handler left open.
+func Serialize(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if agent == nil {
+			agent = NewDBAgent()
+		}
+		agent.Lock()
+		defer agent.Unlock()
+		defer agent.Rollback()
+
+		return next(c)
+	}
+}
+
+// Detach lets other requests use the agent for the rest of a
+// long-lived request, which must not touch it again until it calls the
+// returned func. That takes the agent back acting for the same user as
+// before. Only handlers behind Serialize may detach.
+func (agent *DBAgent) Detach() (reattach func()) {
+	user_id, tab, session := agent.UserID, agent.Tab, agent.Session
+	agent.Unlock()
+	return func() {
+		agent.Lock()
+		agent.UserID, agent.Tab, agent.Session = user_id, tab, session
+	}
+}
+
+// Run gives a detached request the agent again for the length of fn,
+// acting for user_id from tab as Authenticate would.
+func (agent *DBAgent) Run(user_id int, tab string, fn func() error) error {
+	agent.Lock()
+	defer agent.Unlock()
+	defer agent.Rollback()
+
+	agent.UserID = user_id
+	agent.Tab = tab
+	defer func() {
+		agent.UserID = 0
+		agent.Tab = ""
+	}()
+
+	return fn()
+}
+
 func (agent *DBAgent) Open() error {
-	agent.Path = "./db/notes.db"
+	if agent.DB != nil {
+		return nil
+	}
+	agent.Path = settings.DBFile()
 
 	db, err := sql.Open("sqlite", agent.Path)
 	if err != nil {
 		return err
 	}
+	// One connection keeps the per-connection pragmas below in effect
+	// and matches sqlite's single writer.
+	db.SetMaxOpenConns(1)
 
 	if _, err = db.Exec(
 		`
@@ -104,6 +202,32 @@ func (agent *DBAgent) Open() error {
                 WHERE note_id = NEW.note_id;
             END;
 
+        CREATE TRIGGER IF NOT EXISTS move_block_in_quick_search
+        AFTER UPDATE OF note_id ON blocks
+            BEGIN
+                UPDATE quick_search
+                SET (content) = (
+                    SELECT
+                        group_concat(content, ' | ')
+                    FROM blocks
+                    WHERE note_id = quick_search.note_id
+                )
+                WHERE note_id IN (OLD.note_id, NEW.note_id);
+            END;
+
+        CREATE TRIGGER IF NOT EXISTS remove_block_from_quick_search
+        AFTER DELETE ON blocks
+            BEGIN
+                UPDATE quick_search
+                SET (content) = (
+                    SELECT
+                        group_concat(content, ' | ')
+                    FROM blocks
+                    WHERE note_id = OLD.note_id
+                )
+                WHERE note_id = OLD.note_id;
+            END;
+
         CREATE TABLE IF NOT EXISTS notes_archive (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
             created_at DATETIME NOT NULL,
@@ -122,6 +246,17 @@ func (agent *DBAgent) Open() error {
 	); err != nil {
 		return err
 	}
+	if err = migrate(db); err != nil {
+		return err
+	}
+	key, err := settings.StoreKey()
+	if err != nil {
+		return err
+	}
+	if err = openStore(db, key); err != nil {
+		db.Close()
+		return err
+	}
 
 	agent.DB = db
 	return err
@@ -141,7 +276,34 @@ func (agent *DBAgent) Close() error {
 	return err
 }
 
+func (agent *DBAgent) Shutdown(ctx context.Context) error {
+	locked := make(chan struct{})
+	go func() {
+		agent.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer agent.Unlock()
+
+	if agent.DB == nil {
+		return nil
+	}
+	if err := agent.Rollback(); err != nil {
+		return err
+	}
+	if _, err := agent.DB.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE);"); err != nil {
+		return err
+	}
+
+	return agent.Close()
+}
+
 func (agent *DBAgent) Rollback() error {
+	agent.events = nil
 	if agent.Tx == nil {
 		return nil
 	}
@@ -164,6 +326,10 @@ func (agent *DBAgent) Commit() error {
 
 	if err == nil {
 		agent.Tx = nil
+		if len(agent.events) > 0 {
+			hub.Publish(agent.events)
+			agent.events = nil
+		}
 	}
 
 	return err
@@ -210,3 +376,14 @@ func (agent *DBAgent) QueryRow(query string, args ...any) *sql.Row {
 
 	return row
 }
+
+// inClause builds the placeholders and args for "WHERE id IN (...)".
+func inClause(ids []int) (string, []any) {
+	placeholders := make([]string, len(ids))
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	return "(" + strings.Join(placeholders, ", ") + ")", args
+}
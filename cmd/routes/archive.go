@@ -2,7 +2,7 @@ package routes
 
 import (
 	"database/sql"
-	"log"
+	"errors"
 	"strconv"
 
 	"github.com/labstack/echo/v4"
@@ -41,24 +41,27 @@ func GetArchiveList(c echo.Context) error {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
 
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
 	rows, err := agent.Query(
 		`
-        SELECT DISTINCT n.id, n.title, COUNT(b.id)
+        SELECT DISTINCT n.id, unseal(n.title), COUNT(b.id)
         FROM notes_archive n
         LEFT JOIN blocks_archive b
         ON b.note_id = n.id
+        WHERE n.owner_id = ?
         GROUP BY n.id;
         `,
+		agent.UserID,
 	)
+	if err != nil {
+		return handleError()
+	}
 	var notes []ArchivePreview
 	for rows.Next() {
 		note := MaybeArchivePreview{}
@@ -86,36 +89,44 @@ func GetArchivedNote(c echo.Context) error {
 	var err error
 	archived_note_id, err := strconv.Atoi(c.Param("archived_note_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param :archived_note_id")
+		return echo.NewHTTPError(400, "Missing or invalid param :archived_note_id")
 	}
 	if agent == nil {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
 
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
 	rows, err := agent.Query(
 		`
         SELECT
             n.id,
-            n.title,
+            unseal(n.title),
+            n.key_salt IS NOT NULL,
             b.id,
             b.note_id,
-            b.content,
-            b.sort_order
-        FROM notes_archive n, blocks_archive b
-        WHERE b.note_id = n.id
-        AND b.note_id = ?
-        ORDER BY b.sort_order;
+            b.parent_id,
+            unseal(b.content),
+            b.sort_order,
+            b.type,
+            b.collapsed,
+            b.checked,
+            b.attachment,
+            b.language
+        FROM notes_archive n
+        LEFT JOIN blocks_archive b
+        ON b.note_id = n.id
+        WHERE n.id = ?
+        AND n.owner_id = ?
+        ORDER BY b.sort_order, b.id;
         `,
 		archived_note_id,
+		agent.UserID,
 	)
 	if err != nil {
 		return handleError()
@@ -126,10 +137,17 @@ func GetArchivedNote(c echo.Context) error {
 		if err = rows.Scan(
 			&note.ID,
 			&note.Title,
+			&note.Encrypted,
 			&block.ID,
 			&block.NoteID,
+			&block.ParentID,
 			&block.Content,
 			&block.SortOrder,
+			&block.Type,
+			&block.Collapsed,
+			&block.Checked,
+			&block.Attachment,
+			&block.Language,
 		); err != nil {
 			return handleError()
 		}
@@ -138,6 +156,15 @@ func GetArchivedNote(c echo.Context) error {
 			note.Blocks = append(note.Blocks, block.Value())
 		}
 	}
+	if note.ID == 0 {
+		err = NotFound("Archived note %d not found", archived_note_id)
+		return handleError()
+	}
+	// Archived notes are unlocked once restored
+	if note.Encrypted {
+		note.Blocks = nil
+	}
+	note.Blocks = buildOutline(note.Blocks)
 	if err = agent.Commit(); err != nil {
 		return handleError()
 	}
@@ -149,47 +176,52 @@ func RestoreArchivedNote(c echo.Context) error {
 	var err error
 	archived_note_id, err := strconv.Atoi(c.Param("archived_note_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param :archived_note_id")
+		return echo.NewHTTPError(400, "Missing or invalid param :archived_note_id")
 	}
 	if agent == nil {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
 
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
+	defer auditAs("restore")()
 
 	res, err := agent.Exec(
 		`
-        INSERT INTO notes (title, modified_at)
-        SELECT title, CURRENT_TIMESTAMP FROM notes_archive
-        WHERE id = ?;
+        INSERT INTO notes (title, modified_at, owner_id, key_salt, key_check)
+        SELECT title, CURRENT_TIMESTAMP, owner_id, key_salt, key_check FROM notes_archive
+        WHERE id = ?
+        AND owner_id = ?;
         `,
 		archived_note_id,
+		agent.UserID,
 	)
 	if err != nil {
 		return handleError()
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = NotFound("Archived note %d not found", archived_note_id)
+		return handleError()
+	}
 	note_id, err := res.LastInsertId()
 	if err != nil {
 		return handleError()
 	}
+	if err = notify("note", int(note_id)); err != nil {
+		return handleError()
+	}
+	notifyArchive()
 
-	if _, err = agent.Exec(
-		`
-        INSERT INTO blocks (content, sort_order, note_id)
-        SELECT content, sort_order, $1 FROM blocks_archive
-        WHERE note_id = $2;
-        `,
-		int(note_id),
-		archived_note_id,
-	); err != nil {
+	blocks, err := getBlockTree("blocks_archive", archived_note_id)
+	if err != nil {
+		return handleError()
+	}
+	if err = insertBlockTree("blocks", int(note_id), 0, blocks); err != nil {
 		return handleError()
 	}
 
@@ -213,6 +245,13 @@ func RestoreArchivedNote(c echo.Context) error {
 	}
 
 	note, err := getContentByNoteId(int(note_id))
+	// It comes back under a new id, which no session has unlocked
+	if errors.Is(err, ErrLocked) {
+		return c.Render(200, "locked-note", note)
+	}
+	if err != nil {
+		return err
+	}
 
 	return c.Render(200, "restored-note", note)
 
@@ -225,26 +264,32 @@ func ClearArchive(c echo.Context) error {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
 
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
+	defer auditAs("clear")()
 	if _, err = agent.Exec(
 		`
-        DELETE FROM blocks_archive;
-        DELETE FROM notes_archive;
+        DELETE FROM blocks_archive
+        WHERE note_id IN (
+            SELECT id FROM notes_archive WHERE owner_id = $1
+        );
+        DELETE FROM notes_archive
+        WHERE owner_id = $1;
         `,
+		agent.UserID,
 	); err != nil {
 		return handleError()
 	}
+	notifyArchive()
 	if err = agent.Commit(); err != nil {
 		return handleError()
 	}
+	cleanUpAttachments(c)
 
 	return c.Render(200, "empty-archive", nil)
 }
@@ -252,30 +297,36 @@ func ClearArchive(c echo.Context) error {
 func archiveOldNotes() error {
 	var err error
 
+	// Without the archive there would be no way to get them back
+	if !settings.Features.Archive {
+		return nil
+	}
+
 	if agent == nil {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
 		return err
 	}
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
 	rows, err := agent.Query(
 		`
         SELECT id FROM (
             SELECT
                 *,
                 row_number() OVER (
-                    ORDER BY modified_at DESC
+                    ORDER BY modified_at DESC, id DESC
                 ) as rank
             FROM notes
+            WHERE owner_id = ?
         )
-        WHERE rank > 20;
+        WHERE rank > ?;
         `,
+		agent.UserID,
+		settings.ArchiveLimit,
 	)
 	if err != nil {
 		return handleError()
@@ -305,66 +356,80 @@ func archiveNoteById(note_id int) (int, error) {
 		agent = NewDBAgent()
 	}
 	handleError := func() (int, error) {
-		log.Panic(err)
 		agent.Rollback()
 		return -1, err
 	}
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
+	defer auditAs("archive")()
 	res, err := agent.Exec(
 		`
         INSERT INTO notes_archive (
             title,
             created_at,
             modified_at,
-            archived_at
+            archived_at,
+            owner_id,
+            key_salt,
+            key_check
         )
         SELECT
             title,
             created_at,
             modified_at,
-            CURRENT_TIMESTAMP
+            CURRENT_TIMESTAMP,
+            owner_id,
+            key_salt,
+            key_check
         FROM notes
-        WHERE id = $1;
+        WHERE id = $1
+        AND owner_id = $2;
         `,
 		note_id,
+		agent.UserID,
 	)
 	if err != nil {
 		return handleError()
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = NotFound("Note %d not found", note_id)
+		return handleError()
+	}
 
 	archived_note_id, err := res.LastInsertId()
 	if err != nil {
 		return handleError()
 	}
-	if _, err = agent.Exec(
-		`
-        INSERT INTO blocks_archive (
-            note_id,
-            content,
-            sort_order
-        )
-        SELECT
-            $1,
-            content,
-            sort_order
-        FROM blocks
-        WHERE note_id = $2;
-        `,
-		int(archived_note_id),
-		note_id,
-	); err != nil {
+	blocks, err := getBlockTree("blocks", note_id)
+	if err != nil {
 		return handleError()
 	}
+	if err = insertBlockTree("blocks_archive", int(archived_note_id), 0, blocks); err != nil {
+		return handleError()
+	}
+	if err = notify("note", note_id); err != nil {
+		return handleError()
+	}
+	notifyArchive()
 
+	// The note goes last, so the audit log still finds it for the rest
 	if _, err = agent.Exec(
 		`
-        DELETE FROM notes
-        WHERE id = $1;
-        
         DELETE FROM blocks
         WHERE note_id = $1;
+
+        DELETE FROM shares
+        WHERE note_id = $1;
+
+        DELETE FROM collaborators
+        WHERE note_id = $1;
+
+        DELETE FROM comments
+        WHERE note_id = $1;
+
+        DELETE FROM notes
+        WHERE id = $1;
         `,
 		note_id,
 	); err != nil {
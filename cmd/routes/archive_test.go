@@ -0,0 +1,123 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGetArchiveList(t *testing.T) {
+	t.Run("lists archived notes", func(t *testing.T) {
+		app := newTestApp(t)
+
+		rec := app.do(http.MethodGet, "/archive", nil)
+		assertStatus(t, rec, 200)
+		assertContains(t, rec, `<span class="notification">5</span>`, `hx-post="/archive/5"`)
+		if got := strings.Count(rec.Body.String(), `class="archive-preview"`); got != 5 {
+			t.Errorf("rendered %d previews, want 5", got)
+		}
+	})
+
+	t.Run("empty archive", func(t *testing.T) {
+		app := newTestApp(t)
+		app.exec("DELETE FROM notes_archive; DELETE FROM blocks_archive;")
+
+		rec := app.do(http.MethodGet, "/archive", nil)
+		assertStatus(t, rec, 200)
+		assertContains(t, rec, `<span class="notification">0</span>`, "disabled")
+	})
+}
+
+func TestGetArchivedNote(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("INSERT INTO notes_archive (title, created_at, modified_at, owner_id) VALUES ('Empty', 0, 0, 1)")
+
+	tests := []struct {
+		target string
+		status int
+		want   []string
+	}{
+		{"/archive/2", 200, []string{
+			"Readonly View",
+			"Note 22: API Integration Discussion",
+			"The API response time needs to be optimized for faster performance.",
+		}},
+		{"/archive/6", 200, []string{"Readonly View", "Empty"}},
+		{"/archive/999", 404, []string{"Archived note 999 not found"}},
+		{"/archive/abc", 400, []string{"Missing or invalid param :archived_note_id"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			rec := app.do(http.MethodGet, tt.target, nil)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want...)
+		})
+	}
+}
+
+func TestRestoreArchivedNote(t *testing.T) {
+	t.Run("restores", func(t *testing.T) {
+		app := newTestApp(t)
+
+		rec := app.do(http.MethodPost, "/archive/2", nil)
+		assertStatus(t, rec, 200)
+		assertContains(t, rec, "Note 22: API Integration Discussion", `id="preview-21"`)
+
+		assertInts(t, "restored blocks", app.blockOrder(21), []int{57, 58, 59, 60})
+		if got := app.queryInt("SELECT COUNT(*) FROM notes_archive WHERE id = 2"); got != 0 {
+			t.Error("archived note 2 was not removed")
+		}
+		if got := app.queryInt("SELECT COUNT(*) FROM blocks_archive WHERE note_id = 2"); got != 0 {
+			t.Errorf("%d archived blocks left behind", got)
+		}
+		// Restoring past the archive limit pushes the oldest note out
+		if got := app.queryInt("SELECT COUNT(*) FROM notes"); got != 20 {
+			t.Errorf("notes = %d, want 20", got)
+		}
+		if got := app.queryInt("SELECT COUNT(*) FROM notes_archive"); got != 5 {
+			t.Errorf("archived notes = %d, want 5", got)
+		}
+	})
+
+	t.Run("keeps block types", func(t *testing.T) {
+		app := newTestApp(t)
+		app.exec("UPDATE blocks SET type = 'heading' WHERE id = 53")
+
+		rec := app.do(http.MethodDelete, "/notes/20", nil)
+		assertStatus(t, rec, 200)
+		archived := app.queryInt("SELECT id FROM notes_archive WHERE title LIKE 'Note 20:%'")
+		assertContains(t, app.do(http.MethodGet, "/archive/"+strconv.Itoa(archived), nil), "block--heading")
+
+		rec = app.do(http.MethodPost, "/archive/"+strconv.Itoa(archived), nil)
+		assertStatus(t, rec, 200)
+		if got := app.queryInt("SELECT COUNT(*) FROM blocks WHERE type = 'heading'"); got != 1 {
+			t.Errorf("%d headings after restoring, want 1", got)
+		}
+	})
+
+	t.Run("missing note", func(t *testing.T) {
+		app := newTestApp(t)
+
+		rec := app.do(http.MethodPost, "/archive/999", nil)
+		assertStatus(t, rec, 404)
+		if got := app.queryInt("SELECT COUNT(*) FROM notes"); got != 20 {
+			t.Errorf("notes = %d, want 20", got)
+		}
+	})
+}
+
+func TestClearArchive(t *testing.T) {
+	app := newTestApp(t)
+
+	rec := app.do(http.MethodDelete, "/archive/all", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `<span class="notification">0</span>`)
+
+	if got := app.queryInt("SELECT COUNT(*) FROM notes_archive"); got != 0 {
+		t.Errorf("archived notes = %d, want 0", got)
+	}
+	if got := app.queryInt("SELECT COUNT(*) FROM blocks_archive"); got != 0 {
+		t.Errorf("archived blocks = %d, want 0", got)
+	}
+}
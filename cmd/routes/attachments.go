@@ -0,0 +1,744 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Attachments are stored once per content under DataDir/attachments,
+// named by their SHA-256 hash, and shared by every block that shows
+// them. The attachments table records what was sniffed from each file.
+// While the database is encrypted at rest the files are sealed with the
+// data key, like the types recorded, and named by a hash keyed with it.
+// Files in encrypted notes are sealed with the note's key first, and so
+// are their types; they are hashed sealed, so never shared with another
+// note, and only served to sessions that unlocked the note.
+
+// ThumbnailSize bounds the width and height of image thumbnails.
+const ThumbnailSize = 320
+
+// maxThumbnailPixels keeps huge images from being decoded at all.
+const maxThumbnailPixels = 50_000_000
+
+var hashPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+type Attachment struct {
+	Hash     string
+	MimeType string
+	Size     int
+	// key is the key of the encrypted note the file is sealed for.
+	key []byte
+}
+
+// PostAttachments uploads the files in the multipart field "file" as
+// attachment blocks, appended to the note unless after_block_id places
+// them after another block.
+func PostAttachments(c echo.Context) error {
+	var err error
+
+	note_id, err := strconv.Atoi(c.QueryParam("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	// Nothing is read, let alone stored, for those who cannot edit
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if err = canEdit(note_id); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	// Uploads take as long as the client sends them, so other requests
+	// go on meanwhile
+	reattach := agent.Detach()
+	after_id, files, names, err := readUploads(c)
+	reattach()
+	if err != nil {
+		return err
+	}
+
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if err = canEdit(note_id); err != nil {
+		return handleError()
+	}
+	key, err := noteKey(note_id)
+	if err != nil {
+		return handleError()
+	}
+	uploads := []Attachment{}
+	for _, data := range files {
+		var upload Attachment
+		upload, err = storeAttachment(data, key)
+		if err != nil {
+			return handleError()
+		}
+		uploads = append(uploads, upload)
+	}
+	parent_id := 0
+	position := -1
+	if after_id != 0 {
+		var after Block
+		after, err = getNoteBlock(note_id, after_id)
+		if err != nil {
+			return handleError()
+		}
+		var ids []int
+		ids, err = getBlockIds(note_id, after.ParentID)
+		if err != nil {
+			return handleError()
+		}
+		parent_id = after.ParentID
+		position = indexOf(ids, after_id) + 1
+	}
+	for i, upload := range uploads {
+		if err = recordAttachment(upload); err != nil {
+			return handleError()
+		}
+		var sort_order int
+		if position < 0 {
+			sort_order, err = getLastSortOrderUsed(note_id)
+			sort_order += SortGap
+		} else {
+			sort_order, err = sortOrderAt(note_id, parent_id, 0, position+i)
+		}
+		if err != nil {
+			return handleError()
+		}
+		block_type := "file"
+		if isImage(upload.MimeType) {
+			block_type = "image"
+		}
+		var caption string
+		if caption, err = sealBlockContent(note_id, names[i]); err != nil {
+			return handleError()
+		}
+		if _, err = agent.Exec(
+			`
+                INSERT INTO blocks (
+                    note_id,
+                    parent_id,
+                    sort_order,
+                    content,
+                    type,
+                    attachment
+                )
+                VALUES (?, ?, ?, seal(?), ?, ?);
+            `,
+			note_id,
+			nullId(parent_id),
+			sort_order,
+			caption,
+			block_type,
+			upload.Hash,
+		); err != nil {
+			return handleError()
+		}
+	}
+
+	return renderOutline(c, note_id)
+}
+
+// readUploads reads the form value after_block_id and the files in the
+// multipart field "file", with their names, refusing any larger than the
+// upload limit.
+func readUploads(c echo.Context) (int, [][]byte, []string, error) {
+	var err error
+
+	after_id := 0
+	if param := c.FormValue("after_block_id"); param != "" {
+		after_id, err = strconv.Atoi(param)
+		if err != nil {
+			return 0, nil, nil, echo.NewHTTPError(400, "Missing or invalid param after_block_id")
+		}
+	}
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["file"]) == 0 {
+		return 0, nil, nil, echo.NewHTTPError(400, "Missing or invalid param file")
+	}
+	files := [][]byte{}
+	names := []string{}
+	for _, header := range form.File["file"] {
+		name := attachmentName(header.Filename)
+		if header.Size > int64(settings.MaxUploadSize) {
+			return 0, nil, nil, echo.NewHTTPError(413, fmt.Sprintf(
+				"%s is larger than the %s upload limit",
+				name,
+				formatSize(settings.MaxUploadSize),
+			))
+		}
+		var file io.ReadCloser
+		file, err = header.Open()
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		var data []byte
+		data, err = io.ReadAll(io.LimitReader(file, int64(settings.MaxUploadSize)+1))
+		file.Close()
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if len(data) > settings.MaxUploadSize {
+			return 0, nil, nil, echo.NewHTTPError(413, fmt.Sprintf(
+				"%s is larger than the %s upload limit",
+				name,
+				formatSize(settings.MaxUploadSize),
+			))
+		}
+		files = append(files, data)
+		names = append(names, name)
+	}
+
+	return after_id, files, names, nil
+}
+
+// GetAttachment serves an attachment with the content type sniffed when
+// it was uploaded. Only images are shown inline; anything else is a
+// download, named by ?name.
+func GetAttachment(c echo.Context) error {
+	hash := c.Param("hash")
+	if !hashPattern.MatchString(hash) {
+		return echo.NewHTTPError(400, "Missing or invalid param :hash")
+	}
+	attachment, err := getAttachment(hash)
+	if err != nil {
+		return err
+	}
+
+	return serveAttachment(c, attachment, attachmentPath(hash))
+}
+
+// GetThumbnail serves a small copy of an image attachment, or the image
+// itself when no thumbnail could be made.
+func GetThumbnail(c echo.Context) error {
+	hash := c.Param("hash")
+	if !hashPattern.MatchString(hash) {
+		return echo.NewHTTPError(400, "Missing or invalid param :hash")
+	}
+	attachment, err := getAttachment(hash)
+	if err != nil {
+		return err
+	}
+
+	return serveThumbnail(c, attachment)
+}
+
+func serveThumbnail(c echo.Context, attachment Attachment) error {
+	if !isImage(attachment.MimeType) {
+		return NotFound("Attachment %s has no thumbnail", attachment.Hash)
+	}
+	if _, err := os.Stat(thumbnailPath(attachment.Hash)); err == nil {
+		attachment.MimeType = "image/png"
+		return serveAttachment(c, attachment, thumbnailPath(attachment.Hash))
+	}
+
+	return serveAttachment(c, attachment, attachmentPath(attachment.Hash))
+}
+
+func serveAttachment(c echo.Context, attachment Attachment, path string) error {
+	header := c.Response().Header()
+	header.Set("Content-Type", attachment.MimeType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	// The hash in the URL changes whenever the content does. Private, as
+	// only the users whose notes hold it may see it.
+	header.Set("Cache-Control", "private, max-age=31536000, immutable")
+	if !isImage(attachment.MimeType) {
+		header.Set("Content-Disposition", mime.FormatMediaType(
+			"attachment",
+			map[string]string{"filename": attachmentName(c.QueryParam("name"))},
+		))
+	}
+
+	data, err := readAttachment(path, attachment.key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NotFound("Attachment %s not found", attachment.Hash)
+	}
+	if err != nil {
+		return err
+	}
+	http.ServeContent(c.Response(), c.Request(), "", time.Time{}, bytes.NewReader(data))
+	return nil
+}
+
+// getAttachment gets an attachment held by a block of a note the user
+// can see, or of one of their archived notes. Those held only by
+// encrypted notes this session has not unlocked are Locked, and archived
+// encrypted notes hold none until restored.
+func getAttachment(hash string) (Attachment, error) {
+	var err error
+
+	attachment := Attachment{}
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() (Attachment, error) {
+		agent.Rollback()
+		return attachment, err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	rows, err := agent.Query(
+		`
+            SELECT a.hash, unseal(a.mime_type), a.size, a.encrypted, b.note_id
+            FROM attachments a
+            JOIN blocks b
+            ON b.attachment = a.hash
+            JOIN note_access n
+            ON n.note_id = b.note_id
+            WHERE a.hash = $1
+            AND n.user_id = $2
+            UNION
+            SELECT a.hash, unseal(a.mime_type), a.size, a.encrypted, 0
+            FROM attachments a
+            JOIN blocks_archive b
+            ON b.attachment = a.hash
+            JOIN notes_archive n
+            ON n.id = b.note_id
+            WHERE a.hash = $1
+            AND n.owner_id = $2
+            AND n.key_salt IS NULL;
+        `,
+		hash,
+		agent.UserID,
+	)
+	if err != nil {
+		return handleError()
+	}
+	type holder struct {
+		attachment Attachment
+		encrypted  bool
+		noteID     int
+	}
+	holders := []holder{}
+	for rows.Next() {
+		h := holder{}
+		if err = rows.Scan(&h.attachment.Hash, &h.attachment.MimeType, &h.attachment.Size, &h.encrypted, &h.noteID); err != nil {
+			rows.Close()
+			return handleError()
+		}
+		holders = append(holders, h)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return handleError()
+	}
+	err = NotFound("Attachment %s not found", hash)
+	for _, h := range holders {
+		var key []byte
+		if h.noteID != 0 {
+			key, err = noteKey(h.noteID)
+			if errors.Is(err, ErrLocked) {
+				continue
+			}
+			if err != nil {
+				return handleError()
+			}
+		}
+		attachment = h.attachment
+		if h.encrypted {
+			attachment.key = key
+			if attachment.MimeType, err = openContent(key, attachment.MimeType); err != nil {
+				return handleError()
+			}
+		}
+		if err = agent.Commit(); err != nil {
+			return handleError()
+		}
+		return attachment, nil
+	}
+
+	return handleError()
+}
+
+// storeAttachment writes data under its hash, along with a thumbnail
+// for images, unless the same content is already stored. For an
+// encrypted note, key is the note's key, which seals the file before it
+// is hashed. Its row in attachments is left to recordAttachment in the
+// caller's transaction; files that never get one are removed by
+// removeOrphanedAttachments.
+func storeAttachment(data []byte, key []byte) (Attachment, error) {
+	attachment := Attachment{
+		MimeType: http.DetectContentType(data),
+		Size:     len(data),
+		key:      key,
+	}
+	sealed, err := sealBytes(key, data)
+	if err != nil {
+		return attachment, err
+	}
+	sum := sha256.Sum256(sealed)
+	attachment.Hash = hex.EncodeToString(sum[:])
+	path := attachmentPath(attachment.Hash)
+	if _, err := os.Stat(path); err == nil {
+		return attachment, nil
+	}
+	if sealed, err = sealBytes(dataKey, sealed); err != nil {
+		return attachment, err
+	}
+	if err = writeFile(path, sealed); err != nil {
+		return attachment, err
+	}
+	if isImage(attachment.MimeType) {
+		thumb, err := thumbnail(data)
+		if err != nil {
+			// Not decodable here, e.g. webp; the original is shown instead
+			return attachment, nil
+		}
+		if thumb, err = sealBytes(key, thumb); err != nil {
+			return attachment, err
+		}
+		if thumb, err = sealBytes(dataKey, thumb); err != nil {
+			return attachment, err
+		}
+		if err = writeFile(thumbnailPath(attachment.Hash), thumb); err != nil {
+			return attachment, err
+		}
+	}
+
+	return attachment, nil
+}
+
+// recordAttachment adds an attachment storeAttachment stored to the
+// attachments table, its type sealed with the key of the note it is
+// sealed for. It runs in the caller's transaction.
+func recordAttachment(attachment Attachment) error {
+	mime_type, err := sealContent(attachment.key, attachment.MimeType)
+	if err != nil {
+		return err
+	}
+	_, err = agent.Exec(
+		`
+            INSERT INTO attachments (hash, mime_type, size, encrypted)
+            VALUES (?, seal(?), ?, ?)
+            ON CONFLICT (hash) DO NOTHING;
+        `,
+		attachment.Hash,
+		mime_type,
+		attachment.Size,
+		attachment.key != nil,
+	)
+	return err
+}
+
+// readAttachment reads the file at path, opening it with the data key
+// and then key, that of the encrypted note it is sealed for.
+func readAttachment(path string, key []byte) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = openBytes(dataKey, data); err != nil {
+		return nil, err
+	}
+	return openBytes(key, data)
+}
+
+// resealNoteAttachments turns the attachments of note_id's blocks sealed
+// with one key into attachments sealed with the other, where a nil key
+// is none, as resealBlocks does their captions. Each is stored anew and
+// the blocks pointed at it; what is left behind goes as an orphan once
+// no other note holds it. It runs in the caller's transaction.
+func resealNoteAttachments(note_id int, from []byte, to []byte) error {
+	rows, err := agent.Query(
+		`
+            SELECT DISTINCT a.hash
+            FROM blocks b
+            JOIN attachments a
+            ON a.hash = b.attachment
+            WHERE b.note_id = ?
+            AND a.encrypted = ?;
+        `,
+		note_id,
+		from != nil,
+	)
+	if err != nil {
+		return err
+	}
+	hashes := []string{}
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		data, err := readAttachment(attachmentPath(hash), from)
+		if err != nil {
+			return err
+		}
+		attachment, err := storeAttachment(data, to)
+		if err != nil {
+			return err
+		}
+		if err = recordAttachment(attachment); err != nil {
+			return err
+		}
+		if _, err = agent.Exec(
+			"UPDATE blocks SET attachment = ? WHERE note_id = ? AND attachment = ?",
+			attachment.Hash,
+			note_id,
+			hash,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOrphanedAttachments deletes attachments no block, archived or
+// not, refers to any more, along with stray files that never made it
+// into the attachments table. Call it after committing the deletion
+// that left them behind.
+func removeOrphanedAttachments() error {
+	var err error
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if _, err = agent.Exec(
+		`
+            DELETE FROM attachments
+            WHERE hash NOT IN (
+                SELECT attachment FROM blocks
+                WHERE attachment IS NOT NULL
+                UNION
+                SELECT attachment FROM blocks_archive
+                WHERE attachment IS NOT NULL
+            );
+        `,
+	); err != nil {
+		return handleError()
+	}
+	rows, err := agent.Query("SELECT hash FROM attachments;")
+	if err != nil {
+		return handleError()
+	}
+	kept := map[string]bool{}
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			rows.Close()
+			return handleError()
+		}
+		kept[attachmentPath(hash)] = true
+		kept[thumbnailPath(hash)] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	err = filepath.WalkDir(attachmentDir(), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if kept[path] {
+			return nil
+		}
+		return os.Remove(path)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// cleanUpAttachments runs removeOrphanedAttachments for a handler whose
+// own work is already committed, so a failure is only logged.
+func cleanUpAttachments(c echo.Context) {
+	if err := removeOrphanedAttachments(); err != nil {
+		c.Logger().Errorf("removing orphaned attachments: %v", err)
+	}
+}
+
+func attachmentDir() string {
+	return filepath.Join(settings.DataDir, "attachments")
+}
+
+// attachmentPath spreads files over subdirectories by the first two
+// characters of their name.
+func attachmentPath(hash string) string {
+	return attachmentPathFor(dataKey, hash)
+}
+
+func thumbnailPath(hash string) string {
+	return thumbnailPathFor(dataKey, hash)
+}
+
+// attachmentPathFor is where an attachment is stored with key as the
+// data key: under its hash, or a hash of that keyed with key.
+func attachmentPathFor(key []byte, hash string) string {
+	name := hash
+	if key != nil {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(hash))
+		name = hex.EncodeToString(mac.Sum(nil))
+	}
+	return filepath.Join(attachmentDir(), name[:2], name)
+}
+
+// thumbnailPathFor is where a thumbnail is stored with key as the data
+// key. Keyed names do not give away which files are thumbnails.
+func thumbnailPathFor(key []byte, hash string) string {
+	if key != nil {
+		return attachmentPathFor(key, hash+".thumb")
+	}
+	return attachmentPathFor(nil, hash) + ".thumb.png"
+}
+
+// writeFile writes data to path through a temporary file, so a partly
+// written file is never served.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// thumbnail scales an image down to fit ThumbnailSize, averaging a few
+// samples per pixel, and encodes it as PNG.
+func thumbnail(data []byte) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return nil, fmt.Errorf("image is too large for a thumbnail")
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	scale := max(float64(bounds.Dx()), float64(bounds.Dy())) / ThumbnailSize
+	if scale < 1 {
+		scale = 1
+	}
+	width := max(int(float64(bounds.Dx())/scale), 1)
+	height := max(int(float64(bounds.Dy())/scale), 1)
+	samples := min(int(scale+0.5), 4)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b, a uint32
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					px := bounds.Min.X + int((float64(x)+(float64(sx)+0.5)/float64(samples))*scale)
+					py := bounds.Min.Y + int((float64(y)+(float64(sy)+0.5)/float64(samples))*scale)
+					cr, cg, cb, ca := src.At(px, py).RGBA()
+					r, g, b, a = r+cr, g+cg, b+cb, a+ca
+				}
+			}
+			n := uint32(samples * samples)
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isImage reports whether browsers can show a file of mime_type in an
+// <img>. SVG is left out since it can carry scripts.
+func isImage(mime_type string) bool {
+	switch mime_type {
+	case "image/png", "image/jpeg", "image/gif", "image/webp", "image/bmp":
+		return true
+	}
+	return false
+}
+
+// attachmentName keeps only the base name of an uploaded file.
+func attachmentName(filename string) string {
+	name := strings.TrimSpace(filepath.Base(strings.ReplaceAll(filename, "\\", "/")))
+	if name == "" || name == "." || name == "/" {
+		return "attachment"
+	}
+	return name
+}
+
+func formatSize(size int) string {
+	switch {
+	case size >= 1<<20:
+		return strconv.FormatFloat(float64(size)/(1<<20), 'f', -1, 64) + " MiB"
+	case size >= 1<<10:
+		return strconv.FormatFloat(float64(size)/(1<<10), 'f', -1, 64) + " KiB"
+	}
+	return strconv.Itoa(size) + " bytes"
+}
+
+func nullAttachment(hash string) any {
+	if hash == "" {
+		return nil
+	}
+	return hash
+}
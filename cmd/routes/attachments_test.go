@@ -0,0 +1,400 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// upload posts files, keyed by name, to /attachments as a multipart
+// form.
+func (app *testApp) upload(target string, fields map[string]string, files map[string][]byte) *httptest.ResponseRecorder {
+	app.t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	for name, data := range files {
+		part, err := form.CreateFormFile("file", name)
+		if err != nil {
+			app.t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, target, &body)
+	req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+	req.Header.Set("HX-Request", "true")
+
+	return app.serve(req)
+}
+
+func testPNG(t *testing.T, width int, height int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 200, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestPostAttachments(t *testing.T) {
+	t.Run("appends blocks", func(t *testing.T) {
+		app := newTestApp(t)
+		picture := testPNG(t, 400, 200)
+
+		rec := app.upload("/attachments?note_id=2", nil, map[string][]byte{"picture.png": picture})
+		assertStatus(t, rec, 200)
+		hash := hashOf(picture)
+		assertContains(t, rec, `src="/attachments/`+hash+`/thumbnail"`, "picture.png")
+		assertInts(t, "note 2", app.blockOrder(2), []int{3, 4, 5, 57})
+		if got := app.queryString("SELECT type || ' ' || attachment FROM blocks WHERE id = 57"); got != "image "+hash {
+			t.Errorf("block 57 = %q", got)
+		}
+		if !fileExists(attachmentPath(hash)) || !fileExists(thumbnailPath(hash)) {
+			t.Error("the image or its thumbnail was not stored")
+		}
+
+		rec = app.upload("/attachments?note_id=2", nil, map[string][]byte{`C:\Users\me\notes.txt`: []byte("plain notes")})
+		assertStatus(t, rec, 200)
+		assertContains(t, rec, "?name=notes.txt")
+		if got := app.queryString("SELECT type || ' ' || content FROM blocks WHERE id = 58"); got != "file notes.txt" {
+			t.Errorf("block 58 = %q", got)
+		}
+
+		// The same content is stored once
+		assertStatus(t, app.upload("/attachments?note_id=3", nil, map[string][]byte{"copy.png": picture}), 200)
+		if got := app.queryInt("SELECT COUNT(*) FROM attachments"); got != 2 {
+			t.Errorf("%d attachments stored, want 2", got)
+		}
+	})
+
+	t.Run("after a block", func(t *testing.T) {
+		app := newTestApp(t)
+		app.exec("UPDATE blocks SET parent_id = 3 WHERE id = 4")
+
+		rec := app.upload("/attachments?note_id=2", map[string]string{"after_block_id": "4"}, map[string][]byte{"a.txt": []byte("a")})
+		assertStatus(t, rec, 200)
+		assertInts(t, "block 3", app.children(2, 3), []int{4, 57})
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		app := newTestApp(t)
+		settings.MaxUploadSize = 4
+
+		rec := app.upload("/attachments?note_id=2", nil, map[string][]byte{"big.txt": []byte("12345")})
+		assertStatus(t, rec, 413)
+		assertContains(t, rec, "big.txt is larger than the 4 bytes upload limit")
+		assertInts(t, "note 2", app.blockOrder(2), []int{3, 4, 5})
+	})
+
+	t.Run("viewer", func(t *testing.T) {
+		app := newTestApp(t)
+		app.session = app.addUser(2, "other")
+		app.exec("INSERT INTO collaborators (note_id, user_id, role) VALUES (2, 2, 'viewer')")
+
+		rec := app.upload("/attachments?note_id=2", nil, map[string][]byte{"a.txt": []byte("a")})
+		assertStatus(t, rec, 403)
+		if _, err := os.Stat(attachmentDir()); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("stored a viewer's upload: %v", err)
+		}
+	})
+
+	t.Run("other requests go on meanwhile", func(t *testing.T) {
+		app := newTestApp(t)
+
+		body, sending := io.Pipe()
+		form := multipart.NewWriter(sending)
+		req := httptest.NewRequest(http.MethodPost, "/attachments?note_id=2", body)
+		req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+		req.Header.Set("HX-Request", "true")
+		uploaded := make(chan *httptest.ResponseRecorder)
+		go func() { uploaded <- app.serve(req) }()
+		part, _ := form.CreateFormFile("file", "slow.txt")
+		part.Write([]byte("the first half, "))
+
+		served := make(chan int)
+		go func() { served <- app.do(http.MethodGet, "/notes/5", nil).Code }()
+		select {
+		case code := <-served:
+			if code != 200 {
+				t.Errorf("status = %d, want 200", code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the upload held up another request")
+		}
+
+		part.Write([]byte("then the rest"))
+		form.Close()
+		sending.Close()
+		assertStatus(t, <-uploaded, 200)
+		if got := app.queryInt("SELECT COUNT(*) FROM blocks WHERE note_id = 2 AND attachment = ?", hashOf([]byte("the first half, then the rest"))); got != 1 {
+			t.Errorf("%d blocks hold the upload, want 1", got)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		files  map[string][]byte
+		status int
+		want   string
+	}{
+		{"missing note", "/attachments?note_id=999", map[string][]byte{"a.txt": []byte("a")}, 404, "Note 999 not found"},
+		{"invalid note id", "/attachments?note_id=abc", map[string][]byte{"a.txt": []byte("a")}, 400, "Missing or invalid param :note_id"},
+		{"no files", "/attachments?note_id=2", nil, 400, "Missing or invalid param file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			rec := app.upload(tt.target, nil, tt.files)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+			if got := app.queryInt("SELECT COUNT(*) FROM blocks WHERE attachment IS NOT NULL"); got != 0 {
+				t.Errorf("%d attachment blocks were added", got)
+			}
+		})
+	}
+}
+
+func TestGetAttachment(t *testing.T) {
+	app := newTestApp(t)
+	picture := testPNG(t, 640, 320)
+	page := []byte("<!DOCTYPE html><html><script>alert(1)</script></html>")
+	app.upload("/attachments?note_id=2", nil, map[string][]byte{"picture.png": picture, "page.html": page})
+
+	get := func(target string) *httptest.ResponseRecorder {
+		return app.serve(httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	rec := get("/attachments/" + hashOf(picture))
+	assertStatus(t, rec, 200)
+	if got := rec.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := rec.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q", got)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), picture) {
+		t.Error("served a different image")
+	}
+
+	rec = get("/attachments/" + hashOf(picture) + "/thumbnail")
+	assertStatus(t, rec, 200)
+	thumb, err := png.DecodeConfig(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb.Width != ThumbnailSize || thumb.Height != ThumbnailSize/2 {
+		t.Errorf("thumbnail is %dx%d", thumb.Width, thumb.Height)
+	}
+
+	// Anything that isn't an image is only ever downloaded
+	rec = get("/attachments/" + hashOf(page) + "?name=" + url.QueryEscape("my page.html"))
+	assertStatus(t, rec, 200)
+	if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename="my page.html"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	assertStatus(t, get("/attachments/"+hashOf(page)+"/thumbnail"), 404)
+	assertStatus(t, get("/attachments/"+hashOf([]byte("missing"))), 404)
+	assertStatus(t, get("/attachments/not-a-hash"), 400)
+}
+
+func TestAttachmentCleanup(t *testing.T) {
+	picture := testPNG(t, 10, 10)
+	hash := hashOf(picture)
+	stored := func(t *testing.T) bool {
+		t.Helper()
+		return fileExists(attachmentPath(hash))
+	}
+
+	t.Run("deleting the block", func(t *testing.T) {
+		app := newTestApp(t)
+		app.upload("/attachments?note_id=2", nil, map[string][]byte{"picture.png": picture})
+
+		assertStatus(t, app.do(http.MethodDelete, "/blocks/57", nil), 200)
+		if stored(t) || fileExists(thumbnailPath(hash)) {
+			t.Error("the files are still stored")
+		}
+		if got := app.queryInt("SELECT COUNT(*) FROM attachments"); got != 0 {
+			t.Error("the attachment row is left behind")
+		}
+	})
+
+	t.Run("still shared by a copy", func(t *testing.T) {
+		app := newTestApp(t)
+		app.upload("/attachments?note_id=2", nil, map[string][]byte{"picture.png": picture})
+		form := url.Values{"mode": {"copy"}, "note_id": {"3"}, "block_id": {"57"}}
+		assertStatus(t, app.do(http.MethodPost, "/blocks/transfer", form), 200)
+
+		assertStatus(t, app.do(http.MethodDelete, "/blocks?block_id=57", nil), 200)
+		if !stored(t) {
+			t.Error("removed an attachment the copy still shows")
+		}
+	})
+
+	t.Run("clearing the archive", func(t *testing.T) {
+		app := newTestApp(t)
+		app.upload("/attachments?note_id=2", nil, map[string][]byte{"picture.png": picture})
+
+		assertStatus(t, app.do(http.MethodDelete, "/notes/2", nil), 200)
+		if !stored(t) {
+			t.Fatal("archiving the note removed its attachment")
+		}
+		assertStatus(t, app.do(http.MethodDelete, "/archive/all", nil), 200)
+		if stored(t) {
+			t.Error("clearing the archive left the attachment behind")
+		}
+	})
+
+	t.Run("stray files", func(t *testing.T) {
+		app := newTestApp(t)
+		// Stored, but the upload failed before the row was written
+		if _, err := storeAttachment(picture, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		assertStatus(t, app.do(http.MethodDelete, "/blocks/3", nil), 200)
+		if stored(t) {
+			t.Error("the stray file was not removed")
+		}
+	})
+}
+
+func TestAttachmentBlocks(t *testing.T) {
+	app := newTestApp(t)
+	picture := testPNG(t, 10, 10)
+	app.upload("/attachments?note_id=2", nil, map[string][]byte{"picture.png": picture})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		form   url.Values
+		want   string
+	}{
+		{"split", http.MethodPost, "/blocks/57/split", url.Values{"content": {"picture.png"}, "offset": {"3"}, "version": {"1"}}, "Attachments cannot be split"},
+		{"merge", http.MethodPost, "/blocks/57/merge", url.Values{"content": {"picture.png"}, "version": {"1"}}, "Attachments cannot be merged"},
+		{"change type", http.MethodPut, "/blocks/type", url.Values{"type": {"text"}, "block_id": {"57"}}, "Attachments cannot change type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := app.do(tt.method, tt.target, tt.form)
+			assertStatus(t, rec, 422)
+			assertContains(t, rec, tt.want)
+		})
+	}
+
+	rec := app.do(http.MethodGet, "/blocks/export?block_id=57", nil)
+	assertStatus(t, rec, 200)
+	if got, want := rec.Body.String(), "![picture.png](/attachments/"+hashOf(picture)+")\n"; got != want {
+		t.Errorf("export = %q, want %q", got, want)
+	}
+}
+
+func TestEncryptedNoteAttachments(t *testing.T) {
+	app := newTestApp(t)
+	doc := []byte("The secret plans, attached")
+	picture := testPNG(t, 40, 20)
+	app.upload("/attachments?note_id=2", nil, map[string][]byte{"plans.txt": doc})
+	app.upload("/attachments?note_id=2", nil, map[string][]byte{"picture.png": picture})
+	get := func(target string) *httptest.ResponseRecorder {
+		return app.serve(httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	app.encrypt(2, "correct horse")
+	sealed := app.queryString("SELECT attachment FROM blocks WHERE id = 57")
+	if sealed == hashOf(doc) {
+		t.Fatal("the attachment kept its plaintext hash")
+	}
+	if got := app.queryInt("SELECT COUNT(*) FROM attachments WHERE encrypted"); got != 2 {
+		t.Errorf("%d attachments marked encrypted, want 2", got)
+	}
+	for name, data := range storedFiles(t) {
+		if bytes.Contains(data, doc) {
+			t.Errorf("%s is stored in plaintext", name)
+		}
+	}
+	assertStatus(t, get("/attachments/"+hashOf(doc)), 404)
+
+	rec := get("/attachments/" + sealed)
+	assertStatus(t, rec, 200)
+	if !bytes.Equal(rec.Body.Bytes(), doc) {
+		t.Error("served different content")
+	}
+	picture_hash := app.queryString("SELECT attachment FROM blocks WHERE id = 58")
+	rec = get("/attachments/" + picture_hash + "/thumbnail")
+	assertStatus(t, rec, 200)
+	if got := rec.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("thumbnail Content-Type = %q", got)
+	}
+
+	// A collaborator has to unlock the note too
+	session := app.session
+	other := app.addUser(2, "other")
+	rec = app.do(http.MethodPost, "/notes/2/collaborators", url.Values{"username": {"other"}, "role": {"viewer"}})
+	assertStatus(t, rec, 200)
+	app.session = other
+	assertStatus(t, get("/attachments/"+sealed), 423)
+	app.session = session
+
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/lock", nil), 200)
+	assertStatus(t, get("/attachments/"+sealed), 423)
+	assertStatus(t, get("/attachments/"+picture_hash+"/thumbnail"), 423)
+	rec = app.upload("/attachments?note_id=2", nil, map[string][]byte{"more.txt": []byte("more")})
+	assertStatus(t, rec, 423)
+
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/unlock", url.Values{"passphrase": {"correct horse"}}), 200)
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2/encryption", nil), 200)
+	if got := app.queryString("SELECT attachment FROM blocks WHERE id = 57"); got != hashOf(doc) {
+		t.Errorf("attachment = %s after decrypting, want its plaintext hash", got)
+	}
+	if fileExists(attachmentPath(sealed)) {
+		t.Error("the sealed file was left behind")
+	}
+	rec = get("/attachments/" + hashOf(doc))
+	assertStatus(t, rec, 200)
+	if !bytes.Equal(rec.Body.Bytes(), doc) {
+		t.Error("served different content after decrypting")
+	}
+}
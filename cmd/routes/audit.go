@@ -0,0 +1,344 @@
+package routes
+
+import (
+	"database/sql/driver"
+	"html/template"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"modernc.org/sqlite"
+)
+
+// Every change a request makes is appended to audit_log by a trigger on
+// the table it changes, with who made it and the value before and after.
+// The triggers ask audit_user who is acting and audit_action what to call
+// the change, which is create, update, move or delete unless a handler
+// says otherwise with auditAs. Nothing updates or deletes the log, but
+// resealing values that stay the same is not audited, and encrypting a
+// note encrypts the versions of its blocks kept here too.
+
+// AuditEntry is one change from audit_log. Before and After are nil where
+// there was no value, where the change is to someone else's data, or
+// where they are sealed with the passphrase of a note this session has
+// not unlocked.
+type AuditEntry struct {
+	ID        int     `json:"id"`
+	CreatedAt string  `json:"created_at"`
+	UserID    *int    `json:"user_id"`
+	Username  string  `json:"username"`
+	Action    string  `json:"action"`
+	Entity    string  `json:"entity"`
+	EntityID  int     `json:"entity_id"`
+	NoteID    *int    `json:"note_id"`
+	Field     string  `json:"field"`
+	Before    *string `json:"before"`
+	After     *string `json:"after"`
+	Encrypted bool    `json:"encrypted"`
+}
+
+// AuditFilter narrows the audit log down. Zero values match everything;
+// Since and Until are dates, and Before an entry id to page back from.
+type AuditFilter struct {
+	Action string
+	Entity string
+	NoteID int
+	User   string
+	Since  string
+	Until  string
+	Before int
+}
+
+// AuditLog is the audit page: the newest entries matching Filter, and
+// the id to page back from for older ones, if there are any. Query is
+// Filter as a query string, leaving out Before.
+type AuditLog struct {
+	Filter   AuditFilter
+	Entries  []AuditEntry
+	Older    int
+	Query    template.URL
+	Actions  []string
+	Entities []string
+}
+
+var AuditActions = []string{"create", "update", "move", "delete", "archive", "restore", "clear"}
+
+var AuditEntities = []string{"note", "block", "comment", "archived_note", "share", "collaborator", "token", "user"}
+
+const AuditPageSize = 200
+
+// auditPaused stops the triggers recording changes to titles and block
+// contents, for rewriting them sealed differently.
+var auditPaused bool
+
+func init() {
+	sqlite.MustRegisterScalarFunction("audit_user", 0, auditUser)
+	sqlite.MustRegisterScalarFunction("audit_action", 1, auditAction)
+	sqlite.MustRegisterScalarFunction("auditing", 0, auditing)
+}
+
+// auditUser is the user the agent acts for, or NULL outside a request.
+func auditUser(_ *sqlite.FunctionContext, _ []driver.Value) (driver.Value, error) {
+	if agent == nil || agent.UserID == 0 {
+		return nil, nil
+	}
+	return int64(agent.UserID), nil
+}
+
+// auditAction is the action set with auditAs, or else its argument.
+func auditAction(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if agent == nil || agent.Action == "" {
+		return args[0], nil
+	}
+	return agent.Action, nil
+}
+
+func auditing(_ *sqlite.FunctionContext, _ []driver.Value) (driver.Value, error) {
+	if auditPaused {
+		return int64(0), nil
+	}
+	return int64(1), nil
+}
+
+// auditAs records the changes made until done is called as action, as
+// archiving a note deletes it without that being a delete.
+func auditAs(action string) (done func()) {
+	previous := agent.Action
+	agent.Action = action
+	return func() { agent.Action = previous }
+}
+
+// pauseAudit keeps changes to titles and block contents out of the log
+// until resume is called.
+func pauseAudit() (resume func()) {
+	auditPaused = true
+	return func() { auditPaused = false }
+}
+
+func parseAuditFilter(c echo.Context) (AuditFilter, error) {
+	var err error
+
+	filter := AuditFilter{
+		Action: c.QueryParam("action"),
+		Entity: c.QueryParam("entity"),
+		User:   c.QueryParam("user"),
+		Since:  c.QueryParam("since"),
+		Until:  c.QueryParam("until"),
+	}
+	if filter.Action != "" && !slices.Contains(AuditActions, filter.Action) {
+		return filter, echo.NewHTTPError(400, "Missing or invalid param action")
+	}
+	if filter.Entity != "" && !slices.Contains(AuditEntities, filter.Entity) {
+		return filter, echo.NewHTTPError(400, "Missing or invalid param entity")
+	}
+	if param := c.QueryParam("note_id"); param != "" {
+		if filter.NoteID, err = strconv.Atoi(param); err != nil {
+			return filter, echo.NewHTTPError(400, "Missing or invalid param note_id")
+		}
+	}
+	if param := c.QueryParam("before"); param != "" {
+		if filter.Before, err = strconv.Atoi(param); err != nil {
+			return filter, echo.NewHTTPError(400, "Missing or invalid param before")
+		}
+	}
+	for name, date := range map[string]string{"since": filter.Since, "until": filter.Until} {
+		if _, err = time.Parse(time.DateOnly, date); date != "" && err != nil {
+			return filter, echo.NewHTTPError(400, "Missing or invalid param "+name)
+		}
+	}
+
+	return filter, nil
+}
+
+func (filter AuditFilter) query() string {
+	query := url.Values{}
+	for name, value := range map[string]string{
+		"action": filter.Action,
+		"entity": filter.Entity,
+		"user":   filter.User,
+		"since":  filter.Since,
+		"until":  filter.Until,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if filter.NoteID != 0 {
+		query.Set("note_id", strconv.Itoa(filter.NoteID))
+	}
+	return query.Encode()
+}
+
+func GetAudit(c echo.Context) error {
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		return err
+	}
+	entries, err := getAudit(filter, AuditPageSize+1)
+	if err != nil {
+		return err
+	}
+	audit := AuditLog{
+		Filter:   filter,
+		Entries:  entries,
+		Query:    template.URL(filter.query()),
+		Actions:  AuditActions,
+		Entities: AuditEntities,
+	}
+	if len(entries) > AuditPageSize {
+		audit.Entries = entries[:AuditPageSize]
+		audit.Older = audit.Entries[AuditPageSize-1].ID
+	}
+
+	return c.Render(200, "audit", audit)
+}
+
+// ExportAudit downloads every entry matching the filter as JSON.
+func ExportAudit(c echo.Context) error {
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		return err
+	}
+	entries, err := getAudit(filter, -1)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="audit.json"`)
+	return c.JSON(200, entries)
+}
+
+// getAudit gets up to limit entries matching filter, newest first, or
+// all of them for a negative limit. Users see their own changes, and
+// every change to their notes and the notes shared with them, but only
+// owners see the values changed; collaborators see who did what, when.
+func getAudit(filter AuditFilter, limit int) ([]AuditEntry, error) {
+	var err error
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() ([]AuditEntry, error) {
+		agent.Rollback()
+		return nil, err
+	}
+
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	rows, err := agent.Query(
+		`
+        SELECT
+            a.id,
+            a.created_at,
+            a.user_id,
+            COALESCE(u.username, ''),
+            a.action,
+            a.entity,
+            a.entity_id,
+            a.note_id,
+            a.field,
+            CASE
+                WHEN $1 IS NOT a.owner_id AND $1 IS NOT (SELECT owner_id FROM notes WHERE id = a.note_id) THEN NULL
+                WHEN a.field IN ('title', 'content') THEN unseal(a.before)
+                ELSE a.before
+            END,
+            CASE
+                WHEN $1 IS NOT a.owner_id AND $1 IS NOT (SELECT owner_id FROM notes WHERE id = a.note_id) THEN NULL
+                WHEN a.field IN ('title', 'content') THEN unseal(a.after)
+                ELSE a.after
+            END,
+            a.encrypted
+        FROM audit_log a
+        LEFT JOIN users u
+        ON u.id = a.user_id
+        WHERE (
+            a.user_id = $1
+            OR a.owner_id = $1
+            OR a.note_id IN (SELECT note_id FROM note_access WHERE user_id = $1)
+        )
+        AND ($2 = '' OR a.action = $2)
+        AND ($3 = '' OR a.entity = $3)
+        AND ($4 = 0 OR a.note_id = $4)
+        AND ($5 = '' OR u.username = $5)
+        AND ($6 = '' OR a.created_at >= $6)
+        AND ($7 = '' OR a.created_at < date($7, '+1 day'))
+        AND ($8 = 0 OR a.id < $8)
+        ORDER BY a.id DESC
+        LIMIT $9;
+        `,
+		agent.UserID,
+		filter.Action,
+		filter.Entity,
+		filter.NoteID,
+		filter.User,
+		filter.Since,
+		filter.Until,
+		filter.Before,
+		limit,
+	)
+	if err != nil {
+		return handleError()
+	}
+	entries := []AuditEntry{}
+	for rows.Next() {
+		entry := AuditEntry{}
+		if err = rows.Scan(
+			&entry.ID,
+			&entry.CreatedAt,
+			&entry.UserID,
+			&entry.Username,
+			&entry.Action,
+			&entry.Entity,
+			&entry.EntityID,
+			&entry.NoteID,
+			&entry.Field,
+			&entry.Before,
+			&entry.After,
+			&entry.Encrypted,
+		); err != nil {
+			rows.Close()
+			return handleError()
+		}
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	openAuditEntries(entries)
+
+	return entries, nil
+}
+
+// openAuditEntries opens values sealed with the passphrase of a note
+// this session has unlocked, and hides the rest.
+func openAuditEntries(entries []AuditEntry) {
+	keyring.Lock()
+	defer keyring.Unlock()
+	keys := keyring.keys[agent.Session]
+
+	open := func(key []byte, value *string) *string {
+		if value == nil || key == nil {
+			return nil
+		}
+		opened, err := openContent(key, *value)
+		if err != nil {
+			return nil
+		}
+		return &opened
+	}
+	for i := range entries {
+		entry := &entries[i]
+		if !entry.Encrypted || entry.NoteID == nil {
+			continue
+		}
+		key := keys[*entry.NoteID]
+		entry.Before = open(key, entry.Before)
+		entry.After = open(key, entry.After)
+	}
+}
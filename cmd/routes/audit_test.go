@@ -0,0 +1,216 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// audit exports the audit log entries the test session sees matching
+// query, newest first.
+func (app *testApp) audit(query string) []AuditEntry {
+	app.t.Helper()
+
+	rec := app.do(http.MethodGet, "/audit/export?"+query, nil)
+	assertStatus(app.t, rec, 200)
+	entries := []AuditEntry{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		app.t.Fatal(err)
+	}
+	return entries
+}
+
+func value(s *string) string {
+	if s == nil {
+		return "<nil>"
+	}
+	return *s
+}
+
+func TestAuditLog(t *testing.T) {
+	app := newTestApp(t)
+
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Audited"}, "version": {app.version(3)}}), 200)
+	entries := app.audit("action=update&entity=block&note_id=2")
+	if len(entries) != 1 {
+		t.Fatalf("%d block updates, want 1", len(entries))
+	}
+	got := entries[0]
+	if got.EntityID != 3 || got.Field != "content" || got.Username != "demo" || got.UserID == nil || *got.UserID != 1 {
+		t.Errorf("entry = %+v, want demo updating block 3's content", got)
+	}
+	if value(got.Before) != plainBlock || value(got.After) != "Audited" {
+		t.Errorf("before, after = %q, %q, want %q, %q", value(got.Before), value(got.After), plainBlock, "Audited")
+	}
+
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2", nil), 200)
+	if got := len(app.audit("action=archive&entity=block&note_id=2")); got != 3 {
+		t.Errorf("%d blocks archived, want 3", got)
+	}
+	if got := len(app.audit("action=delete")); got != 0 {
+		t.Errorf("archiving recorded %d deletes", got)
+	}
+
+	assertStatus(t, app.do(http.MethodPost, "/archive/2", nil), 200)
+	if got := len(app.audit("action=restore&entity=note")); got != 1 {
+		t.Errorf("%d notes restored, want 1", got)
+	}
+	if got := len(app.audit("action=restore&entity=block")); got != 4 {
+		t.Errorf("%d blocks restored, want 4", got)
+	}
+
+	assertStatus(t, app.do(http.MethodDelete, "/archive/all", nil), 200)
+	archived := app.queryInt("SELECT COUNT(*) FROM audit_log WHERE entity = 'archived_note' AND action = 'clear'")
+	if got := len(app.audit("action=clear&entity=archived_note")); got != archived || got == 0 {
+		t.Errorf("%d archived notes cleared, want %d", got, archived)
+	}
+
+	rec := app.do(http.MethodGet, "/audit?action=update", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Audited", `<option selected>update</option>`)
+	rec = app.do(http.MethodGet, "/audit/export", nil)
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename="audit.json"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+}
+
+func TestAuditLogFilters(t *testing.T) {
+	app := newTestApp(t)
+	other := app.addUser(2, "other")
+	app.session = other
+	assertStatus(t, app.do(http.MethodPost, "/tokens", url.Values{"name": {"theirs"}, "scope": {"read"}}), 200)
+	app.session = "test-session"
+	assertStatus(t, app.do(http.MethodPost, "/tokens", url.Values{"name": {"mine"}, "scope": {"read"}}), 200)
+
+	tokens := app.audit("entity=token")
+	if len(tokens) != 1 || value(tokens[0].After) != `{"name":"mine","scope":"read"}` {
+		t.Errorf("tokens = %+v, want only mine", tokens)
+	}
+	if got := len(app.audit("user=other")); got != 0 {
+		t.Errorf("%d of other's changes shown", got)
+	}
+	if got := len(app.audit("since=2000-01-01&until=2000-12-31")); got != 0 {
+		t.Errorf("%d changes in 2000", got)
+	}
+	if got := len(app.audit("until=9999-12-30&user=demo")); got == 0 {
+		t.Error("no changes by demo")
+	}
+
+	for _, query := range []string{"action=erase", "entity=file", "note_id=two", "since=yesterday", "before=x"} {
+		assertStatus(t, app.do(http.MethodGet, "/audit?"+query, nil), 400)
+	}
+
+	for i := 0; i < AuditPageSize; i++ {
+		app.exec("UPDATE blocks SET checked = NOT checked WHERE id = 3")
+	}
+	rec := app.do(http.MethodGet, "/audit?note_id=2", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `hx-get="/audit?note_id=2&before=`)
+}
+
+func TestAuditLogAppendOnly(t *testing.T) {
+	app := newTestApp(t)
+
+	if _, err := agent.DB.Exec("UPDATE audit_log SET after = 'forged'"); err == nil {
+		t.Error("updated the audit log")
+	}
+	if _, err := agent.DB.Exec("DELETE FROM audit_log"); err == nil {
+		t.Error("deleted from the audit log")
+	}
+	if got := app.queryInt("SELECT COUNT(*) FROM audit_log WHERE after = 'forged'"); got != 0 {
+		t.Errorf("%d entries forged", got)
+	}
+}
+
+func TestAuditLogEncryptedNote(t *testing.T) {
+	app := newTestApp(t)
+	app.encrypt(2, "correct horse")
+
+	// Sealing the blocks is not a change to them
+	if got := len(app.audit("entity=block&note_id=2&user=demo")); got != 0 {
+		t.Errorf("encrypting recorded %d block changes", got)
+	}
+	encrypted := app.audit("entity=note&note_id=2&user=demo")
+	if len(encrypted) != 1 || encrypted[0].Field != "encrypted" || value(encrypted[0].After) != "true" {
+		t.Errorf("entries = %+v, want note 2 encrypted", encrypted)
+	}
+
+	// Nor are the versions of them from before
+	if got := app.queryInt("SELECT COUNT(*) FROM audit_log WHERE before = ? OR after = ?", plainBlock, plainBlock); got != 0 {
+		t.Errorf("%d versions of block 3 left in plaintext", got)
+	}
+	created := app.audit("action=create&entity=block&note_id=2")
+	if len(created) != 3 || !created[2].Encrypted || value(created[2].After) != plainBlock {
+		t.Errorf("entries = %+v, want block 3 created, opened", created)
+	}
+
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Secret plans"}, "version": {app.version(3)}}), 200)
+	if got := app.queryInt("SELECT COUNT(*) FROM audit_log WHERE after = 'Secret plans'"); got != 0 {
+		t.Error("the audit log holds the edit in plaintext")
+	}
+	entries := app.audit("action=update&entity=block")
+	if len(entries) != 1 || !entries[0].Encrypted || value(entries[0].After) != "Secret plans" {
+		t.Errorf("entries = %+v, want the edit opened", entries)
+	}
+
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/lock", nil), 200)
+	entries = app.audit("action=update&entity=block")
+	if len(entries) != 1 || entries[0].Before != nil || entries[0].After != nil {
+		t.Errorf("entries = %+v, want the edit hidden", entries)
+	}
+	assertContains(t, app.do(http.MethodGet, "/audit?entity=block", nil), "encrypted")
+
+	// Decrypting the note decrypts them again
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/unlock", url.Values{"passphrase": {"correct horse"}}), 200)
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2/encryption", nil), 200)
+	entries = app.audit("action=update&entity=block")
+	if len(entries) != 1 || entries[0].Encrypted || value(entries[0].Before) != plainBlock {
+		t.Errorf("entries = %+v, want the edit in plaintext", entries)
+	}
+}
+
+func TestAuditLogCollaborator(t *testing.T) {
+	app := newTestApp(t)
+	other := app.addUser(2, "other")
+	rec := app.do(http.MethodPost, "/notes/2/collaborators", url.Values{"username": {"other"}, "role": {"viewer"}})
+	assertStatus(t, rec, 200)
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Owner only"}, "version": {app.version(3)}}), 200)
+
+	app.session = other
+	entries := app.audit("action=update&entity=block&note_id=2")
+	if len(entries) != 1 || entries[0].Username != "demo" || entries[0].EntityID != 3 {
+		t.Fatalf("entries = %+v, want demo updating block 3", entries)
+	}
+	if entries[0].Before != nil || entries[0].After != nil {
+		t.Errorf("before, after = %q, %q, want them hidden", value(entries[0].Before), value(entries[0].After))
+	}
+	rec = app.do(http.MethodGet, "/audit?note_id=2", nil)
+	assertStatus(t, rec, 200)
+	if strings.Contains(rec.Body.String(), "Owner only") {
+		t.Error("the audit page shows the owner's edit")
+	}
+}
+
+func TestAuditLogArchivedNote(t *testing.T) {
+	app := newTestApp(t)
+	owner := app.session
+	other := app.addUser(2, "other")
+	rec := app.do(http.MethodPost, "/notes/2/collaborators", url.Values{"username": {"other"}, "role": {"editor"}})
+	assertStatus(t, rec, 200)
+	app.session = other
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Edited by other"}, "version": {app.version(3)}}), 200)
+	app.session = owner
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2", nil), 200)
+
+	// The note is gone, but its values are still the owner's to see
+	app.session = other
+	entries := app.audit("action=update&entity=block")
+	if len(entries) != 1 || entries[0].EntityID != 3 {
+		t.Fatalf("entries = %+v, want other updating block 3", entries)
+	}
+	if entries[0].Before != nil || entries[0].After != nil {
+		t.Errorf("before, after = %q, %q, want them hidden", value(entries[0].Before), value(entries[0].After))
+	}
+}
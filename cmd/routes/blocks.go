@@ -3,96 +3,290 @@ package routes
 import (
 	"database/sql"
 	"errors"
-	"log"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 )
 
+// BlockTypes are the kinds of block a note can hold. New blocks are
+// "text"; "todo" blocks have a checkbox, "code" blocks keep their
+// whitespace and are highlighted as their Language, and "table" blocks
+// hold a Table.
+var BlockTypes = []string{"text", "heading", "quote", "todo", "code", "table"}
+
+// Block is a paragraph of a note. Blocks nest under a parent block,
+// ParentID 0 being the top level; Children is only filled in when a
+// whole note is loaded. Attachment is the hash of the file an "image"
+// or "file" block shows, named by its Content.
 type Block struct {
-	ID        int    `json:"id"`
-	NoteID    int    `json:"note_id"`
-	SortOrder int    `json:"sort_order"`
-	Content   string `json:"content"`
+	ID         int     `json:"id"`
+	NoteID     int     `json:"note_id"`
+	ParentID   int     `json:"parent_id"`
+	SortOrder  int     `json:"sort_order"`
+	Content    string  `json:"content"`
+	Type       string  `json:"type"`
+	Collapsed  bool    `json:"collapsed"`
+	Checked    bool    `json:"checked"`
+	Attachment string  `json:"attachment,omitempty"`
+	Language   string  `json:"language,omitempty"`
+	Version    int     `json:"version,omitempty"`
+	Children   []Block `json:"children,omitempty"`
+
+	// shareURL is the share link the block is shown through, if any,
+	// which serves its attachment to those not signed in.
+	shareURL string
+}
+
+// AttachmentURL is where the block's attachment is served.
+func (b Block) AttachmentURL() string {
+	return b.shareURL + "/attachments/" + b.Attachment
 }
 
 type MaybeBlock struct {
-	ID        sql.NullInt64
-	NoteID    sql.NullInt64
-	SortOrder sql.NullInt64
-	Content   sql.NullString
+	ID         sql.NullInt64
+	NoteID     sql.NullInt64
+	ParentID   sql.NullInt64
+	SortOrder  sql.NullInt64
+	Content    sql.NullString
+	Type       sql.NullString
+	Collapsed  sql.NullBool
+	Checked    sql.NullBool
+	Attachment sql.NullString
+	Language   sql.NullString
 }
 
 func (mb MaybeBlock) Valid() bool {
 	return (mb.ID.Valid &&
 		mb.NoteID.Valid &&
 		mb.SortOrder.Valid &&
-		mb.Content.Valid)
+		mb.Content.Valid &&
+		mb.Type.Valid &&
+		mb.Collapsed.Valid &&
+		mb.Checked.Valid)
 }
 
 func (mb MaybeBlock) Value() Block {
 	return Block{
-		ID:        int(mb.ID.Int64),
-		NoteID:    int(mb.NoteID.Int64),
-		SortOrder: int(mb.SortOrder.Int64),
-		Content:   string(mb.Content.String),
+		ID:         int(mb.ID.Int64),
+		NoteID:     int(mb.NoteID.Int64),
+		ParentID:   int(mb.ParentID.Int64),
+		SortOrder:  int(mb.SortOrder.Int64),
+		Content:    string(mb.Content.String),
+		Type:       string(mb.Type.String),
+		Collapsed:  mb.Collapsed.Bool,
+		Checked:    mb.Checked.Bool,
+		Attachment: mb.Attachment.String,
+		Language:   mb.Language.String,
 	}
 }
 
+func validBlockType(block_type string) bool {
+	return slices.Contains(BlockTypes, block_type)
+}
+
+// BlockInsert places a new block editor after AfterBlockID, or first
+// under ParentID when it is 0.
+type BlockInsert struct {
+	NoteID       int
+	ParentID     int
+	AfterBlockID int
+}
+
+// GetNewBlock renders an editor for a new block, appended to the note
+// unless ?after_block_id or ?before_block_id place it next to another.
+// Appended blocks may start as code or a table, given ?block_type.
 func GetNewBlock(c echo.Context) error {
+	var err error
+
 	note_id, err := strconv.Atoi(c.QueryParam("note_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param :note_id")
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	if err = canEdit(note_id); err != nil {
+		return err
+	}
+	after_param := c.QueryParam("after_block_id")
+	before_param := c.QueryParam("before_block_id")
+	if after_param == "" && before_param == "" {
+		block := Block{NoteID: note_id, Type: "text"}
+		if block_type := c.QueryParam("block_type"); block_type == "code" || block_type == "table" {
+			block.Type = block_type
+		}
+		return c.Render(200, "block-editor--new", block)
+	}
+
+	insert := BlockInsert{NoteID: note_id}
+	if after_param != "" {
+		insert.AfterBlockID, err = strconv.Atoi(after_param)
+		if err != nil {
+			return echo.NewHTTPError(400, "Missing or invalid param ?after_block_id")
+		}
+		return c.Render(200, "block-editor--insert", insert)
+	}
+	before_id, err := strconv.Atoi(before_param)
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param ?before_block_id")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	before, err := getNoteBlock(note_id, before_id)
+	if err != nil {
+		return handleError()
+	}
+	ids, err := getBlockIds(note_id, before.ParentID)
+	if err != nil {
+		return handleError()
 	}
-	return c.Render(200, "block-editor--new", Block{NoteID: note_id})
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	insert.ParentID = before.ParentID
+	if index := indexOf(ids, before_id); index > 0 {
+		insert.AfterBlockID = ids[index-1]
+	}
+
+	return c.Render(200, "block-editor--insert", insert)
 }
 
 func GetBlockEditor(c echo.Context) error {
 	block_id, err := strconv.Atoi(c.Param("block_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param :block_id")
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
 	}
 	block, err := getContentByBlockId(block_id)
 	if err != nil {
-		log.Panic(err)
-		return c.NoContent(404)
+		return err
+	}
+	if err = canEdit(block.NoteID); err != nil {
+		return err
 	}
 	return c.Render(200, "block-editor--existing", block)
 }
 
+// PostBlock adds a block to the end of a note, or in place when given
+// ?after_block_id or ?position (0-based index among the children of
+// ?parent_id, the top level by default). ?parent_id alone adds it as the
+// last child. ?type sets the block type, "text" by default.
 func PostBlock(c echo.Context) error {
 	var err error
 
 	note_id, err := strconv.Atoi(c.QueryParam("note_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param :note_id")
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	position := -1
+	if param := c.QueryParam("position"); param != "" {
+		position, err = strconv.Atoi(param)
+		if err != nil || position < 0 {
+			return echo.NewHTTPError(400, "Missing or invalid param ?position")
+		}
+	}
+	parent_id := 0
+	if param := c.QueryParam("parent_id"); param != "" {
+		parent_id, err = strconv.Atoi(param)
+		if err != nil {
+			return echo.NewHTTPError(400, "Missing or invalid param ?parent_id")
+		}
+	}
+	after_id := 0
+	if param := c.QueryParam("after_block_id"); param != "" {
+		after_id, err = strconv.Atoi(param)
+		if err != nil {
+			return echo.NewHTTPError(400, "Missing or invalid param ?after_block_id")
+		}
+	}
+	block_type := "text"
+	if param := c.QueryParam("type"); param != "" {
+		if !validBlockType(param) {
+			return echo.NewHTTPError(400, "Missing or invalid param ?type")
+		}
+		block_type = param
 	}
 	content := c.FormValue("content")
 	if len(content) == 0 {
 		return c.String(422, "Content cannot be empty")
 	}
+	// Tables are posted as pasted CSV
+	if block_type == "table" {
+		table, err := tableFromCSV(content)
+		if err != nil {
+			return err
+		}
+		content = table.String()
+	}
 
 	if agent == nil {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
-	sort_order, err := getLastSortOrderUsed(note_id)
+	if err = canEdit(note_id); err != nil {
+		return handleError()
+	}
+	if after_id != 0 {
+		var after Block
+		after, err = getNoteBlock(note_id, after_id)
+		if err != nil {
+			return handleError()
+		}
+		var ids []int
+		ids, err = getBlockIds(note_id, after.ParentID)
+		if err != nil {
+			return handleError()
+		}
+		parent_id = after.ParentID
+		position = indexOf(ids, after_id) + 1
+	} else if parent_id != 0 {
+		if _, err = getNoteBlock(note_id, parent_id); err != nil {
+			return handleError()
+		}
+		// Without a position, it goes last under its parent
+		if position < 0 {
+			var ids []int
+			ids, err = getBlockIds(note_id, parent_id)
+			if err != nil {
+				return handleError()
+			}
+			position = len(ids)
+		}
+	}
+	var sort_order int
+	if position < 0 {
+		sort_order, err = getLastSortOrderUsed(note_id)
+		sort_order += SortGap
+	} else {
+		sort_order, err = sortOrderAt(note_id, parent_id, 0, position)
+	}
 	if err != nil {
 		return handleError()
 	}
 	block := Block{
 		NoteID:    note_id,
 		Content:   content,
-		SortOrder: sort_order + 1,
+		SortOrder: sort_order,
+		ParentID:  parent_id,
+		Type:      block_type,
+	}
+	sealed, err := sealBlockContent(note_id, content)
+	if err != nil {
+		return handleError()
 	}
 	res, err := agent.Exec(
 		`
@@ -100,13 +294,17 @@ func PostBlock(c echo.Context) error {
                 (
                     note_id,
                     content,
-                    sort_order
+                    sort_order,
+                    parent_id,
+                    type
                 )
             VALUES
                 (
                     $1,
-                    $2,
-                    $3
+                    seal($2),
+                    $3,
+                    $4,
+                    $5
                 );
             
             UPDATE notes
@@ -114,8 +312,10 @@ func PostBlock(c echo.Context) error {
             WHERE id = $1;
         `,
 		block.NoteID,
-		block.Content,
+		sealed,
 		block.SortOrder,
+		nullId(block.ParentID),
+		block.Type,
 	)
 	if err != nil {
 		return handleError()
@@ -125,22 +325,47 @@ func PostBlock(c echo.Context) error {
 		return handleError()
 	}
 	block.ID = int(id)
+	if err = notify("block", block.NoteID); err != nil {
+		return handleError()
+	}
 	if err = agent.Commit(); err != nil {
 		return handleError()
 	}
 
+	// Code and tables are written one block at a time, so no new editor
+	// follows them
+	if position >= 0 || block.Type != "text" {
+		return c.Render(200, "block-container", block)
+	}
 	return c.Render(200, "block-editor--afterpost", block)
 }
 
+// PutBlock saves a block's content. It will not save over a version newer
+// than the form value version, the one the edit began on, which only API
+// tokens may leave out.
 func PutBlock(c echo.Context) error {
 	block_id, err := strconv.Atoi(c.Param("block_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param :block_id")
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
+	}
+	version, err := formVersion(c)
+	if err != nil {
+		return err
 	}
 	block, err := getContentByBlockId(block_id)
 	if err != nil {
-		log.Panic(err)
-		return c.NoContent(404)
+		return err
+	}
+	if err = canEdit(block.NoteID); err != nil {
+		return err
+	}
+	// Live editors save as they type; closing their editor shows the result
+	if saved, ok := liveContent(block.NoteID, block.ID); ok {
+		if c.FormValue("live") != "true" {
+			return Conflict("Block %d is being edited live", block.ID)
+		}
+		block.Content = saved
+		return c.Render(200, "block", block)
 	}
 	content := c.FormValue("content")
 	if len(content) == 0 {
@@ -149,35 +374,51 @@ func PutBlock(c echo.Context) error {
 	if content == block.Content {
 		return c.Render(200, "block", block)
 	}
+	// Someone saved the block since this edit began
+	if version != 0 && version != block.Version {
+		return renderConflict(c, EditConflict{
+			NoteID:  block.NoteID,
+			Target:  "/blocks/" + strconv.Itoa(block.ID),
+			Field:   "content",
+			Version: block.Version,
+			Theirs:  block.Content,
+			Yours:   content,
+		})
+	}
 	block.Content = content
 	if agent == nil {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
+	sealed, err := sealBlockContent(block.NoteID, block.Content)
+	if err != nil {
+		return handleError()
+	}
 	if _, err = agent.Exec(
 		`
             UPDATE blocks
-            SET content = $1
+            SET content = seal($1)
             WHERE id = $2;
 
             UPDATE notes
             SET modified_at = CURRENT_TIMESTAMP
             WHERE id = $3;
         `,
-		block.Content,
+		sealed,
 		block.ID,
 		block.NoteID,
 	); err != nil {
 		return handleError()
 	}
+	if err = notify("block", block.NoteID); err != nil {
+		return handleError()
+	}
 	if err = agent.Commit(); err != nil {
 		return handleError()
 	}
@@ -188,12 +429,14 @@ func PutBlock(c echo.Context) error {
 func GetBlockMover(c echo.Context) error {
 	block_id, err := strconv.Atoi(c.Param("block_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param :block_id")
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
 	}
 	block, err := getContentByBlockId(block_id)
 	if err != nil {
-		log.Panic(err)
-		return c.NoContent(404)
+		return err
+	}
+	if err = canEdit(block.NoteID); err != nil {
+		return err
 	}
 	return c.Render(200, "block-mover", block)
 }
@@ -202,162 +445,165 @@ func CancelBlockMover(c echo.Context) error {
 	return c.NoContent(200)
 }
 
+// MoveBlock moves a block, and with it its children, within its note.
+// The destination is given by ?after_block_id, ?direction (up, down, top
+// or bottom among its siblings) or ?position (0-based index among the
+// children of ?parent_id, its current parent by default). Only the moved
+// block's row is rewritten.
 func MoveBlock(c echo.Context) error {
 	block_id, err := strconv.Atoi(c.Param("block_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param :block_id")
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
 	}
+	position_param := c.QueryParam("position")
+	after_param := c.QueryParam("after_block_id")
 	direction := c.QueryParam("direction")
-	valid, err := regexp.MatchString("up|down|top|bottom", direction)
-	if !valid || err != nil {
-		return c.String(400, "Missing or invalid param ?direction")
+	if position_param == "" && after_param == "" {
+		valid, err := regexp.MatchString("^(up|down|top|bottom)$", direction)
+		if !valid || err != nil {
+			return echo.NewHTTPError(400, "Missing or invalid param ?direction")
+		}
+	}
+	block, err := getContentByBlockId(block_id)
+	if err != nil {
+		return err
+	}
+	if err = canEdit(block.NoteID); err != nil {
+		return err
 	}
 
 	if agent == nil {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
-	if err := agent.Open(); err != nil {
+	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
-	rows, err := agent.Query(
-		`
-            SELECT id, note_id FROM blocks
-            WHERE note_id = (
-                SELECT note_id FROM blocks
-                WHERE id = ?
-                LIMIT 1
-            )
-            ORDER BY sort_order ASC;
-        `,
-		block_id,
-	)
+	parent_id := block.ParentID
+	ids, err := getBlockIds(block.NoteID, parent_id)
 	if err != nil {
 		return handleError()
 	}
-	i := 0
-	ids := []int{}
-	var note_id int
-	switch direction {
-	default:
-		err = errors.New("didn't match any valid direction")
-		return handleError()
-	case "top":
-		ids = append(ids, block_id)
-		for rows.Next() {
-			var id int
-			if err = rows.Scan(&id, &note_id); err != nil {
-				return handleError()
-			}
-			if i == 0 && id == block_id {
+	index := indexOf(ids, block.ID)
+	var position int
+	switch {
+	case position_param != "":
+		position, err = strconv.Atoi(position_param)
+		if err != nil || position < 0 {
+			agent.Rollback()
+			return echo.NewHTTPError(400, "Missing or invalid param ?position")
+		}
+		if param := c.QueryParam("parent_id"); param != "" {
+			parent_id, err = strconv.Atoi(param)
+			if err != nil {
 				agent.Rollback()
-				// @TODO Use proper status code 422
-				return c.String(400, "Cannot move in that direction")
+				return echo.NewHTTPError(400, "Missing or invalid param ?parent_id")
 			}
-			if id != block_id {
-				ids = append(ids, id)
+			if parent_id != 0 {
+				if _, err = getNoteBlock(block.NoteID, parent_id); err != nil {
+					return handleError()
+				}
 			}
-			i++
-		}
-	case "bottom":
-		var index_of_block int
-		for rows.Next() {
-			var id int
-			if err = rows.Scan(&id, &note_id); err != nil {
+			if ids, err = getBlockIds(block.NoteID, parent_id); err != nil {
 				return handleError()
 			}
-			if id == block_id {
-				index_of_block = i
-			} else {
-				ids = append(ids, id)
-			}
-			i++
-
+			index = indexOf(ids, block.ID)
 		}
-		if index_of_block == i-1 {
+		if index < 0 {
+			position = min(position, len(ids))
+		} else {
+			position = min(position, len(ids)-1)
+		}
+	case after_param != "":
+		var after_id int
+		after_id, err = strconv.Atoi(after_param)
+		if err != nil {
 			agent.Rollback()
-			// @TODO Use proper status code 422
-			return c.String(400, "Cannot move in that direction")
+			return echo.NewHTTPError(400, "Missing or invalid param ?after_block_id")
 		}
-		ids = append(ids, block_id)
-	case "up":
-		for rows.Next() {
-			var id int
-			if err = rows.Scan(&id, &note_id); err != nil {
-				return handleError()
-			}
-			if i == 0 && id == block_id {
-				agent.Rollback()
-				// @TODO Use proper status code 422
-				return c.String(400, "Cannot move in that direction")
-			} else if i > 0 && id == block_id {
-				ids = append(ids, ids[i-1])
-				ids[i-1] = block_id
-			} else if id == block_id {
-				ids[i-1] = block_id
-			} else {
-				ids = append(ids, id)
-			}
-			i++
+		var after_block Block
+		after_block, err = getNoteBlock(block.NoteID, after_id)
+		if err != nil || after_id == block.ID {
+			agent.Rollback()
+			return Invalid("Block %d is not another block in this note", after_id)
 		}
-	case "down":
-		for rows.Next() {
-			var id int
-			if err = rows.Scan(&id, &note_id); err != nil {
-				return handleError()
-			}
+		parent_id = after_block.ParentID
+		if ids, err = getBlockIds(block.NoteID, parent_id); err != nil {
+			return handleError()
+		}
+		index = indexOf(ids, block.ID)
+		after := indexOf(ids, after_id)
+		position = after + 1
+		if index >= 0 && after > index {
+			// everything after the block shifts up once it is taken out
+			position = after
+		}
+	default:
+		switch direction {
+		case "up":
+			position = index - 1
+		case "down":
+			position = index + 1
+		case "top":
+			position = 0
+		case "bottom":
+			position = len(ids) - 1
+		}
+		if position < 0 || position >= len(ids) || position == index {
+			agent.Rollback()
+			return Invalid("Cannot move in that direction")
+		}
+	}
 
-			if id == block_id {
-				// push twice to expand array one extra
-				// 2nd one will be replaced next loop
-				ids = append(ids, block_id, block_id)
-			} else if len(ids) > i {
-				ids[i-1] = id
-			} else {
-				ids = append(ids, id)
-			}
-			i++
+	if parent_id != block.ParentID {
+		// A block cannot go under itself or one of its own children
+		var descendants []int
+		descendants, err = getDescendantIds([]int{block.ID})
+		if err != nil {
+			return handleError()
 		}
-		if len(ids) > i {
+		if parent_id == block.ID || indexOf(descendants, parent_id) >= 0 {
 			agent.Rollback()
-			// @TODO Use proper status code 422
-			return c.String(400, "Cannot move in that direction")
+			return Invalid("Cannot move a block inside itself")
 		}
 	}
-	for i, id := range ids {
+	if position != index || parent_id != block.ParentID {
+		var sort_order int
+		sort_order, err = sortOrderAt(block.NoteID, parent_id, block.ID, position)
+		if err != nil {
+			return handleError()
+		}
 		if _, err = agent.Exec(
 			`
                 UPDATE blocks
-                SET sort_order = ?
-                WHERE id = ?
+                SET
+                    sort_order = $1,
+                    parent_id = $2
+                WHERE id = $3;
+
+                UPDATE notes
+                SET modified_at = CURRENT_TIMESTAMP
+                WHERE id = $4;
             `,
-			i,
-			id,
+			sort_order,
+			nullId(parent_id),
+			block.ID,
+			block.NoteID,
 		); err != nil {
 			return handleError()
 		}
+		if err = notify("block", block.NoteID); err != nil {
+			return handleError()
+		}
 	}
-	if _, err = agent.Exec(
-		`
-        UPDATE notes
-        SET modified_at = CURRENT_TIMESTAMP
-        WHERE id = $1   
-        `,
-		note_id,
-	); err != nil {
-		return handleError()
-	}
-
 	if err = agent.Commit(); err != nil {
 		return handleError()
 	}
 
-	note, err := getContentByNoteId(note_id)
+	note, err := getContentByNoteId(block.NoteID)
 	if err != nil {
 		return handleError()
 	}
@@ -365,78 +611,236 @@ func MoveBlock(c echo.Context) error {
 	return c.Render(200, "blocks", note)
 }
 
-func DeleteBlock(c echo.Context) error {
+// SplitBlock splits a block in two at ?offset, counted in characters of
+// the posted content. The text before it stays in the block and the rest
+// goes to a new block directly after. Like PutBlock, it will not save
+// over a version newer than the form value version.
+func SplitBlock(c echo.Context) error {
 	block_id, err := strconv.Atoi(c.Param("block_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param :block_id")
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
+	}
+	version, err := formVersion(c)
+	if err != nil {
+		return err
+	}
+	offset, err := strconv.Atoi(c.FormValue("offset"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param offset")
+	}
+	content := []rune(c.FormValue("content"))
+	if offset < 0 || offset > len(content) {
+		return echo.NewHTTPError(400, "Missing or invalid param offset")
+	}
+	before := strings.TrimSpace(string(content[:offset]))
+	after := strings.TrimSpace(string(content[offset:]))
+	if len(before) == 0 || len(after) == 0 {
+		return Invalid("Cannot split at the start or end of a block")
 	}
 	block, err := getContentByBlockId(block_id)
 	if err != nil {
-		return c.NoContent(404)
+		return err
+	}
+	if err = canEdit(block.NoteID); err != nil {
+		return err
+	}
+	if err = checkBlockEdit(block, version); err != nil {
+		return err
+	}
+	if block.Attachment != "" {
+		return Invalid("Attachments cannot be split")
+	}
+	if block.Type == "table" {
+		return Invalid("Tables cannot be split")
 	}
 
 	if agent == nil {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
-	if err := agent.Open(); err != nil {
+	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
-	rows, err := agent.Query(
+	ids, err := getBlockIds(block.NoteID, block.ParentID)
+	if err != nil {
+		return handleError()
+	}
+	sort_order, err := sortOrderAt(block.NoteID, block.ParentID, 0, indexOf(ids, block.ID)+1)
+	if err != nil {
+		return handleError()
+	}
+	if before, err = sealBlockContent(block.NoteID, before); err != nil {
+		return handleError()
+	}
+	if after, err = sealBlockContent(block.NoteID, after); err != nil {
+		return handleError()
+	}
+	// The new block is a sibling; any children stay with the first half
+	if _, err = agent.Exec(
 		`
-            SELECT id, sort_order FROM blocks
-            WHERE note_id = ?
-            AND sort_order > ?
+            UPDATE blocks
+            SET content = seal($1)
+            WHERE id = $2;
+
+            INSERT INTO blocks (note_id, parent_id, content, sort_order, type, language)
+            VALUES ($3, $4, seal($5), $6, $7, $8);
         `,
+		before,
+		block.ID,
 		block.NoteID,
-		block.SortOrder,
-	)
+		nullId(block.ParentID),
+		after,
+		sort_order,
+		block.Type,
+		block.Language,
+	); err != nil {
+		return handleError()
+	}
+
+	return renderOutline(c, block.NoteID)
+}
+
+// MergeBlock appends the posted content to the block shown above this
+// one, the reverse of SplitBlock, and deletes this block. Its children
+// move to the end of the block it was merged into. Like PutBlock, it will
+// not save over a version newer than the form value version.
+func MergeBlock(c echo.Context) error {
+	block_id, err := strconv.Atoi(c.Param("block_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
+	}
+	version, err := formVersion(c)
 	if err != nil {
+		return err
+	}
+	block, err := getContentByBlockId(block_id)
+	if err != nil {
+		return err
+	}
+	if err = canEdit(block.NoteID); err != nil {
+		return err
+	}
+	if err = checkBlockEdit(block, version); err != nil {
+		return err
+	}
+	content := strings.TrimSpace(c.FormValue("content"))
+	if len(content) > 0 {
+		content = " " + content
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	for rows.Next() {
-		block_to_move := Block{}
-		if err = rows.Scan(
-			&block_to_move.ID,
-			&block_to_move.SortOrder,
-		); err != nil {
-			return handleError()
-		}
-		if _, err = agent.Exec(
-			`
-                UPDATE blocks
-                SET sort_order = ?
-                WHERE id = ?;   
-            `,
-			block_to_move.ID,
-			block_to_move.SortOrder-1,
-		); err != nil {
-			return handleError()
-		}
+	note, err := getContentByNoteId(block.NoteID)
+	if err != nil {
+		return handleError()
+	}
+	shown := flattenOutline(note.Blocks, false)
+	index := slices.IndexFunc(shown, func(b Block) bool { return b.ID == block.ID })
+	if index <= 0 {
+		agent.Rollback()
+		return Invalid("There is no block before this one to merge into")
+	}
+	target := shown[index-1]
+	if _, ok := liveContent(target.NoteID, target.ID); ok {
+		agent.Rollback()
+		return Conflict("Block %d is being edited live", target.ID)
+	}
+	if block.Attachment != "" || target.Attachment != "" {
+		agent.Rollback()
+		return Invalid("Attachments cannot be merged")
+	}
+	if block.Type == "table" || target.Type == "table" {
+		agent.Rollback()
+		return Invalid("Tables cannot be merged")
+	}
+	// Shift the children past the ones the target already has
+	var last, first sql.NullInt64
+	row := agent.QueryRow(
+		`
+            SELECT
+                (SELECT MAX(sort_order) FROM blocks WHERE parent_id = $1),
+                (SELECT MIN(sort_order) FROM blocks WHERE parent_id = $2);
+        `,
+		target.ID,
+		block.ID,
+	)
+	if err = row.Scan(&last, &first); err != nil {
+		return handleError()
+	}
+	if content, err = sealBlockContent(block.NoteID, target.Content+content); err != nil {
+		return handleError()
 	}
 	if _, err = agent.Exec(
 		`
-            DELETE FROM blocks
-            WHERE id = $1;
-
-            UPDATE notes
-            SET modified_at = CURRENT_TIMESTAMP
+            UPDATE blocks
+            SET content = seal($1)
             WHERE id = $2;
+
+            UPDATE blocks
+            SET
+                parent_id = $2,
+                sort_order = sort_order + $3
+            WHERE parent_id = $4;
+
+            DELETE FROM blocks
+            WHERE id = $4;
         `,
+		content,
+		target.ID,
+		last.Int64-first.Int64+SortGap,
 		block.ID,
-		block.NoteID,
 	); err != nil {
 		return handleError()
 	}
+
+	return renderOutline(c, block.NoteID)
+}
+
+func DeleteBlock(c echo.Context) error {
+	block_id, err := strconv.Atoi(c.Param("block_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
+	}
+	block, err := getContentByBlockId(block_id)
+	if err != nil {
+		return err
+	}
+	if err = canEdit(block.NoteID); err != nil {
+		return err
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if err = deleteBlockTrees([]int{block.ID}); err != nil {
+		return handleError()
+	}
+	if err = touchNotes([]int{block.NoteID}); err != nil {
+		return handleError()
+	}
 	if err = agent.Commit(); err != nil {
 		return handleError()
 
 	}
+	cleanUpAttachments(c)
 
 	return c.NoContent(200)
 }
@@ -450,7 +854,6 @@ func getContentByBlockId(block_id int) (Block, error) {
 		agent = NewDBAgent()
 	}
 	handleError := func() (Block, error) {
-		log.Panic(err)
 		agent.Rollback()
 		return block, err
 	}
@@ -462,19 +865,45 @@ func getContentByBlockId(block_id int) (Block, error) {
             SELECT
                 id,
                 note_id,
+                COALESCE(parent_id, 0),
                 sort_order,
-                content
+                unseal(content),
+                type,
+                collapsed,
+                checked,
+                COALESCE(attachment, ''),
+                language,
+                version
             FROM blocks
-                WHERE id = ?;
+                WHERE id = ?
+                AND note_id IN (SELECT note_id FROM note_access WHERE user_id = ?);
         `,
 		block_id,
+		agent.UserID,
 	)
 	if err = row.Scan(
 		&block.ID,
 		&block.NoteID,
+		&block.ParentID,
 		&block.SortOrder,
 		&block.Content,
+		&block.Type,
+		&block.Collapsed,
+		&block.Checked,
+		&block.Attachment,
+		&block.Language,
+		&block.Version,
 	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = NotFound("Block %d not found", block_id)
+		}
+		return handleError()
+	}
+	key, err := noteKey(block.NoteID)
+	if err != nil {
+		return handleError()
+	}
+	if block.Content, err = openContent(key, block.Content); err != nil {
 		return handleError()
 	}
 	if err = agent.Commit(); err != nil {
@@ -491,14 +920,12 @@ func getLastSortOrderUsed(note_id int) (int, error) {
 		agent = NewDBAgent()
 	}
 	handleError := func() (int, error) {
-		log.Panic(err)
 		return -1, err
 	}
 
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
 	var sort_order sql.NullInt64
 	row := agent.QueryRow(
 		`
@@ -0,0 +1,418 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBlockFragments(t *testing.T) {
+	app := newTestApp(t)
+
+	tests := []struct {
+		target string
+		status int
+		want   string
+	}{
+		{"/blocks/new?note_id=2", 200, `hx-post="/blocks?note_id=2"`},
+		{"/blocks/new", 400, "Missing or invalid param :note_id"},
+		{"/blocks/new?note_id=2&after_block_id=4", 200, `hx-post="/blocks?note_id=2&after_block_id=4"`},
+		{"/blocks/new?note_id=2&before_block_id=4", 200, `hx-post="/blocks?note_id=2&after_block_id=3"`},
+		{"/blocks/new?note_id=2&before_block_id=3", 200, `hx-post="/blocks?note_id=2&position=0"`},
+		{"/blocks/new?note_id=2&before_block_id=11", 422, "Block 11 is not in this note"},
+		{"/blocks/new?note_id=2&after_block_id=x", 400, "Missing or invalid param ?after_block_id"},
+		{"/blocks/4/edit", 200, `value="We should integrate a task management feature."`},
+		{"/blocks/999/edit", 404, "Block 999 not found"},
+		{"/blocks/abc/edit", 400, "Missing or invalid param :block_id"},
+		{"/blocks/4/move", 200, `hx-put="/blocks/4/move?direction=up"`},
+		{"/blocks/999/move", 404, "Block 999 not found"},
+		{"/blocks/4/move/cancel", 200, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			rec := app.do(http.MethodGet, tt.target, nil)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+		})
+	}
+}
+
+func TestPostBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		content string
+		status  int
+		want    string
+	}{
+		{"appends", "/blocks?note_id=2", "Fourth idea", 200, `id="block-container-57"`},
+		{"empty content", "/blocks?note_id=2", "", 422, "Content cannot be empty"},
+		{"missing note", "/blocks?note_id=999", "Orphan", 404, "Note 999 not found"},
+		{"invalid note id", "/blocks", "Orphan", 400, "Missing or invalid param :note_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			rec := app.do(http.MethodPost, tt.target, url.Values{"content": {tt.content}})
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+
+			want := []int{3, 4, 5}
+			if tt.status == 200 {
+				want = append(want, 57)
+			}
+			assertInts(t, "blocks", app.blockOrder(2), want)
+			if got := app.queryInt("SELECT COUNT(*) FROM blocks"); got != 56+len(want)-3 {
+				t.Errorf("%d blocks in total", got)
+			}
+		})
+	}
+}
+
+func TestInsertBlock(t *testing.T) {
+	// note 2 holds blocks 3, 4 and 5, in that order
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   []int
+	}{
+		{"at the top", "position=0", 200, []int{57, 3, 4, 5}},
+		{"in the middle", "position=2", 200, []int{3, 4, 57, 5}},
+		{"past the end", "position=10", 200, []int{3, 4, 5, 57}},
+		{"after a block", "after_block_id=3", 200, []int{3, 57, 4, 5}},
+		{"after the last block", "after_block_id=5", 200, []int{3, 4, 5, 57}},
+		{"after a block in another note", "after_block_id=11", 422, []int{3, 4, 5}},
+		{"negative position", "position=-1", 400, []int{3, 4, 5}},
+		{"invalid block id", "after_block_id=x", 400, []int{3, 4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			rec := app.do(http.MethodPost, "/blocks?note_id=2&"+tt.query, url.Values{"content": {"Inserted"}})
+			assertStatus(t, rec, tt.status)
+			assertInts(t, "blocks", app.blockOrder(2), tt.want)
+			if tt.status == 200 {
+				// Only the new block comes back, without another editor
+				assertContains(t, rec, `id="block-container-57"`, "Inserted")
+				if strings.Contains(rec.Body.String(), `id="block-editor"`) {
+					t.Error("inserting opened a new block editor")
+				}
+			}
+		})
+	}
+
+	t.Run("rebalances dense keys", func(t *testing.T) {
+		app := newTestApp(t)
+
+		// The seed packs note 2 as 1, 2, 3 so there is no room after 3
+		for range 3 {
+			rec := app.do(http.MethodPost, "/blocks?note_id=2&after_block_id=3", url.Values{"content": {"Inserted"}})
+			assertStatus(t, rec, 200)
+		}
+		assertInts(t, "blocks", app.blockOrder(2), []int{3, 59, 58, 57, 4, 5})
+	})
+
+	t.Run("under a parent", func(t *testing.T) {
+		app := newTestApp(t)
+		app.exec("UPDATE blocks SET parent_id = 3 WHERE id = 4")
+
+		// Without a position, children go last
+		rec := app.do(http.MethodPost, "/blocks?note_id=2&parent_id=3", url.Values{"content": {"Last child"}})
+		assertStatus(t, rec, 200)
+		assertContains(t, rec, `id="block-container-57"`)
+		assertInts(t, "block 3", app.children(2, 3), []int{4, 57})
+		assertInts(t, "top level", app.children(2, 0), []int{3, 5})
+
+		assertStatus(t, app.do(http.MethodPost, "/blocks?note_id=2&parent_id=5", url.Values{"content": {"Only child"}}), 200)
+		assertInts(t, "block 5", app.children(2, 5), []int{58})
+
+		assertStatus(t, app.do(http.MethodPost, "/blocks?note_id=2&parent_id=3&position=0", url.Values{"content": {"First child"}}), 200)
+		assertInts(t, "block 3", app.children(2, 3), []int{59, 4, 57})
+
+		// Past the end, keys follow the parent's own children
+		assertStatus(t, app.do(http.MethodPost, "/blocks?note_id=2&parent_id=4&position=9", url.Values{"content": {"Far child"}}), 200)
+		if got := app.queryInt("SELECT sort_order FROM blocks WHERE id = 60"); got != SortGap {
+			t.Errorf("sort_order = %d, want %d", got, SortGap)
+		}
+		last := app.queryInt("SELECT sort_order FROM blocks WHERE id = 57")
+		assertStatus(t, app.do(http.MethodPost, "/blocks?note_id=2&parent_id=3&position=9", url.Values{"content": {"Later child"}}), 200)
+		if got := app.queryInt("SELECT sort_order FROM blocks WHERE id = 61"); got != last+SortGap {
+			t.Errorf("sort_order = %d, want %d", got, last+SortGap)
+		}
+		assertInts(t, "block 3", app.children(2, 3), []int{59, 4, 57, 61})
+
+		assertStatus(t, app.do(http.MethodPost, "/blocks?note_id=2&parent_id=11", url.Values{"content": {"Elsewhere"}}), 422)
+	})
+}
+
+func TestPutBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		content string
+		status  int
+		want    string
+	}{
+		{"updates", "/blocks/4", "Changed", 200, "Changed"},
+		{"unchanged", "/blocks/4", "We should integrate a task management feature.", 200, `id="block-4"`},
+		{"empty content renders the original", "/blocks/4", "", 422, "We should integrate a task management feature."},
+		{"missing block", "/blocks/999", "Changed", 404, "Block 999 not found"},
+		{"invalid block id", "/blocks/abc", "Changed", 400, "Missing or invalid param :block_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			rec := app.do(http.MethodPut, tt.target, url.Values{"content": {tt.content}, "version": {"1"}})
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+
+			want := "We should integrate a task management feature."
+			if tt.name == "updates" {
+				want = tt.content
+			}
+			if got := app.queryString("SELECT content FROM blocks WHERE id = 4"); got != want {
+				t.Errorf("content = %q, want %q", got, want)
+			}
+			if tt.name == "updates" {
+				assertContains(t, app.do(http.MethodPost, "/search", url.Values{"search-term": {"Changed"}}), "Note 2:")
+			}
+		})
+	}
+}
+
+func TestMoveBlock(t *testing.T) {
+	// note 2 holds blocks 3, 4 and 5, in that order
+	tests := []struct {
+		name   string
+		block  string
+		query  string
+		status int
+		want   []int
+	}{
+		{"up", "4", "direction=up", 200, []int{4, 3, 5}},
+		{"up from the top", "3", "direction=up", 422, []int{3, 4, 5}},
+		{"up from the bottom", "5", "direction=up", 200, []int{3, 5, 4}},
+		{"down", "4", "direction=down", 200, []int{3, 5, 4}},
+		{"down from the top", "3", "direction=down", 200, []int{4, 3, 5}},
+		{"down from the bottom", "5", "direction=down", 422, []int{3, 4, 5}},
+		{"top", "5", "direction=top", 200, []int{5, 3, 4}},
+		{"top from the top", "3", "direction=top", 422, []int{3, 4, 5}},
+		{"bottom", "3", "direction=bottom", 200, []int{4, 5, 3}},
+		{"bottom from the bottom", "5", "direction=bottom", 422, []int{3, 4, 5}},
+		{"unknown direction", "4", "direction=sideways", 400, []int{3, 4, 5}},
+		{"direction with extra text", "4", "direction=upwards", 400, []int{3, 4, 5}},
+		{"missing direction", "4", "", 400, []int{3, 4, 5}},
+		{"position", "5", "position=1", 200, []int{3, 5, 4}},
+		{"position 0", "4", "position=0", 200, []int{4, 3, 5}},
+		{"position past the end", "3", "position=10", 200, []int{4, 5, 3}},
+		{"current position", "4", "position=1", 200, []int{3, 4, 5}},
+		{"negative position", "4", "position=-1", 400, []int{3, 4, 5}},
+		{"after a later block", "3", "after_block_id=4", 200, []int{4, 3, 5}},
+		{"after an earlier block", "5", "after_block_id=3", 200, []int{3, 5, 4}},
+		{"after the last block", "3", "after_block_id=5", 200, []int{4, 5, 3}},
+		{"after itself", "4", "after_block_id=4", 422, []int{3, 4, 5}},
+		{"after a block in another note", "4", "after_block_id=11", 422, []int{3, 4, 5}},
+		{"missing block", "999", "direction=up", 404, []int{3, 4, 5}},
+		{"invalid block id", "abc", "direction=up", 400, []int{3, 4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			rec := app.do(http.MethodPut, "/blocks/"+tt.block+"/move?"+tt.query, nil)
+			assertStatus(t, rec, tt.status)
+			assertInts(t, "blocks", app.blockOrder(2), tt.want)
+
+			if tt.status != 200 {
+				return
+			}
+			body := rec.Body.String()
+			last := -1
+			for _, id := range tt.want {
+				i := strings.Index(body, `id="block-container-`+strconv.Itoa(id)+`"`)
+				if i < last {
+					t.Errorf("block %d rendered out of order", id)
+				}
+				last = i
+			}
+		})
+	}
+
+	t.Run("single block", func(t *testing.T) {
+		app := newTestApp(t)
+		app.exec("DELETE FROM blocks WHERE id IN (4, 5)")
+
+		for _, direction := range []string{"up", "down", "top", "bottom"} {
+			rec := app.do(http.MethodPut, "/blocks/3/move?direction="+direction, nil)
+			assertStatus(t, rec, 422)
+		}
+	})
+
+	t.Run("touches one row", func(t *testing.T) {
+		app := newTestApp(t)
+		app.exec("UPDATE blocks SET sort_order = sort_order * ?", SortGap)
+
+		rec := app.do(http.MethodPut, "/blocks/5/move?position=0", nil)
+		assertStatus(t, rec, 200)
+		assertInts(t, "blocks", app.blockOrder(2), []int{5, 3, 4})
+		assertInts(t, "untouched sort orders",
+			app.queryInts("SELECT sort_order FROM blocks WHERE id IN (3, 4) ORDER BY id"),
+			[]int{SortGap, 2 * SortGap},
+		)
+	})
+
+	t.Run("rebalances dense keys", func(t *testing.T) {
+		app := newTestApp(t)
+
+		// The seed packs note 2 as 1, 2, 3 so there is no room between 3 and 4
+		for range 3 {
+			rec := app.do(http.MethodPut, "/blocks/5/move?direction=up", nil)
+			assertStatus(t, rec, 200)
+			rec = app.do(http.MethodPut, "/blocks/5/move?direction=down", nil)
+			assertStatus(t, rec, 200)
+		}
+		assertInts(t, "blocks", app.blockOrder(2), []int{3, 4, 5})
+		if got := app.queryInt("SELECT COUNT(DISTINCT sort_order) FROM blocks WHERE note_id = 2"); got != 3 {
+			t.Errorf("%d distinct sort orders, want 3", got)
+		}
+	})
+}
+
+func TestSplitBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		block   string
+		content string
+		offset  string
+		status  int
+		before  string
+		after   string
+	}{
+		{"splits", "4", "We should integrate a task management feature.", "9", 200, "We should", "integrate a task management feature."},
+		{"unsaved content", "4", "Rewritten before splitting", "9", 200, "Rewritten", "before splitting"},
+		{"counts characters", "4", "héllo wörld", "5", 200, "héllo", "wörld"},
+		{"at the start", "4", "Some content", "0", 422, "", ""},
+		{"at the end", "4", "Some content", "12", 422, "", ""},
+		{"between spaces only", "4", "Some   ", "5", 422, "", ""},
+		{"past the end", "4", "Some content", "13", 400, "", ""},
+		{"missing offset", "4", "Some content", "", 400, "", ""},
+		{"missing block", "999", "Some content", "4", 404, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.exec("UPDATE blocks SET type = 'quote' WHERE id = 4")
+
+			rec := app.do(http.MethodPost, "/blocks/"+tt.block+"/split", url.Values{
+				"content": {tt.content},
+				"offset":  {tt.offset},
+				"version": {"1"},
+			})
+			assertStatus(t, rec, tt.status)
+			if tt.status != 200 {
+				assertInts(t, "blocks", app.blockOrder(2), []int{3, 4, 5})
+				return
+			}
+
+			// The new block goes directly after the one that was split
+			assertInts(t, "blocks", app.blockOrder(2), []int{3, 4, 57, 5})
+			body := rec.Body.String()
+			if strings.Index(body, `id="block-container-4"`) > strings.Index(body, `id="block-container-57"`) {
+				t.Error("blocks rendered out of order")
+			}
+			if got := app.queryString("SELECT content FROM blocks WHERE id = 4"); got != tt.before {
+				t.Errorf("block 4 = %q, want %q", got, tt.before)
+			}
+			if got := app.queryString("SELECT content FROM blocks WHERE id = 57"); got != tt.after {
+				t.Errorf("block 57 = %q, want %q", got, tt.after)
+			}
+			if got := app.queryString("SELECT type FROM blocks WHERE id = 57"); got != "quote" {
+				t.Errorf("block 57 type = %q, want quote", got)
+			}
+		})
+	}
+}
+
+func TestMergeBlock(t *testing.T) {
+	const third = "Adding user notifications will increase engagement significantly."
+
+	tests := []struct {
+		name    string
+		block   string
+		content string
+		status  int
+		want    []int
+		merged  string
+	}{
+		{"merges", "4", "Changed", 200, []int{3, 5}, third + " Changed"},
+		{"empty block", "4", "", 200, []int{3, 5}, third},
+		{"first block", "3", "Changed", 422, []int{3, 4, 5}, third},
+		{"missing block", "999", "Changed", 404, []int{3, 4, 5}, third},
+		{"invalid block id", "abc", "Changed", 400, []int{3, 4, 5}, third},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			rec := app.do(http.MethodPost, "/blocks/"+tt.block+"/merge", url.Values{"content": {tt.content}, "version": {"1"}})
+			assertStatus(t, rec, tt.status)
+			assertInts(t, "blocks", app.blockOrder(2), tt.want)
+			if got := app.queryString("SELECT content FROM blocks WHERE id = 3"); got != tt.merged {
+				t.Errorf("block 3 = %q, want %q", got, tt.merged)
+			}
+			if tt.status == 200 {
+				assertContains(t, rec, `id="blocks"`, tt.merged)
+			}
+		})
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		app := newTestApp(t)
+		original := app.queryString("SELECT content FROM blocks WHERE id = 4")
+
+		rec := app.do(http.MethodPost, "/blocks/4/split", url.Values{"content": {original}, "offset": {"9"}, "version": {app.version(4)}})
+		assertStatus(t, rec, 200)
+		rec = app.do(http.MethodPost, "/blocks/57/merge", url.Values{"content": {"integrate a task management feature."}, "version": {app.version(57)}})
+		assertStatus(t, rec, 200)
+		if got := app.queryString("SELECT content FROM blocks WHERE id = 4"); got != original {
+			t.Errorf("block 4 = %q, want %q", got, original)
+		}
+	})
+}
+
+func TestDeleteBlock(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		status int
+		want   []int
+	}{
+		{"first", "/blocks/11", 200, []int{12, 13, 14}},
+		{"middle", "/blocks/12", 200, []int{11, 13, 14}},
+		{"last", "/blocks/14", 200, []int{11, 12, 13}},
+		{"missing block", "/blocks/999", 404, []int{11, 12, 13, 14}},
+		{"invalid block id", "/blocks/abc", 400, []int{11, 12, 13, 14}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			rec := app.do(http.MethodDelete, tt.target, nil)
+			assertStatus(t, rec, tt.status)
+			assertInts(t, "blocks", app.blockOrder(5), tt.want)
+
+			// Deleting leaves a gap instead of renumbering the rest
+			for _, id := range tt.want {
+				if got := app.queryInt("SELECT sort_order FROM blocks WHERE id = ?", id); got != id-10 {
+					t.Errorf("block %d sort order = %d, want %d", id, got, id-10)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package routes
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DeleteBlocks deletes every block_id, children included, in one go.
+// Moving and copying a selection goes through TransferBlocks.
+func DeleteBlocks(c echo.Context) error {
+	var err error
+
+	block_ids, err := formInts(c, "block_id")
+	if err != nil || len(block_ids) == 0 {
+		return echo.NewHTTPError(400, "Missing or invalid param block_id")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	blocks, err := getBlocksById(block_ids)
+	if err != nil {
+		return handleError()
+	}
+	if err = canEditAll(noteIds(blocks)); err != nil {
+		return handleError()
+	}
+	if err = deleteBlockTrees(block_ids); err != nil {
+		return handleError()
+	}
+	if err = touchNotes(noteIds(blocks)); err != nil {
+		return handleError()
+	}
+	previews, err := getAllPreviews()
+	if err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	cleanUpAttachments(c)
+
+	return c.Render(200, "blocks-transferred", BlockTransfer{
+		Mode:     "delete",
+		Removed:  block_ids,
+		Previews: previews,
+	})
+}
+
+// PutBlockTypes changes the type of every block_id and renders the note
+// holding the first of them, which is the one on screen.
+func PutBlockTypes(c echo.Context) error {
+	var err error
+
+	block_ids, err := formInts(c, "block_id")
+	if err != nil || len(block_ids) == 0 {
+		return echo.NewHTTPError(400, "Missing or invalid param block_id")
+	}
+	block_type := c.FormValue("type")
+	if !validBlockType(block_type) {
+		return echo.NewHTTPError(400, "Missing or invalid param type")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	blocks, err := getBlocksById(block_ids)
+	if err != nil {
+		return handleError()
+	}
+	if err = canEditAll(noteIds(blocks)); err != nil {
+		return handleError()
+	}
+	for _, block := range blocks {
+		if block.Attachment != "" {
+			agent.Rollback()
+			return Invalid("Attachments cannot change type")
+		}
+		if block.Type == "table" && block_type != "table" {
+			agent.Rollback()
+			return Invalid("Tables cannot change type")
+		}
+	}
+	// Blocks becoming tables are read as CSV, a row per line
+	if block_type == "table" {
+		for _, block := range blocks {
+			if block.Type == "table" {
+				continue
+			}
+			var table Table
+			if table, err = tableFromCSV(block.Content); err != nil {
+				return handleError()
+			}
+			var sealed string
+			if sealed, err = sealBlockContent(block.NoteID, table.String()); err != nil {
+				return handleError()
+			}
+			if _, err = agent.Exec(
+				`
+                    UPDATE blocks
+                    SET content = seal(?)
+                    WHERE id = ?;
+                `,
+				sealed,
+				block.ID,
+			); err != nil {
+				return handleError()
+			}
+		}
+	}
+	in, args := inClause(block_ids)
+	if _, err = agent.Exec(
+		`
+            UPDATE blocks
+            SET type = ?
+            WHERE id IN `+in+`;
+        `,
+		append([]any{block_type}, args...)...,
+	); err != nil {
+		return handleError()
+	}
+	if err = touchNotes(noteIds(blocks)); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	note, err := getContentByNoteId(blocks[0].NoteID)
+	if err != nil {
+		return handleError()
+	}
+
+	return c.Render(200, "blocks", note)
+}
+
+// ExportBlocks downloads the selected blocks, with their children, as
+// Markdown.
+func ExportBlocks(c echo.Context) error {
+	var err error
+
+	block_ids, err := formInts(c, "block_id")
+	if err != nil || len(block_ids) == 0 {
+		return echo.NewHTTPError(400, "Missing or invalid param block_id")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	blocks, err := getBlocksById(block_ids)
+	if err != nil {
+		return handleError()
+	}
+	descendants, err := getDescendantIds(block_ids)
+	if err != nil {
+		return handleError()
+	}
+	// Export top to bottom, each selected block with everything below it
+	trees := []Block{}
+	for _, note_id := range noteIds(blocks) {
+		var outline []Block
+		outline, err = getBlockTree("blocks", note_id)
+		if err != nil {
+			return handleError()
+		}
+		var key []byte
+		if key, err = noteKey(note_id); err != nil {
+			return handleError()
+		}
+		if err = openBlocks(key, outline); err != nil {
+			return handleError()
+		}
+		for _, block := range flattenOutline(outline, true) {
+			if indexOf(block_ids, block.ID) >= 0 && indexOf(descendants, block.ID) < 0 {
+				trees = append(trees, block)
+			}
+		}
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="blocks.md"`)
+	return c.Blob(200, "text/markdown; charset=UTF-8", []byte(blocksMarkdown(trees)))
+}
+
+// getBlocksById loads blocks in display order, grouped by note. It fails
+// with NotFound unless every id exists.
+func getBlocksById(block_ids []int) ([]Block, error) {
+	in, args := inClause(block_ids)
+	rows, err := agent.Query(
+		`
+            SELECT
+                id,
+                note_id,
+                COALESCE(parent_id, 0),
+                sort_order,
+                unseal(content),
+                type,
+                collapsed,
+                checked,
+                COALESCE(attachment, ''),
+                language
+            FROM blocks
+            WHERE id IN `+in+`
+            AND note_id IN (SELECT note_id FROM note_access WHERE user_id = ?)
+            ORDER BY note_id, sort_order;
+        `,
+		append(args, agent.UserID)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blocks := []Block{}
+	ids := []int{}
+	for rows.Next() {
+		block := Block{}
+		if err = rows.Scan(
+			&block.ID,
+			&block.NoteID,
+			&block.ParentID,
+			&block.SortOrder,
+			&block.Content,
+			&block.Type,
+			&block.Collapsed,
+			&block.Checked,
+			&block.Attachment,
+			&block.Language,
+		); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+		ids = append(ids, block.ID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range block_ids {
+		if indexOf(ids, id) < 0 {
+			return nil, NotFound("Block %d not found", id)
+		}
+	}
+	for i := range blocks {
+		var key []byte
+		if key, err = noteKey(blocks[i].NoteID); err != nil {
+			return nil, err
+		}
+		if blocks[i].Content, err = openContent(key, blocks[i].Content); err != nil {
+			return nil, err
+		}
+	}
+
+	return blocks, nil
+}
+
+// touchNotes marks notes as modified now, telling everyone who has them
+// open.
+func touchNotes(note_ids []int) error {
+	in, args := inClause(note_ids)
+	if _, err := agent.Exec(
+		`
+            UPDATE notes
+            SET modified_at = CURRENT_TIMESTAMP
+            WHERE id IN `+in+`;
+        `,
+		args...,
+	); err != nil {
+		return err
+	}
+	for _, note_id := range note_ids {
+		if err := notify("block", note_id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func noteIds(blocks []Block) []int {
+	ids := []int{}
+	for _, block := range blocks {
+		if indexOf(ids, block.NoteID) < 0 {
+			ids = append(ids, block.NoteID)
+		}
+	}
+	return ids
+}
+
+// blocksMarkdown renders blocks as a Markdown document, a paragraph per
+// block. Blocks with children become nested lists.
+func blocksMarkdown(blocks []Block) string {
+	paragraphs := make([]string, len(blocks))
+	for i, block := range blocks {
+		if len(block.Children) == 0 {
+			paragraphs[i] = blockMarkdown(block)
+		} else {
+			paragraphs[i] = strings.TrimSuffix(outlineMarkdown(block, 0), "\n")
+		}
+	}
+	return strings.Join(paragraphs, "\n\n") + "\n"
+}
+
+func blockMarkdown(block Block) string {
+	switch block.Type {
+	case "heading":
+		return "## " + block.Content
+	case "quote":
+		return "> " + block.Content
+	case "image":
+		return "![" + block.Content + "](/attachments/" + block.Attachment + ")"
+	case "file":
+		return "[" + block.Content + "](/attachments/" + block.Attachment + ")"
+	case "todo":
+		if block.Checked {
+			return "- [x] " + block.Content
+		}
+		return "- [ ] " + block.Content
+	case "code":
+		// The fence must be longer than any run of backticks in the code
+		fence := "```"
+		for strings.Contains(block.Content, fence) {
+			fence += "`"
+		}
+		return fence + block.Language + "\n" + block.Content + "\n" + fence
+	case "table":
+		return tableMarkdown(block.Content)
+	default:
+		return block.Content
+	}
+}
+
+// outlineMarkdown renders a block and its children as list items,
+// indented two spaces a level.
+func outlineMarkdown(block Block, depth int) string {
+	item := blockMarkdown(block)
+	if block.Type != "todo" {
+		// to-dos are list items already
+		item = "- " + item
+	}
+	indent := strings.Repeat("  ", depth)
+	// Lines of a code block continue the item
+	item = strings.ReplaceAll(item, "\n", "\n"+indent+"  ")
+	md := indent + item + "\n"
+	for _, child := range block.Children {
+		md += outlineMarkdown(child, depth+1)
+	}
+	return md
+}
@@ -0,0 +1,92 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDeleteBlocks(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		note2  []int
+		note5  []int
+	}{
+		{"across notes", "block_id=3&block_id=5&block_id=12", 200, []int{4}, []int{11, 13, 14}},
+		{"missing block", "block_id=3&block_id=999", 404, []int{3, 4, 5}, []int{11, 12, 13, 14}},
+		{"invalid block id", "block_id=3&block_id=abc", 400, []int{3, 4, 5}, []int{11, 12, 13, 14}},
+		{"no blocks", "", 400, []int{3, 4, 5}, []int{11, 12, 13, 14}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			rec := app.do(http.MethodDelete, "/blocks?"+tt.query, nil)
+			assertStatus(t, rec, tt.status)
+			assertInts(t, "note 2", app.blockOrder(2), tt.note2)
+			assertInts(t, "note 5", app.blockOrder(5), tt.note5)
+			if tt.status == 200 {
+				assertContains(t, rec,
+					`id="block-container-3" hx-swap-oob="delete"`,
+					`id="block-container-12" hx-swap-oob="delete"`,
+				)
+			}
+		})
+	}
+}
+
+func TestPutBlockTypes(t *testing.T) {
+	tests := []struct {
+		name   string
+		form   url.Values
+		status int
+		want   string
+	}{
+		{"changes", url.Values{"block_id": {"3", "4"}, "type": {"heading"}}, 200, `class="block block--heading"`},
+		{"invalid type", url.Values{"block_id": {"3"}, "type": {"banner"}}, 400, "Missing or invalid param type"},
+		{"missing block", url.Values{"block_id": {"3", "999"}, "type": {"quote"}}, 404, "Block 999 not found"},
+		{"no blocks", url.Values{"type": {"quote"}}, 400, "Missing or invalid param block_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			rec := app.do(http.MethodPut, "/blocks/type", tt.form)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+
+			want := 0
+			if tt.status == 200 {
+				want = 2
+				assertContains(t, rec, `id="blocks"`, `id="block-container-5"`)
+			}
+			if got := app.queryInt("SELECT COUNT(*) FROM blocks WHERE type != 'text'"); got != want {
+				t.Errorf("%d blocks changed, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestExportBlocks(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET type = 'heading' WHERE id = 3")
+	app.exec("UPDATE blocks SET type = 'quote' WHERE id = 4")
+
+	rec := app.do(http.MethodGet, "/blocks/export?block_id=11&block_id=4&block_id=3", nil)
+	assertStatus(t, rec, 200)
+	want := "## Adding user notifications will increase engagement significantly.\n\n" +
+		"> We should integrate a task management feature.\n\n" +
+		app.queryString("SELECT content FROM blocks WHERE id = 11") + "\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("export = %q, want %q", got, want)
+	}
+	if got := rec.Header().Get("Content-Disposition"); !strings.Contains(got, "attachment") {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	assertStatus(t, app.do(http.MethodGet, "/blocks/export?block_id=999", nil), 404)
+	assertStatus(t, app.do(http.MethodGet, "/blocks/export", nil), 400)
+}
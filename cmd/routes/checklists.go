@@ -0,0 +1,308 @@
+package routes
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// BlockCheck is a to-do block that was just ticked or unticked, along
+// with its note's preview so the sidebar progress can follow.
+type BlockCheck struct {
+	Block   Block
+	Preview Note
+}
+
+// CheckBlock ticks or unticks a to-do block, as given by ?checked.
+func CheckBlock(c echo.Context) error {
+	block_id, err := strconv.Atoi(c.Param("block_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
+	}
+	checked, err := strconv.ParseBool(c.QueryParam("checked"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param ?checked")
+	}
+	block, err := getContentByBlockId(block_id)
+	if err != nil {
+		return err
+	}
+	if err = canEdit(block.NoteID); err != nil {
+		return err
+	}
+	if block.Type != "todo" {
+		return Invalid("Block %d is not a to-do", block_id)
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if _, err = agent.Exec(
+		`
+            UPDATE blocks
+            SET checked = $1
+            WHERE id = $2;
+
+            UPDATE notes
+            SET modified_at = CURRENT_TIMESTAMP
+            WHERE id = $3;
+        `,
+		checked,
+		block.ID,
+		block.NoteID,
+	); err != nil {
+		return handleError()
+	}
+	if err = notify("block", block.NoteID); err != nil {
+		return handleError()
+	}
+	preview, err := getNotePreview(block.NoteID)
+	if err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	block.Checked = checked
+
+	return c.Render(200, "block-checked", BlockCheck{Block: block, Preview: preview})
+}
+
+// HideCompleted shows or hides a note's ticked to-dos, as given by
+// ?hide. The blocks stay in place; only the note's view changes.
+func HideCompleted(c echo.Context) error {
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	hide, err := strconv.ParseBool(c.QueryParam("hide"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param ?hide")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if err = canEdit(note_id); err != nil {
+		return handleError()
+	}
+	if _, err = agent.Exec(
+		`
+            UPDATE notes
+            SET hide_completed = ?
+            WHERE id = ?;
+        `,
+		hide,
+		note_id,
+	); err != nil {
+		return handleError()
+	}
+	if err = notify("block", note_id); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	note, err := getContentByNoteId(note_id)
+	if err != nil {
+		return err
+	}
+
+	return c.Render(200, "blocks", note)
+}
+
+// SinkCompleted moves a note's ticked to-dos below the rest of their
+// siblings, at every level of the outline. Otherwise the order is kept.
+func SinkCompleted(c echo.Context) error {
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	if err = canEdit(note_id); err != nil {
+		return err
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	outline, err := getBlockTree("blocks", note_id)
+	if err != nil {
+		return handleError()
+	}
+	if err = sinkCompleted(outline); err != nil {
+		return handleError()
+	}
+
+	return renderOutline(c, note_id)
+}
+
+// GetOpenTodos lists the unticked to-dos of every note, most recently
+// modified note first.
+func GetOpenTodos(c echo.Context) error {
+	var err error
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	rows, err := agent.Query(
+		`
+            SELECT n.id, unseal(n.title)
+            FROM notes n
+            WHERE n.owner_id = ?
+            AND EXISTS (
+                SELECT 1 FROM blocks b
+                WHERE b.note_id = n.id
+                AND b.type = 'todo'
+                AND NOT b.checked
+            )
+            ORDER BY n.modified_at DESC, n.id DESC;
+        `,
+		agent.UserID,
+	)
+	if err != nil {
+		return handleError()
+	}
+	notes := []Note{}
+	for rows.Next() {
+		note := Note{}
+		if err = rows.Scan(&note.ID, &note.Title); err != nil {
+			rows.Close()
+			return handleError()
+		}
+		notes = append(notes, note)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return handleError()
+	}
+	for i := range notes {
+		var outline []Block
+		outline, err = getBlockTree("blocks", notes[i].ID)
+		if err != nil {
+			return handleError()
+		}
+		// Locked notes keep their to-dos to themselves
+		var key []byte
+		key, err = noteKey(notes[i].ID)
+		if errors.Is(err, ErrLocked) {
+			notes[i].Locked = true
+			continue
+		}
+		if err != nil {
+			return handleError()
+		}
+		if err = openBlocks(key, outline); err != nil {
+			return handleError()
+		}
+		// Listed in reading order, however deeply they are nested
+		for _, block := range flattenOutline(outline, true) {
+			if block.Type == "todo" && !block.Checked {
+				notes[i].Blocks = append(notes[i].Blocks, block)
+			}
+		}
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return c.Render(200, "open-todos", notes)
+}
+
+// getNotePreview loads what a note's sidebar preview shows.
+func getNotePreview(note_id int) (Note, error) {
+	note := Note{}
+	row := agent.QueryRow(
+		`
+            SELECT
+                n.id,
+                unseal(n.title),
+                COUNT(b.id),
+                COUNT(b.id) FILTER (WHERE b.checked)
+            FROM notes n
+            LEFT JOIN blocks b
+            ON b.note_id = n.id
+            AND b.type = 'todo'
+            WHERE n.id = ?
+            AND n.id IN (SELECT note_id FROM note_access WHERE user_id = ?)
+            GROUP BY n.id;
+        `,
+		note_id,
+		agent.UserID,
+	)
+	err := row.Scan(&note.ID, &note.Title, &note.Todos, &note.TodosDone)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = NotFound("Note %d not found", note_id)
+	}
+	return note, err
+}
+
+// sinkCompleted renumbers each level of outline with its ticked to-dos
+// last, leaving levels that are already in that order alone.
+func sinkCompleted(outline []Block) error {
+	open := []Block{}
+	done := []Block{}
+	for _, block := range outline {
+		if block.Type == "todo" && block.Checked {
+			done = append(done, block)
+		} else {
+			open = append(open, block)
+		}
+	}
+	sunk := append(open, done...)
+	for i := range sunk {
+		if sunk[i].ID == outline[i].ID {
+			continue
+		}
+		for j, block := range sunk {
+			if _, err := agent.Exec(
+				`
+                    UPDATE blocks
+                    SET sort_order = ?
+                    WHERE id = ?;
+                `,
+				(j+1)*SortGap,
+				block.ID,
+			); err != nil {
+				return err
+			}
+		}
+		break
+	}
+	for _, block := range outline {
+		if err := sinkCompleted(block.Children); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckBlock(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET type = 'todo' WHERE id IN (3, 5)")
+
+	rec := app.do(http.MethodPut, "/blocks/3/check?checked=true", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec,
+		"block--todo checked",
+		`hx-put="/blocks/3/check?checked=false"`,
+		`id="preview-2"`,
+		"1/2 done",
+	)
+	if got := app.queryInt("SELECT checked FROM blocks WHERE id = 3"); got != 1 {
+		t.Error("block 3 was not checked")
+	}
+
+	rec = app.do(http.MethodPut, "/blocks/3/check?checked=false", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `hx-put="/blocks/3/check?checked=true"`, "0/2 done")
+
+	tests := []struct {
+		target string
+		status int
+		want   string
+	}{
+		{"/blocks/4/check?checked=true", 422, "Block 4 is not a to-do"},
+		{"/blocks/999/check?checked=true", 404, "Block 999 not found"},
+		{"/blocks/3/check?checked=maybe", 400, "Missing or invalid param ?checked"},
+		{"/blocks/abc/check?checked=true", 400, "Missing or invalid param :block_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			rec := app.do(http.MethodPut, tt.target, nil)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+		})
+	}
+}
+
+func TestTodoProgress(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET type = 'todo' WHERE id IN (3, 4, 5)")
+	app.exec("UPDATE blocks SET checked = TRUE WHERE id IN (3, 4, 6)")
+
+	rec := app.do(http.MethodGet, "/preview-links", nil)
+	assertStatus(t, rec, 200)
+	// Block 6 is checked but not a to-do, so note 3 shows no progress
+	assertContains(t, rec, "2/3 done")
+	if got := strings.Count(rec.Body.String(), `class="todo-progress`); got != 1 {
+		t.Errorf("%d notes show progress, want 1", got)
+	}
+
+	rec = app.do(http.MethodPut, "/notes/2", url.Values{"title": {"Renamed"}, "version": {"1"}})
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Renamed", "2/3 done")
+}
+
+func TestHideCompleted(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET type = 'todo' WHERE id = 3")
+
+	rec := app.do(http.MethodPut, "/notes/2/hide-completed?hide=true", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `<div id="blocks" class="hide-completed">`, "show completed")
+	if got := app.queryInt("SELECT hide_completed FROM notes WHERE id = 2"); got != 1 {
+		t.Error("note 2 does not hide completed to-dos")
+	}
+	assertContains(t, app.do(http.MethodGet, "/notes/2", nil), `class="hide-completed"`)
+
+	rec = app.do(http.MethodPut, "/notes/2/hide-completed?hide=false", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `<div id="blocks">`, "hide completed")
+
+	assertStatus(t, app.do(http.MethodPut, "/notes/999/hide-completed?hide=true", nil), 404)
+	assertStatus(t, app.do(http.MethodPut, "/notes/2/hide-completed", nil), 400)
+}
+
+func TestSinkCompleted(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET type = 'todo' WHERE id IN (3, 5, 12, 13)")
+	app.exec("UPDATE blocks SET checked = TRUE WHERE id IN (3, 12)")
+	app.exec("UPDATE blocks SET parent_id = 11 WHERE id IN (12, 13)")
+
+	rec := app.do(http.MethodPut, "/notes/2/sink-completed", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `id="block-container-3"`)
+	assertInts(t, "note 2", app.blockOrder(2), []int{4, 5, 3})
+
+	// Nested levels are sorted too
+	assertStatus(t, app.do(http.MethodPut, "/notes/5/sink-completed", nil), 200)
+	assertInts(t, "block 11", app.children(5, 11), []int{13, 12})
+	assertInts(t, "note 5", app.children(5, 0), []int{11, 14})
+
+	assertStatus(t, app.do(http.MethodPut, "/notes/999/sink-completed", nil), 404)
+}
+
+func TestGetOpenTodos(t *testing.T) {
+	t.Run("lists unchecked to-dos", func(t *testing.T) {
+		app := newTestApp(t)
+		app.exec("UPDATE blocks SET type = 'todo' WHERE id IN (3, 5, 6)")
+		app.exec("UPDATE blocks SET checked = TRUE WHERE id = 5")
+
+		rec := app.do(http.MethodGet, "/todos", nil)
+		assertStatus(t, rec, 200)
+		assertContains(t, rec,
+			"Note 2: Ideas for New Features",
+			"Note 3: Client Feedback",
+			`id="todo-3"`,
+			`id="todo-6"`,
+			"Adding user notifications will increase engagement significantly.",
+		)
+		if got := rec.Body.String(); strings.Contains(got, `id="todo-5"`) || strings.Contains(got, `id="todo-4"`) {
+			t.Error("listed a checked to-do or a plain block")
+		}
+	})
+
+	t.Run("nothing to do", func(t *testing.T) {
+		app := newTestApp(t)
+
+		rec := app.do(http.MethodGet, "/todos", nil)
+		assertStatus(t, rec, 200)
+		assertContains(t, rec, "nothing left to do")
+	})
+}
+
+func TestExportTodos(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET type = 'todo' WHERE id IN (3, 4)")
+	app.exec("UPDATE blocks SET checked = TRUE WHERE id = 3")
+	app.exec("UPDATE blocks SET parent_id = 3 WHERE id = 4")
+
+	rec := app.do(http.MethodGet, "/blocks/export?block_id=3", nil)
+	assertStatus(t, rec, 200)
+	want := "- [x] Adding user notifications will increase engagement significantly.\n" +
+		"  - [ ] We should integrate a task management feature.\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("export = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package routes
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// PutBlockLanguage changes the language a code block is highlighted as.
+func PutBlockLanguage(c echo.Context) error {
+	block_id, err := strconv.Atoi(c.Param("block_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
+	}
+	language := c.FormValue("language")
+	if !validCodeLanguage(language) {
+		return echo.NewHTTPError(400, "Missing or invalid param language")
+	}
+	block, err := getContentByBlockId(block_id)
+	if err != nil {
+		return err
+	}
+	if err = canEdit(block.NoteID); err != nil {
+		return err
+	}
+	if block.Type != "code" {
+		return Invalid("Block %d is not code", block_id)
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if _, err = agent.Exec(
+		`
+            UPDATE blocks
+            SET language = $1
+            WHERE id = $2;
+
+            UPDATE notes
+            SET modified_at = CURRENT_TIMESTAMP
+            WHERE id = $3;
+        `,
+		language,
+		block.ID,
+		block.NoteID,
+	); err != nil {
+		return handleError()
+	}
+	if err = notify("block", block.NoteID); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	block.Language = language
+
+	return c.Render(200, "block", block)
+}
+
+// GetRawBlock downloads a code block's source as a file named after
+// the block, with its language's extension.
+func GetRawBlock(c echo.Context) error {
+	block_id, err := strconv.Atoi(c.Param("block_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
+	}
+	block, err := getContentByBlockId(block_id)
+	if err != nil {
+		return err
+	}
+	if block.Type != "code" {
+		return Invalid("Block %d is not code", block_id)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(
+		`attachment; filename="block-%d.%s"`,
+		block.ID,
+		codeExtension(block.Language),
+	))
+	return c.Blob(200, echo.MIMETextPlainCharsetUTF8, []byte(block.Content))
+}
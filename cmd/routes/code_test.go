@@ -0,0 +1,137 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		language string
+		code     string
+		want     string
+	}{
+		{
+			"go",
+			"func main() {\n\t// say hi\n\tfmt.Println(\"<hi>\", 42)\n}",
+			`<span class="tok-keyword">func</span> main() {` + "\n\t" +
+				`<span class="tok-comment">// say hi</span>` + "\n\t" +
+				`fmt.Println(<span class="tok-string">&#34;&lt;hi&gt;&#34;</span>, <span class="tok-number">42</span>)` + "\n}",
+		},
+		{
+			"python",
+			"def f(x):\n    return x2 # done",
+			`<span class="tok-keyword">def</span> f(x):` + "\n    " +
+				`<span class="tok-keyword">return</span> x2 <span class="tok-comment"># done</span>`,
+		},
+		{
+			"sql",
+			"select 'it''s' FROM t",
+			`<span class="tok-keyword">select</span> <span class="tok-string">&#39;it&#39;</span><span class="tok-string">&#39;s&#39;</span> <span class="tok-keyword">FROM</span> t`,
+		},
+		{
+			"javascript",
+			"const s = `a\nb`; /* x */",
+			`<span class="tok-keyword">const</span> s = <span class="tok-string">` + "`a\nb`" + `</span>; <span class="tok-comment">/* x */</span>`,
+		},
+		{
+			"json",
+			`{"open": "no end`,
+			`{<span class="tok-string">&#34;open&#34;</span>: <span class="tok-string">&#34;no end</span>`,
+		},
+		{"", "if <b> {}", "if &lt;b&gt; {}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.language, func(t *testing.T) {
+			if got := string(highlight(tt.code, tt.language)); got != tt.want {
+				t.Errorf("highlight = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodeBlocks(t *testing.T) {
+	app := newTestApp(t)
+	code := "package main\n\nfunc main() {\n\tprintln(\"hi\")\n}"
+
+	rec := app.do(http.MethodPost, "/blocks?note_id=2&type=code", url.Values{"content": {code}})
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `id="block-container-57"`, "block--code", "<pre><code>")
+	if strings.Contains(rec.Body.String(), `id="block-editor"`) {
+		t.Error("a new editor followed the code block")
+	}
+	if got := app.queryString("SELECT type || ':' || content FROM blocks WHERE id = 57"); got != "code:"+code {
+		t.Errorf("block 57 = %q", got)
+	}
+
+	rec = app.do(http.MethodPut, "/blocks/57/language", url.Values{"language": {"go"}})
+	assertStatus(t, rec, 200)
+	assertContains(t, rec,
+		`<option value="go" selected>go</option>`,
+		`<span class="tok-keyword">package</span> main`,
+		`href="/blocks/57/raw"`,
+	)
+	if got := app.queryString("SELECT language FROM blocks WHERE id = 57"); got != "go" {
+		t.Errorf("language = %q", got)
+	}
+
+	rec = app.do(http.MethodGet, "/blocks/57/edit", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "<textarea", "func main() {\n\tprintln(&#34;hi&#34;)\n}</textarea>")
+
+	rec = app.do(http.MethodGet, "/blocks/57/raw", nil)
+	assertStatus(t, rec, 200)
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename="block-57.go"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	if got := rec.Body.String(); got != code {
+		t.Errorf("raw = %q, want %q", got, code)
+	}
+
+	rec = app.do(http.MethodGet, "/blocks/export?block_id=57", nil)
+	assertStatus(t, rec, 200)
+	if got, want := rec.Body.String(), "```go\n"+code+"\n```\n"; got != want {
+		t.Errorf("export = %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		form   url.Values
+		status int
+		want   string
+	}{
+		{"unknown language", http.MethodPut, "/blocks/57/language", url.Values{"language": {"cobol"}}, 400, "Missing or invalid param language"},
+		{"language of text", http.MethodPut, "/blocks/3/language", url.Values{"language": {"go"}}, 422, "Block 3 is not code"},
+		{"raw text", http.MethodGet, "/blocks/3/raw", nil, 422, "Block 3 is not code"},
+		{"raw missing block", http.MethodGet, "/blocks/999/raw", nil, 404, "Block 999 not found"},
+		{"unknown type", http.MethodPost, "/blocks?note_id=2&type=chart", url.Values{"content": {"x"}}, 400, "Missing or invalid param ?type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := app.do(tt.method, tt.target, tt.form)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+		})
+	}
+}
+
+func TestExportNestedCode(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET type = 'code', language = 'sh', content = ? WHERE id = 4", "echo ```\nls")
+	app.exec("UPDATE blocks SET parent_id = 3 WHERE id = 4")
+
+	rec := app.do(http.MethodGet, "/blocks/export?block_id=3", nil)
+	assertStatus(t, rec, 200)
+	want := "- Adding user notifications will increase engagement significantly.\n" +
+		"  - ````sh\n" +
+		"    echo ```\n" +
+		"    ls\n" +
+		"    ````\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("export = %q, want %q", got, want)
+	}
+}
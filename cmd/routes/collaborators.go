@@ -0,0 +1,377 @@
+package routes
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Collaborator is another user a note is shared with.
+type Collaborator struct {
+	UserID   int
+	Username string
+	Role     string
+}
+
+// CollaboratorList is a note's collaborators, for the panel its owner
+// manages them in.
+type CollaboratorList struct {
+	Note          Note
+	Collaborators []Collaborator
+}
+
+// CollaboratorRoles are what a collaborator may do with a note, least
+// first. Viewers only read it and its comments, commenters add their
+// own, and editors change it like its owner, short of deleting or
+// sharing it.
+var CollaboratorRoles = []string{"viewer", "commenter", "editor"}
+
+// noteRole is agent.UserID's role on note_id: "owner" or one of
+// CollaboratorRoles. Notes the user cannot see are NotFound. It runs in
+// the caller's transaction.
+func noteRole(note_id int) (string, error) {
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	var role string
+	row := agent.QueryRow(
+		"SELECT role FROM note_access WHERE note_id = ? AND user_id = ?",
+		note_id,
+		agent.UserID,
+	)
+	err := row.Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = NotFound("Note %d not found", note_id)
+	}
+	return role, err
+}
+
+// canEdit fails unless agent.UserID owns note_id or edits it.
+func canEdit(note_id int) error {
+	role, err := noteRole(note_id)
+	if err != nil {
+		return err
+	}
+	if role != "owner" && role != "editor" {
+		return Forbidden("Note %d is shared with you as a %s", note_id, role)
+	}
+	return nil
+}
+
+// canComment fails unless agent.UserID may comment on note_id, which
+// all but its viewers may.
+func canComment(note_id int) error {
+	role, err := noteRole(note_id)
+	if err != nil {
+		return err
+	}
+	if role == "viewer" {
+		return Forbidden("Note %d is shared with you as a %s", note_id, role)
+	}
+	return nil
+}
+
+// canEditAll is canEdit for every note of a selection of blocks.
+func canEditAll(note_ids []int) error {
+	for _, note_id := range note_ids {
+		if err := canEdit(note_id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isOwner fails unless agent.UserID owns note_id. Only owners delete
+// and share their notes.
+func isOwner(note_id int) error {
+	role, err := noteRole(note_id)
+	if err != nil {
+		return err
+	}
+	if role != "owner" {
+		return Forbidden("Only the owner of note %d can do that", note_id)
+	}
+	return nil
+}
+
+// GetCollaborators lists who a note is shared with.
+func GetCollaborators(c echo.Context) error {
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+
+	return renderCollaborators(c, note_id)
+}
+
+// PostCollaborator shares a note with the user named by the form value
+// username, as the form value role. Sharing it again changes the role.
+func PostCollaborator(c echo.Context) error {
+	var err error
+
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	username := c.FormValue("username")
+	role := c.FormValue("role")
+	if !slices.Contains(CollaboratorRoles, role) {
+		return echo.NewHTTPError(400, "Missing or invalid param role")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if err = isOwner(note_id); err != nil {
+		return handleError()
+	}
+	var user_id int
+	row := agent.QueryRow("SELECT id FROM users WHERE username = ?", username)
+	if err = row.Scan(&user_id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = NotFound("User %s not found", username)
+		}
+		return handleError()
+	}
+	if user_id == agent.UserID {
+		err = Invalid("You already own note %d", note_id)
+		return handleError()
+	}
+	if _, err = agent.Exec(
+		`
+            INSERT INTO collaborators (note_id, user_id, role)
+            VALUES (?, ?, ?)
+            ON CONFLICT (note_id, user_id) DO UPDATE SET role = excluded.role;
+        `,
+		note_id,
+		user_id,
+		role,
+	); err != nil {
+		return handleError()
+	}
+	if err = notify("note", note_id); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return renderCollaborators(c, note_id)
+}
+
+// PutCollaborator changes a collaborator's role to the form value role.
+func PutCollaborator(c echo.Context) error {
+	var err error
+
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	user_id, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :user_id")
+	}
+	role := c.FormValue("role")
+	if !slices.Contains(CollaboratorRoles, role) {
+		return echo.NewHTTPError(400, "Missing or invalid param role")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if err = isOwner(note_id); err != nil {
+		return handleError()
+	}
+	res, err := agent.Exec(
+		"UPDATE collaborators SET role = ? WHERE note_id = ? AND user_id = ?",
+		role,
+		note_id,
+		user_id,
+	)
+	if err != nil {
+		return handleError()
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = NotFound("Collaborator %d not found", user_id)
+		return handleError()
+	}
+	if err = notify("note", note_id); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return renderCollaborators(c, note_id)
+}
+
+// DeleteCollaborator stops sharing a note with a user. Owners remove
+// anyone; collaborators can only leave.
+func DeleteCollaborator(c echo.Context) error {
+	var err error
+
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	user_id, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :user_id")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if user_id != agent.UserID {
+		if err = isOwner(note_id); err != nil {
+			return handleError()
+		}
+	}
+	// The collaborator hears of it while they still can
+	if err = notify("note", note_id); err != nil {
+		return handleError()
+	}
+	res, err := agent.Exec(
+		"DELETE FROM collaborators WHERE note_id = ? AND user_id = ?",
+		note_id,
+		user_id,
+	)
+	if err != nil {
+		return handleError()
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = NotFound("Collaborator %d not found", user_id)
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return c.NoContent(200)
+}
+
+// GetSharedPreviews lists the notes other users shared with this one,
+// for the sidebar.
+func GetSharedPreviews(c echo.Context) error {
+	var err error
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	rows, err := agent.Query(
+		`
+            SELECT n.id, unseal(n.title), c.role
+            FROM collaborators c
+            JOIN notes n
+            ON n.id = c.note_id
+            WHERE c.user_id = ?
+            ORDER BY n.modified_at DESC, n.id DESC;
+        `,
+		agent.UserID,
+	)
+	if err != nil {
+		return handleError()
+	}
+	notes := []Note{}
+	for rows.Next() {
+		note := Note{}
+		if err = rows.Scan(&note.ID, &note.Title, &note.Role); err != nil {
+			rows.Close()
+			return handleError()
+		}
+		notes = append(notes, note)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return c.Render(200, "shared-previews", notes)
+}
+
+func renderCollaborators(c echo.Context, note_id int) error {
+	var err error
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if err = isOwner(note_id); err != nil {
+		return handleError()
+	}
+	list := CollaboratorList{}
+	if list.Note, err = getNotePreview(note_id); err != nil {
+		return handleError()
+	}
+	rows, err := agent.Query(
+		`
+            SELECT u.id, u.username, c.role
+            FROM collaborators c
+            JOIN users u
+            ON u.id = c.user_id
+            WHERE c.note_id = ?
+            ORDER BY u.username;
+        `,
+		note_id,
+	)
+	if err != nil {
+		return handleError()
+	}
+	for rows.Next() {
+		collaborator := Collaborator{}
+		if err = rows.Scan(&collaborator.UserID, &collaborator.Username, &collaborator.Role); err != nil {
+			rows.Close()
+			return handleError()
+		}
+		list.Collaborators = append(list.Collaborators, collaborator)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return c.Render(200, "collaborators", list)
+}
@@ -0,0 +1,143 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// addUser creates an account with a session and returns the session,
+// for requests made as that user.
+func (app *testApp) addUser(user_id int, username string) string {
+	app.t.Helper()
+
+	session := username + "-session"
+	app.exec("INSERT INTO users (id, username, password_hash) VALUES (?, ?, '')", user_id, username)
+	app.exec(
+		"INSERT INTO sessions (token_hash, user_id, expires_at) VALUES (?, ?, '9999-12-31 00:00:00')",
+		hashToken(session),
+		user_id,
+	)
+	return session
+}
+
+func TestCollaborators(t *testing.T) {
+	app := newTestApp(t)
+	owner := app.session
+	other := app.addUser(2, "other")
+
+	rec := app.do(http.MethodPost, "/notes/2/collaborators", url.Values{"username": {"other"}, "role": {"viewer"}})
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `id="collaborator-2"`, `<option value="viewer" selected>viewer</option>`)
+
+	app.session = other
+	rec = app.do(http.MethodGet, "/notes/shared", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Shared with me", `hx-get="/notes/2"`, "viewer")
+
+	rec = app.do(http.MethodGet, "/notes/2", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "This note is shared with you as a viewer", "Adding user notifications")
+	if strings.Contains(rec.Body.String(), `hx-get="/notes/2/edit"`) {
+		t.Error("a viewer was offered the title editor")
+	}
+	rec = app.do(http.MethodPost, "/search", url.Values{"search-term": {"notifications"}})
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Note 2: Ideas for New Features")
+
+	writes := []struct {
+		method string
+		target string
+		form   url.Values
+	}{
+		{http.MethodPut, "/notes/2", url.Values{"title": {"mine"}, "version": {"1"}}},
+		{http.MethodGet, "/notes/2/edit", nil},
+		{http.MethodPut, "/notes/2/hide-completed?hide=true", nil},
+		{http.MethodPut, "/notes/2/sink-completed", nil},
+		{http.MethodGet, "/blocks/new?note_id=2", nil},
+		{http.MethodPost, "/blocks?note_id=2", url.Values{"content": {"mine"}}},
+		{http.MethodGet, "/blocks/3/edit", nil},
+		{http.MethodPut, "/blocks/3", url.Values{"content": {"mine"}, "version": {"1"}}},
+		{http.MethodPut, "/blocks/3/indent", nil},
+		{http.MethodPut, "/blocks/3/check?checked=true", nil},
+		{http.MethodDelete, "/blocks/3", nil},
+		{http.MethodDelete, "/blocks?block_id=3", nil},
+		{http.MethodPut, "/blocks/type", url.Values{"type": {"todo"}, "block_id": {"3"}}},
+	}
+	for _, tt := range writes {
+		t.Run("viewer "+tt.method+" "+tt.target, func(t *testing.T) {
+			rec := app.do(tt.method, tt.target, tt.form)
+			assertStatus(t, rec, 403)
+			assertContains(t, rec, "Note 2 is shared with you as a viewer")
+		})
+	}
+
+	app.session = owner
+	rec = app.do(http.MethodPut, "/notes/2/collaborators/2", url.Values{"role": {"editor"}})
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `<option value="editor" selected>editor</option>`)
+
+	app.session = other
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Edited by other"}, "version": {app.version(3)}}), 200)
+	if got := app.queryString("SELECT content FROM blocks WHERE id = 3"); got != "Edited by other" {
+		t.Errorf("block 3 = %q", got)
+	}
+	owner_only := []struct {
+		method string
+		target string
+	}{
+		{http.MethodDelete, "/notes/2"},
+		{http.MethodGet, "/notes/2/shares"},
+		{http.MethodGet, "/notes/2/collaborators"},
+		{http.MethodDelete, "/notes/2/collaborators/1"},
+	}
+	for _, tt := range owner_only {
+		t.Run("editor "+tt.method+" "+tt.target, func(t *testing.T) {
+			rec := app.do(tt.method, tt.target, nil)
+			assertStatus(t, rec, 403)
+			assertContains(t, rec, "Only the owner of note 2 can do that")
+		})
+	}
+
+	// Collaborators can leave
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2/collaborators/2", nil), 200)
+	assertStatus(t, app.do(http.MethodGet, "/notes/2", nil), 404)
+	rec = app.do(http.MethodGet, "/notes/shared", nil)
+	assertStatus(t, rec, 200)
+	if strings.Contains(rec.Body.String(), "Shared with me") {
+		t.Error("a note is still shared after leaving it")
+	}
+}
+
+func TestInviteCollaborator(t *testing.T) {
+	app := newTestApp(t)
+	stranger := app.addUser(2, "stranger")
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		status int
+		want   string
+	}{
+		{"unknown user", url.Values{"username": {"nobody"}, "role": {"viewer"}}, 404, "User nobody not found"},
+		{"owner", url.Values{"username": {"demo"}, "role": {"editor"}}, 422, "You already own note 2"},
+		{"unknown role", url.Values{"username": {"stranger"}, "role": {"admin"}}, 400, "Missing or invalid param role"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := app.do(http.MethodPost, "/notes/2/collaborators", tt.form)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+		})
+	}
+
+	// Users a note is not shared with cannot tell it exists
+	app.session = stranger
+	assertStatus(t, app.do(http.MethodGet, "/notes/2/collaborators", nil), 404)
+	rec := app.do(http.MethodPost, "/notes/2/collaborators", url.Values{"username": {"stranger"}, "role": {"editor"}})
+	assertStatus(t, rec, 404)
+	if got := app.queryInt("SELECT COUNT(*) FROM collaborators"); got != 0 {
+		t.Errorf("collaborators = %d, want 0", got)
+	}
+}
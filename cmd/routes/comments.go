@@ -0,0 +1,244 @@
+package routes
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Comment is something said about a note by someone who can see it.
+// Its owner, editors and commenters post them; viewers only read them.
+type Comment struct {
+	ID        int
+	NoteID    int
+	UserID    int
+	Username  string
+	Content   string
+	CreatedAt string
+	// CanDelete is set for the user's own comments, and for every
+	// comment on a note they own.
+	CanDelete bool
+}
+
+// CommentList is a note's comments, oldest first, under the note.
+type CommentList struct {
+	Note     Note
+	Comments []Comment
+}
+
+// GetComments lists a note's comments.
+func GetComments(c echo.Context) error {
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+
+	return renderComments(c, note_id)
+}
+
+// PostComment adds the form value content as a comment on a note.
+func PostComment(c echo.Context) error {
+	var err error
+
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	content := strings.TrimSpace(c.FormValue("content"))
+	if content == "" {
+		return echo.NewHTTPError(400, "Missing or invalid param content")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if err = canComment(note_id); err != nil {
+		return handleError()
+	}
+	key, err := noteKey(note_id)
+	if err != nil {
+		return handleError()
+	}
+	if content, err = sealContent(key, content); err != nil {
+		return handleError()
+	}
+	if _, err = agent.Exec(
+		"INSERT INTO comments (note_id, user_id, content) VALUES (?, ?, seal(?))",
+		note_id,
+		agent.UserID,
+		content,
+	); err != nil {
+		return handleError()
+	}
+	if err = notify("note", note_id); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return renderComments(c, note_id)
+}
+
+// DeleteComment removes a comment. Users delete their own, and owners
+// any on their notes.
+func DeleteComment(c echo.Context) error {
+	var err error
+
+	comment_id, err := strconv.Atoi(c.Param("comment_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :comment_id")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	comment := Comment{ID: comment_id}
+	row := agent.QueryRow("SELECT note_id, user_id FROM comments WHERE id = ?", comment_id)
+	if err = row.Scan(&comment.NoteID, &comment.UserID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = NotFound("Comment %d not found", comment_id)
+		}
+		return handleError()
+	}
+	// Only those who can see the note learn the comment exists
+	if _, err = noteRole(comment.NoteID); err != nil {
+		err = NotFound("Comment %d not found", comment_id)
+		return handleError()
+	}
+	if comment.UserID != agent.UserID {
+		if err = isOwner(comment.NoteID); err != nil {
+			return handleError()
+		}
+	}
+	if _, err = agent.Exec("DELETE FROM comments WHERE id = ?", comment_id); err != nil {
+		return handleError()
+	}
+	if err = notify("note", comment.NoteID); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return c.NoContent(200)
+}
+
+func renderComments(c echo.Context, note_id int) error {
+	var err error
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	list := CommentList{Note: Note{ID: note_id}, Comments: []Comment{}}
+	if list.Note.Role, err = noteRole(note_id); err != nil {
+		return handleError()
+	}
+	key, err := noteKey(note_id)
+	if err != nil {
+		return handleError()
+	}
+	rows, err := agent.Query(
+		`
+            SELECT c.id, c.note_id, c.user_id, u.username, unseal(c.content), c.created_at
+            FROM comments c
+            JOIN users u
+            ON u.id = c.user_id
+            WHERE c.note_id = ?
+            ORDER BY c.created_at, c.id;
+        `,
+		note_id,
+	)
+	if err != nil {
+		return handleError()
+	}
+	for rows.Next() {
+		comment := Comment{}
+		if err = rows.Scan(
+			&comment.ID,
+			&comment.NoteID,
+			&comment.UserID,
+			&comment.Username,
+			&comment.Content,
+			&comment.CreatedAt,
+		); err != nil {
+			rows.Close()
+			return handleError()
+		}
+		if comment.Content, err = openContent(key, comment.Content); err != nil {
+			rows.Close()
+			return handleError()
+		}
+		comment.CanDelete = comment.UserID == agent.UserID || list.Note.Role == "owner"
+		list.Comments = append(list.Comments, comment)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return c.Render(200, "comments", list)
+}
+
+// resealComments turns the comments on note_id from content sealed with
+// one key into content sealed with the other, as resealBlocks does the
+// note's blocks. It runs in the caller's transaction.
+func resealComments(note_id int, from []byte, to []byte) error {
+	rows, err := agent.Query("SELECT id, unseal(content) FROM comments WHERE note_id = ?", note_id)
+	if err != nil {
+		return err
+	}
+	comments := []Comment{}
+	for rows.Next() {
+		comment := Comment{}
+		if err = rows.Scan(&comment.ID, &comment.Content); err != nil {
+			rows.Close()
+			return err
+		}
+		comments = append(comments, comment)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, comment := range comments {
+		var content string
+		if content, err = openContent(from, comment.Content); err != nil {
+			return err
+		}
+		if content, err = sealContent(to, content); err != nil {
+			return err
+		}
+		if _, err = agent.Exec("UPDATE comments SET content = seal(?) WHERE id = ?", content, comment.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
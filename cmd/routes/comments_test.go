@@ -0,0 +1,79 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestComments(t *testing.T) {
+	app := newTestApp(t)
+	owner := app.session
+	viewer := app.addUser(2, "viewer")
+	commenter := app.addUser(3, "commenter")
+	for username, role := range map[string]string{"viewer": "viewer", "commenter": "commenter"} {
+		rec := app.do(http.MethodPost, "/notes/2/collaborators", url.Values{"username": {username}, "role": {role}})
+		assertStatus(t, rec, 200)
+	}
+	post := func(content string) *httptest.ResponseRecorder {
+		return app.do(http.MethodPost, "/notes/2/comments", url.Values{"content": {content}})
+	}
+
+	app.session = commenter
+	rec := app.do(http.MethodGet, "/notes/2", nil)
+	assertContains(t, rec, "This note is shared with you as a commenter", `hx-get="/notes/2/comments"`)
+	rec = post("Could this wait until next quarter?")
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "commenter", "Could this wait until next quarter?", `hx-delete="/comments/1"`)
+	assertStatus(t, post("  "), 400)
+	if got := app.queryString("SELECT content FROM comments WHERE id = 1"); got != "Could this wait until next quarter?" {
+		t.Errorf("comment 1 = %q", got)
+	}
+
+	// Viewers read the comments, but neither post nor delete them
+	app.session = viewer
+	rec = app.do(http.MethodGet, "/notes/2/comments", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Could this wait until next quarter?")
+	for _, unwanted := range []string{`hx-post="/notes/2/comments"`, `hx-delete="/comments/1"`} {
+		if strings.Contains(rec.Body.String(), unwanted) {
+			t.Errorf("a viewer was offered %s", unwanted)
+		}
+	}
+	assertStatus(t, post("Me too"), 403)
+	assertStatus(t, app.do(http.MethodDelete, "/comments/1", nil), 403)
+
+	// Owners delete anyone's, and nobody else sees comments on their notes
+	app.session = owner
+	assertStatus(t, post("Noted"), 200)
+	assertStatus(t, app.do(http.MethodDelete, "/comments/1", nil), 200)
+	app.session = commenter
+	assertStatus(t, app.do(http.MethodDelete, "/comments/2", nil), 403)
+	app.exec("DELETE FROM collaborators WHERE user_id = 3")
+	assertStatus(t, app.do(http.MethodGet, "/notes/2/comments", nil), 404)
+	assertStatus(t, app.do(http.MethodDelete, "/comments/2", nil), 404)
+	app.session = owner
+	if got := app.queryInts("SELECT id FROM comments"); len(got) != 1 || got[0] != 2 {
+		t.Errorf("comments = %v, want [2]", got)
+	}
+}
+
+func TestEncryptedNoteComments(t *testing.T) {
+	app := newTestApp(t)
+	rec := app.do(http.MethodPost, "/notes/2/comments", url.Values{"content": {"Before encrypting"}})
+	assertStatus(t, rec, 200)
+	app.encrypt(2, "correct horse")
+
+	if got := app.queryString("SELECT content FROM comments WHERE id = 1"); got == "Before encrypting" {
+		t.Error("the comment is still stored in plaintext")
+	}
+	rec = app.do(http.MethodGet, "/notes/2/comments", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Before encrypting")
+
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/lock", nil), 200)
+	assertStatus(t, app.do(http.MethodGet, "/notes/2/comments", nil), 423)
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/comments", url.Values{"content": {"Locked out"}}), 423)
+}
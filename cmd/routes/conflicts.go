@@ -0,0 +1,68 @@
+package routes
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// EditConflict is an edit made on an out-of-date version of a title or
+// block, set beside the current one. The user keeps theirs, overwrites
+// it with their own or saves a merge of the two, which are PUT back to
+// Target with the current Version.
+type EditConflict struct {
+	NoteID  int
+	Target  string
+	Field   string
+	Version int
+	Theirs  string
+	Yours   string
+}
+
+// Merged is a first draft of the merge: whichever version holds the
+// other, or else both, theirs first.
+func (conflict EditConflict) Merged() string {
+	switch {
+	case strings.Contains(conflict.Theirs, conflict.Yours):
+		return conflict.Theirs
+	case strings.Contains(conflict.Yours, conflict.Theirs):
+		return conflict.Yours
+	case strings.Contains(conflict.Theirs+conflict.Yours, "\n"):
+		return conflict.Theirs + "\n" + conflict.Yours
+	default:
+		return conflict.Theirs + " " + conflict.Yours
+	}
+}
+
+// formVersion is the form value version, the version an edit was made
+// on. The app always sends it. Scripts using API tokens may leave it out,
+// and then get 0: their edits apply whatever the version.
+func formVersion(c echo.Context) (int, error) {
+	param := c.FormValue("version")
+	if param == "" && c.Get("api_token") != nil {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(param)
+	if err != nil || version < 1 {
+		return 0, echo.NewHTTPError(400, "Missing or invalid param version")
+	}
+	return version, nil
+}
+
+// checkBlockEdit refuses an edit to block begun on an older version of
+// it, or made while it is edited live, either of which would write over
+// newer content.
+func checkBlockEdit(block Block, version int) error {
+	if _, ok := liveContent(block.NoteID, block.ID); ok {
+		return Conflict("Block %d is being edited live", block.ID)
+	}
+	if version != 0 && version != block.Version {
+		return Conflict("Block %d changed since this edit began; reload and try again", block.ID)
+	}
+	return nil
+}
+
+func renderConflict(c echo.Context, conflict EditConflict) error {
+	return c.Render(409, "edit-conflict", conflict)
+}
@@ -0,0 +1,105 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestBlockVersions(t *testing.T) {
+	app := newTestApp(t)
+	original := app.queryString("SELECT content FROM blocks WHERE id = 3")
+
+	rec := app.do(http.MethodGet, "/blocks/3/edit", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `hx-vals='{"version": 1}'`)
+
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Mine"}, "version": {"1"}}), 200)
+	if got := app.queryInt("SELECT version FROM blocks WHERE id = 3"); got != 2 {
+		t.Errorf("version = %d, want 2", got)
+	}
+
+	// Another tab still editing version 1
+	rec = app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Stale"}, "version": {"1"}})
+	assertStatus(t, rec, 409)
+	assertContains(t, rec, "edit-conflict", "Mine", "Stale", `name="version" value="2"`, `hx-put="/blocks/3"`)
+	if got := app.queryString("SELECT content FROM blocks WHERE id = 3"); got != "Mine" {
+		t.Errorf("content = %q after a conflict, want %q", got, "Mine")
+	}
+
+	// Saving what is already there is no conflict
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Mine"}, "version": {"1"}}), 200)
+
+	// Overwriting once the current version is known
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Stale"}, "version": {"2"}}), 200)
+	if got := app.queryInt("SELECT version FROM blocks WHERE id = 3"); got != 3 {
+		t.Errorf("version = %d, want 3", got)
+	}
+
+	// The app always sends the version; only API tokens may leave it out
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {original}}), 400)
+	token := app.createToken("importer", "write")
+	assertStatus(t, app.bearer(token, http.MethodPut, "/blocks/3", url.Values{"content": {original}}), 200)
+	if got := app.queryString("SELECT content FROM blocks WHERE id = 3"); got != original {
+		t.Errorf("content = %q, want %q", got, original)
+	}
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"x"}, "version": {"none"}}), 400)
+}
+
+func TestSplitMergeVersions(t *testing.T) {
+	app := newTestApp(t)
+	original := app.queryString("SELECT content FROM blocks WHERE id = 4")
+	assertStatus(t, app.do(http.MethodPut, "/blocks/4", url.Values{"content": {"Mine, newer"}, "version": {"1"}}), 200)
+
+	// Another tab still editing version 1
+	rec := app.do(http.MethodPost, "/blocks/4/split", url.Values{"content": {original}, "offset": {"9"}, "version": {"1"}})
+	assertStatus(t, rec, 409)
+	rec = app.do(http.MethodPost, "/blocks/4/merge", url.Values{"content": {original}, "version": {"1"}})
+	assertStatus(t, rec, 409)
+	assertInts(t, "blocks", app.blockOrder(2), []int{3, 4, 5})
+	if got := app.queryString("SELECT content FROM blocks WHERE id = 4"); got != "Mine, newer" {
+		t.Errorf("content = %q after a conflict, want %q", got, "Mine, newer")
+	}
+
+	assertStatus(t, app.do(http.MethodPost, "/blocks/4/split", url.Values{"content": {"Mine, newer"}, "offset": {"5"}, "version": {"2"}}), 200)
+	assertInts(t, "blocks", app.blockOrder(2), []int{3, 4, 57, 5})
+}
+
+func TestTitleVersions(t *testing.T) {
+	app := newTestApp(t)
+
+	rec := app.do(http.MethodGet, "/notes/2/edit", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `hx-vals='{"version": 1}'`)
+
+	assertStatus(t, app.do(http.MethodPut, "/notes/2", url.Values{"title": {"Plans"}, "version": {"1"}}), 200)
+	rec = app.do(http.MethodPut, "/notes/2", url.Values{"title": {"Ideas"}, "version": {"1"}})
+	assertStatus(t, rec, 409)
+	assertContains(t, rec, "Plans", "Ideas", "Plans Ideas", `name="title"`, `hx-put="/notes/2"`)
+	if got := app.queryString("SELECT title FROM notes WHERE id = 2"); got != "Plans" {
+		t.Errorf("title = %q after a conflict, want %q", got, "Plans")
+	}
+
+	// Touching the note otherwise leaves the title's version be
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Changed"}, "version": {app.version(3)}}), 200)
+	assertStatus(t, app.do(http.MethodPut, "/notes/2", url.Values{"title": {"Plans and ideas"}, "version": {"2"}}), 200)
+}
+
+func TestMergedConflict(t *testing.T) {
+	tests := []struct {
+		theirs string
+		yours  string
+		want   string
+	}{
+		{"Buy milk", "Buy milk and eggs", "Buy milk and eggs"},
+		{"Buy milk and eggs", "milk", "Buy milk and eggs"},
+		{"Buy milk", "Sell cows", "Buy milk Sell cows"},
+		{"a\nb", "c", "a\nb\nc"},
+	}
+	for _, tt := range tests {
+		conflict := EditConflict{Theirs: tt.theirs, Yours: tt.yours}
+		if got := conflict.Merged(); got != tt.want {
+			t.Errorf("Merged(%q, %q) = %q, want %q", tt.theirs, tt.yours, got, tt.want)
+		}
+	}
+}
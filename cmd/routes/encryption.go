@@ -0,0 +1,574 @@
+package routes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/argon2"
+)
+
+// Encrypted notes keep their blocks' content as ciphertext, sealed with
+// AES-256-GCM under a key derived from a passphrase with Argon2id. The
+// note stores the salt and keyCheck sealed under the key, which tells a
+// right passphrase from a wrong one, but never the key. Titles stay
+// readable, so the notes can still be listed; uploaded files are kept as
+// they are, only their captions are sealed.
+
+// keyCheck is what notes.key_check holds, sealed.
+const keyCheck = "gonote"
+
+// keyring holds the keys of the notes each session unlocked, by session
+// and note. It is only ever kept in memory: logging out or restarting
+// the server locks every note again.
+var keyring = struct {
+	sync.Mutex
+	keys map[string]map[int][]byte
+}{keys: map[string]map[int][]byte{}}
+
+// GetEncryption shows whether a note is encrypted, with the means to
+// encrypt it or to lock it and stop encrypting it.
+func GetEncryption(c echo.Context) error {
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+
+	return renderEncryption(c, note_id)
+}
+
+// PostEncryption encrypts a note with the form value passphrase, given
+// again as confirm, and unlocks it for this session. Its share links go,
+// since they show it to anyone without the passphrase.
+func PostEncryption(c echo.Context) error {
+	var err error
+
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	passphrase := c.FormValue("passphrase")
+	if len(passphrase) < MinPasswordLength {
+		return Invalid("Passphrases are at least %d characters", MinPasswordLength)
+	}
+	if c.FormValue("confirm") != passphrase {
+		return Invalid("The passphrases do not match")
+	}
+	if err = requireBrowser(); err != nil {
+		return err
+	}
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return err
+	}
+	key := deriveKey(passphrase, salt)
+	check, err := sealContent(key, keyCheck)
+	if err != nil {
+		return err
+	}
+
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if err = isOwner(note_id); err != nil {
+		return handleError()
+	}
+	encrypted, err := noteEncrypted(note_id)
+	if err != nil {
+		return handleError()
+	}
+	if encrypted {
+		err = Conflict("Note %d is already encrypted", note_id)
+		return handleError()
+	}
+	// Set first, so quick_search drops the blocks as they are sealed
+	if _, err = agent.Exec(
+		`
+            UPDATE notes
+            SET key_salt = $1, key_check = $2
+            WHERE id = $3;
+
+            DELETE FROM shares
+            WHERE note_id = $3;
+        `,
+		base64.StdEncoding.EncodeToString(salt),
+		check,
+		note_id,
+	); err != nil {
+		return handleError()
+	}
+	if err = resealBlocks(note_id, nil, key); err != nil {
+		return handleError()
+	}
+	if err = notify("note", note_id); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	keepKey(agent.Session, note_id, key)
+	// The attachments the note held unsealed
+	cleanUpAttachments(c)
+
+	return renderNote(c, note_id)
+}
+
+// DeleteEncryption decrypts a note for good. It has to be unlocked.
+func DeleteEncryption(c echo.Context) error {
+	var err error
+
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if err = isOwner(note_id); err != nil {
+		return handleError()
+	}
+	key, err := noteKey(note_id)
+	if err != nil {
+		return handleError()
+	}
+	if key == nil {
+		err = Conflict("Note %d is not encrypted", note_id)
+		return handleError()
+	}
+	// Cleared first, so quick_search takes the blocks back as they open
+	if _, err = agent.Exec(
+		"UPDATE notes SET key_salt = NULL, key_check = NULL WHERE id = ?",
+		note_id,
+	); err != nil {
+		return handleError()
+	}
+	if err = resealBlocks(note_id, key, nil); err != nil {
+		return handleError()
+	}
+	if err = notify("note", note_id); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	forgetNoteKeys(note_id)
+	cleanUpAttachments(c)
+
+	return renderNote(c, note_id)
+}
+
+// PostUnlock unlocks an encrypted note for this session with the form
+// value passphrase. Collaborators unlock it with the same passphrase.
+func PostUnlock(c echo.Context) error {
+	var err error
+
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	if err = requireBrowser(); err != nil {
+		return err
+	}
+
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if _, err = noteRole(note_id); err != nil {
+		return handleError()
+	}
+	var salt, check string
+	row := agent.QueryRow(
+		"SELECT COALESCE(key_salt, ''), COALESCE(key_check, '') FROM notes WHERE id = ?",
+		note_id,
+	)
+	if err = row.Scan(&salt, &check); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	if salt == "" {
+		return renderNote(c, note_id)
+	}
+	salt_bytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return err
+	}
+	key := deriveKey(c.FormValue("passphrase"), salt_bytes)
+	if opened, err := openContent(key, check); err != nil || opened != keyCheck {
+		return echo.NewHTTPError(401, "Wrong passphrase")
+	}
+	keepKey(agent.Session, note_id, key)
+
+	return renderNote(c, note_id)
+}
+
+// PostLock locks an encrypted note again for this session.
+func PostLock(c echo.Context) error {
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	keyring.Lock()
+	delete(keyring.keys[agent.Session], note_id)
+	keyring.Unlock()
+
+	return renderNote(c, note_id)
+}
+
+// renderNote renders a note as GetNoteContent does: editable, read-only
+// for viewers, or asking for its passphrase while it is locked.
+func renderNote(c echo.Context, note_id int) error {
+	note, err := getContentByNoteId(note_id)
+	if errors.Is(err, ErrLocked) {
+		return c.Render(200, "locked-note", note)
+	}
+	if err != nil {
+		return err
+	}
+	if !note.CanEdit() {
+		return c.Render(200, "shared-note-content", note)
+	}
+
+	return c.Render(200, "note-content", note)
+}
+
+func renderEncryption(c echo.Context, note_id int) error {
+	var err error
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if err = isOwner(note_id); err != nil {
+		return handleError()
+	}
+	note, err := getNotePreview(note_id)
+	if err != nil {
+		return handleError()
+	}
+	if note.Encrypted, err = noteEncrypted(note_id); err != nil {
+		return handleError()
+	}
+	if note.Encrypted {
+		_, err = noteKey(note_id)
+		note.Locked = errors.Is(err, ErrLocked)
+		if err != nil && !note.Locked {
+			return handleError()
+		}
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return c.Render(200, "encryption", note)
+}
+
+// requireBrowser keeps API tokens from unlocking notes, which are
+// unlocked per browser session.
+func requireBrowser() error {
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	if agent.Session == "" {
+		return Forbidden("Encrypted notes are unlocked from a browser session")
+	}
+	return nil
+}
+
+// noteEncrypted reports whether note_id is encrypted. It runs in the
+// caller's transaction.
+func noteEncrypted(note_id int) (bool, error) {
+	var encrypted bool
+	row := agent.QueryRow("SELECT key_salt IS NOT NULL FROM notes WHERE id = ?", note_id)
+	if err := row.Scan(&encrypted); err != nil {
+		return false, err
+	}
+	return encrypted, nil
+}
+
+// noteKey is the key note_id's blocks are sealed with, or nil if it is
+// not encrypted. Encrypted notes the session has not unlocked are
+// Locked. It runs in the caller's transaction.
+func noteKey(note_id int) ([]byte, error) {
+	encrypted, err := noteEncrypted(note_id)
+	if err != nil || !encrypted {
+		return nil, err
+	}
+	keyring.Lock()
+	defer keyring.Unlock()
+	key := keyring.keys[agent.Session][note_id]
+	if agent.Session == "" || key == nil {
+		return nil, Locked("Note %d is encrypted; unlock it with its passphrase", note_id)
+	}
+	return key, nil
+}
+
+// resealBlocks turns every block of note_id from content sealed with one
+// key into content sealed with the other, where a nil key is none, and
+// their attachments and the note's comments with it.
+func resealBlocks(note_id int, from []byte, to []byte) error {
+	// What the blocks say stays the same, so the audit log leaves it out
+	defer pauseAudit()()
+
+	rows, err := agent.Query("SELECT id, unseal(content) FROM blocks WHERE note_id = ?", note_id)
+	if err != nil {
+		return err
+	}
+	blocks := []Block{}
+	for rows.Next() {
+		block := Block{}
+		if err = rows.Scan(&block.ID, &block.Content); err != nil {
+			rows.Close()
+			return err
+		}
+		blocks = append(blocks, block)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		var content string
+		if content, err = openContent(from, block.Content); err != nil {
+			return err
+		}
+		if content, err = sealContent(to, content); err != nil {
+			return err
+		}
+		if _, err = agent.Exec("UPDATE blocks SET content = seal(?) WHERE id = ?", content, block.ID); err != nil {
+			return err
+		}
+	}
+	if err = resealNoteAttachments(note_id, from, to); err != nil {
+		return err
+	}
+	if err = resealComments(note_id, from, to); err != nil {
+		return err
+	}
+	return resealAudit(note_id, from, to)
+}
+
+// resealAudit reseals the versions of note_id's blocks kept in the audit
+// log as resealBlocks does the blocks, so none stay readable without the
+// passphrase. Only resealing while the audit is paused may change them.
+// Versions that don't open with from are left as they are.
+func resealAudit(note_id int, from []byte, to []byte) error {
+	rows, err := agent.Query(
+		`
+        SELECT id, unseal(before), unseal(after)
+        FROM audit_log
+        WHERE note_id = ?
+        AND field = 'content'
+        AND encrypted = ?;
+        `,
+		note_id,
+		from != nil,
+	)
+	if err != nil {
+		return err
+	}
+	type version struct {
+		id     int
+		before sql.NullString
+		after  sql.NullString
+	}
+	versions := []version{}
+	for rows.Next() {
+		v := version{}
+		if err = rows.Scan(&v.id, &v.before, &v.after); err != nil {
+			rows.Close()
+			return err
+		}
+		versions = append(versions, v)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	reseal := func(value *sql.NullString) bool {
+		if !value.Valid {
+			return true
+		}
+		content, err := openContent(from, value.String)
+		if err != nil {
+			return false
+		}
+		value.String, err = sealContent(to, content)
+		return err == nil
+	}
+	for _, v := range versions {
+		if !reseal(&v.before) || !reseal(&v.after) {
+			continue
+		}
+		if _, err = agent.Exec(
+			"UPDATE audit_log SET before = seal(?), after = seal(?), encrypted = ? WHERE id = ?",
+			v.before,
+			v.after,
+			to != nil,
+			v.id,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealBlockContent seals content for note_id, as it is stored. It runs
+// in the caller's transaction.
+func sealBlockContent(note_id int, content string) (string, error) {
+	key, err := noteKey(note_id)
+	if err != nil {
+		return "", err
+	}
+	return sealContent(key, content)
+}
+
+// openBlocks opens the content of blocks and their children, sealed with
+// key.
+func openBlocks(key []byte, blocks []Block) error {
+	if key == nil {
+		return nil
+	}
+	for i := range blocks {
+		content, err := openContent(key, blocks[i].Content)
+		if err != nil {
+			return err
+		}
+		blocks[i].Content = content
+		if err = openBlocks(key, blocks[i].Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deriveKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, 32)
+}
+
+// sealContent encrypts content with key, as base64 of the nonce followed
+// by the ciphertext. A nil key leaves content as it is.
+func sealContent(key []byte, content string) (string, error) {
+	if key == nil {
+		return content, nil
+	}
+	sealed, err := sealBytes(key, []byte(content))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openContent decrypts what sealContent sealed with key.
+func openContent(key []byte, sealed string) (string, error) {
+	if key == nil {
+		return sealed, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", errors.New("encryption: malformed ciphertext")
+	}
+	content, err := openBytes(key, data)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// sealBytes encrypts data with key as the nonce followed by the
+// ciphertext. A nil key leaves data as it is.
+func sealBytes(key []byte, data []byte) ([]byte, error) {
+	if key == nil {
+		return data, nil
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// openBytes decrypts what sealBytes sealed with key.
+func openBytes(key []byte, sealed []byte) ([]byte, error) {
+	if key == nil {
+		return sealed, nil
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encryption: malformed ciphertext")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func keepKey(session string, note_id int, key []byte) {
+	keyring.Lock()
+	defer keyring.Unlock()
+	if keyring.keys[session] == nil {
+		keyring.keys[session] = map[int][]byte{}
+	}
+	keyring.keys[session][note_id] = key
+}
+
+// forgetKeys locks every note a session unlocked, as it logs out.
+func forgetKeys(session string) {
+	keyring.Lock()
+	defer keyring.Unlock()
+	delete(keyring.keys, session)
+}
+
+// forgetNoteKeys drops a note's key from every session.
+func forgetNoteKeys(note_id int) {
+	keyring.Lock()
+	defer keyring.Unlock()
+	for _, keys := range keyring.keys {
+		delete(keys, note_id)
+	}
+}
@@ -0,0 +1,139 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+const plainBlock = "Adding user notifications will increase engagement significantly."
+
+// encrypt locks note_id behind passphrase, leaving it unlocked for the
+// test session.
+func (app *testApp) encrypt(note_id int, passphrase string) {
+	app.t.Helper()
+
+	form := url.Values{"passphrase": {passphrase}, "confirm": {passphrase}}
+	rec := app.do(http.MethodPost, "/notes/"+strconv.Itoa(note_id)+"/encryption", form)
+	assertStatus(app.t, rec, 200)
+}
+
+func TestEncryptNote(t *testing.T) {
+	app := newTestApp(t)
+	app.encrypt(2, "correct horse")
+
+	if got := app.queryString("SELECT content FROM blocks WHERE id = 3"); got == plainBlock {
+		t.Error("block 3 is still stored in plaintext")
+	}
+	if got := app.queryInt("SELECT COUNT(*) FROM quick_search WHERE note_id = 2 AND content IS NOT NULL"); got != 0 {
+		t.Error("note 2 is still indexed with its content")
+	}
+	rec := app.do(http.MethodPost, "/search", url.Values{"search-term": {"engagement significantly"}})
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "No results")
+
+	// Unlocked for the session that encrypted it
+	rec = app.do(http.MethodGet, "/notes/2", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, plainBlock)
+
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Secret plans"}, "version": {app.version(3)}}), 200)
+	if got := app.queryString("SELECT content FROM blocks WHERE id = 3"); got == "Secret plans" {
+		t.Error("edited block 3 is stored in plaintext")
+	}
+	rec = app.do(http.MethodGet, "/blocks/export?block_id=3", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Secret plans")
+
+	// Another session sees the prompt until it unlocks
+	other := app.addUser(2, "other")
+	rec = app.do(http.MethodPost, "/notes/2/collaborators", url.Values{"username": {"other"}, "role": {"editor"}})
+	assertStatus(t, rec, 200)
+	app.session = other
+	rec = app.do(http.MethodGet, "/notes/2", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `hx-post="/notes/2/unlock"`)
+	assertStatus(t, app.do(http.MethodGet, "/blocks/3/edit", nil), 423)
+
+	rec = app.do(http.MethodPost, "/notes/2/unlock", url.Values{"passphrase": {"wrong"}})
+	assertStatus(t, rec, 401)
+	assertContains(t, rec, "Wrong passphrase")
+	rec = app.do(http.MethodPost, "/notes/2/unlock", url.Values{"passphrase": {"correct horse"}})
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Secret plans")
+
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/lock", nil), 200)
+	assertContains(t, app.do(http.MethodGet, "/notes/2", nil), `hx-post="/notes/2/unlock"`)
+}
+
+func TestEncryptNoteRules(t *testing.T) {
+	app := newTestApp(t)
+
+	form := url.Values{"passphrase": {"correct horse"}, "confirm": {"correct mouse"}}
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/encryption", form), 422)
+	form = url.Values{"passphrase": {"short"}, "confirm": {"short"}}
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/encryption", form), 422)
+
+	app.createShare(2, nil)
+	app.encrypt(2, "correct horse")
+	if got := app.queryInt("SELECT COUNT(*) FROM shares WHERE note_id = 2"); got != 0 {
+		t.Errorf("%d share links left on an encrypted note, want 0", got)
+	}
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/shares", nil), 422)
+	form = url.Values{"passphrase": {"correct horse"}, "confirm": {"correct horse"}}
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/encryption", form), 409)
+
+	form = url.Values{"mode": {"copy"}, "note_id": {"3"}, "block_id": {"3"}}
+	assertStatus(t, app.do(http.MethodPost, "/blocks/transfer", form), 422)
+
+	// Collaborators cannot encrypt or decrypt someone else's note
+	other := app.addUser(2, "other")
+	rec := app.do(http.MethodPost, "/notes/2/collaborators", url.Values{"username": {"other"}, "role": {"editor"}})
+	assertStatus(t, rec, 200)
+	app.session = other
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2/encryption", nil), 403)
+}
+
+func TestDecryptNote(t *testing.T) {
+	app := newTestApp(t)
+	app.encrypt(2, "correct horse")
+
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/lock", nil), 200)
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2/encryption", nil), 423)
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/unlock", url.Values{"passphrase": {"correct horse"}}), 200)
+
+	rec := app.do(http.MethodDelete, "/notes/2/encryption", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, plainBlock)
+	if got := app.queryString("SELECT content FROM blocks WHERE id = 3"); got != plainBlock {
+		t.Errorf("block 3 = %q after decrypting, want plaintext", got)
+	}
+	if got := app.queryInt("SELECT COUNT(*) FROM quick_search WHERE note_id = 2 AND content LIKE '%engagement%'"); got != 1 {
+		t.Error("note 2 is not indexed again after decrypting")
+	}
+}
+
+func TestArchiveEncryptedNote(t *testing.T) {
+	app := newTestApp(t)
+	app.encrypt(2, "correct horse")
+	sealed := app.queryString("SELECT content FROM blocks WHERE id = 3")
+
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2", nil), 200)
+	archived := app.queryInt("SELECT id FROM notes_archive WHERE key_salt IS NOT NULL")
+	if got := app.queryInt("SELECT COUNT(*) FROM blocks_archive WHERE content = ?", sealed); got != 1 {
+		t.Error("archived block 3 is not kept as ciphertext")
+	}
+	rec := app.do(http.MethodGet, "/archive/"+strconv.Itoa(archived), nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "This note is encrypted and archived")
+
+	// Restoring makes a new note, which comes back locked
+	rec = app.do(http.MethodPost, "/archive/"+strconv.Itoa(archived), nil)
+	assertStatus(t, rec, 200)
+	restored := app.queryInt("SELECT id FROM notes WHERE key_salt IS NOT NULL")
+	assertContains(t, rec, `hx-post="/notes/`+strconv.Itoa(restored)+`/unlock"`)
+	rec = app.do(http.MethodPost, "/notes/"+strconv.Itoa(restored)+"/unlock", url.Values{"passphrase": {"correct horse"}})
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, plainBlock)
+}
@@ -0,0 +1,124 @@
+package routes
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrValidation = errors.New("validation failed")
+	ErrConflict   = errors.New("conflict")
+	ErrForbidden  = errors.New("forbidden")
+	ErrLocked     = errors.New("locked")
+)
+
+// Error is a domain error with a message that is safe to show the user.
+// Kind is one of ErrNotFound, ErrValidation, ErrConflict, ErrForbidden or
+// ErrLocked, so callers can match it with errors.Is.
+type Error struct {
+	Kind    error
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+func NotFound(format string, args ...any) error {
+	return &Error{Kind: ErrNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func Invalid(format string, args ...any) error {
+	return &Error{Kind: ErrValidation, Message: fmt.Sprintf(format, args...)}
+}
+
+func Conflict(format string, args ...any) error {
+	return &Error{Kind: ErrConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+func Forbidden(format string, args ...any) error {
+	return &Error{Kind: ErrForbidden, Message: fmt.Sprintf(format, args...)}
+}
+
+func Locked(format string, args ...any) error {
+	return &Error{Kind: ErrLocked, Message: fmt.Sprintf(format, args...)}
+}
+
+type ErrorResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"error"`
+}
+
+// HandleError is the echo HTTPErrorHandler. HTMX requests get an "error"
+// fragment swapped into #errors, everything else gets a JSON body.
+func HandleError(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	res := errorResponse(err)
+	if res.Status >= 500 {
+		c.Logger().Error(err)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(res.Status)
+	} else if c.Request().Header.Get("HX-Request") == "true" {
+		header := c.Response().Header()
+		header.Set("HX-Retarget", "#errors")
+		header.Set("HX-Reswap", "beforeend")
+		header.Set("X-Error-Fragment", "true")
+		err = c.Render(res.Status, "error", res)
+	} else if strings.Contains(c.Request().Header.Get("Accept"), "text/html") {
+		err = c.Render(res.Status, "error-page", res)
+	} else {
+		err = c.JSON(res.Status, res)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
+
+// errorResponse is what the user is told of err: the status it maps to
+// and a message, which for unexpected errors gives nothing away.
+func errorResponse(err error) ErrorResponse {
+	res := ErrorResponse{
+		Status:  http.StatusInternalServerError,
+		Message: http.StatusText(http.StatusInternalServerError),
+	}
+	var domain_err *Error
+	var http_err *echo.HTTPError
+	switch {
+	case errors.As(err, &domain_err):
+		res.Message = domain_err.Message
+		switch {
+		case errors.Is(err, ErrNotFound):
+			res.Status = http.StatusNotFound
+		case errors.Is(err, ErrValidation):
+			res.Status = http.StatusUnprocessableEntity
+		case errors.Is(err, ErrConflict):
+			res.Status = http.StatusConflict
+		case errors.Is(err, ErrForbidden):
+			res.Status = http.StatusForbidden
+		case errors.Is(err, ErrLocked):
+			res.Status = http.StatusLocked
+		}
+	case errors.Is(err, sql.ErrNoRows):
+		res.Status = http.StatusNotFound
+		res.Message = http.StatusText(http.StatusNotFound)
+	case errors.As(err, &http_err):
+		res.Status = http_err.Code
+		res.Message = fmt.Sprint(http_err.Message)
+	}
+	return res
+}
@@ -0,0 +1,206 @@
+package routes
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Event is a change to a note, streamed to the open tabs of everyone who
+// can see it. Type is "note" when the note was created, archived or
+// shared, "title" when it was renamed and "block" when its blocks
+// changed. "archive" events tell an owner their archive changed.
+type Event struct {
+	Type   string `json:"type"`
+	NoteID int    `json:"note_id"`
+
+	users []int
+	tab   string
+}
+
+// TabHeader names the browser tab a request came from. Changes are not
+// streamed back to the tab that made them, which shows them already.
+const TabHeader = "GoNote-Tab"
+
+// newTab names the tab a page is served to, for its event stream and
+// the TabHeader of its requests.
+func newTab() string {
+	tab := make([]byte, 9)
+	rand.Read(tab)
+	return base64.RawURLEncoding.EncodeToString(tab)
+}
+
+// EventKeepAlive is how often an idle event stream sends a comment, so
+// proxies don't close it.
+const EventKeepAlive = 30 * time.Second
+
+// Hub hands events to the event streams of the tabs they concern.
+type Hub struct {
+	sync.Mutex
+	streams map[*eventStream]bool
+	closed  bool
+}
+
+type eventStream struct {
+	userID int
+	tab    string
+	events chan Event
+}
+
+var hub = NewHub()
+
+func NewHub() *Hub {
+	return &Hub{streams: map[*eventStream]bool{}}
+}
+
+// CloseEvents ends every event stream and live socket, letting the
+// server shut down without waiting on tabs that never close.
+func CloseEvents() {
+	hub.Close()
+	closeLive()
+}
+
+func (hub *Hub) Subscribe(user_id int, tab string) *eventStream {
+	hub.Lock()
+	defer hub.Unlock()
+
+	stream := &eventStream{userID: user_id, tab: tab, events: make(chan Event, 64)}
+	if hub.closed {
+		close(stream.events)
+		return stream
+	}
+	hub.streams[stream] = true
+	return stream
+}
+
+func (hub *Hub) Unsubscribe(stream *eventStream) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	if hub.streams[stream] {
+		delete(hub.streams, stream)
+		close(stream.events)
+	}
+}
+
+// Publish sends events to the streams of their users. A tab too far
+// behind misses events rather than holding up the request that made
+// them.
+func (hub *Hub) Publish(events []Event) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	for stream := range hub.streams {
+		for _, event := range events {
+			if !slices.Contains(event.users, stream.userID) {
+				continue
+			}
+			if event.tab != "" && event.tab == stream.tab {
+				continue
+			}
+			select {
+			case stream.events <- event:
+			default:
+			}
+		}
+	}
+}
+
+func (hub *Hub) Close() {
+	hub.Lock()
+	defer hub.Unlock()
+
+	for stream := range hub.streams {
+		close(stream.events)
+	}
+	hub.streams = map[*eventStream]bool{}
+	hub.closed = true
+}
+
+// GetEvents streams changes to the user's notes as server-sent events
+// until the tab goes away. ?tab names the tab, as TabHeader does for its
+// other requests.
+func GetEvents(c echo.Context) error {
+	user := c.Get("user").(User)
+	stream := hub.Subscribe(user.ID, c.QueryParam("tab"))
+	defer hub.Unsubscribe(stream)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(200)
+	res.Flush()
+
+	// The stream stays open far longer than any request may hold the agent
+	reattach := agent.Detach()
+	defer reattach()
+
+	keepalive := time.NewTicker(EventKeepAlive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-keepalive.C:
+			fmt.Fprint(res, ": keepalive\n\n")
+		case event, ok := <-stream.events:
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		res.Flush()
+	}
+}
+
+// notify queues an event for everyone who can see note_id, sent once the
+// agent's transaction commits. It runs in that transaction, so call it
+// before taking anyone's access away.
+func notify(event_type string, note_id int) error {
+	rows, err := agent.Query(
+		"SELECT user_id FROM note_access WHERE note_id = ? AND user_id IS NOT NULL",
+		note_id,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	event := Event{Type: event_type, NoteID: note_id, tab: agent.Tab}
+	for rows.Next() {
+		var user_id int
+		if err = rows.Scan(&user_id); err != nil {
+			return err
+		}
+		event.users = append(event.users, user_id)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	queueEvent(event)
+	return nil
+}
+
+// notifyArchive queues an "archive" event for agent.UserID.
+func notifyArchive() {
+	queueEvent(Event{Type: "archive", users: []int{agent.UserID}, tab: agent.Tab})
+}
+
+func queueEvent(event Event) {
+	for _, queued := range agent.events {
+		if queued.Type == event.Type && queued.NoteID == event.NoteID {
+			return
+		}
+	}
+	agent.events = append(agent.events, event)
+}
@@ -0,0 +1,135 @@
+package routes
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listen opens an event stream as session, from tab, on a live server
+// for the app. Streams end when the test does.
+func (app *testApp) listen(session string, tab string) <-chan Event {
+	app.t.Helper()
+
+	srv := httptest.NewServer(app.e)
+	app.t.Cleanup(srv.Close)
+	app.t.Cleanup(CloseEvents)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/events?tab="+tab, nil)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session})
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		app.t.Fatalf("GET /events = %d", res.StatusCode)
+	}
+	if got := res.Header.Get("Content-Type"); got != "text/event-stream" {
+		app.t.Fatalf("Content-Type = %q", got)
+	}
+
+	events := make(chan Event, 16)
+	go func() {
+		defer res.Body.Close()
+		defer close(events)
+		event := Event{}
+		lines := bufio.NewScanner(res.Body)
+		for lines.Scan() {
+			line := lines.Text()
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				json.Unmarshal([]byte(data), &event)
+			} else if line == "" && event.Type != "" {
+				events <- event
+				event = Event{}
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("event stream ended")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event within 5s")
+	}
+	return Event{}
+}
+
+func assertEvent(t *testing.T, events <-chan Event, event_type string, note_id int) {
+	t.Helper()
+
+	got := nextEvent(t, events)
+	if got.Type != event_type || got.NoteID != note_id {
+		t.Errorf("event = %s %d, want %s %d", got.Type, got.NoteID, event_type, note_id)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	app := newTestApp(t)
+	other := app.addUser(2, "other")
+	events := app.listen(app.session, "first")
+
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Changed"}, "version": {app.version(3)}}), 200)
+	assertEvent(t, events, "block", 2)
+
+	assertStatus(t, app.do(http.MethodPut, "/notes/2", url.Values{"title": {"Renamed"}, "version": {"1"}}), 200)
+	assertEvent(t, events, "title", 2)
+
+	// Not echoed to the tab making the change
+	req := httptest.NewRequest(http.MethodPut, "/blocks/4", strings.NewReader("content=Mine&version=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(TabHeader, "first")
+	assertStatus(t, app.serve(req), 200)
+	// Not published when rolled back
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2/collaborators/2", nil), 404)
+
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/collaborators", url.Values{"username": {"other"}, "role": {"editor"}}), 200)
+	assertEvent(t, events, "note", 2)
+
+	// Collaborators hear of changes to notes shared with them, and only those
+	shared := app.listen(other, "second")
+	assertStatus(t, app.do(http.MethodPut, "/blocks/11", url.Values{"content": {"Not shared"}, "version": {app.version(11)}}), 200)
+	assertEvent(t, events, "block", 5)
+	assertStatus(t, app.do(http.MethodPut, "/blocks/5", url.Values{"content": {"Shared"}, "version": {app.version(5)}}), 200)
+	assertEvent(t, events, "block", 2)
+	assertEvent(t, shared, "block", 2)
+
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2", nil), 200)
+	assertEvent(t, events, "note", 2)
+	assertEvent(t, events, "archive", 0)
+	assertEvent(t, shared, "note", 2)
+
+	CloseEvents()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("got an event after closing")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("event stream still open after closing")
+	}
+}
+
+func TestEventsLoginRequired(t *testing.T) {
+	app := newTestApp(t)
+	app.session = ""
+
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	assertStatus(t, app.serve(req), 401)
+}
@@ -0,0 +1,253 @@
+package routes
+
+import (
+	"html/template"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CodeLanguages are the languages a code block can be highlighted as,
+// in the order they are offered. "" is plain text.
+var CodeLanguages = []string{"", "go", "javascript", "typescript", "python", "rust", "sql", "shell", "json"}
+
+// codeLanguage describes just enough of a language's syntax to pick
+// out its keywords, types, strings, comments and numbers.
+type codeLanguage struct {
+	extension    string
+	keywords     map[string]bool
+	types        map[string]bool
+	lineComments []string
+	blockComment [2]string
+	// quotes start and end strings; a quote character tripled, as in
+	// Python's """, starts a string that runs to the same triple
+	quotes     string
+	ignoreCase bool
+}
+
+func newCodeLanguage(extension string, keywords string, types string) codeLanguage {
+	set := func(words string) map[string]bool {
+		m := map[string]bool{}
+		for _, word := range strings.Fields(words) {
+			m[word] = true
+		}
+		return m
+	}
+	return codeLanguage{
+		extension:    extension,
+		keywords:     set(keywords),
+		types:        set(types),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+	}
+}
+
+var codeLanguages = map[string]codeLanguage{}
+
+func init() {
+	golang := newCodeLanguage(
+		"go",
+		"break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var",
+		"any bool byte comparable complex64 complex128 error float32 float64 int int8 int16 int32 int64 rune string uint uint8 uint16 uint32 uint64 uintptr true false iota nil append cap clear close copy delete len make max min new panic print println recover",
+	)
+	golang.quotes = "\"'`"
+	codeLanguages["go"] = golang
+
+	javascript := newCodeLanguage(
+		"js",
+		"async await break case catch class const continue debugger default delete do else export extends finally for from function if import in instanceof let new of return static super switch this throw try typeof var void while with yield",
+		"true false null undefined NaN Infinity Array Boolean Date Error JSON Map Math Number Object Promise RegExp Set String Symbol console document window",
+	)
+	javascript.quotes = "\"'`"
+	codeLanguages["javascript"] = javascript
+
+	typescript := newCodeLanguage(
+		"ts",
+		"abstract as async await break case catch class const continue declare default delete do else enum export extends finally for from function if implements import in instanceof interface keyof let namespace new of private protected public readonly return static super switch this throw try type typeof var void while yield",
+		"any boolean never number object string symbol unknown void true false null undefined Array Date Error Map Promise Record Set console",
+	)
+	typescript.quotes = "\"'`"
+	codeLanguages["typescript"] = typescript
+
+	python := newCodeLanguage(
+		"py",
+		"and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield",
+		"True False None bool bytes dict float int list object set str tuple len print range self super type",
+	)
+	python.lineComments = []string{"#"}
+	python.blockComment = [2]string{}
+	codeLanguages["python"] = python
+
+	rust := newCodeLanguage(
+		"rs",
+		"as async await break const continue crate dyn else enum extern fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait type unsafe use where while",
+		"bool char f32 f64 i8 i16 i32 i64 i128 isize str u8 u16 u32 u64 u128 usize true false Some None Ok Err Option Result String Vec Box",
+	)
+	codeLanguages["rust"] = rust
+
+	sql := newCodeLanguage(
+		"sql",
+		"add all alter and as asc begin between by case check commit create cross default delete desc distinct drop else end exists foreign from full group having if in index inner insert into is join key left like limit not null offset on or order outer primary references returning right rollback select set table then transaction trigger union unique update using values view when where with",
+		"integer int text real blob boolean datetime varchar char numeric true false count sum avg min max coalesce",
+	)
+	sql.lineComments = []string{"--"}
+	sql.ignoreCase = true
+	codeLanguages["sql"] = sql
+
+	shell := newCodeLanguage(
+		"sh",
+		"case do done elif else esac export fi for function if in local readonly return set then unset until while",
+		"cd echo exit printf read shift source test true false",
+	)
+	shell.lineComments = []string{"#"}
+	shell.blockComment = [2]string{}
+	codeLanguages["shell"] = shell
+
+	json := newCodeLanguage("json", "", "true false null")
+	json.lineComments = nil
+	json.blockComment = [2]string{}
+	json.quotes = `"`
+	codeLanguages["json"] = json
+}
+
+// validCodeLanguage reports whether language is one of CodeLanguages.
+func validCodeLanguage(language string) bool {
+	for _, l := range CodeLanguages {
+		if l == language {
+			return true
+		}
+	}
+	return false
+}
+
+// codeExtension is the file extension a code block downloads with.
+func codeExtension(language string) string {
+	if lang, ok := codeLanguages[language]; ok {
+		return lang.extension
+	}
+	return "txt"
+}
+
+// highlight renders code as HTML, wrapping each token worth colouring
+// in a <span class="tok-..."> and escaping everything else. Unknown
+// languages, and plain text, are only escaped.
+func highlight(code string, language string) template.HTML {
+	lang, ok := codeLanguages[language]
+	if !ok {
+		return template.HTML(template.HTMLEscapeString(code))
+	}
+
+	var out strings.Builder
+	span := func(class string, text string) {
+		out.WriteString(`<span class="tok-` + class + `">`)
+		out.WriteString(template.HTMLEscapeString(text))
+		out.WriteString(`</span>`)
+	}
+	for i := 0; i < len(code); {
+		rest := code[i:]
+
+		if start := lang.blockComment[0]; start != "" && strings.HasPrefix(rest, start) {
+			end := strings.Index(rest[len(start):], lang.blockComment[1])
+			n := len(rest)
+			if end >= 0 {
+				n = len(start) + end + len(lang.blockComment[1])
+			}
+			span("comment", rest[:n])
+			i += n
+			continue
+		}
+		if lineComment(lang, rest) {
+			n := strings.IndexByte(rest, '\n')
+			if n < 0 {
+				n = len(rest)
+			}
+			span("comment", rest[:n])
+			i += n
+			continue
+		}
+		if strings.IndexByte(lang.quotes, rest[0]) >= 0 {
+			n := stringLength(rest)
+			span("string", rest[:n])
+			i += n
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(rest)
+		prev, _ := utf8.DecodeLastRuneInString(code[:i])
+		if unicode.IsDigit(r) && !isIdentRune(prev) {
+			n := strings.IndexFunc(rest, func(r rune) bool {
+				return !(isIdentRune(r) || r == '.')
+			})
+			if n < 0 {
+				n = len(rest)
+			}
+			span("number", rest[:n])
+			i += n
+			continue
+		}
+		if isIdentRune(r) {
+			n := strings.IndexFunc(rest, func(r rune) bool { return !isIdentRune(r) })
+			if n < 0 {
+				n = len(rest)
+			}
+			word := rest[:n]
+			key := word
+			if lang.ignoreCase {
+				key = strings.ToLower(word)
+			}
+			switch {
+			case lang.keywords[key]:
+				span("keyword", word)
+			case lang.types[key]:
+				span("type", word)
+			default:
+				out.WriteString(template.HTMLEscapeString(word))
+			}
+			i += n
+			continue
+		}
+
+		out.WriteString(template.HTMLEscapeString(rest[:size]))
+		i += size
+	}
+
+	return template.HTML(out.String())
+}
+
+func lineComment(lang codeLanguage, rest string) bool {
+	for _, prefix := range lang.lineComments {
+		if strings.HasPrefix(rest, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// stringLength measures the string literal rest starts with, up to and
+// including its closing quote. Backslashes escape the next character.
+// Strings left open run to the end of the line, or of the code for
+// triple quotes and backticks, which may span lines.
+func stringLength(rest string) int {
+	quote := rest[:1]
+	multiline := quote == "`"
+	if strings.HasPrefix(rest, strings.Repeat(quote, 3)) {
+		quote = rest[:3]
+		multiline = true
+	}
+	for i := len(quote); i < len(rest); i++ {
+		switch {
+		case rest[i] == '\\':
+			i++
+		case rest[i] == '\n' && !multiline:
+			return i
+		case strings.HasPrefix(rest[i:], quote):
+			return i + len(quote)
+		}
+	}
+	return len(rest)
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
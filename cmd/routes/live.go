@@ -0,0 +1,538 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+// LiveMessage goes either way over a note's live socket. Clients send
+// "focus" on opening a block's editor, an "op" for every edit made in it
+// and "blur" on closing it. The server answers "focus" with the block's
+// "doc", applies each op and "ack"s it, hands it on to the block's other
+// editors as an "op" of their own, and tells everyone with the note open
+// who is editing which block with "presence". Blocks are saved once the
+// edits to them pause. What fails comes back as an "error".
+type LiveMessage struct {
+	Type    string       `json:"type"`
+	BlockID int          `json:"block_id,omitempty"`
+	Rev     int          `json:"rev"`
+	Op      TextOp       `json:"op,omitempty"`
+	Content string       `json:"content,omitempty"`
+	Editors []LiveEditor `json:"editors,omitempty"`
+	Status  int          `json:"status,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// LiveEditor is someone editing a block of the note.
+type LiveEditor struct {
+	BlockID  int    `json:"block_id"`
+	Username string `json:"username"`
+}
+
+// MaxLiveHistory is how many of a block's past edits are kept to bring
+// late edits up to date. Editors further behind are sent the block anew.
+const MaxLiveHistory = 500
+
+// LiveSaveDelay is how long a block edited live goes without an edit
+// before it is saved, so a burst of typing is one write, and one entry
+// in the audit log, rather than one a keystroke. A block is saved at
+// once when its last editor leaves it.
+const LiveSaveDelay = 2 * time.Second
+
+type liveNote struct {
+	clients map[*liveClient]bool
+	blocks  map[int]*liveBlock
+}
+
+// liveBlock is a block as its live editors share it: its content at
+// revision rev, with the edits leading there from revision base. saved
+// is the content last written to the blocks table, and the timer saves
+// the rest as the editor who made the last edit. A block is forgotten
+// once it has no editors and nothing left to save.
+type liveBlock struct {
+	id      int
+	noteID  int
+	rev     int
+	base    int
+	content string
+	saved   string
+	history []TextOp
+	editors map[*liveClient]bool
+	userID  int
+	tab     string
+	timer   *time.Timer
+}
+
+type liveClient struct {
+	conn    *websocket.Conn
+	noteID  int
+	user    User
+	tab     string
+	blockID int
+	send    chan LiveMessage
+	// readOnly is set for sockets opened with a read-only API token,
+	// which the GET opening them lets through.
+	readOnly bool
+}
+
+// live holds the notes open over live sockets. Code holding the agent
+// may lock it, but never the other way around.
+var live = struct {
+	sync.Mutex
+	notes map[int]*liveNote
+}{notes: map[int]*liveNote{}}
+
+// GetLiveNote opens a live socket on a note, for editing its blocks
+// together with everyone else who has it open. ?tab names the tab, as
+// TabHeader does for its other requests.
+func GetLiveNote(c echo.Context) error {
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	if _, err = noteRole(note_id); err != nil {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Commit(); err != nil {
+		return err
+	}
+	client := &liveClient{
+		noteID: note_id,
+		user:   c.Get("user").(User),
+		tab:    c.QueryParam("tab"),
+		send:   make(chan LiveMessage, 64),
+
+		readOnly: c.Get("api_token_scope") == "read",
+	}
+	server := websocket.Server{Handshake: sameOrigin, Handler: client.serve}
+
+	// The socket stays open far longer than any request may hold the agent
+	reattach := agent.Detach()
+	defer reattach()
+	server.ServeHTTP(c.Response(), c.Request())
+
+	return nil
+}
+
+// sameOrigin turns away sockets opened by other sites, which browsers
+// would open with the user's cookies.
+func sameOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil || origin.Host != req.Host {
+		return errors.New("websocket: cross-origin request")
+	}
+	config.Origin = origin
+	return nil
+}
+
+// liveContent is what the editors of a block being edited live have
+// typed so far, which is saved shortly.
+func liveContent(note_id int, block_id int) (string, bool) {
+	live.Lock()
+	defer live.Unlock()
+
+	if note := live.notes[note_id]; note != nil {
+		if block := note.blocks[block_id]; block != nil {
+			return block.content, true
+		}
+	}
+	return "", false
+}
+
+// saveLive saves every block edited live without waiting for the edits
+// to pause, for shutting down.
+func saveLive() {
+	live.Lock()
+	blocks := []*liveBlock{}
+	for _, note := range live.notes {
+		for _, shared := range note.blocks {
+			if shared.timer != nil {
+				shared.timer.Stop()
+			}
+			blocks = append(blocks, shared)
+		}
+	}
+	live.Unlock()
+
+	for _, shared := range blocks {
+		shared.save()
+	}
+}
+
+// closeLive closes every live socket.
+func closeLive() {
+	live.Lock()
+	defer live.Unlock()
+
+	for _, note := range live.notes {
+		for client := range note.clients {
+			client.conn.Close()
+		}
+	}
+}
+
+func (client *liveClient) serve(conn *websocket.Conn) {
+	client.conn = conn
+	client.join()
+	defer client.leave()
+
+	go func() {
+		var err error
+		for msg := range client.send {
+			if err == nil {
+				err = websocket.JSON.Send(conn, msg)
+			}
+		}
+	}()
+	for {
+		msg := LiveMessage{}
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return
+		}
+		var err error
+		switch msg.Type {
+		case "focus":
+			err = client.focus(msg.BlockID)
+		case "blur":
+			client.blur()
+		case "op":
+			err = client.edit(msg.BlockID, msg.Rev, msg.Op)
+		default:
+			err = echo.NewHTTPError(400, "Unknown message type "+strconv.Quote(msg.Type))
+		}
+		if err != nil {
+			res := errorResponse(err)
+			live.Lock()
+			client.post(LiveMessage{Type: "error", BlockID: msg.BlockID, Status: res.Status, Error: res.Message})
+			live.Unlock()
+		}
+	}
+}
+
+func (client *liveClient) join() {
+	live.Lock()
+	defer live.Unlock()
+
+	note := live.notes[client.noteID]
+	if note == nil {
+		note = &liveNote{clients: map[*liveClient]bool{}, blocks: map[int]*liveBlock{}}
+		live.notes[client.noteID] = note
+	}
+	note.clients[client] = true
+	note.sendPresence()
+}
+
+func (client *liveClient) leave() {
+	live.Lock()
+	defer live.Unlock()
+
+	note := live.notes[client.noteID]
+	client.stopEditing()
+	delete(note.clients, client)
+	close(client.send)
+	client.conn.Close()
+	if len(note.clients) == 0 {
+		// Blocks still to be saved keep the note until they are
+		if len(note.blocks) == 0 {
+			delete(live.notes, client.noteID)
+		}
+		return
+	}
+	note.sendPresence()
+}
+
+// focus makes the client an editor of block_id and sends it the block.
+func (client *liveClient) focus(block_id int) error {
+	return agent.Run(client.user.ID, client.tab, func() error {
+		block, err := getContentByBlockId(block_id)
+		// Live edits are shared in the clear, between sessions
+		if errors.Is(err, ErrLocked) {
+			return Invalid("Encrypted notes cannot be edited live")
+		}
+		if err != nil {
+			return err
+		}
+		if block.NoteID != client.noteID {
+			return NotFound("Block %d not found", block_id)
+		}
+		if err = client.canEdit(block.NoteID); err != nil {
+			return err
+		}
+		if block.Type == "table" {
+			return Invalid("Tables cannot be edited live")
+		}
+
+		live.Lock()
+		defer live.Unlock()
+
+		client.stopEditing()
+		note := live.notes[client.noteID]
+		shared := note.blocks[block_id]
+		if shared == nil {
+			shared = &liveBlock{
+				id:      block_id,
+				noteID:  block.NoteID,
+				content: block.Content,
+				saved:   block.Content,
+				editors: map[*liveClient]bool{},
+			}
+			note.blocks[block_id] = shared
+		}
+		shared.editors[client] = true
+		client.blockID = block_id
+		if !shared.reload(block.Content) {
+			client.post(shared.doc())
+		}
+		note.sendPresence()
+		return nil
+	})
+}
+
+func (client *liveClient) blur() {
+	live.Lock()
+	defer live.Unlock()
+
+	client.stopEditing()
+	live.notes[client.noteID].sendPresence()
+}
+
+// edit applies an op the client made at revision rev, after the edits
+// others made since, and has the result saved once edits pause.
+func (client *liveClient) edit(block_id int, rev int, op TextOp) error {
+	return agent.Run(client.user.ID, client.tab, func() error {
+		block, err := getContentByBlockId(block_id)
+		if err != nil {
+			return err
+		}
+		if err = client.canEdit(block.NoteID); err != nil {
+			return err
+		}
+
+		live.Lock()
+		defer live.Unlock()
+
+		shared := live.notes[client.noteID].blocks[block_id]
+		if shared == nil || client.blockID != block_id {
+			return Invalid("Block %d is not open for editing", block_id)
+		}
+		// Changed some other way: the op was made on content that is gone
+		if shared.reload(block.Content) {
+			return nil
+		}
+		if rev < shared.base || rev > shared.rev {
+			client.post(shared.doc())
+			return Conflict("Block %d changed too much to catch up with", block_id)
+		}
+		for _, past := range shared.history[rev-shared.base:] {
+			if op, _, err = transformOps(op, past); err != nil {
+				return Invalid("That edit does not fit block %d", block_id)
+			}
+		}
+		content, err := op.Apply(shared.content)
+		if err != nil {
+			return Invalid("That edit does not fit block %d", block_id)
+		}
+
+		shared.content = content
+		shared.userID = client.user.ID
+		shared.tab = client.tab
+		shared.saveAfter(LiveSaveDelay)
+		shared.rev++
+		shared.history = append(shared.history, op)
+		if len(shared.history) > MaxLiveHistory {
+			shared.history = shared.history[1:]
+			shared.base++
+		}
+		client.post(LiveMessage{Type: "ack", BlockID: block_id, Rev: shared.rev})
+		for editor := range shared.editors {
+			if editor != client {
+				editor.post(LiveMessage{Type: "op", BlockID: block_id, Rev: shared.rev, Op: op})
+			}
+		}
+		return nil
+	})
+}
+
+// canEdit is canEdit for the client, which may only read if it opened
+// the socket with a read-only API token.
+func (client *liveClient) canEdit(note_id int) error {
+	if client.readOnly {
+		return Forbidden("This API token is read-only")
+	}
+	return canEdit(note_id)
+}
+
+// stopEditing takes the client off the block it edits, forgetting the
+// block once no one does. It needs live locked.
+func (client *liveClient) stopEditing() {
+	if client.blockID == 0 {
+		return
+	}
+	note := live.notes[client.noteID]
+	if shared := note.blocks[client.blockID]; shared != nil {
+		delete(shared.editors, client)
+		if len(shared.editors) == 0 {
+			if shared.pending() {
+				shared.saveAfter(0)
+			} else {
+				shared.forget()
+			}
+		}
+	}
+	client.blockID = 0
+}
+
+// post queues msg for the client. A client too far behind to take it is
+// disconnected, to join again with the blocks as they are. It needs live
+// locked.
+func (client *liveClient) post(msg LiveMessage) {
+	select {
+	case client.send <- msg:
+	default:
+		client.conn.Close()
+	}
+}
+
+// reload starts the block over from content if it was changed some other
+// way than live, sending it anew to every editor. It needs live locked.
+func (shared *liveBlock) reload(content string) bool {
+	if content == shared.saved {
+		return false
+	}
+	shared.rev++
+	shared.base = shared.rev
+	shared.history = nil
+	shared.content = content
+	shared.saved = content
+	for editor := range shared.editors {
+		editor.post(shared.doc())
+	}
+	return true
+}
+
+// pending reports whether the block has edits left to save. Blocks are
+// never saved empty, as with PutBlock. It needs live locked.
+func (shared *liveBlock) pending() bool {
+	return shared.content != "" && shared.content != shared.saved
+}
+
+// saveAfter has the block saved once it goes delay without another
+// call. It needs live locked.
+func (shared *liveBlock) saveAfter(delay time.Duration) {
+	if shared.timer == nil {
+		shared.timer = time.AfterFunc(delay, shared.save)
+		return
+	}
+	shared.timer.Reset(delay)
+}
+
+// save writes the block's pending edits to the blocks table, and
+// forgets the block if no one edits it any more.
+func (shared *liveBlock) save() {
+	live.Lock()
+	pending, user_id, tab := shared.pending(), shared.userID, shared.tab
+	live.Unlock()
+
+	if pending {
+		if err := agent.Run(user_id, tab, shared.write); err != nil {
+			log.Printf("saving live block %d: %v", shared.id, err)
+		}
+	}
+
+	live.Lock()
+	defer live.Unlock()
+	if len(shared.editors) == 0 {
+		shared.forget()
+	}
+}
+
+func (shared *liveBlock) write() error {
+	block, err := getContentByBlockId(shared.id)
+	if err != nil {
+		return err
+	}
+
+	live.Lock()
+	defer live.Unlock()
+
+	// Changed some other way meanwhile, which wins as it does in edit
+	if shared.reload(block.Content) || !shared.pending() {
+		return nil
+	}
+	if _, err = agent.Exec(
+		`
+            UPDATE blocks
+            SET content = seal($1)
+            WHERE id = $2;
+
+            UPDATE notes
+            SET modified_at = CURRENT_TIMESTAMP
+            WHERE id = $3;
+        `,
+		shared.content,
+		block.ID,
+		block.NoteID,
+	); err != nil {
+		return err
+	}
+	if err = notify("block", block.NoteID); err != nil {
+		return err
+	}
+	if err = agent.Commit(); err != nil {
+		return err
+	}
+	shared.saved = shared.content
+	return nil
+}
+
+// forget drops the block, and its note too once that has neither
+// clients nor blocks. It needs live locked.
+func (shared *liveBlock) forget() {
+	if shared.timer != nil {
+		shared.timer.Stop()
+	}
+	note := live.notes[shared.noteID]
+	if note == nil || note.blocks[shared.id] != shared {
+		return
+	}
+	delete(note.blocks, shared.id)
+	if len(note.clients) == 0 && len(note.blocks) == 0 {
+		delete(live.notes, shared.noteID)
+	}
+}
+
+func (shared *liveBlock) doc() LiveMessage {
+	return LiveMessage{Type: "doc", BlockID: shared.id, Rev: shared.rev, Content: shared.content}
+}
+
+// sendPresence tells each client who else is editing which block. It
+// needs live locked.
+func (note *liveNote) sendPresence() {
+	for client := range note.clients {
+		editors := []LiveEditor{}
+		for other := range note.clients {
+			if other != client && other.blockID != 0 {
+				editors = append(editors, LiveEditor{BlockID: other.blockID, Username: other.user.Username})
+			}
+		}
+		sort.Slice(editors, func(i, j int) bool {
+			if editors[i].BlockID != editors[j].BlockID {
+				return editors[i].BlockID < editors[j].BlockID
+			}
+			return editors[i].Username < editors[j].Username
+		})
+		client.post(LiveMessage{Type: "presence", Editors: editors})
+	}
+}
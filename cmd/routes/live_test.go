@@ -0,0 +1,231 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// openLive opens a live socket on note_id as session, from a page at
+// origin. Sockets close when the test ends.
+func (app *testApp) openLive(srv *httptest.Server, session string, note_id int, origin string) (*websocket.Conn, error) {
+	app.t.Helper()
+
+	target := "ws" + strings.TrimPrefix(srv.URL, "http") + "/notes/" + strconv.Itoa(note_id) + "/live?tab=" + session
+	config, err := websocket.NewConfig(target, origin)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	config.Header.Set("Cookie", (&http.Cookie{Name: SessionCookie, Value: session}).String())
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	app.t.Cleanup(func() { conn.Close() })
+	return conn, nil
+}
+
+// liveServer serves the app for live sockets. Sockets are hijacked, so
+// the server does not wait for them on closing; the test does, before
+// the agent goes away.
+func (app *testApp) liveServer() *httptest.Server {
+	app.t.Cleanup(saveLive)
+	handlers := sync.WaitGroup{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		app.e.ServeHTTP(w, r)
+	}))
+	app.t.Cleanup(handlers.Wait)
+	app.t.Cleanup(srv.Close)
+	app.t.Cleanup(CloseEvents)
+	return srv
+}
+
+// awaitContent waits for the live editors' edits to block_id to be
+// saved as want.
+func (app *testApp) awaitContent(block_id int, want string) {
+	app.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := app.queryString("SELECT content FROM blocks WHERE id = ?", block_id)
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			app.t.Fatalf("content = %q, want %q", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func sendLive(t *testing.T, conn *websocket.Conn, msg LiveMessage) {
+	t.Helper()
+
+	if err := websocket.JSON.Send(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nextLive reads messages until one of msg_type arrives.
+func nextLive(t *testing.T, conn *websocket.Conn, msg_type string) LiveMessage {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg := LiveMessage{}
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			t.Fatalf("waiting for %s: %v", msg_type, err)
+		}
+		if msg.Type == msg_type {
+			return msg
+		}
+	}
+}
+
+func TestLiveEditing(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser(2, "other")
+	app.exec("INSERT INTO collaborators (note_id, user_id, role) VALUES (2, 2, 'editor')")
+	app.exec("UPDATE blocks SET content = 'Hello world' WHERE id = 3")
+	srv := app.liveServer()
+
+	first, err := app.openLive(srv, app.session, 2, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := app.openLive(srv, "other-session", 2, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendLive(t, first, LiveMessage{Type: "focus", BlockID: 3})
+	doc := nextLive(t, first, "doc")
+	if doc.Content != "Hello world" || doc.Rev != 0 {
+		t.Errorf("doc = %q at %d", doc.Content, doc.Rev)
+	}
+	presence := nextLive(t, second, "presence")
+	for len(presence.Editors) == 0 {
+		presence = nextLive(t, second, "presence")
+	}
+	if presence.Editors[0] != (LiveEditor{BlockID: 3, Username: "demo"}) {
+		t.Errorf("presence = %v", presence.Editors)
+	}
+	sendLive(t, second, LiveMessage{Type: "focus", BlockID: 3})
+	nextLive(t, second, "doc")
+	audited := app.queryInt("SELECT COUNT(*) FROM audit_log WHERE entity = 'block' AND entity_id = 3")
+
+	// Both edit revision 0 at once
+	sendLive(t, first, LiveMessage{Type: "op", BlockID: 3, Rev: 0, Op: op(5, ",", 6)})
+	sendLive(t, second, LiveMessage{Type: "op", BlockID: 3, Rev: 0, Op: op(11, "!")})
+	for _, conn := range []*websocket.Conn{first, second} {
+		if ack := nextLive(t, conn, "ack"); ack.Rev < 1 {
+			t.Errorf("ack at %d", ack.Rev)
+		}
+	}
+	// Saved once the edits pause, not an edit at a time
+	if got := app.queryString("SELECT content FROM blocks WHERE id = 3"); got != "Hello world" {
+		t.Errorf("content = %q before the edits paused", got)
+	}
+
+	// Saving the block from the editor only closes it while it is live
+	rec := app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Hello"}, "version": {app.version(3)}})
+	assertStatus(t, rec, 409)
+	// Nor does splitting or merging it write over what is typed live
+	assertStatus(t, app.do(http.MethodPost, "/blocks/3/split", url.Values{"content": {"Hello"}, "offset": {"2"}, "version": {app.version(3)}}), 409)
+	assertStatus(t, app.do(http.MethodPost, "/blocks/4/merge", url.Values{"content": {"Hi"}, "version": {app.version(4)}}), 409)
+	rec = app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Hello"}, "live": {"true"}, "version": {app.version(3)}})
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Hello, world!")
+
+	// Closing the editors saves the block at once
+	sendLive(t, first, LiveMessage{Type: "blur"})
+	sendLive(t, second, LiveMessage{Type: "blur"})
+	app.awaitContent(3, "Hello, world!")
+	if got := app.queryInt("SELECT COUNT(*) FROM audit_log WHERE entity = 'block' AND entity_id = 3"); got != audited+1 {
+		t.Errorf("%d audit entries for the edits, want 1", got-audited)
+	}
+}
+
+func TestLiveEditingForbidden(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser(2, "other")
+	app.exec("INSERT INTO collaborators (note_id, user_id, role) VALUES (2, 2, 'viewer')")
+	srv := app.liveServer()
+
+	conn, err := app.openLive(srv, "other-session", 2, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendLive(t, conn, LiveMessage{Type: "focus", BlockID: 3})
+	if msg := nextLive(t, conn, "error"); msg.Status != 403 {
+		t.Errorf("error = %d %s, want 403", msg.Status, msg.Error)
+	}
+
+	if _, err = app.openLive(srv, "other-session", 5, srv.URL); err == nil {
+		t.Error("opened a note that is not shared")
+	}
+	if _, err = app.openLive(srv, app.session, 2, "http://evil.example"); err == nil {
+		t.Error("opened a socket from another site")
+	}
+}
+
+func TestLiveEditingReadToken(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET content = 'Hello world' WHERE id = 3")
+	read := app.createToken("reader", "read")
+	srv := app.liveServer()
+
+	// Scripts can send any Origin they like
+	target := "ws" + strings.TrimPrefix(srv.URL, "http") + "/notes/2/live"
+	config, err := websocket.NewConfig(target, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Header.Set("Authorization", "Bearer "+read)
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	sendLive(t, conn, LiveMessage{Type: "focus", BlockID: 3})
+	if msg := nextLive(t, conn, "error"); msg.Status != 403 {
+		t.Errorf("focus error = %d %s, want 403", msg.Status, msg.Error)
+	}
+	sendLive(t, conn, LiveMessage{Type: "op", BlockID: 3, Rev: 0, Op: op(11, "!")})
+	if msg := nextLive(t, conn, "error"); msg.Status != 403 {
+		t.Errorf("op error = %d %s, want 403", msg.Status, msg.Error)
+	}
+	if got := app.queryString("SELECT content FROM blocks WHERE id = 3"); got != "Hello world" {
+		t.Errorf("content = %q, want it unchanged", got)
+	}
+}
+
+func TestLiveEditingPause(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET content = 'Hello world' WHERE id = 3")
+	srv := app.liveServer()
+
+	conn, err := app.openLive(srv, app.session, 2, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendLive(t, conn, LiveMessage{Type: "focus", BlockID: 3})
+	nextLive(t, conn, "doc")
+	for rev, insert := range []string{"!", "!", "!"} {
+		sendLive(t, conn, LiveMessage{Type: "op", BlockID: 3, Rev: rev, Op: op(11+rev, insert)})
+		nextLive(t, conn, "ack")
+	}
+
+	// Still open, but saved once the typing stops
+	app.awaitContent(3, "Hello world!!!")
+}
@@ -0,0 +1,47 @@
+package routes
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jadenrose/go-note/cmd/config"
+)
+
+func TestMigrate(t *testing.T) {
+	cfg := config.Default()
+	cfg.DataDir = t.TempDir()
+	Configure(cfg)
+	agent = nil
+	t.Cleanup(func() {
+		agent.Close()
+		agent = nil
+	})
+
+	// Reopening must not run the migrations again
+	for range 2 {
+		if err := Open(); err != nil {
+			t.Fatal(err)
+		}
+		var version int
+		if err := agent.DB.QueryRow("PRAGMA user_version;").Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		if version != len(migrations) {
+			t.Errorf("user_version = %d, want %d", version, len(migrations))
+		}
+		if _, err := agent.DB.Exec("SELECT type FROM blocks; SELECT type FROM blocks_archive;"); err != nil {
+			t.Error(err)
+		}
+		agent.Close()
+	}
+
+	seed, err := os.ReadFile("../../db/notes.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("PRAGMA user_version = %d;", len(migrations)); !strings.Contains(string(seed), want) {
+		t.Errorf("db/notes.sql does not set %q", want)
+	}
+}
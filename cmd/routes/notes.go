@@ -2,18 +2,40 @@ package routes
 
 import (
 	"database/sql"
-	"log"
+	"errors"
 	"strconv"
 
 	"github.com/labstack/echo/v4"
 )
 
+// Note is a titled list of blocks. Todos and TodosDone count its to-do
+// blocks, for the progress shown with its preview. Role is the current
+// user's, "owner" or one of CollaboratorRoles, where it was looked up.
 type Note struct {
-	ID         int
-	Title      string
-	CreatedAt  string
-	ModifiedAt string
-	Blocks     []Block
+	ID            int
+	Title         string
+	CreatedAt     string
+	ModifiedAt    string
+	HideCompleted bool
+	Todos         int
+	TodosDone     int
+	Role          string
+	Version       int
+	// Encrypted notes are Locked until the session unlocks them, and
+	// then have no Blocks.
+	Encrypted bool
+	Locked    bool
+	Blocks    []Block
+}
+
+// CanEdit reports whether the current user may change the note.
+func (n Note) CanEdit() bool {
+	return n.Role == "owner" || n.Role == "editor"
+}
+
+// CanComment reports whether the current user may comment on the note.
+func (n Note) CanComment() bool {
+	return n.CanEdit() || n.Role == "commenter"
 }
 
 type MaybeNote struct {
@@ -43,26 +65,27 @@ func Index(c echo.Context) error {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
 
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
 
 	notes, err := getAllPreviews()
 	if err != nil {
 		return handleError()
 	}
 	if len(notes) > 0 {
-		note, err := getContentByNoteId(notes[0].ID)
-		if err != nil {
+		// A locked note opens with the prompt to unlock it
+		notes[0], err = getContentByNoteId(notes[0].ID)
+		if err != nil && !errors.Is(err, ErrLocked) {
+			return handleError()
+		}
+		if err = agent.Commit(); err != nil {
 			return handleError()
 		}
-		notes[0] = note
 
 		return c.Render(200, "index", notes)
 	}
@@ -78,16 +101,16 @@ func Index(c echo.Context) error {
 func GetPreviewLinks(c echo.Context) error {
 	var err error
 
-	agent := NewDBAgent()
+	if agent == nil {
+		agent = NewDBAgent()
+	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
 	notes, err := getAllPreviews()
 	if err != nil {
 		return handleError()
@@ -107,15 +130,10 @@ func GetNoteContent(c echo.Context) error {
 	}
 	note_id, err := strconv.Atoi(c.Param("note_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param :note_id")
-	}
-	note, err := getContentByNoteId(note_id)
-	if err != nil {
-		log.Panic(err)
-		return c.NoContent(404)
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
 	}
 
-	return c.Render(200, "note-content", note)
+	return renderNote(c, note_id)
 }
 
 func GetTitleEditor(c echo.Context) error {
@@ -123,23 +141,27 @@ func GetTitleEditor(c echo.Context) error {
 
 	note_id, err := strconv.Atoi(c.Param("note_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param :note_id")
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
 	}
 	if agent == nil {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
 	}
-	if err := agent.Open(); err != nil {
+	if err = canEdit(note_id); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
-	row := agent.QueryRow("SELECT id, title FROM notes WHERE id = ?", note_id)
+	row := agent.QueryRow("SELECT id, unseal(title), version FROM notes WHERE id = ?", note_id)
 	note := Note{}
-	if err = row.Scan(&note.ID, &note.Title); err != nil {
+	if err = row.Scan(&note.ID, &note.Title, &note.Version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = NotFound("Note %d not found", note_id)
+		}
 		return handleError()
 	}
 	if err = agent.Commit(); err != nil {
@@ -149,34 +171,56 @@ func GetTitleEditor(c echo.Context) error {
 	return c.Render(200, "title-editor", note)
 }
 
+// PutTitle renames a note. It will not rename over a title newer than the
+// form value version, the one the edit began on, which only API tokens
+// may leave out.
 func PutTitle(c echo.Context) error {
 	var err error
 
 	note_id, err := strconv.Atoi(c.Param("note_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param :note_id")
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
 	}
 	title := c.FormValue("title")
 	if len(title) == 0 {
-		return c.String(422, "Title cannot be empty")
+		return Invalid("Title cannot be empty")
+	}
+	version, err := formVersion(c)
+	if err != nil {
+		return err
 	}
 	if agent == nil {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
-	if _, err := agent.Exec(
+	if err = canEdit(note_id); err != nil {
+		return handleError()
+	}
+	conflict := EditConflict{
+		NoteID: note_id,
+		Target: "/notes/" + strconv.Itoa(note_id),
+		Field:  "title",
+		Yours:  title,
+	}
+	row := agent.QueryRow("SELECT unseal(title), version FROM notes WHERE id = ?", note_id)
+	if err = row.Scan(&conflict.Theirs, &conflict.Version); err != nil {
+		return handleError()
+	}
+	if version != 0 && version != conflict.Version && title != conflict.Theirs {
+		agent.Rollback()
+		return renderConflict(c, conflict)
+	}
+	if _, err = agent.Exec(
 		`
             UPDATE notes
             SET
-                title = ?
+                title = seal(?),
                 modified_at = CURRENT_TIMESTAMP
             WHERE id = ?;
         `,
@@ -185,11 +229,18 @@ func PutTitle(c echo.Context) error {
 	); err != nil {
 		return handleError()
 	}
+	if err = notify("title", note_id); err != nil {
+		return handleError()
+	}
+	note, err := getNotePreview(note_id)
+	if err != nil {
+		return handleError()
+	}
 	if err = agent.Commit(); err != nil {
 		return handleError()
 	}
 
-	return c.Render(200, "replace-title", Note{ID: note_id, Title: title})
+	return c.Render(200, "replace-title", note)
 }
 
 func GetNewNote(c echo.Context) error {
@@ -207,15 +258,13 @@ func PostNote(c echo.Context) error {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
-	res, err := agent.Exec("INSERT INTO notes (title) VALUES (?);", title)
+	res, err := agent.Exec("INSERT INTO notes (title, owner_id) VALUES (seal(?), ?);", title, agent.UserID)
 	if err != nil {
 		return handleError()
 	}
@@ -223,6 +272,9 @@ func PostNote(c echo.Context) error {
 	if err != nil {
 		return handleError()
 	}
+	if err = notify("note", int(new_note_id)); err != nil {
+		return handleError()
+	}
 	if err = archiveOldNotes(); err != nil {
 		return handleError()
 	}
@@ -243,7 +295,7 @@ func PostNote(c echo.Context) error {
 func ShowMoreOptions(c echo.Context) error {
 	note_id, err := strconv.Atoi(c.QueryParam("note_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param ?note_id")
+		return echo.NewHTTPError(400, "Missing or invalid param ?note_id")
 	}
 
 	return c.Render(200, "more-options", Note{ID: note_id})
@@ -252,7 +304,7 @@ func ShowMoreOptions(c echo.Context) error {
 func HideMoreOptions(c echo.Context) error {
 	note_id, err := strconv.Atoi(c.QueryParam("note_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param ?note_id")
+		return echo.NewHTTPError(400, "Missing or invalid param ?note_id")
 	}
 
 	return c.Render(200, "show-more-options", Note{ID: note_id})
@@ -263,20 +315,21 @@ func DeleteNote(c echo.Context) error {
 
 	note_id, err := strconv.Atoi(c.Param("note_id"))
 	if err != nil {
-		return c.String(400, "Missing or invalid param :note_id")
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
 	}
 	if agent == nil {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
+	if err = isOwner(note_id); err != nil {
+		return handleError()
+	}
 
 	if _, err = archiveNoteById(note_id); err != nil {
 		return handleError()
@@ -285,8 +338,11 @@ func DeleteNote(c echo.Context) error {
 	row := agent.QueryRow(
 		`
         SELECT id FROM notes
-        ORDER BY modified_at DESC LIMIT 1;
-        `)
+        WHERE owner_id = ?
+        ORDER BY modified_at DESC, id DESC LIMIT 1;
+        `,
+		agent.UserID,
+	)
 	next_note_id := sql.NullInt64{}
 	if err = row.Scan(&next_note_id); err != nil {
 		if err = agent.Commit(); err != nil {
@@ -312,6 +368,58 @@ func DeleteNote(c echo.Context) error {
 
 }
 
+// GetNoteTitles autocompletes note titles for the note pickers,
+// leaving out ?exclude_note_id.
+func GetNoteTitles(c echo.Context) error {
+	var err error
+
+	title := c.QueryParam("title")
+	exclude_note_id, _ := strconv.Atoi(c.QueryParam("exclude_note_id"))
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	rows, err := agent.Query(
+		`
+            SELECT id, unseal(title) FROM notes
+            WHERE unseal(title) LIKE '%' || ? || '%'
+            AND id != ?
+            AND id IN (
+                SELECT note_id FROM note_access
+                WHERE user_id = ?
+                AND role IN ('owner', 'editor')
+            )
+            ORDER BY modified_at DESC, id DESC
+            LIMIT 10;
+        `,
+		title,
+		exclude_note_id,
+		agent.UserID,
+	)
+	if err != nil {
+		return handleError()
+	}
+	notes := []Note{}
+	for rows.Next() {
+		note := Note{}
+		if err = rows.Scan(&note.ID, &note.Title); err != nil {
+			return handleError()
+		}
+		notes = append(notes, note)
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return c.Render(200, "note-title-options", notes)
+}
+
 func getAllPreviews() ([]Note, error) {
 	notes := []Note{}
 	if agent == nil {
@@ -319,16 +427,27 @@ func getAllPreviews() ([]Note, error) {
 	}
 	rows, err := agent.Query(
 		`
-            SELECT id, title FROM notes
-            ORDER BY modified_at DESC;
+            SELECT
+                n.id,
+                unseal(n.title),
+                COUNT(b.id),
+                COUNT(b.id) FILTER (WHERE b.checked)
+            FROM notes n
+            LEFT JOIN blocks b
+            ON b.note_id = n.id
+            AND b.type = 'todo'
+            WHERE n.owner_id = ?
+            GROUP BY n.id
+            ORDER BY n.modified_at DESC, n.id DESC;
         `,
+		agent.UserID,
 	)
 	if err != nil {
 		return notes, err
 	}
 	for rows.Next() {
 		n := Note{}
-		err = rows.Scan(&n.ID, &n.Title)
+		err = rows.Scan(&n.ID, &n.Title, &n.Todos, &n.TodosDone)
 		if err != nil {
 			return notes, err
 		}
@@ -355,17 +474,30 @@ func getContentByNoteId(note_id int) (Note, error) {
 		`
             SELECT
                 n.id,
-                n.title,
+                unseal(n.title),
+                n.hide_completed,
+                n.key_salt IS NOT NULL,
+                a.role,
                 b.id,
                 b.note_id,
+                b.parent_id,
                 b.sort_order,
-                b.content
+                unseal(b.content),
+                b.type,
+                b.collapsed,
+                b.checked,
+                b.attachment,
+                b.language
             FROM notes n
+            JOIN note_access a
+            ON a.note_id = n.id
+            AND a.user_id = ?
             LEFT JOIN blocks b
             ON b.note_id = n.id
             WHERE n.id = ?
-            ORDER BY sort_order ASC;
+            ORDER BY b.sort_order ASC, b.id ASC;
         `,
+		agent.UserID,
 		note_id,
 	)
 	if err != nil {
@@ -376,10 +508,19 @@ func getContentByNoteId(note_id int) (Note, error) {
 		if err = rows.Scan(
 			&note.ID,
 			&note.Title,
+			&note.HideCompleted,
+			&note.Encrypted,
+			&note.Role,
 			&block.ID,
 			&block.NoteID,
+			&block.ParentID,
 			&block.SortOrder,
 			&block.Content,
+			&block.Type,
+			&block.Collapsed,
+			&block.Checked,
+			&block.Attachment,
+			&block.Language,
 		); err != nil {
 			return handleError()
 		}
@@ -388,6 +529,36 @@ func getContentByNoteId(note_id int) (Note, error) {
 			note.Blocks = append(note.Blocks, block.Value())
 		}
 	}
+	if err = rows.Err(); err != nil {
+		return handleError()
+	}
+	if note.ID == 0 {
+		return note, NotFound("Note %d not found", note_id)
+	}
+	if note.Encrypted {
+		var key []byte
+		key, err = noteKey(note_id)
+		if errors.Is(err, ErrLocked) {
+			note.Locked = true
+			note.Blocks = nil
+			return note, err
+		}
+		if err == nil {
+			err = openBlocks(key, note.Blocks)
+		}
+		if err != nil {
+			return handleError()
+		}
+	}
+	for _, block := range note.Blocks {
+		if block.Type == "todo" {
+			note.Todos++
+			if block.Checked {
+				note.TodosDone++
+			}
+		}
+	}
+	note.Blocks = buildOutline(note.Blocks)
 
 	return note, nil
 }
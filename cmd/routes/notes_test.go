@@ -0,0 +1,298 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	t.Run("opens the most recent note", func(t *testing.T) {
+		app := newTestApp(t)
+
+		rec := app.do(http.MethodGet, "/", nil)
+		assertStatus(t, rec, 200)
+		assertContains(t, rec,
+			"<!doctype html>",
+			`id="preview-1"`,
+			"Note 20: Deployment Plan for Version 2.0",
+			"Monitor post-deployment metrics closely.",
+			// Reloaded on the changes streamed from /events
+			`<body hx-ext="sse" sse-connect="/events?tab=`,
+			`hx-trigger="sse:archive"`,
+		)
+	})
+
+	t.Run("locked note", func(t *testing.T) {
+		app := newTestApp(t)
+		app.encrypt(20, "correct horse")
+		assertStatus(t, app.do(http.MethodPost, "/notes/20/lock", nil), 200)
+
+		rec := app.do(http.MethodGet, "/", nil)
+		assertStatus(t, rec, 200)
+		assertContains(t, rec,
+			"<!doctype html>",
+			"Note 20: Deployment Plan for Version 2.0",
+			`hx-post="/notes/20/unlock"`,
+		)
+	})
+
+	t.Run("no notes", func(t *testing.T) {
+		app := newTestApp(t)
+		app.exec("DELETE FROM notes; DELETE FROM blocks;")
+
+		rec := app.do(http.MethodGet, "/", nil)
+		assertStatus(t, rec, 200)
+		assertContains(t, rec, "no notes yet...")
+	})
+}
+
+func TestGetPreviewLinks(t *testing.T) {
+	app := newTestApp(t)
+
+	rec := app.do(http.MethodGet, "/preview-links", nil)
+	assertStatus(t, rec, 200)
+	if got := strings.Count(rec.Body.String(), `class="preview"`); got != 20 {
+		t.Errorf("rendered %d previews, want 20", got)
+	}
+	if strings.Index(rec.Body.String(), "Note 20:") > strings.Index(rec.Body.String(), "Note 19:") {
+		t.Error("previews are not sorted most recent first")
+	}
+}
+
+func TestMoreOptions(t *testing.T) {
+	app := newTestApp(t)
+
+	tests := []struct {
+		target string
+		status int
+		want   string
+	}{
+		{"/more-options/show?note_id=3", 200, `id="more-options-3"`},
+		{"/more-options/hide?note_id=3", 200, `id="preview-more-options-3"`},
+		{"/more-options/show?note_id=x", 400, "Missing or invalid param ?note_id"},
+		{"/more-options/hide", 400, "Missing or invalid param ?note_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			rec := app.do(http.MethodGet, tt.target, nil)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+		})
+	}
+}
+
+func TestGetNoteContent(t *testing.T) {
+	app := newTestApp(t)
+
+	tests := []struct {
+		target string
+		status int
+		want   []string
+	}{
+		{"/notes/2", 200, []string{
+			"Note 2: Ideas for New Features",
+			`id="block-container-3"`,
+			`id="block-container-5"`,
+		}},
+		{"/notes/999", 404, []string{"Note 999 not found"}},
+		{"/notes/abc", 400, []string{"Missing or invalid param :note_id"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			rec := app.do(http.MethodGet, tt.target, nil)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want...)
+		})
+	}
+}
+
+func TestGetTitleEditor(t *testing.T) {
+	app := newTestApp(t)
+
+	tests := []struct {
+		target string
+		status int
+		want   string
+	}{
+		{"/notes/3/edit", 200, `value="Note 3: Client Feedback"`},
+		{"/notes/999/edit", 404, "Note 999 not found"},
+		{"/notes/abc/edit", 400, "Missing or invalid param :note_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			rec := app.do(http.MethodGet, tt.target, nil)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+		})
+	}
+}
+
+func TestPutTitle(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		title  string
+		status int
+		want   string
+	}{
+		{"renames", "/notes/3", "Renamed", 200, `hx-swap-oob="true"`},
+		{"empty title", "/notes/3", "", 422, "Title cannot be empty"},
+		{"missing note", "/notes/999", "Renamed", 404, "Note 999 not found"},
+		{"invalid id", "/notes/abc", "Renamed", 400, "Missing or invalid param :note_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			rec := app.do(http.MethodPut, tt.target, url.Values{"title": {tt.title}, "version": {"1"}})
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+
+			want := "Note 3: Client Feedback"
+			if tt.status == 200 {
+				want = tt.title
+			}
+			if got := app.queryString("SELECT title FROM notes WHERE id = 3"); got != want {
+				t.Errorf("title = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestGetNewNote(t *testing.T) {
+	app := newTestApp(t)
+
+	rec := app.do(http.MethodGet, "/notes/new", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `hx-post="/notes"`)
+}
+
+func TestPostNote(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		want  string
+	}{
+		{"titled", "Groceries", "Groceries"},
+		{"untitled", "", "Untitled Note"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			rec := app.do(http.MethodPost, "/notes", url.Values{"title": {tt.title}})
+			assertStatus(t, rec, 200)
+			assertContains(t, rec, tt.want, `hx-post="/blocks?note_id=21"`, `id="preview-21"`)
+
+			if got := app.queryString("SELECT title FROM notes WHERE id = 21"); got != tt.want {
+				t.Errorf("title = %q, want %q", got, tt.want)
+			}
+			// The seed is at the archive limit, so the oldest note is archived
+			if got := app.queryInt("SELECT COUNT(*) FROM notes"); got != 20 {
+				t.Errorf("notes = %d, want 20", got)
+			}
+			if got := app.queryInt("SELECT COUNT(*) FROM notes WHERE id = 1"); got != 0 {
+				t.Error("note 1 was not archived")
+			}
+		})
+	}
+}
+
+func TestArchiveOldNotes(t *testing.T) {
+	tests := []struct {
+		notes    int
+		archived int
+	}{
+		{19, 0},
+		{20, 0},
+		{21, 1},
+		{25, 5},
+	}
+	t.Run("archive turned off", func(t *testing.T) {
+		app := newTestApp(t)
+		settings.Features.Archive = false
+
+		assertStatus(t, app.do(http.MethodPost, "/notes", url.Values{"title": {"Kept"}}), 200)
+		if got := app.queryInt("SELECT COUNT(*) FROM notes"); got != 21 {
+			t.Errorf("notes = %d, want 21", got)
+		}
+		if got := app.queryInt("SELECT COUNT(*) FROM notes_archive"); got != 5 {
+			t.Errorf("archived %d notes, want 5", got)
+		}
+	})
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d notes", tt.notes), func(t *testing.T) {
+			app := newTestApp(t)
+			app.exec("DELETE FROM notes WHERE id > ?", tt.notes)
+			for id := 21; id <= tt.notes; id++ {
+				app.exec("INSERT INTO notes (id, title, owner_id) VALUES (?, 'extra', 1)", id)
+			}
+
+			agent.UserID = 1
+			if err := archiveOldNotes(); err != nil {
+				t.Fatal(err)
+			}
+			if err := agent.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := app.queryInt("SELECT COUNT(*) FROM notes_archive"); got != 5+tt.archived {
+				t.Errorf("archived %d notes, want %d", got-5, tt.archived)
+			}
+			kept := min(tt.notes, settings.ArchiveLimit)
+			if got := app.queryInt("SELECT COUNT(*) FROM notes"); got != kept {
+				t.Errorf("kept %d notes, want %d", got, kept)
+			}
+			// The oldest notes go first
+			if tt.archived > 0 {
+				assertInts(t, "oldest kept note",
+					app.queryInts("SELECT MIN(id) FROM notes"),
+					[]int{tt.archived + 1},
+				)
+			}
+		})
+	}
+}
+
+func TestDeleteNote(t *testing.T) {
+	t.Run("archives the note and opens the next", func(t *testing.T) {
+		app := newTestApp(t)
+
+		rec := app.do(http.MethodDelete, "/notes/20", nil)
+		assertStatus(t, rec, 200)
+		assertContains(t, rec, `id="main-container" hx-swap-oob="true"`, "Note 19: Final Presentation Slides")
+
+		if got := app.queryInt("SELECT COUNT(*) FROM notes WHERE id = 20"); got != 0 {
+			t.Error("note 20 was not deleted")
+		}
+		if got := app.queryInt("SELECT COUNT(*) FROM blocks WHERE note_id = 20"); got != 0 {
+			t.Errorf("%d blocks left behind", got)
+		}
+		archived := app.queryInt("SELECT id FROM notes_archive WHERE title LIKE 'Note 20:%'")
+		if got := app.queryInt("SELECT COUNT(*) FROM blocks_archive WHERE note_id = ?", archived); got != 4 {
+			t.Errorf("archived %d blocks, want 4", got)
+		}
+	})
+
+	t.Run("last note", func(t *testing.T) {
+		app := newTestApp(t)
+		app.exec("DELETE FROM notes WHERE id > 1")
+
+		rec := app.do(http.MethodDelete, "/notes/1", nil)
+		assertStatus(t, rec, 200)
+		assertContains(t, rec, "no notes yet...")
+	})
+
+	t.Run("missing note", func(t *testing.T) {
+		app := newTestApp(t)
+
+		rec := app.do(http.MethodDelete, "/notes/999", nil)
+		assertStatus(t, rec, 404)
+		if got := app.queryInt("SELECT COUNT(*) FROM notes_archive"); got != 5 {
+			t.Errorf("archive has %d notes, want 5", got)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package routes
+
+import "database/sql"
+
+// SortGap is the space left between neighbouring blocks' sort_order, so
+// a block can be moved or inserted between two others by giving it the
+// midpoint of their keys instead of renumbering the whole note.
+//
+// sort_order only orders siblings: the blocks of a note sharing a
+// parent_id, where 0 stands for the top level.
+const SortGap = 1024
+
+// getBlockIds lists the children of parent_id in display order.
+func getBlockIds(note_id int, parent_id int) ([]int, error) {
+	rows, err := agent.Query(
+		`
+            SELECT id FROM blocks
+            WHERE note_id = ?
+            AND parent_id IS ?
+            ORDER BY sort_order ASC, id ASC;
+        `,
+		note_id,
+		nullId(parent_id),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// sortOrderAt returns a sort_order that puts a block at position among
+// the children of parent_id, skipping block_id itself so a block can be
+// placed relative to its current neighbours. When two neighbours have
+// no room left between them the siblings are rebalanced first.
+func sortOrderAt(note_id int, parent_id int, block_id int, position int) (int, error) {
+	rows, err := agent.Query(
+		`
+            SELECT sort_order FROM blocks
+            WHERE note_id = ?
+            AND parent_id IS ?
+            AND id != ?
+            ORDER BY sort_order ASC, id ASC
+            LIMIT 2 OFFSET ?;
+        `,
+		note_id,
+		nullId(parent_id),
+		block_id,
+		max(position-1, 0),
+	)
+	if err != nil {
+		return 0, err
+	}
+	neighbours := []int{}
+	for rows.Next() {
+		var sort_order int
+		if err = rows.Scan(&sort_order); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		neighbours = append(neighbours, sort_order)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if position == 0 {
+		if len(neighbours) == 0 {
+			return SortGap, nil
+		}
+		return neighbours[0] - SortGap, nil
+	}
+	if len(neighbours) == 0 {
+		// position is past the last of parent_id's children
+		return lastSortOrderAt(note_id, parent_id, block_id)
+	}
+	if len(neighbours) == 1 {
+		return neighbours[0] + SortGap, nil
+	}
+
+	before, after := neighbours[0], neighbours[1]
+	if after-before < 2 {
+		if err = rebalanceBlocks(note_id, parent_id); err != nil {
+			return 0, err
+		}
+		return sortOrderAt(note_id, parent_id, block_id, position)
+	}
+
+	return before + (after-before)/2, nil
+}
+
+// lastSortOrderAt returns a sort_order after every child of parent_id
+// but block_id, or SortGap when there are none.
+func lastSortOrderAt(note_id int, parent_id int, block_id int) (int, error) {
+	var last sql.NullInt64
+	row := agent.QueryRow(
+		`
+            SELECT MAX(sort_order) FROM blocks
+            WHERE note_id = ?
+            AND parent_id IS ?
+            AND id != ?;
+        `,
+		note_id,
+		nullId(parent_id),
+		block_id,
+	)
+	if err := row.Scan(&last); err != nil {
+		return 0, err
+	}
+	if !last.Valid {
+		return SortGap, nil
+	}
+	return int(last.Int64) + SortGap, nil
+}
+
+// rebalanceBlocks spreads the sort_order keys of parent_id's children
+// SortGap apart again, keeping their order. Only needed once repeated
+// moves into the same gap have used it up.
+func rebalanceBlocks(note_id int, parent_id int) error {
+	ids, err := getBlockIds(note_id, parent_id)
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		if _, err = agent.Exec(
+			`
+                UPDATE blocks
+                SET sort_order = ?
+                WHERE id = ?;
+            `,
+			(i+1)*SortGap,
+			id,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func indexOf(ids []int, id int) int {
+	for i := range ids {
+		if ids[i] == id {
+			return i
+		}
+	}
+	return -1
+}
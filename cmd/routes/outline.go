@@ -0,0 +1,419 @@
+package routes
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// IndentBlock makes a block the last child of the sibling above it.
+func IndentBlock(c echo.Context) error {
+	block_id, err := strconv.Atoi(c.Param("block_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
+	}
+	block, err := getContentByBlockId(block_id)
+	if err != nil {
+		return err
+	}
+	if err = canEdit(block.NoteID); err != nil {
+		return err
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	ids, err := getBlockIds(block.NoteID, block.ParentID)
+	if err != nil {
+		return handleError()
+	}
+	index := indexOf(ids, block.ID)
+	if index == 0 {
+		agent.Rollback()
+		return Invalid("There is no block above this one to indent under")
+	}
+	parent_id := ids[index-1]
+	children, err := getBlockIds(block.NoteID, parent_id)
+	if err != nil {
+		return handleError()
+	}
+	sort_order, err := sortOrderAt(block.NoteID, parent_id, block.ID, len(children))
+	if err != nil {
+		return handleError()
+	}
+	// Open the new parent up so the block stays in view
+	if _, err = agent.Exec(
+		`
+            UPDATE blocks
+            SET
+                parent_id = $1,
+                sort_order = $2
+            WHERE id = $3;
+
+            UPDATE blocks
+            SET collapsed = FALSE
+            WHERE id = $1;
+        `,
+		parent_id,
+		sort_order,
+		block.ID,
+	); err != nil {
+		return handleError()
+	}
+
+	return renderOutline(c, block.NoteID)
+}
+
+// OutdentBlock moves a block out of its parent to directly below it.
+func OutdentBlock(c echo.Context) error {
+	block_id, err := strconv.Atoi(c.Param("block_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
+	}
+	block, err := getContentByBlockId(block_id)
+	if err != nil {
+		return err
+	}
+	if err = canEdit(block.NoteID); err != nil {
+		return err
+	}
+	if block.ParentID == 0 {
+		return Invalid("Cannot outdent a top level block")
+	}
+	parent, err := getContentByBlockId(block.ParentID)
+	if err != nil {
+		return err
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	ids, err := getBlockIds(parent.NoteID, parent.ParentID)
+	if err != nil {
+		return handleError()
+	}
+	sort_order, err := sortOrderAt(parent.NoteID, parent.ParentID, block.ID, indexOf(ids, parent.ID)+1)
+	if err != nil {
+		return handleError()
+	}
+	if _, err = agent.Exec(
+		`
+            UPDATE blocks
+            SET
+                parent_id = $1,
+                sort_order = $2
+            WHERE id = $3;
+        `,
+		nullId(parent.ParentID),
+		sort_order,
+		block.ID,
+	); err != nil {
+		return handleError()
+	}
+
+	return renderOutline(c, block.NoteID)
+}
+
+// CollapseBlock hides or shows a block's children, as given by
+// ?collapsed.
+func CollapseBlock(c echo.Context) error {
+	block_id, err := strconv.Atoi(c.Param("block_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
+	}
+	collapsed, err := strconv.ParseBool(c.QueryParam("collapsed"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param ?collapsed")
+	}
+	block, err := getContentByBlockId(block_id)
+	if err != nil {
+		return err
+	}
+	if err = canEdit(block.NoteID); err != nil {
+		return err
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if _, err = agent.Exec(
+		`
+            UPDATE blocks
+            SET collapsed = ?
+            WHERE id = ?;
+        `,
+		collapsed,
+		block.ID,
+	); err != nil {
+		return handleError()
+	}
+
+	return renderOutline(c, block.NoteID)
+}
+
+// renderOutline marks the note modified, commits and renders its blocks.
+func renderOutline(c echo.Context, note_id int) error {
+	var err error
+
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = touchNotes([]int{note_id}); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	note, err := getContentByNoteId(note_id)
+	if err != nil {
+		return handleError()
+	}
+
+	return c.Render(200, "blocks", note)
+}
+
+// nullId stores a parent_id of 0, the top level, as NULL.
+func nullId(id int) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// buildOutline nests blocks under their parents. blocks must be in
+// sibling order; any whose parent is missing stay at the top level.
+func buildOutline(blocks []Block) []Block {
+	present := map[int]bool{}
+	for _, block := range blocks {
+		present[block.ID] = true
+	}
+	children := map[int][]Block{}
+	for _, block := range blocks {
+		parent_id := block.ParentID
+		if !present[parent_id] {
+			parent_id = 0
+		}
+		children[parent_id] = append(children[parent_id], block)
+	}
+
+	var nest func(parent_id int) []Block
+	nest = func(parent_id int) []Block {
+		level := children[parent_id]
+		for i := range level {
+			level[i].Children = nest(level[i].ID)
+		}
+		return level
+	}
+	return nest(0)
+}
+
+// flattenOutline lists an outline's blocks top to bottom, leaving out
+// the children of collapsed blocks unless hidden is set.
+func flattenOutline(outline []Block, hidden bool) []Block {
+	blocks := []Block{}
+	for _, block := range outline {
+		blocks = append(blocks, block)
+		if hidden || !block.Collapsed {
+			blocks = append(blocks, flattenOutline(block.Children, hidden)...)
+		}
+	}
+	return blocks
+}
+
+// getDescendantIds lists every block below block_ids in the outline,
+// not including block_ids themselves.
+func getDescendantIds(block_ids []int) ([]int, error) {
+	in, args := inClause(block_ids)
+	rows, err := agent.Query(
+		`
+            WITH RECURSIVE descendants (id) AS (
+                SELECT id FROM blocks
+                WHERE parent_id IN `+in+`
+                UNION
+                SELECT b.id FROM blocks b
+                JOIN descendants d
+                ON b.parent_id = d.id
+            )
+            SELECT id FROM descendants;
+        `,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// deleteBlockTrees deletes block_ids along with everything below them.
+func deleteBlockTrees(block_ids []int) error {
+	in, args := inClause(block_ids)
+	_, err := agent.Exec(
+		`
+            WITH RECURSIVE tree (id) AS (
+                SELECT id FROM blocks
+                WHERE id IN `+in+`
+                UNION
+                SELECT b.id FROM blocks b
+                JOIN tree t
+                ON b.parent_id = t.id
+            )
+            DELETE FROM blocks
+            WHERE id IN (SELECT id FROM tree);
+        `,
+		args...,
+	)
+	return err
+}
+
+// getBlockTree loads a note's outline from table, either blocks or
+// blocks_archive.
+func getBlockTree(table string, note_id int) ([]Block, error) {
+	rows, err := agent.Query(
+		`
+            SELECT
+                id,
+                note_id,
+                COALESCE(parent_id, 0),
+                sort_order,
+                unseal(content),
+                type,
+                collapsed,
+                checked,
+                COALESCE(attachment, ''),
+                language
+            FROM `+table+`
+            WHERE note_id = ?
+            ORDER BY sort_order ASC, id ASC;
+        `,
+		note_id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blocks := []Block{}
+	for rows.Next() {
+		block := Block{}
+		if err = rows.Scan(
+			&block.ID,
+			&block.NoteID,
+			&block.ParentID,
+			&block.SortOrder,
+			&block.Content,
+			&block.Type,
+			&block.Collapsed,
+			&block.Checked,
+			&block.Attachment,
+			&block.Language,
+		); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return buildOutline(blocks), nil
+}
+
+// insertBlockTree inserts blocks and their children into table under
+// parent_id of note_id. Every block gets a new id, so parent_id is
+// mapped onto the copies as it goes.
+func insertBlockTree(table string, note_id int, parent_id int, blocks []Block) error {
+	for _, block := range blocks {
+		res, err := agent.Exec(
+			`
+                INSERT INTO `+table+` (
+                    note_id,
+                    parent_id,
+                    sort_order,
+                    content,
+                    type,
+                    collapsed,
+                    checked,
+                    attachment,
+                    language
+                )
+                VALUES (?, ?, ?, seal(?), ?, ?, ?, ?, ?);
+            `,
+			note_id,
+			nullId(parent_id),
+			block.SortOrder,
+			block.Content,
+			block.Type,
+			block.Collapsed,
+			block.Checked,
+			nullAttachment(block.Attachment),
+			block.Language,
+		)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if err = insertBlockTree(table, note_id, int(id), block.Children); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getNoteBlock loads a block that other blocks of note_id are being
+// placed relative to, failing validation unless it is in that note.
+func getNoteBlock(note_id int, block_id int) (Block, error) {
+	blocks, err := getBlocksById([]int{block_id})
+	if errors.Is(err, ErrNotFound) || (err == nil && blocks[0].NoteID != note_id) {
+		return Block{}, Invalid("Block %d is not in this note", block_id)
+	}
+	if err != nil {
+		return Block{}, err
+	}
+	return blocks[0], nil
+}
+
+// findBlock looks a block up anywhere in an outline.
+func findBlock(outline []Block, block_id int) (Block, bool) {
+	for _, block := range flattenOutline(outline, true) {
+		if block.ID == block_id {
+			return block, true
+		}
+	}
+	return Block{}, false
+}
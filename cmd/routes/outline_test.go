@@ -0,0 +1,236 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// children lists a block's children in display order, or a note's top
+// level blocks when parent_id is 0.
+func (app *testApp) children(note_id int, parent_id int) []int {
+	app.t.Helper()
+
+	return app.queryInts(
+		"SELECT id FROM blocks WHERE note_id = ? AND parent_id IS ? ORDER BY sort_order, id",
+		note_id,
+		nullId(parent_id),
+	)
+}
+
+func TestIndentBlock(t *testing.T) {
+	t.Run("under the sibling above", func(t *testing.T) {
+		app := newTestApp(t)
+
+		rec := app.do(http.MethodPut, "/blocks/4/indent", nil)
+		assertStatus(t, rec, 200)
+		assertContains(t, rec, `id="block-children-3"`, `id="block-container-4"`)
+		assertInts(t, "top level", app.children(2, 0), []int{3, 5})
+		assertInts(t, "block 3", app.children(2, 3), []int{4})
+
+		// Indented blocks go last under the sibling above
+		assertStatus(t, app.do(http.MethodPut, "/blocks/5/indent", nil), 200)
+		assertInts(t, "block 3", app.children(2, 3), []int{4, 5})
+
+		assertStatus(t, app.do(http.MethodPut, "/blocks/5/indent", nil), 200)
+		assertInts(t, "block 3", app.children(2, 3), []int{4})
+		assertInts(t, "block 4", app.children(2, 4), []int{5})
+
+		rec = app.do(http.MethodPut, "/blocks/3/indent", nil)
+		assertStatus(t, rec, 422)
+		assertContains(t, rec, "There is no block above this one to indent under")
+	})
+
+	t.Run("expands a collapsed parent", func(t *testing.T) {
+		app := newTestApp(t)
+		app.exec("UPDATE blocks SET collapsed = TRUE WHERE id = 3")
+
+		assertStatus(t, app.do(http.MethodPut, "/blocks/4/indent", nil), 200)
+		if got := app.queryInt("SELECT collapsed FROM blocks WHERE id = 3"); got != 0 {
+			t.Error("block 3 is still collapsed")
+		}
+	})
+}
+
+func TestOutdentBlock(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET parent_id = 3 WHERE id IN (4, 5)")
+
+	rec := app.do(http.MethodPut, "/blocks/4/outdent", nil)
+	assertStatus(t, rec, 200)
+	// Outdented blocks land right below their old parent
+	assertInts(t, "top level", app.children(2, 0), []int{3, 4})
+	assertInts(t, "block 3", app.children(2, 3), []int{5})
+
+	rec = app.do(http.MethodPut, "/blocks/3/outdent", nil)
+	assertStatus(t, rec, 422)
+	assertContains(t, rec, "Cannot outdent a top level block")
+}
+
+func TestCollapseBlock(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET parent_id = 3 WHERE id = 4")
+
+	rec := app.do(http.MethodPut, "/blocks/3/collapse?collapsed=true", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "block-collapse collapsed", `hx-put="/blocks/3/collapse?collapsed=false"`)
+	if strings.Contains(rec.Body.String(), `id="block-container-4"`) {
+		t.Error("collapsed block still shows its children")
+	}
+
+	rec = app.do(http.MethodPut, "/blocks/3/collapse?collapsed=false", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `id="block-container-4"`)
+
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3/collapse?collapsed=maybe", nil), 400)
+	assertStatus(t, app.do(http.MethodPut, "/blocks/999/collapse?collapsed=true", nil), 404)
+}
+
+func TestMoveNestedBlock(t *testing.T) {
+	t.Run("carries children", func(t *testing.T) {
+		app := newTestApp(t)
+		app.exec("UPDATE blocks SET parent_id = 3 WHERE id = 4")
+
+		assertStatus(t, app.do(http.MethodPut, "/blocks/3/move?position=1", nil), 200)
+		assertInts(t, "top level", app.children(2, 0), []int{5, 3})
+		assertInts(t, "block 3", app.children(2, 3), []int{4})
+	})
+
+	t.Run("into another parent", func(t *testing.T) {
+		app := newTestApp(t)
+
+		assertStatus(t, app.do(http.MethodPut, "/blocks/3/move?position=0&parent_id=5", nil), 200)
+		assertInts(t, "top level", app.children(2, 0), []int{4, 5})
+		assertInts(t, "block 5", app.children(2, 5), []int{3})
+
+		// Placing after a block takes that block's parent
+		assertStatus(t, app.do(http.MethodPut, "/blocks/4/move?after_block_id=3", nil), 200)
+		assertInts(t, "block 5", app.children(2, 5), []int{3, 4})
+	})
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"after a child", "after_block_id=4"},
+		{"under a child", "position=0&parent_id=4"},
+		{"under itself", "position=0&parent_id=3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.exec("UPDATE blocks SET parent_id = 3 WHERE id = 4")
+
+			rec := app.do(http.MethodPut, "/blocks/3/move?"+tt.query, nil)
+			assertStatus(t, rec, 422)
+			assertContains(t, rec, "Cannot move a block inside itself")
+			assertInts(t, "block 3", app.children(2, 3), []int{4})
+		})
+	}
+}
+
+func TestNestedBlockTrees(t *testing.T) {
+	nest := func(app *testApp) {
+		app.exec("UPDATE blocks SET parent_id = 3 WHERE id = 4")
+	}
+
+	t.Run("delete removes children", func(t *testing.T) {
+		app := newTestApp(t)
+		nest(app)
+
+		assertStatus(t, app.do(http.MethodDelete, "/blocks/3", nil), 200)
+		assertInts(t, "note 2", app.blockOrder(2), []int{5})
+	})
+
+	t.Run("bulk delete removes children", func(t *testing.T) {
+		app := newTestApp(t)
+		nest(app)
+
+		rec := app.do(http.MethodDelete, "/blocks?block_id=3", nil)
+		assertStatus(t, rec, 200)
+		assertInts(t, "note 2", app.blockOrder(2), []int{5})
+	})
+
+	t.Run("transfer moves children", func(t *testing.T) {
+		app := newTestApp(t)
+		nest(app)
+
+		form := url.Values{"mode": {"move"}, "note_id": {"3"}, "block_id": {"3"}}
+		assertStatus(t, app.do(http.MethodPost, "/blocks/transfer", form), 200)
+		assertInts(t, "note 3", app.children(3, 0), []int{6, 7, 3})
+		assertInts(t, "block 3", app.children(3, 3), []int{4})
+		assertInts(t, "note 2", app.blockOrder(2), []int{5})
+	})
+
+	t.Run("transfer copies children", func(t *testing.T) {
+		app := newTestApp(t)
+		nest(app)
+
+		// Selecting a child along with its parent copies it once
+		form := url.Values{"mode": {"copy"}, "note_id": {"3"}, "block_id": {"3", "4"}}
+		assertStatus(t, app.do(http.MethodPost, "/blocks/transfer", form), 200)
+		assertInts(t, "note 3", app.children(3, 0), []int{6, 7, 57})
+		assertInts(t, "block 57", app.children(3, 57), []int{58})
+		assertInts(t, "block 3", app.children(2, 3), []int{4})
+	})
+
+	t.Run("export nests list items", func(t *testing.T) {
+		app := newTestApp(t)
+		nest(app)
+
+		rec := app.do(http.MethodGet, "/blocks/export?block_id=3&block_id=5", nil)
+		assertStatus(t, rec, 200)
+		want := "- Adding user notifications will increase engagement significantly.\n" +
+			"  - We should integrate a task management feature.\n\n"
+		if got := rec.Body.String(); !strings.HasPrefix(got, want) {
+			t.Errorf("export = %q, want it to start with %q", got, want)
+		}
+	})
+
+	t.Run("split leaves children with the first half", func(t *testing.T) {
+		app := newTestApp(t)
+		nest(app)
+
+		form := url.Values{"content": {"Adding user notifications will increase engagement."}, "offset": {"6"}, "version": {"1"}}
+		assertStatus(t, app.do(http.MethodPost, "/blocks/3/split", form), 200)
+		assertInts(t, "top level", app.children(2, 0), []int{3, 57, 5})
+		assertInts(t, "block 3", app.children(2, 3), []int{4})
+	})
+
+	t.Run("merge goes into the block above on screen", func(t *testing.T) {
+		app := newTestApp(t)
+		nest(app)
+
+		assertStatus(t, app.do(http.MethodPost, "/blocks/5/merge", url.Values{"content": {"Done."}, "version": {app.version(5)}}), 200)
+		assertInts(t, "note 2", app.blockOrder(2), []int{3, 4})
+		if got := app.queryString("SELECT content FROM blocks WHERE id = 4"); got != "We should integrate a task management feature. Done." {
+			t.Errorf("merged content = %q", got)
+		}
+	})
+
+	t.Run("archive keeps nesting", func(t *testing.T) {
+		app := newTestApp(t)
+		app.exec("UPDATE blocks SET parent_id = 53 WHERE id = 54; UPDATE blocks SET parent_id = 54 WHERE id = 55")
+
+		assertStatus(t, app.do(http.MethodDelete, "/notes/20", nil), 200)
+		archived := app.queryInt("SELECT id FROM notes_archive WHERE title LIKE 'Note 20:%'")
+		rec := app.do(http.MethodGet, "/archive/"+strconv.Itoa(archived), nil)
+		assertStatus(t, rec, 200)
+		if got := strings.Count(rec.Body.String(), `class="block-children"`); got != 2 {
+			t.Errorf("archived note renders %d nested levels, want 2", got)
+		}
+
+		assertStatus(t, app.do(http.MethodPost, "/archive/"+strconv.Itoa(archived), nil), 200)
+		note_id := app.queryInt("SELECT id FROM notes WHERE title LIKE 'Note 20:%'")
+		top := app.children(note_id, 0)
+		if len(top) != 2 {
+			t.Fatalf("restored top level = %v, want 2 blocks", top)
+		}
+		child := app.children(note_id, top[0])
+		if len(child) != 1 || len(app.children(note_id, child[0])) != 1 {
+			t.Error("restored note lost its nesting")
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package routes
+
+import "github.com/labstack/echo/v4"
+
+// Register adds every route to e, skipping those behind a disabled
+// feature toggle. Everything past the account pages and share links
+// needs a signed in user.
+func Register(e *echo.Echo) {
+	e.GET("/login", GetLogin)
+	e.POST("/login", PostLogin)
+	e.GET("/signup", GetSignup)
+	e.POST("/signup", PostSignup)
+	e.POST("/logout", PostLogout)
+
+	e.GET("/s/:token", GetSharedNote)
+	e.POST("/s/:token", PostSharePassword)
+	e.GET("/s/:token/content", GetSharedNoteContent)
+	e.GET("/s/:token/attachments/:hash", GetSharedAttachment)
+	e.GET("/s/:token/attachments/:hash/thumbnail", GetSharedThumbnail)
+
+	app := e.Group("", Authenticate)
+	app.GET("/", Index)
+	app.GET("/events", GetEvents)
+
+	app.GET("/preview-links", GetPreviewLinks)
+	app.GET("/more-options/show", ShowMoreOptions)
+	app.GET("/more-options/hide", HideMoreOptions)
+	app.DELETE("/notes/:note_id", DeleteNote)
+
+	app.GET("/notes/new", GetNewNote)
+	app.POST("/notes", PostNote)
+	app.GET("/notes/:note_id", GetNoteContent)
+	app.GET("/notes/:note_id/edit", GetTitleEditor)
+	app.GET("/notes/:note_id/live", GetLiveNote)
+	app.PUT("/notes/:note_id", PutTitle)
+	app.GET("/notes/titles", GetNoteTitles)
+	app.PUT("/notes/:note_id/hide-completed", HideCompleted)
+	app.PUT("/notes/:note_id/sink-completed", SinkCompleted)
+	app.GET("/notes/:note_id/shares", GetShares)
+	app.POST("/notes/:note_id/shares", PostShare)
+	app.DELETE("/notes/:note_id/shares/:share_id", DeleteShare)
+	app.GET("/notes/:note_id/comments", GetComments)
+	app.POST("/notes/:note_id/comments", PostComment)
+	app.DELETE("/comments/:comment_id", DeleteComment)
+	app.GET("/notes/:note_id/collaborators", GetCollaborators)
+	app.POST("/notes/:note_id/collaborators", PostCollaborator)
+	app.PUT("/notes/:note_id/collaborators/:user_id", PutCollaborator)
+	app.DELETE("/notes/:note_id/collaborators/:user_id", DeleteCollaborator)
+	app.GET("/notes/shared", GetSharedPreviews)
+	app.GET("/notes/:note_id/encryption", GetEncryption)
+	app.POST("/notes/:note_id/encryption", PostEncryption)
+	app.DELETE("/notes/:note_id/encryption", DeleteEncryption)
+	app.POST("/notes/:note_id/unlock", PostUnlock)
+	app.POST("/notes/:note_id/lock", PostLock)
+
+	app.GET("/blocks/new", GetNewBlock)
+	app.GET("/blocks/:block_id/edit", GetBlockEditor)
+	app.GET("/blocks/:block_id/move", GetBlockMover)
+	app.GET("/blocks/:block_id/move/cancel", CancelBlockMover)
+	app.GET("/blocks/:block_id/transfer", GetBlockTransfer)
+	app.POST("/blocks", PostBlock)
+	app.PUT("/blocks/:block_id", PutBlock)
+	app.PUT("/blocks/:block_id/move", MoveBlock)
+	app.POST("/blocks/:block_id/split", SplitBlock)
+	app.POST("/blocks/:block_id/merge", MergeBlock)
+	app.PUT("/blocks/:block_id/indent", IndentBlock)
+	app.PUT("/blocks/:block_id/outdent", OutdentBlock)
+	app.PUT("/blocks/:block_id/collapse", CollapseBlock)
+	app.PUT("/blocks/:block_id/check", CheckBlock)
+	app.PUT("/blocks/:block_id/language", PutBlockLanguage)
+	app.GET("/blocks/:block_id/raw", GetRawBlock)
+	app.PUT("/blocks/:block_id/cells", PutTableCell)
+	app.POST("/blocks/:block_id/rows", PostTableRow)
+	app.DELETE("/blocks/:block_id/rows", DeleteTableRow)
+	app.POST("/blocks/:block_id/columns", PostTableColumn)
+	app.DELETE("/blocks/:block_id/columns", DeleteTableColumn)
+	app.PUT("/blocks/:block_id/sort", SortTable)
+	app.DELETE("/blocks/:block_id", DeleteBlock)
+	app.POST("/blocks/transfer", TransferBlocks)
+	app.PUT("/blocks/type", PutBlockTypes)
+	app.DELETE("/blocks", DeleteBlocks)
+	app.GET("/blocks/export", ExportBlocks)
+
+	app.GET("/todos", GetOpenTodos)
+
+	app.GET("/tokens", GetTokens)
+	app.POST("/tokens", PostToken)
+	app.DELETE("/tokens/:token_id", DeleteToken)
+
+	app.GET("/audit", GetAudit)
+	app.GET("/audit/export", ExportAudit)
+
+	app.POST("/attachments", PostAttachments)
+	app.GET("/attachments/:hash", GetAttachment)
+	app.GET("/attachments/:hash/thumbnail", GetThumbnail)
+
+	if settings.Features.Archive {
+		app.GET("/archive", GetArchiveList)
+		app.GET("/archive/:archived_note_id", GetArchivedNote)
+		app.POST("/archive/:archived_note_id", RestoreArchivedNote)
+		app.DELETE("/archive/all", ClearArchive)
+	}
+
+	if settings.Features.Search {
+		app.POST("/search", QuickSearch)
+	}
+}
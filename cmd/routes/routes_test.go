@@ -0,0 +1,209 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	gonote "github.com/jadenrose/go-note"
+	"github.com/jadenrose/go-note/cmd/assets"
+	"github.com/jadenrose/go-note/cmd/config"
+	"github.com/labstack/echo/v4"
+)
+
+// testApp is the echo app wired up as in main, backed by a fresh
+// database in a temp dir seeded from db/notes.sql.
+//
+// The seed has notes 1-20 (note 2 holds blocks 3, 4 and 5, note 5 holds
+// blocks 11-14, note 20 holds blocks 53-56) and archived notes 1-5 with
+// four blocks each. All seeded notes share a modified_at, so ties are
+// broken by id and note 20 counts as the most recent. Everything belongs
+// to user 1, who requests are signed in as.
+type testApp struct {
+	t       *testing.T
+	e       *echo.Echo
+	session string
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.DataDir = t.TempDir()
+	Configure(cfg)
+
+	agent = nil
+	hub = NewHub()
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		agent.Close()
+		agent = nil
+	})
+
+	seed, err := os.ReadFile("../../db/notes.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = agent.DB.Exec(string(seed)); err != nil {
+		t.Fatal(err)
+	}
+
+	static, err := assets.New(gonote.FS, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Renderer = NewTemplates(cfg, gonote.FS, static)
+	e.HTTPErrorHandler = HandleError
+	e.Use(Serialize)
+	Register(e)
+
+	app := &testApp{t: t, e: e, session: "test-session"}
+	app.exec(
+		"INSERT INTO sessions (token_hash, user_id, expires_at) VALUES (?, 1, '9999-12-31 00:00:00')",
+		hashToken(app.session),
+	)
+
+	return app
+}
+
+// serve sends req signed in with the app's session, if there is one.
+func (app *testApp) serve(req *http.Request) *httptest.ResponseRecorder {
+	if app.session != "" {
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: app.session})
+	}
+	rec := httptest.NewRecorder()
+	app.e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// do sends an HTMX request, form encoding form as the body if given.
+func (app *testApp) do(method string, target string, form url.Values) *httptest.ResponseRecorder {
+	app.t.Helper()
+
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	}
+	req.Header.Set("HX-Request", "true")
+
+	return app.serve(req)
+}
+
+func (app *testApp) queryInt(query string, args ...any) int {
+	app.t.Helper()
+
+	var n int
+	if err := agent.DB.QueryRow(query, args...).Scan(&n); err != nil {
+		app.t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+func (app *testApp) queryString(query string, args ...any) string {
+	app.t.Helper()
+
+	var s string
+	if err := agent.DB.QueryRow(query, args...).Scan(&s); err != nil {
+		app.t.Fatalf("%s: %v", query, err)
+	}
+	return s
+}
+
+// version is the version of block_id the app's editors send with edits,
+// 1 for blocks that don't exist.
+func (app *testApp) version(block_id int) string {
+	app.t.Helper()
+
+	return app.queryString("SELECT COALESCE((SELECT version FROM blocks WHERE id = ?), 1)", block_id)
+}
+
+func (app *testApp) queryInts(query string, args ...any) []int {
+	app.t.Helper()
+
+	rows, err := agent.DB.Query(query, args...)
+	if err != nil {
+		app.t.Fatalf("%s: %v", query, err)
+	}
+	defer rows.Close()
+	ints := []int{}
+	for rows.Next() {
+		var n int
+		if err = rows.Scan(&n); err != nil {
+			app.t.Fatal(err)
+		}
+		ints = append(ints, n)
+	}
+	return ints
+}
+
+func (app *testApp) exec(query string, args ...any) {
+	app.t.Helper()
+
+	if _, err := agent.DB.Exec(query, args...); err != nil {
+		app.t.Fatalf("%s: %v", query, err)
+	}
+}
+
+// blockOrder lists a note's block ids in display order.
+func (app *testApp) blockOrder(note_id int) []int {
+	app.t.Helper()
+
+	return app.queryInts(
+		"SELECT id FROM blocks WHERE note_id = ? ORDER BY sort_order",
+		note_id,
+	)
+}
+
+func assertStatus(t *testing.T, rec *httptest.ResponseRecorder, want int) {
+	t.Helper()
+
+	if rec.Code != want {
+		t.Fatalf("status = %d, want %d\n%s", rec.Code, want, rec.Body.String())
+	}
+}
+
+func assertContains(t *testing.T, rec *httptest.ResponseRecorder, fragments ...string) {
+	t.Helper()
+
+	body := rec.Body.String()
+	for _, fragment := range fragments {
+		if !strings.Contains(body, fragment) {
+			t.Errorf("body is missing %q\n%s", fragment, body)
+		}
+	}
+}
+
+func assertInts(t *testing.T, name string, got []int, want []int) {
+	t.Helper()
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %v, want %v", name, got, want)
+	}
+}
+
+func TestHandleError(t *testing.T) {
+	app := newTestApp(t)
+
+	t.Run("htmx requests get a fragment", func(t *testing.T) {
+		rec := app.do(http.MethodGet, "/notes/999", nil)
+		assertStatus(t, rec, 404)
+		assertContains(t, rec, `class="error"`, "Note 999 not found")
+		if got := rec.Header().Get("HX-Retarget"); got != "#errors" {
+			t.Errorf("HX-Retarget = %q, want #errors", got)
+		}
+	})
+
+	t.Run("other requests get json", func(t *testing.T) {
+		rec := app.serve(httptest.NewRequest(http.MethodGet, "/notes/999", nil))
+		assertStatus(t, rec, 404)
+		assertContains(t, rec, `{"status":404,"error":"Note 999 not found"}`)
+	})
+}
@@ -1,8 +1,6 @@
 package routes
 
 import (
-	"log"
-
 	"github.com/labstack/echo/v4"
 )
 
@@ -29,21 +27,21 @@ func QuickSearch(c echo.Context) error {
 		agent = NewDBAgent()
 	}
 	handleError := func() error {
-		log.Panic(err)
 		agent.Rollback()
-		return c.NoContent(500)
+		return err
 	}
 
 	if err = agent.Open(); err != nil {
 		return handleError()
 	}
-	defer agent.Close()
 	rows, err := agent.Query(
 		`
         SELECT note_id, title, content
-        FROM quick_search($1);
+        FROM quick_search($1)
+        WHERE note_id IN (SELECT note_id FROM note_access WHERE user_id = $2);
         `,
 		search_term,
+		agent.UserID,
 	)
 	if err != nil {
 		return handleError()
@@ -0,0 +1,32 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestQuickSearch(t *testing.T) {
+	app := newTestApp(t)
+
+	tests := []struct {
+		term   string
+		status int
+		want   []string
+	}{
+		{"deployment", 200, []string{
+			`data-search-term="deployment"`,
+			"Note 20: Deployment Plan for Version 2.0",
+		}},
+		{"Client Feedback", 200, []string{"Note 3: Client Feedback"}},
+		{"xyzzy", 200, []string{"No results"}},
+		{"", 200, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.term, func(t *testing.T) {
+			rec := app.do(http.MethodPost, "/search", url.Values{"search-term": {tt.term}})
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want...)
+		})
+	}
+}
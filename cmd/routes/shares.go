@@ -0,0 +1,491 @@
+package routes
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Share is a public, read-only link to a note. Anyone with the token
+// can view the note as it is now, without logging in, until the link
+// expires or is revoked. The token is kept as is, unlike session and API
+// tokens, since it is meant to be handed out again.
+type Share struct {
+	ID        int
+	NoteID    int
+	Token     string
+	Password  bool
+	ExpiresAt string
+	CreatedAt string
+
+	ownerID      int
+	passwordHash string
+	expired      bool
+}
+
+// ShareList is a note's share links, for the share panel. BaseURL is
+// where this server was reached, to spell the links out in full.
+type ShareList struct {
+	Note    Note
+	Shares  []Share
+	BaseURL string
+}
+
+// SharePage is a shared note as its visitors see it. Locked is set
+// until the link's password has been given.
+type SharePage struct {
+	Token  string
+	Note   Note
+	Locked bool
+}
+
+// GetShares lists a note's share links.
+func GetShares(c echo.Context) error {
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	if err = isOwner(note_id); err != nil {
+		return err
+	}
+	note, err := getContentByNoteId(note_id)
+	if err != nil {
+		return err
+	}
+	shares, err := getShares(note_id)
+	if err != nil {
+		return err
+	}
+
+	return c.Render(200, "shares", ShareList{Note: note, Shares: shares, BaseURL: baseURL(c)})
+}
+
+// PostShare creates a share link for a note, expiring after the form
+// value expires_in and locked with the form value password, if given.
+func PostShare(c echo.Context) error {
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	expires_at := sql.NullString{}
+	if expires_in := c.FormValue("expires_in"); expires_in != "" {
+		lifetime, err := time.ParseDuration(expires_in)
+		if err != nil || lifetime <= 0 {
+			return echo.NewHTTPError(400, "Missing or invalid param expires_in")
+		}
+		expires_at.String = time.Now().UTC().Add(lifetime).Format(time.DateTime)
+		expires_at.Valid = true
+	}
+	password_hash := sql.NullString{}
+	if password := c.FormValue("password"); password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		password_hash.String = string(hash)
+		password_hash.Valid = true
+	}
+	if err = isOwner(note_id); err != nil {
+		return err
+	}
+	note, err := getContentByNoteId(note_id)
+	if err != nil {
+		return err
+	}
+	if note.Encrypted {
+		return Invalid("Encrypted notes cannot be shared by link")
+	}
+	secret := make([]byte, 24)
+	if _, err = rand.Read(secret); err != nil {
+		return err
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if _, err = agent.Exec(
+		`
+            INSERT INTO shares (note_id, token, password_hash, expires_at)
+            VALUES (?, ?, ?, ?);
+        `,
+		note_id,
+		base64.RawURLEncoding.EncodeToString(secret),
+		password_hash,
+		expires_at,
+	); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	shares, err := getShares(note_id)
+	if err != nil {
+		return err
+	}
+
+	return c.Render(200, "shares", ShareList{Note: note, Shares: shares, BaseURL: baseURL(c)})
+}
+
+// DeleteShare revokes a share link. Visitors who have it open are
+// turned away at their next refresh.
+func DeleteShare(c echo.Context) error {
+	var err error
+
+	note_id, err := strconv.Atoi(c.Param("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :note_id")
+	}
+	share_id, err := strconv.Atoi(c.Param("share_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :share_id")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	res, err := agent.Exec(
+		`
+            DELETE FROM shares
+            WHERE id = ?
+            AND note_id = ?
+            AND note_id IN (SELECT id FROM notes WHERE owner_id = ?);
+        `,
+		share_id,
+		note_id,
+		agent.UserID,
+	)
+	if err != nil {
+		return handleError()
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = NotFound("Share link %d not found", share_id)
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return c.NoContent(200)
+}
+
+// GetSharedNote is the public page of a share link, or its password
+// prompt.
+func GetSharedNote(c echo.Context) error {
+	share, err := getShare(c.Param("token"))
+	if err != nil {
+		return err
+	}
+	page := SharePage{Token: share.Token, Locked: !shareUnlocked(c, share)}
+	if !page.Locked {
+		if page.Note, err = getSharedNote(share); err != nil {
+			return err
+		}
+	}
+
+	return c.Render(200, "share-page", page)
+}
+
+// GetSharedNoteContent is polled by an open share page, so it follows
+// edits to the note. Once the link stops working the page is reloaded
+// to say so.
+func GetSharedNoteContent(c echo.Context) error {
+	share, err := getShare(c.Param("token"))
+	if err != nil {
+		c.Response().Header().Set("HX-Refresh", "true")
+		return err
+	}
+	if !shareUnlocked(c, share) {
+		c.Response().Header().Set("HX-Refresh", "true")
+		return echo.NewHTTPError(401, "This share link needs a password")
+	}
+	note, err := getSharedNote(share)
+	if err != nil {
+		c.Response().Header().Set("HX-Refresh", "true")
+		return err
+	}
+
+	return c.Render(200, "readonly-note-content", note)
+}
+
+// GetSharedAttachment serves an attachment of a shared note, as
+// GetAttachment does to signed in users.
+func GetSharedAttachment(c echo.Context) error {
+	attachment, err := getSharedAttachment(c)
+	if err != nil {
+		return err
+	}
+
+	return serveAttachment(c, attachment, attachmentPath(attachment.Hash))
+}
+
+// GetSharedThumbnail serves the thumbnail of an image in a shared note.
+func GetSharedThumbnail(c echo.Context) error {
+	attachment, err := getSharedAttachment(c)
+	if err != nil {
+		return err
+	}
+
+	return serveThumbnail(c, attachment)
+}
+
+// PostSharePassword unlocks a share link for the browser giving its
+// password.
+func PostSharePassword(c echo.Context) error {
+	share, err := getShare(c.Param("token"))
+	if err != nil {
+		return err
+	}
+	if !share.Password {
+		return redirect(c, "/s/"+share.Token)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(share.passwordHash), []byte(c.FormValue("password"))) != nil {
+		return echo.NewHTTPError(401, "Wrong password")
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     shareCookie(share),
+		Value:    shareKey(share),
+		Path:     "/s/" + share.Token,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return redirect(c, "/s/"+share.Token)
+}
+
+// getShare looks up a working share link by its token.
+func getShare(token string) (Share, error) {
+	var err error
+
+	share := Share{}
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() (Share, error) {
+		agent.Rollback()
+		return share, err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	row := agent.QueryRow(
+		`
+            SELECT
+                s.id,
+                s.note_id,
+                s.token,
+                COALESCE(s.password_hash, ''),
+                COALESCE(s.expires_at <= CURRENT_TIMESTAMP, FALSE),
+                n.owner_id
+            FROM shares s
+            JOIN notes n
+            ON n.id = s.note_id
+            WHERE s.token = ?;
+        `,
+		token,
+	)
+	if err = row.Scan(
+		&share.ID,
+		&share.NoteID,
+		&share.Token,
+		&share.passwordHash,
+		&share.expired,
+		&share.ownerID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = NotFound("Share link not found")
+		}
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	if share.expired {
+		return share, echo.NewHTTPError(410, "This share link has expired")
+	}
+	share.Password = share.passwordHash != ""
+
+	return share, nil
+}
+
+// getSharedNote loads a shared note on behalf of its owner, its
+// attachments linked through the share.
+func getSharedNote(share Share) (Note, error) {
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	agent.UserID = share.ownerID
+	defer func() { agent.UserID = 0 }()
+
+	note, err := getContentByNoteId(share.NoteID)
+	if err != nil {
+		return note, err
+	}
+	shareBlocks(note.Blocks, "/s/"+share.Token)
+
+	return note, nil
+}
+
+func shareBlocks(blocks []Block, url string) {
+	for i := range blocks {
+		blocks[i].shareURL = url
+		shareBlocks(blocks[i].Children, url)
+	}
+}
+
+// getSharedAttachment gets the attachment :hash if a block of the note
+// shared by :token holds it, and the browser may see that note.
+func getSharedAttachment(c echo.Context) (Attachment, error) {
+	var err error
+
+	attachment := Attachment{}
+	hash := c.Param("hash")
+	if !hashPattern.MatchString(hash) {
+		return attachment, echo.NewHTTPError(400, "Missing or invalid param :hash")
+	}
+	share, err := getShare(c.Param("token"))
+	if err != nil {
+		return attachment, err
+	}
+	if !shareUnlocked(c, share) {
+		return attachment, echo.NewHTTPError(401, "This share link needs a password")
+	}
+
+	handleError := func() (Attachment, error) {
+		agent.Rollback()
+		return attachment, err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	// Encrypted notes cannot be shared, so neither are their attachments
+	row := agent.QueryRow(
+		`
+            SELECT hash, unseal(mime_type), size
+            FROM attachments a
+            WHERE hash = $1
+            AND NOT encrypted
+            AND EXISTS (
+                SELECT 1 FROM blocks
+                WHERE note_id = $2
+                AND attachment = a.hash
+            );
+        `,
+		hash,
+		share.NoteID,
+	)
+	if err = row.Scan(&attachment.Hash, &attachment.MimeType, &attachment.Size); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = NotFound("Attachment %s not found", hash)
+		}
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return attachment, nil
+}
+
+func getShares(note_id int) ([]Share, error) {
+	var err error
+
+	shares := []Share{}
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() ([]Share, error) {
+		agent.Rollback()
+		return shares, err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	rows, err := agent.Query(
+		`
+            SELECT
+                id,
+                note_id,
+                token,
+                password_hash IS NOT NULL,
+                COALESCE(expires_at, ''),
+                created_at
+            FROM shares
+            WHERE note_id = ?
+            ORDER BY created_at DESC, id DESC;
+        `,
+		note_id,
+	)
+	if err != nil {
+		return handleError()
+	}
+	for rows.Next() {
+		share := Share{}
+		if err = rows.Scan(
+			&share.ID,
+			&share.NoteID,
+			&share.Token,
+			&share.Password,
+			&share.ExpiresAt,
+			&share.CreatedAt,
+		); err != nil {
+			rows.Close()
+			return handleError()
+		}
+		shares = append(shares, share)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return shares, nil
+}
+
+// shareUnlocked reports whether the browser may see a share link's note:
+// always without a password, and otherwise once it was given.
+func shareUnlocked(c echo.Context, share Share) bool {
+	if !share.Password {
+		return true
+	}
+	cookie, err := c.Cookie(shareCookie(share))
+	return err == nil && cookie.Value == shareKey(share)
+}
+
+func baseURL(c echo.Context) string {
+	return c.Scheme() + "://" + c.Request().Host
+}
+
+func shareCookie(share Share) string {
+	return "share_" + strconv.Itoa(share.ID)
+}
+
+// shareKey proves a browser knew a share link's password. It derives
+// from the password's hash, which never leaves the server.
+func shareKey(share Share) string {
+	return hashToken(share.Token + ":" + share.passwordHash)
+}
@@ -0,0 +1,184 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// createShare makes a share link for note_id and returns its token.
+func (app *testApp) createShare(note_id int, form url.Values) string {
+	app.t.Helper()
+
+	before := app.queryInt("SELECT COUNT(*) FROM shares")
+	rec := app.do(http.MethodPost, "/notes/"+strconv.Itoa(note_id)+"/shares", form)
+	assertStatus(app.t, rec, 200)
+	if got := app.queryInt("SELECT COUNT(*) FROM shares"); got != before+1 {
+		app.t.Fatalf("shares = %d, want %d", got, before+1)
+	}
+	return app.queryString("SELECT token FROM shares ORDER BY id DESC LIMIT 1")
+}
+
+// visit requests a share page as a visitor who is not logged in,
+// sending along cookies it was given.
+func (app *testApp) visit(method string, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	app.t.Helper()
+
+	session := app.session
+	app.session = ""
+	defer func() { app.session = session }()
+
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	}
+	req.Header.Set("Accept", "text/html")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	return app.serve(req)
+}
+
+func TestShareNote(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.createShare(2, nil)
+	if len(token) < 32 {
+		t.Errorf("token %q is too short to be unguessable", token)
+	}
+	rec := app.do(http.MethodGet, "/notes/2/shares", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "http://example.com/s/"+token, "never expires")
+
+	rec = app.visit(http.MethodGet, "/s/"+token, nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec,
+		`class="title readonly"`,
+		"Adding user notifications will increase engagement significantly.",
+		`hx-get="/s/`+token+`/content"`,
+	)
+
+	// Later edits show up in the live view
+	app.exec("UPDATE blocks SET content = 'Edited after sharing' WHERE id = 3")
+	rec = app.visit(http.MethodGet, "/s/"+token+"/content", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Edited after sharing")
+
+	share_id := app.queryInt("SELECT id FROM shares WHERE token = ?", token)
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2/shares/"+strconv.Itoa(share_id), nil), 200)
+	rec = app.visit(http.MethodGet, "/s/"+token, nil)
+	assertStatus(t, rec, 404)
+	assertContains(t, rec, "Share link not found")
+	rec = app.visit(http.MethodGet, "/s/"+token+"/content", nil)
+	assertStatus(t, rec, 404)
+	if got := rec.Header().Get("HX-Refresh"); got != "true" {
+		t.Errorf("HX-Refresh = %q, want true", got)
+	}
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2/shares/"+strconv.Itoa(share_id), nil), 404)
+}
+
+func TestShareExpiry(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.createShare(2, url.Values{"expires_in": {"24h"}})
+	assertStatus(t, app.visit(http.MethodGet, "/s/"+token, nil), 200)
+
+	app.exec("UPDATE shares SET expires_at = '2000-01-01 00:00:00'")
+	rec := app.visit(http.MethodGet, "/s/"+token, nil)
+	assertStatus(t, rec, 410)
+	assertContains(t, rec, "This share link has expired")
+
+	rec = app.do(http.MethodPost, "/notes/2/shares", url.Values{"expires_in": {"-1h"}})
+	assertStatus(t, rec, 400)
+	assertContains(t, rec, "Missing or invalid param expires_in")
+}
+
+func TestSharePassword(t *testing.T) {
+	app := newTestApp(t)
+	token := app.createShare(2, url.Values{"password": {"open sesame"}})
+
+	rec := app.visit(http.MethodGet, "/s/"+token, nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, `name="password"`)
+	if body := rec.Body.String(); strings.Contains(body, "Adding user notifications") {
+		t.Error("a locked share showed its note")
+	}
+	assertStatus(t, app.visit(http.MethodGet, "/s/"+token+"/content", nil), 401)
+
+	rec = app.visit(http.MethodPost, "/s/"+token, url.Values{"password": {"guess"}})
+	assertStatus(t, rec, 401)
+	assertContains(t, rec, "Wrong password")
+
+	rec = app.visit(http.MethodPost, "/s/"+token, url.Values{"password": {"open sesame"}})
+	assertStatus(t, rec, 303)
+	var unlocked *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "share_"+strconv.Itoa(app.queryInt("SELECT id FROM shares")) {
+			unlocked = cookie
+		}
+	}
+	if unlocked == nil {
+		t.Fatal("no cookie unlocked the share")
+	}
+	rec = app.visit(http.MethodGet, "/s/"+token, nil, unlocked)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Adding user notifications will increase engagement significantly.")
+
+	forged := &http.Cookie{Name: unlocked.Name, Value: hashToken(token + ":")}
+	assertStatus(t, app.visit(http.MethodGet, "/s/"+token+"/content", nil, forged), 401)
+}
+
+func TestShareOwnership(t *testing.T) {
+	app := newTestApp(t)
+	token := app.createShare(2, nil)
+	app.exec("INSERT INTO users (id, username, password_hash) VALUES (2, 'other', '')")
+	app.exec("INSERT INTO sessions (token_hash, user_id, expires_at) VALUES (?, 2, '9999-12-31 00:00:00')", hashToken("other-session"))
+	app.session = "other-session"
+
+	share_id := app.queryInt("SELECT id FROM shares WHERE token = ?", token)
+	assertStatus(t, app.do(http.MethodGet, "/notes/2/shares", nil), 404)
+	assertStatus(t, app.do(http.MethodPost, "/notes/2/shares", nil), 404)
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2/shares/"+strconv.Itoa(share_id), nil), 404)
+
+	// Archiving a note takes its links down
+	app.session = "test-session"
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2", nil), 200)
+	assertStatus(t, app.visit(http.MethodGet, "/s/"+token, nil), 404)
+}
+
+func TestShareAttachments(t *testing.T) {
+	app := newTestApp(t)
+	picture := testPNG(t, 40, 20)
+	other := []byte("attached to another note")
+	app.upload("/attachments?note_id=2", nil, map[string][]byte{"picture.png": picture})
+	app.upload("/attachments?note_id=3", nil, map[string][]byte{"other.txt": other})
+	token := app.createShare(2, url.Values{"password": {"open sesame"}})
+	url_for := func(hash string) string {
+		return "/s/" + token + "/attachments/" + hash
+	}
+
+	assertStatus(t, app.visit(http.MethodGet, url_for(hashOf(picture)), nil), 401)
+	rec := app.visit(http.MethodPost, "/s/"+token, url.Values{"password": {"open sesame"}})
+	cookies := rec.Result().Cookies()
+
+	rec = app.visit(http.MethodGet, "/s/"+token, nil, cookies...)
+	assertContains(t, rec, `src="`+url_for(hashOf(picture))+`/thumbnail"`)
+	rec = app.visit(http.MethodGet, url_for(hashOf(picture)), nil, cookies...)
+	assertStatus(t, rec, 200)
+	if got := rec.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	assertStatus(t, app.visit(http.MethodGet, url_for(hashOf(picture))+"/thumbnail", nil, cookies...), 200)
+
+	// Only what the shared note holds
+	assertStatus(t, app.visit(http.MethodGet, url_for(hashOf(other)), nil, cookies...), 404)
+	assertStatus(t, app.visit(http.MethodGet, url_for("not-a-hash"), nil, cookies...), 400)
+
+	app.exec("UPDATE shares SET expires_at = '2000-01-01 00:00:00'")
+	assertStatus(t, app.visit(http.MethodGet, url_for(hashOf(picture)), nil, cookies...), 410)
+}
@@ -0,0 +1,396 @@
+package routes
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/jadenrose/go-note/cmd/config"
+	"modernc.org/sqlite"
+)
+
+// A database encrypted at rest keeps note titles and block contents,
+// archived or not, sealed row by row with a data key, and attachments
+// sealed file by file, named by a hash keyed with it. The data key is
+// kept in store_key sealed under the store key from key_file or
+// GONOTE_KEY, and only ever opened in memory. Queries read and write
+// those columns through the seal and unseal SQL functions, which leave
+// values as they are while the database is not encrypted.
+//
+// quick_search would hold the plaintext, so encrypted databases index
+// notes in a TEMP table instead, rebuilt whenever the database is opened.
+// Ids, timestamps, accounts and the hashes and sizes of attachments are
+// not encrypted. The titles and contents kept in the audit log and the
+// types of attachments are sealed like the rest.
+
+// dataKey opens and seals values for seal and unseal, nil while the
+// database is not encrypted at rest. Open sets it before any request.
+var dataKey []byte
+
+var ErrWrongKey = errors.New("wrong key for the encrypted database")
+
+func init() {
+	sqlite.MustRegisterScalarFunction("seal", 1, storeFunc(sealContent))
+	sqlite.MustRegisterScalarFunction("unseal", 1, storeFunc(openContent))
+}
+
+// storeFunc makes a SQL function applying fn with dataKey to text.
+func storeFunc(fn func(key []byte, value string) (string, error)) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		value, ok := args[0].(string)
+		if !ok || dataKey == nil {
+			return args[0], nil
+		}
+		return fn(dataKey, value)
+	}
+}
+
+// openStore opens the data key with key, which Open read from the
+// config. A database first opened with a key is encrypted there and then;
+// one opened without the key it was encrypted with is refused.
+func openStore(db *sql.DB, key []byte) error {
+	dataKey = nil
+
+	var wrapped string
+	var files_sealed bool
+	err := db.QueryRow("SELECT data_key, files_sealed FROM store_key").Scan(&wrapped, &files_sealed)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) && key == nil:
+		return nil
+	case errors.Is(err, sql.ErrNoRows):
+		if err = resealStore(db, key); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case key == nil:
+		return errors.New("the database is encrypted; set key_file or " + config.Prefix + "KEY")
+	default:
+		opened, err := openContent(key, wrapped)
+		if err != nil {
+			return ErrWrongKey
+		}
+		dataKey = []byte(opened)
+		// Stores encrypted before attachments were have them sealed now
+		if !files_sealed {
+			return resealStore(db, key)
+		}
+	}
+
+	return indexInMemory(db)
+}
+
+// resealStore seals every title, block content and attachment with a new
+// data key, kept sealed under key, opening them with the current data key
+// if the database is already encrypted.
+func resealStore(db *sql.DB, key []byte) error {
+	next := make([]byte, config.KeySize)
+	if _, err := rand.Read(next); err != nil {
+		return err
+	}
+	wrapped, err := sealContent(key, string(next))
+	if err != nil {
+		return err
+	}
+
+	if _, err = db.Exec(dropSearchIndex); err != nil {
+		return err
+	}
+	defer pauseAudit()()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Attachments are not sealed yet in stores encrypted before they were
+	var files_sealed bool
+	err = tx.QueryRow("SELECT files_sealed FROM store_key").Scan(&files_sealed)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	files := dataKey
+	if !files_sealed {
+		files = nil
+	}
+
+	for _, column := range []struct {
+		table, name, where string
+		from               []byte
+	}{
+		{"notes", "title", "TRUE", dataKey},
+		{"blocks", "content", "TRUE", dataKey},
+		{"notes_archive", "title", "TRUE", dataKey},
+		{"blocks_archive", "content", "TRUE", dataKey},
+		{"audit_log", "before", "field IN ('title', 'content')", dataKey},
+		{"audit_log", "after", "field IN ('title', 'content')", dataKey},
+		{"attachments", "mime_type", "TRUE", files},
+	} {
+		if err = resealColumn(tx, column.table, column.name, column.where, column.from, next); err != nil {
+			return fmt.Errorf("sealing %s.%s: %w", column.table, column.name, err)
+		}
+	}
+	stale, err := resealAttachments(tx, files, next)
+	if err != nil {
+		return fmt.Errorf("sealing attachments: %w", err)
+	}
+	if _, err = tx.Exec(
+		`
+        DELETE FROM store_key;
+        INSERT INTO store_key (id, data_key, files_sealed) VALUES (1, ?, TRUE);
+        `,
+		wrapped,
+	); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	dataKey = next
+	// Any left behind are orphans now, for removeOrphanedAttachments
+	for _, path := range stale {
+		os.Remove(path)
+	}
+
+	if err = indexInMemory(db); err != nil {
+		return err
+	}
+	// Rewrite the file so no page still holds what was there before
+	_, err = db.Exec("VACUUM; PRAGMA wal_checkpoint(TRUNCATE);")
+	return err
+}
+
+// resealColumn reseals column in the rows of table matching where from
+// the key from to next, leaving NULLs be.
+func resealColumn(tx *sql.Tx, table string, column string, where string, from []byte, next []byte) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT rowid, %s FROM %s WHERE %s AND %[1]s IS NOT NULL", column, table, where))
+	if err != nil {
+		return err
+	}
+	values := map[int]string{}
+	for rows.Next() {
+		var id int
+		var value string
+		if err = rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		values[id] = value
+	}
+	if err = errors.Join(rows.Err(), rows.Close()); err != nil {
+		return err
+	}
+
+	update := fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ?", table, column)
+	for id, value := range values {
+		if value, err = openContent(from, value); err != nil {
+			return err
+		}
+		if value, err = sealContent(next, value); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(update, value, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resealAttachments writes every attachment and thumbnail sealed with
+// from again, sealed with next under the name next gives it, and returns
+// the paths of the files it replaced, to remove once next is the data key.
+func resealAttachments(tx *sql.Tx, from []byte, next []byte) ([]string, error) {
+	rows, err := tx.Query("SELECT hash FROM attachments")
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	if err = errors.Join(rows.Err(), rows.Close()); err != nil {
+		return nil, err
+	}
+
+	var stale []string
+	for _, hash := range hashes {
+		for _, path := range []struct{ from, next string }{
+			{attachmentPathFor(from, hash), attachmentPathFor(next, hash)},
+			{thumbnailPathFor(from, hash), thumbnailPathFor(next, hash)},
+		} {
+			data, err := os.ReadFile(path.from)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if data, err = openBytes(from, data); err != nil {
+				return nil, err
+			}
+			if data, err = sealBytes(next, data); err != nil {
+				return nil, err
+			}
+			if err = writeFile(path.next, data); err != nil {
+				return nil, err
+			}
+			stale = append(stale, path.from)
+		}
+	}
+	return stale, nil
+}
+
+// dropSearchIndex empties quick_search and drops the triggers keeping it,
+// on disk and in memory. Deleting from an FTS5 table can leave the old
+// terms in its index, so the table on disk is made again instead.
+const dropSearchIndex = `
+        PRAGMA secure_delete = ON;
+        DROP TRIGGER IF EXISTS main.add_note_to_quick_search;
+        DROP TRIGGER IF EXISTS main.update_note_in_quick_search;
+        DROP TRIGGER IF EXISTS main.remove_note_from_quick_search;
+        DROP TRIGGER IF EXISTS main.add_block_to_quick_search;
+        DROP TRIGGER IF EXISTS main.update_block_in_quick_search;
+        DROP TRIGGER IF EXISTS main.move_block_in_quick_search;
+        DROP TRIGGER IF EXISTS main.remove_block_from_quick_search;
+        DROP TRIGGER IF EXISTS temp.add_note_to_quick_search;
+        DROP TRIGGER IF EXISTS temp.update_note_in_quick_search;
+        DROP TRIGGER IF EXISTS temp.remove_note_from_quick_search;
+        DROP TRIGGER IF EXISTS temp.add_block_to_quick_search;
+        DROP TRIGGER IF EXISTS temp.update_block_in_quick_search;
+        DROP TRIGGER IF EXISTS temp.move_block_in_quick_search;
+        DROP TRIGGER IF EXISTS temp.remove_block_from_quick_search;
+        DROP TABLE IF EXISTS temp.quick_search;
+        DROP TABLE IF EXISTS main.quick_search;
+        CREATE VIRTUAL TABLE main.quick_search
+        USING fts5(note_id UNINDEXED, title, content, tokenize="trigram");
+`
+
+// indexInMemory moves quick_search of an encrypted database into a TEMP
+// table, which lives only as long as the connection, so the plaintext it
+// indexes never reaches the disk. Open keeps to a single connection.
+// Unqualified, quick_search names the TEMP table, which comes first.
+func indexInMemory(db *sql.DB) error {
+	if _, err := db.Exec(dropSearchIndex); err != nil {
+		return err
+	}
+	_, err := db.Exec(
+		`
+        CREATE VIRTUAL TABLE temp.quick_search
+        USING fts5(note_id UNINDEXED, title, content, tokenize="trigram");
+
+        INSERT INTO temp.quick_search (note_id, title, content)
+        SELECT
+            n.id,
+            unseal(n.title),
+            (
+                SELECT group_concat(unseal(content), ' | ')
+                FROM blocks
+                WHERE note_id = n.id
+                AND n.key_salt IS NULL
+            )
+        FROM notes n;
+
+        CREATE TEMP TRIGGER IF NOT EXISTS add_note_to_quick_search
+        AFTER INSERT ON notes
+            BEGIN
+                INSERT INTO quick_search (note_id, title)
+                VALUES (NEW.id, unseal(NEW.title));
+            END;
+
+        CREATE TEMP TRIGGER IF NOT EXISTS update_note_in_quick_search
+        AFTER UPDATE OF title ON notes
+            BEGIN
+                UPDATE quick_search
+                SET title = unseal(NEW.title)
+                WHERE note_id = NEW.id;
+            END;
+
+        CREATE TEMP TRIGGER IF NOT EXISTS remove_note_from_quick_search
+        AFTER DELETE ON notes
+            BEGIN
+                DELETE FROM quick_search
+                WHERE note_id = OLD.id;
+            END;
+
+        CREATE TEMP TRIGGER IF NOT EXISTS add_block_to_quick_search
+        AFTER INSERT ON blocks
+            BEGIN
+                UPDATE quick_search
+                SET (content) = (
+                    SELECT
+                        group_concat(unseal(content), ' | ')
+                    FROM blocks
+                    WHERE note_id = NEW.note_id
+                    AND note_id NOT IN (SELECT id FROM notes WHERE key_salt IS NOT NULL)
+                )
+                WHERE note_id = NEW.note_id;
+            END;
+
+        CREATE TEMP TRIGGER IF NOT EXISTS update_block_in_quick_search
+        AFTER UPDATE OF content ON blocks
+            BEGIN
+                UPDATE quick_search
+                SET (content) = (
+                    SELECT
+                        group_concat(unseal(content), ' | ')
+                    FROM blocks
+                    WHERE note_id = NEW.note_id
+                    AND note_id NOT IN (SELECT id FROM notes WHERE key_salt IS NOT NULL)
+                )
+                WHERE note_id = NEW.note_id;
+            END;
+
+        CREATE TEMP TRIGGER IF NOT EXISTS move_block_in_quick_search
+        AFTER UPDATE OF note_id ON blocks
+            BEGIN
+                UPDATE quick_search
+                SET (content) = (
+                    SELECT
+                        group_concat(unseal(content), ' | ')
+                    FROM blocks
+                    WHERE note_id = quick_search.note_id
+                    AND note_id NOT IN (SELECT id FROM notes WHERE key_salt IS NOT NULL)
+                )
+                WHERE note_id IN (OLD.note_id, NEW.note_id);
+            END;
+
+        CREATE TEMP TRIGGER IF NOT EXISTS remove_block_from_quick_search
+        AFTER DELETE ON blocks
+            BEGIN
+                UPDATE quick_search
+                SET (content) = (
+                    SELECT
+                        group_concat(unseal(content), ' | ')
+                    FROM blocks
+                    WHERE note_id = OLD.note_id
+                    AND note_id NOT IN (SELECT id FROM notes WHERE key_salt IS NOT NULL)
+                )
+                WHERE note_id = OLD.note_id;
+            END;
+        `,
+	)
+	return err
+}
+
+// RotateKey seals the database under key with a new data key, opening it
+// with the configured key first, then closes it. A database that was not
+// encrypted at rest is encrypted.
+func RotateKey(key []byte) error {
+	if err := Open(); err != nil {
+		return err
+	}
+	if err := resealStore(agent.DB, key); err != nil {
+		agent.Close()
+		return err
+	}
+	return agent.Close()
+}
@@ -0,0 +1,243 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// reopen closes the database and opens it again with key, base64
+// encoded, or with no key if it is empty.
+func (app *testApp) reopen(key string) error {
+	app.t.Helper()
+
+	if agent.DB != nil {
+		if err := agent.Close(); err != nil {
+			app.t.Fatal(err)
+		}
+	}
+	cfg := settings
+	cfg.Key = key
+	Configure(cfg)
+	return Open()
+}
+
+func testKey(b byte) ([]byte, string) {
+	key := bytes.Repeat([]byte{b}, 32)
+	return key, base64.StdEncoding.EncodeToString(key)
+}
+
+func TestEncryptAtRest(t *testing.T) {
+	app := newTestApp(t)
+	key, encoded := testKey(1)
+	if err := RotateKey(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{settings.DBFile(), settings.DBFile() + "-wal"} {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("engagement significantly")) {
+			t.Errorf("%s still holds plaintext", path)
+		}
+	}
+	if err := Open(); err == nil {
+		t.Error("opened the encrypted database without a key")
+	}
+	if err := app.reopen(encoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := app.queryString("SELECT title FROM notes WHERE id = 2"); got == "Note 2: Ideas for New Features" {
+		t.Error("note 2's title is stored in plaintext")
+	}
+	if got := app.queryString("SELECT content FROM blocks WHERE id = 3"); got == plainBlock {
+		t.Error("block 3 is stored in plaintext")
+	}
+	if got := app.queryInt("SELECT COUNT(*) FROM main.quick_search"); got != 0 {
+		t.Errorf("%d notes indexed on disk, want 0", got)
+	}
+
+	rec := app.do(http.MethodGet, "/notes/2", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Note 2: Ideas for New Features", plainBlock)
+
+	assertStatus(t, app.do(http.MethodPut, "/blocks/3", url.Values{"content": {"Rotating keys"}, "version": {app.version(3)}}), 200)
+	if got := app.queryString("SELECT content FROM blocks WHERE id = 3"); got == "Rotating keys" {
+		t.Error("edited block 3 is stored in plaintext")
+	}
+	rec = app.do(http.MethodPost, "/search", url.Values{"search-term": {"Rotating keys"}})
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Note 2: Ideas for New Features")
+
+	assertStatus(t, app.do(http.MethodDelete, "/notes/2", nil), 200)
+	archived := app.queryInt("SELECT id FROM notes_archive ORDER BY id DESC LIMIT 1")
+	rec = app.do(http.MethodGet, "/archive/"+strconv.Itoa(archived), nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Note 2: Ideas for New Features", "Rotating keys")
+	rec = app.do(http.MethodPost, "/search", url.Values{"search-term": {"Rotating keys"}})
+	assertContains(t, rec, "No results")
+}
+
+func TestRotateKey(t *testing.T) {
+	app := newTestApp(t)
+	old_key, old_encoded := testKey(1)
+	if err := RotateKey(old_key); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.reopen(old_encoded); err != nil {
+		t.Fatal(err)
+	}
+	before := app.queryString("SELECT content FROM blocks WHERE id = 3")
+
+	new_key, new_encoded := testKey(2)
+	if err := RotateKey(new_key); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.reopen(old_encoded); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("opening with the old key: err = %v, want %v", err, ErrWrongKey)
+	}
+	if err := app.reopen(new_encoded); err != nil {
+		t.Fatal(err)
+	}
+	if got := app.queryString("SELECT content FROM blocks WHERE id = 3"); got == before {
+		t.Error("block 3 is still sealed with the old data key")
+	}
+	rec := app.do(http.MethodGet, "/notes/2", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, plainBlock)
+	rec = app.do(http.MethodPost, "/search", url.Values{"search-term": {"engagement significantly"}})
+	assertContains(t, rec, "Note 2: Ideas for New Features")
+	rec = app.do(http.MethodGet, "/audit/export?entity=block&note_id=2", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, plainBlock)
+}
+
+// storedFiles reads every file under the attachment directory, by name.
+func storedFiles(t *testing.T) map[string][]byte {
+	t.Helper()
+
+	files := map[string][]byte{}
+	err := filepath.WalkDir(attachmentDir(), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		files[entry.Name()], err = os.ReadFile(path)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestEncryptAttachmentsAtRest(t *testing.T) {
+	app := newTestApp(t)
+	picture := testPNG(t, 400, 200)
+	before := []byte("uploaded before encrypting")
+	after := []byte("uploaded after encrypting")
+	app.upload("/attachments?note_id=2", nil, map[string][]byte{"picture.png": picture, "before.txt": before})
+
+	get := func(hash string) []byte {
+		t.Helper()
+		rec := app.serve(httptest.NewRequest(http.MethodGet, "/attachments/"+hash, nil))
+		assertStatus(t, rec, 200)
+		return rec.Body.Bytes()
+	}
+	assertSealed := func() {
+		t.Helper()
+		files := storedFiles(t)
+		// The picture, its thumbnail and the two text files
+		if len(files) != 4 {
+			t.Errorf("%d files stored, want 4", len(files))
+		}
+		for name, data := range files {
+			for _, plain := range [][]byte{picture, before, after} {
+				if name == hashOf(plain) || bytes.Contains(data, plain) {
+					t.Errorf("%s is stored in plaintext", name)
+				}
+			}
+		}
+		if got := app.queryInt("SELECT COUNT(*) FROM attachments WHERE mime_type LIKE 'text/plain%' OR mime_type = 'image/png'"); got != 0 {
+			t.Errorf("%d types stored in plaintext", got)
+		}
+		if !bytes.Equal(get(hashOf(picture)), picture) || !bytes.Equal(get(hashOf(before)), before) {
+			t.Error("served different attachments")
+		}
+		assertStatus(t, app.serve(httptest.NewRequest(http.MethodGet, "/attachments/"+hashOf(picture)+"/thumbnail", nil)), 200)
+	}
+
+	key, encoded := testKey(1)
+	if err := RotateKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.reopen(encoded); err != nil {
+		t.Fatal(err)
+	}
+	assertStatus(t, app.upload("/attachments?note_id=2", nil, map[string][]byte{"after.txt": after}), 200)
+	if !bytes.Equal(get(hashOf(after)), after) {
+		t.Error("served a different attachment")
+	}
+	block_id := app.queryInt("SELECT id FROM blocks WHERE attachment = ?", hashOf(after))
+	assertSealed()
+
+	key, encoded = testKey(2)
+	if err := RotateKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.reopen(encoded); err != nil {
+		t.Fatal(err)
+	}
+	assertSealed()
+
+	// Removing attachments finds them by their sealed names
+	assertStatus(t, app.do(http.MethodDelete, "/blocks/"+strconv.Itoa(block_id), nil), 200)
+	if got := len(storedFiles(t)); got != 3 {
+		t.Errorf("%d files stored, want 3", got)
+	}
+}
+
+func TestSealAttachmentsInEncryptedStore(t *testing.T) {
+	app := newTestApp(t)
+	data := []byte("stored before attachments were sealed")
+	app.upload("/attachments?note_id=2", nil, map[string][]byte{"old.txt": data})
+	key, encoded := testKey(1)
+	if err := RotateKey(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// An encrypted store from before, with the file as it was uploaded
+	if err := app.reopen(encoded); err != nil {
+		t.Fatal(err)
+	}
+	hash := hashOf(data)
+	if err := os.Remove(attachmentPath(hash)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(attachmentPathFor(nil, hash), data); err != nil {
+		t.Fatal(err)
+	}
+	app.exec("UPDATE attachments SET mime_type = 'text/plain; charset=utf-8'")
+	app.exec("UPDATE store_key SET files_sealed = FALSE")
+
+	if err := app.reopen(encoded); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(attachmentPathFor(nil, hash)) {
+		t.Error("the file is still stored in plaintext")
+	}
+	rec := app.serve(httptest.NewRequest(http.MethodGet, "/attachments/"+hash, nil))
+	assertStatus(t, rec, 200)
+	if !bytes.Equal(rec.Body.Bytes(), data) || rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("served %q as %q", rec.Body.String(), rec.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,321 @@
+package routes
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Table is the grid a "table" block keeps, as JSON, in its Content:
+// rows of cells, the first row being the header. Every row has the
+// same number of cells.
+type Table [][]string
+
+// parseTable reads a table block's Content.
+func parseTable(content string) (Table, error) {
+	table := Table{}
+	if err := json.Unmarshal([]byte(content), &table); err != nil {
+		return nil, err
+	}
+	if len(table) == 0 || len(table[0]) == 0 {
+		return nil, Invalid("A table needs at least one row and column")
+	}
+	return table.padded(), nil
+}
+
+// tableCells is parseTable for templates, which show content that is
+// not a table as a single cell.
+func tableCells(content string) Table {
+	table, err := parseTable(content)
+	if err != nil {
+		return Table{{content}}
+	}
+	return table
+}
+
+// tableFromCSV reads pasted CSV into a table. Text copied from a
+// spreadsheet is tab separated, so a tab in the first line picks tabs
+// over commas.
+func tableFromCSV(text string) (Table, error) {
+	text = strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+	reader := csv.NewReader(strings.NewReader(text))
+	if first, _, _ := strings.Cut(text, "\n"); strings.Contains(first, "\t") {
+		reader.Comma = '\t'
+	}
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	table, err := reader.ReadAll()
+	if err != nil {
+		return nil, Invalid("Cannot read the pasted rows: %v", err)
+	}
+	if len(table) == 0 {
+		return nil, Invalid("Content cannot be empty")
+	}
+	return Table(table).padded(), nil
+}
+
+func (t Table) String() string {
+	content, _ := json.Marshal(t)
+	return string(content)
+}
+
+func (t Table) width() int {
+	width := 0
+	for _, row := range t {
+		width = max(width, len(row))
+	}
+	return width
+}
+
+// padded fills short rows with empty cells.
+func (t Table) padded() Table {
+	width := t.width()
+	for i, row := range t {
+		for len(row) < width {
+			row = append(row, "")
+		}
+		t[i] = row
+	}
+	return t
+}
+
+// sortRows sorts the rows below the header by column. Cells that are
+// both numbers compare as numbers, the rest as text ignoring case.
+func (t Table) sortRows(column int, desc bool) {
+	slices.SortStableFunc(t[1:], func(a []string, b []string) int {
+		order := compareCells(a[column], b[column])
+		if desc {
+			return -order
+		}
+		return order
+	})
+}
+
+func compareCells(a string, b string) int {
+	x, x_err := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	y, y_err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	if x_err == nil && y_err == nil {
+		return cmp.Compare(x, y)
+	}
+	return cmp.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// tableMarkdown renders a table as a Markdown pipe table.
+func tableMarkdown(content string) string {
+	table := tableCells(content)
+	line := func(cells []string) string {
+		escaped := make([]string, len(cells))
+		for i, cell := range cells {
+			cell = strings.ReplaceAll(cell, "|", `\|`)
+			escaped[i] = strings.Join(strings.Fields(cell), " ")
+		}
+		return "| " + strings.Join(escaped, " | ") + " |"
+	}
+	lines := []string{line(table[0]), line(slices.Repeat([]string{"---"}, len(table[0])))}
+	for _, row := range table[1:] {
+		lines = append(lines, line(row))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// getTableBlock loads the table block named by :block_id.
+func getTableBlock(c echo.Context) (Block, Table, error) {
+	block_id, err := strconv.Atoi(c.Param("block_id"))
+	if err != nil {
+		return Block{}, nil, echo.NewHTTPError(400, "Missing or invalid param :block_id")
+	}
+	block, err := getContentByBlockId(block_id)
+	if err != nil {
+		return block, nil, err
+	}
+	if err = canEdit(block.NoteID); err != nil {
+		return block, nil, err
+	}
+	if block.Type != "table" {
+		return block, nil, Invalid("Block %d is not a table", block_id)
+	}
+	table, err := parseTable(block.Content)
+	if err != nil {
+		return block, nil, err
+	}
+	return block, table, nil
+}
+
+// tableIndex reads the row or column index ?param, which must be
+// below limit.
+func tableIndex(c echo.Context, param string, limit int) (int, error) {
+	index, err := strconv.Atoi(c.QueryParam(param))
+	if err != nil || index < 0 || index >= limit {
+		return 0, echo.NewHTTPError(400, "Missing or invalid param ?"+param)
+	}
+	return index, nil
+}
+
+// saveTable stores table as block's content and renders the block.
+func saveTable(c echo.Context, block Block, table Table) error {
+	var err error
+
+	block.Content = table.String()
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	sealed, err := sealBlockContent(block.NoteID, block.Content)
+	if err != nil {
+		return handleError()
+	}
+	if _, err = agent.Exec(
+		`
+            UPDATE blocks
+            SET content = seal($1)
+            WHERE id = $2;
+
+            UPDATE notes
+            SET modified_at = CURRENT_TIMESTAMP
+            WHERE id = $3;
+        `,
+		sealed,
+		block.ID,
+		block.NoteID,
+	); err != nil {
+		return handleError()
+	}
+	if err = notify("block", block.NoteID); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return c.Render(200, "block", block)
+}
+
+// PutTableCell sets the cell at ?row and ?column to the posted value.
+func PutTableCell(c echo.Context) error {
+	block, table, err := getTableBlock(c)
+	if err != nil {
+		return err
+	}
+	row, err := tableIndex(c, "row", len(table))
+	if err != nil {
+		return err
+	}
+	column, err := tableIndex(c, "column", table.width())
+	if err != nil {
+		return err
+	}
+	table[row][column] = c.FormValue("value")
+
+	return saveTable(c, block, table)
+}
+
+// PostTableRow adds an empty row before ?at, or at the bottom.
+func PostTableRow(c echo.Context) error {
+	block, table, err := getTableBlock(c)
+	if err != nil {
+		return err
+	}
+	at := len(table)
+	if c.QueryParam("at") != "" {
+		// Nothing goes above the header
+		if at, err = tableIndex(c, "at", len(table)+1); err != nil || at == 0 {
+			return echo.NewHTTPError(400, "Missing or invalid param ?at")
+		}
+	}
+	table = slices.Insert(table, at, make([]string, table.width()))
+
+	return saveTable(c, block, table)
+}
+
+// DeleteTableRow removes the row at ?row, which cannot be the header.
+func DeleteTableRow(c echo.Context) error {
+	block, table, err := getTableBlock(c)
+	if err != nil {
+		return err
+	}
+	row, err := tableIndex(c, "row", len(table))
+	if err != nil {
+		return err
+	}
+	if row == 0 {
+		return Invalid("The header row cannot be removed")
+	}
+	table = slices.Delete(table, row, row+1)
+
+	return saveTable(c, block, table)
+}
+
+// PostTableColumn adds an empty column before ?at, or at the right.
+func PostTableColumn(c echo.Context) error {
+	block, table, err := getTableBlock(c)
+	if err != nil {
+		return err
+	}
+	at := table.width()
+	if c.QueryParam("at") != "" {
+		if at, err = tableIndex(c, "at", table.width()+1); err != nil {
+			return err
+		}
+	}
+	for i := range table {
+		table[i] = slices.Insert(table[i], at, "")
+	}
+
+	return saveTable(c, block, table)
+}
+
+// DeleteTableColumn removes the column at ?column, as long as another
+// is left.
+func DeleteTableColumn(c echo.Context) error {
+	block, table, err := getTableBlock(c)
+	if err != nil {
+		return err
+	}
+	column, err := tableIndex(c, "column", table.width())
+	if err != nil {
+		return err
+	}
+	if table.width() == 1 {
+		return Invalid("A table needs at least one column")
+	}
+	for i := range table {
+		table[i] = slices.Delete(table[i], column, column+1)
+	}
+
+	return saveTable(c, block, table)
+}
+
+// SortTable sorts the rows below the header by ?column, descending
+// given ?desc=true. The new order is saved.
+func SortTable(c echo.Context) error {
+	block, table, err := getTableBlock(c)
+	if err != nil {
+		return err
+	}
+	column, err := tableIndex(c, "column", table.width())
+	if err != nil {
+		return err
+	}
+	desc := false
+	if param := c.QueryParam("desc"); param != "" {
+		desc, err = strconv.ParseBool(param)
+		if err != nil {
+			return echo.NewHTTPError(400, "Missing or invalid param ?desc")
+		}
+	}
+	table.sortRows(column, desc)
+
+	return saveTable(c, block, table)
+}
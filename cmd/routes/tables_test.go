@@ -0,0 +1,169 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// table reads a table block's cells back from the database.
+func (app *testApp) table(block_id int) Table {
+	app.t.Helper()
+
+	table, err := parseTable(app.queryString("SELECT content FROM blocks WHERE id = ?", block_id))
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	return table
+}
+
+func assertTable(t *testing.T, got Table, want Table) {
+	t.Helper()
+
+	if got.String() != want.String() {
+		t.Errorf("table = %s, want %s", got, want)
+	}
+}
+
+func TestTableFromCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want Table
+	}{
+		{"csv", "name,size\r\n\"Smith, J\",3\n", Table{{"name", "size"}, {"Smith, J", "3"}}},
+		{"spreadsheet", "a\tb, c\n1\t2", Table{{"a", "b, c"}, {"1", "2"}}},
+		{"ragged", "a,b,c\n1", Table{{"a", "b", "c"}, {"1", "", ""}}},
+		{"one cell", "just text", Table{{"just text"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tableFromCSV(tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertTable(t, got, tt.want)
+		})
+	}
+
+	if _, err := tableFromCSV("  \n"); err == nil {
+		t.Error("read a table from blank text")
+	}
+}
+
+func TestPostTable(t *testing.T) {
+	app := newTestApp(t)
+
+	rec := app.do(http.MethodPost, "/blocks?note_id=2&type=table", url.Values{"content": {"name,qty\nbolts,10\nnuts,2"}})
+	assertStatus(t, rec, 200)
+	assertContains(t, rec,
+		`id="block-container-57"`,
+		`<table class="block-table">`,
+		`value="bolts"`,
+		`hx-put="/blocks/57/cells?row=1&column=0"`,
+	)
+	assertTable(t, app.table(57), Table{{"name", "qty"}, {"bolts", "10"}, {"nuts", "2"}})
+
+	rec = app.do(http.MethodPost, "/blocks?note_id=2&type=table", url.Values{"content": {""}})
+	assertStatus(t, rec, 422)
+}
+
+func TestEditTable(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET type = 'table', content = ? WHERE id = 4", Table{{"item", "qty"}, {"Bolts", "10"}, {"nuts", "9"}, {"axles", "100"}}.String())
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		form   url.Values
+		want   Table
+	}{
+		{"edit cell", http.MethodPut, "/blocks/4/cells?row=1&column=1", url.Values{"value": {"12"}}, Table{{"item", "qty"}, {"Bolts", "12"}, {"nuts", "9"}, {"axles", "100"}}},
+		{"sort as numbers", http.MethodPut, "/blocks/4/sort?column=1", nil, Table{{"item", "qty"}, {"nuts", "9"}, {"Bolts", "12"}, {"axles", "100"}}},
+		{"sort as text", http.MethodPut, "/blocks/4/sort?column=0&desc=true", nil, Table{{"item", "qty"}, {"nuts", "9"}, {"Bolts", "12"}, {"axles", "100"}}},
+		{"add row", http.MethodPost, "/blocks/4/rows?at=1", nil, Table{{"item", "qty"}, {"", ""}, {"nuts", "9"}, {"Bolts", "12"}, {"axles", "100"}}},
+		{"remove row", http.MethodDelete, "/blocks/4/rows?row=1", nil, Table{{"item", "qty"}, {"nuts", "9"}, {"Bolts", "12"}, {"axles", "100"}}},
+		{"add column", http.MethodPost, "/blocks/4/columns", nil, Table{{"item", "qty", ""}, {"nuts", "9", ""}, {"Bolts", "12", ""}, {"axles", "100", ""}}},
+		{"remove column", http.MethodDelete, "/blocks/4/columns?column=0", nil, Table{{"qty", ""}, {"9", ""}, {"12", ""}, {"100", ""}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := app.do(tt.method, tt.target, tt.form)
+			assertStatus(t, rec, 200)
+			assertContains(t, rec, `id="block-4"`)
+			assertTable(t, app.table(4), tt.want)
+		})
+	}
+
+	failures := []struct {
+		name   string
+		method string
+		target string
+		status int
+		want   string
+	}{
+		{"header row", http.MethodDelete, "/blocks/4/rows?row=0", 422, "The header row cannot be removed"},
+		{"row above the header", http.MethodPost, "/blocks/4/rows?at=0", 400, "Missing or invalid param ?at"},
+		{"cell out of range", http.MethodPut, "/blocks/4/cells?row=4&column=0", 400, "Missing or invalid param ?row"},
+		{"column out of range", http.MethodPut, "/blocks/4/sort?column=2", 400, "Missing or invalid param ?column"},
+		{"not a table", http.MethodPost, "/blocks/3/rows", 422, "Block 3 is not a table"},
+		{"missing block", http.MethodPost, "/blocks/999/columns", 404, "Block 999 not found"},
+	}
+	for _, tt := range failures {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := app.do(tt.method, tt.target, nil)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+		})
+	}
+
+	app.exec("UPDATE blocks SET content = ? WHERE id = 4", Table{{"only"}}.String())
+	rec := app.do(http.MethodDelete, "/blocks/4/columns?column=0", nil)
+	assertStatus(t, rec, 422)
+	assertContains(t, rec, "A table needs at least one column")
+}
+
+func TestTableBlockTypes(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET content = 'a,b' WHERE id = 4")
+
+	form := url.Values{"type": {"table"}, "block_id": {"3", "4"}}
+	assertStatus(t, app.do(http.MethodPut, "/blocks/type", form), 200)
+	assertTable(t, app.table(3), Table{{"Adding user notifications will increase engagement significantly."}})
+	assertTable(t, app.table(4), Table{{"a", "b"}})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		form   url.Values
+		want   string
+	}{
+		{"change type", http.MethodPut, "/blocks/type", url.Values{"type": {"text"}, "block_id": {"4"}}, "Tables cannot change type"},
+		{"split", http.MethodPost, "/blocks/4/split", url.Values{"content": {"a,b"}, "offset": {"1"}, "version": {app.version(4)}}, "Tables cannot be split"},
+		{"merge", http.MethodPost, "/blocks/5/merge", url.Values{"content": {"x"}, "version": {app.version(5)}}, "Tables cannot be merged"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := app.do(tt.method, tt.target, tt.form)
+			assertStatus(t, rec, 422)
+			assertContains(t, rec, tt.want)
+		})
+	}
+}
+
+func TestExportTable(t *testing.T) {
+	app := newTestApp(t)
+	app.exec("UPDATE blocks SET type = 'table', content = ? WHERE id = 4", Table{{"a|b", "c"}, {"1\n2", ""}}.String())
+
+	rec := app.do(http.MethodGet, "/blocks/export?block_id=3&block_id=4", nil)
+	assertStatus(t, rec, 200)
+	want := "Adding user notifications will increase engagement significantly.\n\n" +
+		"| a\\|b | c |\n" +
+		"| --- | --- |\n" +
+		"| 1 2 |  |\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("export = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,49 @@
+package routes
+
+import (
+	"html/template"
+	"io"
+	"io/fs"
+
+	"github.com/jadenrose/go-note/cmd/assets"
+	"github.com/jadenrose/go-note/cmd/config"
+	"github.com/labstack/echo/v4"
+)
+
+type Templates struct {
+	Templates *template.Template
+	// Reload is set in dev mode to re-parse the templates on every render.
+	Reload func() (*template.Template, error)
+}
+
+func (t *Templates) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	if t.Reload != nil {
+		templates, err := t.Reload()
+		if err != nil {
+			return err
+		}
+		return templates.ExecuteTemplate(w, name, data)
+	}
+	return t.Templates.ExecuteTemplate(w, name, data)
+}
+
+func NewTemplates(cfg config.Config, fsys fs.FS, static *assets.Static) *Templates {
+	funcs := template.FuncMap{
+		"feature":           cfg.Features.Enabled,
+		"asset":             static.URL,
+		"highlight":         highlight,
+		"codeLanguages":     func() []string { return CodeLanguages },
+		"collaboratorRoles": func() []string { return CollaboratorRoles },
+		"tableCells":        tableCells,
+		"newTab":            newTab,
+	}
+	parse := func() (*template.Template, error) {
+		return template.New("").Funcs(funcs).ParseFS(fsys, "html/*.html")
+	}
+
+	t := &Templates{Templates: template.Must(parse())}
+	if cfg.Dev {
+		t.Reload = parse
+	}
+	return t
+}
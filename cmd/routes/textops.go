@@ -0,0 +1,192 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"unicode/utf16"
+)
+
+// TextOp is an edit to a block's content, in the format of ot.js: a run
+// of parts spanning the whole content, each retaining n characters
+// (n > 0), deleting n of them (n < 0) or inserting a string. Characters
+// are counted in UTF-16 code units, as in the browser.
+type TextOp []OpPart
+
+// OpPart is one part of a TextOp, a number or a string in JSON.
+type OpPart struct {
+	N      int
+	Insert string
+}
+
+var ErrOpLength = errors.New("operation does not fit the content")
+
+func (part OpPart) MarshalJSON() ([]byte, error) {
+	if part.N != 0 {
+		return json.Marshal(part.N)
+	}
+	return json.Marshal(part.Insert)
+}
+
+func (part *OpPart) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		part.N = 0
+		return json.Unmarshal(data, &part.Insert)
+	}
+	part.Insert = ""
+	return json.Unmarshal(data, &part.N)
+}
+
+func (op TextOp) retain(n int) TextOp {
+	if n == 0 {
+		return op
+	}
+	if last := len(op) - 1; last >= 0 && op[last].N > 0 {
+		op[last].N += n
+		return op
+	}
+	return append(op, OpPart{N: n})
+}
+
+func (op TextOp) delete(n int) TextOp {
+	if n == 0 {
+		return op
+	}
+	if last := len(op) - 1; last >= 0 && op[last].N < 0 {
+		op[last].N -= n
+		return op
+	}
+	return append(op, OpPart{N: -n})
+}
+
+// insert keeps inserts ahead of a delete at the same place, as ot.js
+// does, so equal edits come out equal.
+func (op TextOp) insert(s string) TextOp {
+	if s == "" {
+		return op
+	}
+	last := len(op) - 1
+	if last >= 0 && op[last].N == 0 {
+		op[last].Insert += s
+		return op
+	}
+	if last >= 0 && op[last].N < 0 {
+		if last > 0 && op[last-1].N == 0 {
+			op[last-1].Insert += s
+			return op
+		}
+		op = append(op, op[last])
+		op[last] = OpPart{Insert: s}
+		return op
+	}
+	return append(op, OpPart{Insert: s})
+}
+
+// baseLen is the length of the content op applies to.
+func (op TextOp) baseLen() int {
+	n := 0
+	for _, part := range op {
+		if part.N > 0 {
+			n += part.N
+		} else if part.N < 0 {
+			n -= part.N
+		}
+	}
+	return n
+}
+
+// Apply edits content, which must be as long as op expects.
+func (op TextOp) Apply(content string) (string, error) {
+	doc := utf16.Encode([]rune(content))
+	if op.baseLen() != len(doc) {
+		return "", ErrOpLength
+	}
+	edited := []uint16{}
+	at := 0
+	for _, part := range op {
+		switch {
+		case part.N > 0:
+			edited = append(edited, doc[at:at+part.N]...)
+			at += part.N
+		case part.N < 0:
+			at -= part.N
+		default:
+			edited = append(edited, utf16.Encode([]rune(part.Insert))...)
+		}
+	}
+	return string(utf16.Decode(edited)), nil
+}
+
+// transformOps rewrites two concurrent edits of the same content so
+// that applying a and then b' gives what b and then a' does. Where both
+// insert at the same place, a's insert goes first.
+func transformOps(a TextOp, b TextOp) (TextOp, TextOp, error) {
+	if a.baseLen() != b.baseLen() {
+		return nil, nil, ErrOpLength
+	}
+	a_prime, b_prime := TextOp{}, TextOp{}
+	parts_a, parts_b := append([]OpPart{}, a...), append([]OpPart{}, b...)
+	var pa, pb *OpPart
+	next := func(parts *[]OpPart) *OpPart {
+		if len(*parts) == 0 {
+			return nil
+		}
+		part := (*parts)[0]
+		*parts = (*parts)[1:]
+		return &part
+	}
+	pa, pb = next(&parts_a), next(&parts_b)
+	for pa != nil || pb != nil {
+		if pa != nil && pa.N == 0 {
+			a_prime = a_prime.insert(pa.Insert)
+			b_prime = b_prime.retain(insertLen(pa.Insert))
+			pa = next(&parts_a)
+			continue
+		}
+		if pb != nil && pb.N == 0 {
+			a_prime = a_prime.retain(insertLen(pb.Insert))
+			b_prime = b_prime.insert(pb.Insert)
+			pb = next(&parts_b)
+			continue
+		}
+		if pa == nil || pb == nil {
+			return nil, nil, ErrOpLength
+		}
+		n := min(abs(pa.N), abs(pb.N))
+		switch {
+		case pa.N > 0 && pb.N > 0:
+			a_prime = a_prime.retain(n)
+			b_prime = b_prime.retain(n)
+		case pa.N < 0 && pb.N > 0:
+			a_prime = a_prime.delete(n)
+		case pa.N > 0 && pb.N < 0:
+			b_prime = b_prime.delete(n)
+		}
+		// Deleted by both: neither has anything left to do there
+		if pa.N = shrink(pa.N, n); pa.N == 0 {
+			pa = next(&parts_a)
+		}
+		if pb.N = shrink(pb.N, n); pb.N == 0 {
+			pb = next(&parts_b)
+		}
+	}
+	return a_prime, b_prime, nil
+}
+
+// shrink takes n characters off a retain or delete.
+func shrink(part_n int, n int) int {
+	if part_n > 0 {
+		return part_n - n
+	}
+	return part_n + n
+}
+
+func insertLen(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,105 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func op(parts ...any) TextOp {
+	op := TextOp{}
+	for _, part := range parts {
+		switch part := part.(type) {
+		case int:
+			op = append(op, OpPart{N: part})
+		case string:
+			op = append(op, OpPart{Insert: part})
+		}
+	}
+	return op
+}
+
+func TestApplyOp(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		op      TextOp
+		want    string
+		err     error
+	}{
+		{"insert", "Hello world", op(5, ",", 6), "Hello, world", nil},
+		{"delete", "Hello world", op(5, -6), "Hello", nil},
+		{"replace", "Hello world", op(6, "there", -5), "Hello there", nil},
+		{"empty", "", op("Hi"), "Hi", nil},
+		{"utf-16", "a😀b", op(3, "!", 1), "a😀!b", nil},
+		{"too short", "Hello", op(3), "", ErrOpLength},
+		{"too long", "Hello", op(3, -3), "", ErrOpLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.op.Apply(tt.content)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Apply() error = %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("Apply() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformOps(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		a       TextOp
+		b       TextOp
+		want    string
+	}{
+		{"inserts apart", "Hello world", op(5, ",", 6), op(11, "!"), "Hello, world!"},
+		{"inserts together", "ab", op(1, "X", 1), op(1, "Y", 1), "aXYb"},
+		{"insert in delete", "Hello world", op(5, -6), op(8, "!", 3), "Hello!"},
+		{"same delete", "Hello world", op(5, -6), op(5, -6), "Hello"},
+		{"overlapping deletes", "abcdef", op(1, -3, 2), op(2, -3, 1), "af"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a_prime, b_prime, err := transformOps(tt.a, tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Either order of the two edits ends the same
+			after_a, _ := tt.a.Apply(tt.content)
+			ab, err := b_prime.Apply(after_a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after_b, _ := tt.b.Apply(tt.content)
+			ba, err := a_prime.Apply(after_b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ab != tt.want || ba != tt.want {
+				t.Errorf("transformed = %q and %q, want %q", ab, ba, tt.want)
+			}
+		})
+	}
+
+	if _, _, err := transformOps(op(3), op(4)); !errors.Is(err, ErrOpLength) {
+		t.Errorf("transformOps() on different contents error = %v", err)
+	}
+}
+
+func TestTextOpJSON(t *testing.T) {
+	var got TextOp
+	if err := json.Unmarshal([]byte(`[5,"x",-2]`), &got); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `[5,"x",-2]` {
+		t.Errorf("json = %s", data)
+	}
+}
@@ -0,0 +1,277 @@
+package routes
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// APIToken lets scripts act for a user, sent as "Authorization: Bearer".
+// Only a hash of the token is stored, so Token is set just once, when it
+// is created.
+type APIToken struct {
+	ID         int
+	Name       string
+	Scope      string
+	CreatedAt  string
+	LastUsedAt string
+	Token      string
+}
+
+// TokenList is the tokens page: the user's tokens, with the one just
+// created, if any, shown first.
+type TokenList struct {
+	Created APIToken
+	Tokens  []APIToken
+}
+
+// TokenScopes are what a token may do: "read" only allows GET requests,
+// "write" allows everything but managing tokens.
+var TokenScopes = []string{"read", "write"}
+
+// TokenPrefix marks API tokens so they are easy to spot in scripts and
+// secret scanners.
+const TokenPrefix = "gn_"
+
+const MaxTokenNameLength = 64
+
+// getTokenUser authenticates a request by its Authorization header. A
+// bad token fails the request rather than falling back to the session.
+func getTokenUser(c echo.Context, header string) (User, error) {
+	var err error
+
+	user := User{}
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || !strings.HasPrefix(token, TokenPrefix) {
+		return user, echo.NewHTTPError(401, "Invalid API token")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() (User, error) {
+		agent.Rollback()
+		return user, err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	var token_id int
+	var scope string
+	row := agent.QueryRow(
+		`
+            SELECT t.id, t.scope, u.id, u.username
+            FROM api_tokens t
+            JOIN users u
+            ON u.id = t.user_id
+            WHERE t.token_hash = ?;
+        `,
+		hashToken(token),
+	)
+	if err = row.Scan(&token_id, &scope, &user.ID, &user.Username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = echo.NewHTTPError(401, "Invalid API token")
+		}
+		return handleError()
+	}
+	method := c.Request().Method
+	if scope == "read" && method != http.MethodGet && method != http.MethodHead {
+		err = echo.NewHTTPError(403, "This API token is read-only")
+		return handleError()
+	}
+	if _, err = agent.Exec(
+		"UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?",
+		token_id,
+	); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	c.Set("api_token", token_id)
+	c.Set("api_token_scope", scope)
+
+	return user, nil
+}
+
+// requireSession keeps API tokens from listing or minting other tokens.
+func requireSession(c echo.Context) error {
+	if c.Get("api_token") != nil {
+		return echo.NewHTTPError(403, "API tokens cannot manage tokens")
+	}
+	return nil
+}
+
+func GetTokens(c echo.Context) error {
+	if err := requireSession(c); err != nil {
+		return err
+	}
+	tokens, err := getTokens()
+	if err != nil {
+		return err
+	}
+
+	return c.Render(200, "tokens", TokenList{Tokens: tokens})
+}
+
+// PostToken creates a token named by the form value name, with the form
+// value scope. The token itself is shown once, in the response.
+func PostToken(c echo.Context) error {
+	var err error
+
+	if err = requireSession(c); err != nil {
+		return err
+	}
+	name := strings.TrimSpace(c.FormValue("name"))
+	if len(name) == 0 {
+		return Invalid("Name cannot be empty")
+	}
+	if len(name) > MaxTokenNameLength {
+		return Invalid("Names are at most %d characters", MaxTokenNameLength)
+	}
+	scope := c.FormValue("scope")
+	if !slices.Contains(TokenScopes, scope) {
+		return echo.NewHTTPError(400, "Missing or invalid param scope")
+	}
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return err
+	}
+	created := APIToken{
+		Name:  name,
+		Scope: scope,
+		Token: TokenPrefix + base64.RawURLEncoding.EncodeToString(secret),
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if _, err = agent.Exec(
+		`
+            INSERT INTO api_tokens (user_id, name, token_hash, scope)
+            VALUES (?, ?, ?, ?);
+        `,
+		agent.UserID,
+		name,
+		hashToken(created.Token),
+		scope,
+	); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+	tokens, err := getTokens()
+	if err != nil {
+		return err
+	}
+
+	return c.Render(200, "tokens", TokenList{Created: created, Tokens: tokens})
+}
+
+// DeleteToken revokes a token. Scripts using it are turned away from
+// then on.
+func DeleteToken(c echo.Context) error {
+	var err error
+
+	if err = requireSession(c); err != nil {
+		return err
+	}
+	token_id, err := strconv.Atoi(c.Param("token_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :token_id")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	res, err := agent.Exec(
+		"DELETE FROM api_tokens WHERE id = ? AND user_id = ?",
+		token_id,
+		agent.UserID,
+	)
+	if err != nil {
+		return handleError()
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = NotFound("API token %d not found", token_id)
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return c.NoContent(200)
+}
+
+func getTokens() ([]APIToken, error) {
+	var err error
+
+	tokens := []APIToken{}
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() ([]APIToken, error) {
+		agent.Rollback()
+		return tokens, err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	rows, err := agent.Query(
+		`
+            SELECT id, name, scope, created_at, COALESCE(last_used_at, '')
+            FROM api_tokens
+            WHERE user_id = ?
+            ORDER BY created_at DESC, id DESC;
+        `,
+		agent.UserID,
+	)
+	if err != nil {
+		return handleError()
+	}
+	for rows.Next() {
+		token := APIToken{}
+		if err = rows.Scan(
+			&token.ID,
+			&token.Name,
+			&token.Scope,
+			&token.CreatedAt,
+			&token.LastUsedAt,
+		); err != nil {
+			rows.Close()
+			return handleError()
+		}
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	return tokens, nil
+}
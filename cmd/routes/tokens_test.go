@@ -0,0 +1,108 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+var newTokenPattern = regexp.MustCompile(`<code id="new-token">(gn_[A-Za-z0-9_-]+)</code>`)
+
+// createToken makes an API token for user 1 and returns it.
+func (app *testApp) createToken(name string, scope string) string {
+	app.t.Helper()
+
+	rec := app.do(http.MethodPost, "/tokens", url.Values{"name": {name}, "scope": {scope}})
+	assertStatus(app.t, rec, 200)
+	match := newTokenPattern.FindStringSubmatch(rec.Body.String())
+	if match == nil {
+		app.t.Fatalf("no token was shown\n%s", rec.Body.String())
+	}
+	return match[1]
+}
+
+// bearer sends a request authenticated by token alone.
+func (app *testApp) bearer(token string, method string, target string, form url.Values) *httptest.ResponseRecorder {
+	app.t.Helper()
+
+	session := app.session
+	app.session = ""
+	defer func() { app.session = session }()
+
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return app.serve(req)
+}
+
+func TestAPITokens(t *testing.T) {
+	app := newTestApp(t)
+
+	read := app.createToken("backup script", "read")
+	write := app.createToken("importer", "write")
+	if got := app.queryInt("SELECT COUNT(*) FROM api_tokens WHERE token_hash IN (?, ?)", read, write); got != 0 {
+		t.Error("a token was stored unhashed")
+	}
+
+	rec := app.do(http.MethodGet, "/tokens", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "backup script", "importer", "read-only", "read-write", "never used")
+	if newTokenPattern.MatchString(rec.Body.String()) {
+		t.Error("a token was shown again")
+	}
+
+	rec = app.bearer(read, http.MethodGet, "/notes/2", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Adding user notifications will increase engagement significantly.")
+	if got := app.queryInt("SELECT COUNT(*) FROM api_tokens WHERE name = 'backup script' AND last_used_at IS NOT NULL"); got != 1 {
+		t.Error("last_used_at was not recorded")
+	}
+
+	rec = app.bearer(read, http.MethodPut, "/notes/2", url.Values{"title": {"renamed"}})
+	assertStatus(t, rec, 403)
+	assertContains(t, rec, "This API token is read-only")
+
+	rec = app.bearer(write, http.MethodPut, "/notes/2", url.Values{"title": {"renamed"}})
+	assertStatus(t, rec, 200)
+	if got := app.queryString("SELECT title FROM notes WHERE id = 2"); got != "renamed" {
+		t.Errorf("title = %q, want renamed", got)
+	}
+
+	failures := []struct {
+		name   string
+		token  string
+		method string
+		target string
+		status int
+		want   string
+	}{
+		{"unknown token", "gn_nope", http.MethodGet, "/notes/2", 401, "Invalid API token"},
+		{"not a token", "session", http.MethodGet, "/notes/2", 401, "Invalid API token"},
+		{"list tokens", write, http.MethodGet, "/tokens", 403, "API tokens cannot manage tokens"},
+		{"create tokens", write, http.MethodPost, "/tokens", 403, "API tokens cannot manage tokens"},
+	}
+	for _, tt := range failures {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := app.bearer(tt.token, tt.method, tt.target, nil)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+		})
+	}
+
+	token_id := app.queryInt("SELECT id FROM api_tokens WHERE name = 'importer'")
+	assertStatus(t, app.do(http.MethodDelete, "/tokens/"+strconv.Itoa(token_id), nil), 200)
+	assertStatus(t, app.bearer(write, http.MethodGet, "/notes/2", nil), 401)
+	assertStatus(t, app.do(http.MethodDelete, "/tokens/"+strconv.Itoa(token_id), nil), 404)
+
+	rec = app.do(http.MethodPost, "/tokens", url.Values{"name": {"x"}, "scope": {"admin"}})
+	assertStatus(t, rec, 400)
+	assertContains(t, rec, "Missing or invalid param scope")
+}
@@ -0,0 +1,194 @@
+package routes
+
+import (
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+type BlockTransfer struct {
+	Mode     string
+	NoteID   int
+	Removed  []int
+	Previews []Note
+}
+
+func GetBlockTransfer(c echo.Context) error {
+	block_id, err := strconv.Atoi(c.Param("block_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param :block_id")
+	}
+	block, err := getContentByBlockId(block_id)
+	if err != nil {
+		return err
+	}
+	return c.Render(200, "block-transfer", block)
+}
+
+// TransferBlocks moves or copies one or more blocks to the end of
+// another note. The form carries a block_id per block, the target
+// note_id and mode, either "move" or "copy".
+func TransferBlocks(c echo.Context) error {
+	var err error
+
+	note_id, err := strconv.Atoi(c.FormValue("note_id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing or invalid param note_id")
+	}
+	mode := c.FormValue("mode")
+	if mode != "move" && mode != "copy" {
+		return echo.NewHTTPError(400, "Missing or invalid param mode")
+	}
+	block_ids, err := formInts(c, "block_id")
+	if err != nil || len(block_ids) == 0 {
+		return echo.NewHTTPError(400, "Missing or invalid param block_id")
+	}
+
+	if agent == nil {
+		agent = NewDBAgent()
+	}
+	handleError := func() error {
+		agent.Rollback()
+		return err
+	}
+	if err = agent.Open(); err != nil {
+		return handleError()
+	}
+	if err = transferBlocks(block_ids, note_id, mode == "copy"); err != nil {
+		return handleError()
+	}
+	previews, err := getAllPreviews()
+	if err != nil {
+		return handleError()
+	}
+	if err = agent.Commit(); err != nil {
+		return handleError()
+	}
+
+	transfer := BlockTransfer{
+		Mode:     mode,
+		NoteID:   note_id,
+		Previews: previews,
+	}
+	if mode == "move" {
+		transfer.Removed = block_ids
+	}
+
+	return c.Render(200, "blocks-transferred", transfer)
+}
+
+// transferBlocks appends blocks to the top level of note_id in their
+// current order, moving them out of their notes or leaving copies
+// behind. Children go along with their parents. Every note involved is
+// marked modified; the quick_search triggers reindex them.
+func transferBlocks(block_ids []int, note_id int, as_copy bool) error {
+	if err := canEdit(note_id); err != nil {
+		return err
+	}
+
+	blocks, err := getBlocksById(block_ids)
+	if err != nil {
+		return err
+	}
+	// Blocks go as they are stored, so never between keys
+	for _, from := range noteIds(blocks) {
+		if from == note_id {
+			continue
+		}
+		for _, id := range []int{from, note_id} {
+			var encrypted bool
+			if encrypted, err = noteEncrypted(id); err != nil {
+				return err
+			}
+			if encrypted {
+				return Invalid("Blocks cannot be moved or copied in or out of encrypted notes")
+			}
+		}
+	}
+	// Copies can come from notes that are only shared to read
+	if !as_copy {
+		if err = canEditAll(noteIds(blocks)); err != nil {
+			return err
+		}
+	}
+	// Blocks under another selected block are carried by it
+	descendants, err := getDescendantIds(block_ids)
+	if err != nil {
+		return err
+	}
+	trees := map[int][]Block{}
+
+	sort_order, err := getLastSortOrderUsed(note_id)
+	if err != nil {
+		return err
+	}
+	modified := []int{note_id}
+	for _, block := range blocks {
+		if indexOf(descendants, block.ID) >= 0 {
+			continue
+		}
+		sort_order += SortGap
+		if as_copy {
+			if trees[block.NoteID] == nil {
+				if trees[block.NoteID], err = getBlockTree("blocks", block.NoteID); err != nil {
+					return err
+				}
+			}
+			tree, _ := findBlock(trees[block.NoteID], block.ID)
+			tree.SortOrder = sort_order
+			err = insertBlockTree("blocks", note_id, 0, []Block{tree})
+		} else if block.NoteID == note_id {
+			return Invalid("Block %d is already in that note", block.ID)
+		} else {
+			_, err = agent.Exec(
+				`
+                    UPDATE blocks
+                    SET
+                        note_id = ?,
+                        parent_id = NULL,
+                        sort_order = ?
+                    WHERE id = ?;
+                `,
+				note_id,
+				sort_order,
+				block.ID,
+			)
+			modified = append(modified, block.NoteID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !as_copy && len(descendants) > 0 {
+		in, args := inClause(descendants)
+		if _, err = agent.Exec(
+			`
+                UPDATE blocks
+                SET note_id = ?
+                WHERE id IN `+in+`;
+            `,
+			append([]any{note_id}, args...)...,
+		); err != nil {
+			return err
+		}
+	}
+
+	return touchNotes(modified)
+}
+
+// formInts parses every value of a repeated form field.
+func formInts(c echo.Context, name string) ([]int, error) {
+	params, err := c.FormParams()
+	if err != nil {
+		return nil, err
+	}
+	ints := []int{}
+	for _, value := range params[name] {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
@@ -0,0 +1,134 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGetBlockTransfer(t *testing.T) {
+	app := newTestApp(t)
+
+	tests := []struct {
+		target string
+		status int
+		want   string
+	}{
+		{"/blocks/4/transfer", 200, `hx-get="/notes/titles?exclude_note_id=2"`},
+		{"/blocks/999/transfer", 404, "Block 999 not found"},
+		{"/blocks/abc/transfer", 400, "Missing or invalid param :block_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			rec := app.do(http.MethodGet, tt.target, nil)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+		})
+	}
+}
+
+func TestGetNoteTitles(t *testing.T) {
+	app := newTestApp(t)
+
+	rec := app.do(http.MethodGet, "/notes/titles?title=feedback", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "Note 3: Client Feedback", `"note_id": 3`)
+
+	rec = app.do(http.MethodGet, "/notes/titles?title=feedback&exclude_note_id=3", nil)
+	assertStatus(t, rec, 200)
+	assertContains(t, rec, "No matching notes")
+}
+
+func TestTransferBlocks(t *testing.T) {
+	transfer := func(mode string, note_id string, block_ids ...string) url.Values {
+		return url.Values{"mode": {mode}, "note_id": {note_id}, "block_id": block_ids}
+	}
+
+	t.Run("move", func(t *testing.T) {
+		app := newTestApp(t)
+		app.exec("UPDATE notes SET modified_at = '2000-01-01'")
+
+		rec := app.do(http.MethodPost, "/blocks/transfer", transfer("move", "3", "4", "3"))
+		assertStatus(t, rec, 200)
+		assertContains(t, rec,
+			`id="block-container-3" hx-swap-oob="delete"`,
+			`id="block-container-4" hx-swap-oob="delete"`,
+			`id="preview-links"`,
+		)
+
+		// Moved blocks keep their relative order, whatever order they were sent in
+		assertInts(t, "note 3", app.blockOrder(3), []int{6, 7, 3, 4})
+		assertInts(t, "note 2", app.blockOrder(2), []int{5})
+		if got := app.queryInt("SELECT COUNT(*) FROM notes WHERE id IN (2, 3) AND modified_at > '2000-01-01'"); got != 2 {
+			t.Errorf("%d notes marked modified, want 2", got)
+		}
+
+		rec = app.do(http.MethodPost, "/search", url.Values{"search-term": {"task management"}})
+		assertContains(t, rec, "Note 3:")
+		if got := app.queryInt("SELECT COUNT(*) FROM quick_search WHERE note_id = 2 AND content LIKE '%task management%'"); got != 0 {
+			t.Error("note 2 is still indexed with the moved content")
+		}
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		app := newTestApp(t)
+
+		rec := app.do(http.MethodPost, "/blocks/transfer", transfer("copy", "3", "3", "4"))
+		assertStatus(t, rec, 200)
+		assertContains(t, rec, `id="preview-links"`)
+		if got := rec.Body.String(); strings.Contains(got, `hx-swap-oob="delete"`) {
+			t.Error("copying removed the originals from the page")
+		}
+		assertInts(t, "note 3", app.blockOrder(3), []int{6, 7, 57, 58})
+		assertInts(t, "note 2", app.blockOrder(2), []int{3, 4, 5})
+		if got := app.queryString("SELECT content FROM blocks WHERE id = 58"); got != "We should integrate a task management feature." {
+			t.Errorf("copied content = %q", got)
+		}
+	})
+
+	t.Run("copy within a note", func(t *testing.T) {
+		app := newTestApp(t)
+
+		rec := app.do(http.MethodPost, "/blocks/transfer", transfer("copy", "2", "3"))
+		assertStatus(t, rec, 200)
+		assertInts(t, "note 2", app.blockOrder(2), []int{3, 4, 5, 57})
+	})
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		status int
+		want   string
+	}{
+		{"move within a note", transfer("move", "2", "3"), 422, "Block 3 is already in that note"},
+		{"missing note", transfer("move", "999", "3"), 404, "Note 999 not found"},
+		{"missing block", transfer("move", "3", "4", "999"), 404, "Block 999 not found"},
+		{"invalid mode", transfer("swap", "3", "4"), 400, "Missing or invalid param mode"},
+		{"invalid note id", transfer("move", "abc", "4"), 400, "Missing or invalid param note_id"},
+		{"no blocks", transfer("move", "3"), 400, "Missing or invalid param block_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			rec := app.do(http.MethodPost, "/blocks/transfer", tt.form)
+			assertStatus(t, rec, tt.status)
+			assertContains(t, rec, tt.want)
+
+			// Nothing is half done
+			assertInts(t, "note 2", app.blockOrder(2), []int{3, 4, 5})
+			assertInts(t, "note 3", app.blockOrder(3), []int{6, 7})
+		})
+	}
+}
+
+func TestDeleteBlockUpdatesSearch(t *testing.T) {
+	app := newTestApp(t)
+
+	rec := app.do(http.MethodDelete, "/blocks/4", nil)
+	assertStatus(t, rec, 200)
+	if got := app.queryInt("SELECT COUNT(*) FROM quick_search WHERE content LIKE '%task management%'"); got != 0 {
+		t.Error("deleted block is still indexed")
+	}
+}
@@ -3,20 +3,76 @@ DROP TABLE IF EXISTS notes;
 DROP TABLE IF EXISTS blocks;
 DROP TABLE IF EXISTS notes_archive;
 DROP TABLE IF EXISTS blocks_archive;
+DROP TABLE IF EXISTS attachments;
+DROP VIEW IF EXISTS note_access;
+DROP TABLE IF EXISTS collaborators;
+DROP TABLE IF EXISTS comments;
+DROP TABLE IF EXISTS shares;
+DROP TABLE IF EXISTS api_tokens;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS store_key;
+DROP TABLE IF EXISTS audit_log;
+
+PRAGMA user_version = 17;
+
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+    password_hash TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS sessions (
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users (id),
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    scope TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME
+);
 
 CREATE TABLE IF NOT EXISTS notes (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     modified_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-    title TEXT NOT NULL
+    title TEXT NOT NULL,
+    hide_completed BOOLEAN NOT NULL DEFAULT FALSE,
+    owner_id INTEGER REFERENCES users (id),
+    version INTEGER NOT NULL DEFAULT 1,
+    -- Set for encrypted notes, whose blocks hold ciphertext
+    key_salt TEXT,
+    key_check TEXT
 );
+CREATE INDEX IF NOT EXISTS notes_owner_id ON notes (owner_id);
 CREATE TABLE IF NOT EXISTS blocks (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     sort_order INTEGER NOT NULL,
     content TEXT NOT NULL,
     note_id INTEGER NOT NULL,
+    type TEXT NOT NULL DEFAULT 'text',
+    parent_id INTEGER REFERENCES blocks (id),
+    collapsed BOOLEAN NOT NULL DEFAULT FALSE,
+    checked BOOLEAN NOT NULL DEFAULT FALSE,
+    attachment TEXT REFERENCES attachments (hash),
+    language TEXT NOT NULL DEFAULT '',
+    version INTEGER NOT NULL DEFAULT 1,
     FOREIGN KEY (note_id) REFERENCES notes (id)
 );
+CREATE TABLE IF NOT EXISTS attachments (
+    hash TEXT PRIMARY KEY,
+    mime_type TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    -- Sealed with the key of the encrypted note holding it
+    encrypted BOOLEAN NOT NULL DEFAULT FALSE
+);
 
 CREATE VIRTUAL TABLE IF NOT EXISTS quick_search
 USING fts5(note_id UNINDEXED, title, content, tokenize="trigram");
@@ -52,6 +108,7 @@ AFTER INSERT ON blocks
                 group_concat(content, ' | ')
             FROM blocks
             WHERE note_id = NEW.note_id
+            AND note_id NOT IN (SELECT id FROM notes WHERE key_salt IS NOT NULL)
         )
         WHERE note_id = NEW.note_id;
     END;
@@ -65,25 +122,407 @@ AFTER UPDATE OF content ON blocks
                 group_concat(content, ' | ')
             FROM blocks
             WHERE note_id = NEW.note_id
+            AND note_id NOT IN (SELECT id FROM notes WHERE key_salt IS NOT NULL)
         )
         WHERE note_id = NEW.note_id;
     END;
 
+CREATE TRIGGER IF NOT EXISTS move_block_in_quick_search
+AFTER UPDATE OF note_id ON blocks
+    BEGIN
+        UPDATE quick_search
+        SET (content) = (
+            SELECT
+                group_concat(content, ' | ')
+            FROM blocks
+            WHERE note_id = quick_search.note_id
+            AND note_id NOT IN (SELECT id FROM notes WHERE key_salt IS NOT NULL)
+        )
+        WHERE note_id IN (OLD.note_id, NEW.note_id);
+    END;
+
+CREATE TRIGGER IF NOT EXISTS remove_block_from_quick_search
+AFTER DELETE ON blocks
+    BEGIN
+        UPDATE quick_search
+        SET (content) = (
+            SELECT
+                group_concat(content, ' | ')
+            FROM blocks
+            WHERE note_id = OLD.note_id
+            AND note_id NOT IN (SELECT id FROM notes WHERE key_salt IS NOT NULL)
+        )
+        WHERE note_id = OLD.note_id;
+    END;
+
+-- Versions count edits, so edits made on stale content can be caught
+CREATE TRIGGER IF NOT EXISTS bump_note_version
+AFTER UPDATE OF title ON notes
+WHEN NEW.title IS NOT OLD.title
+    BEGIN
+        UPDATE notes
+        SET version = OLD.version + 1
+        WHERE id = NEW.id;
+    END;
+
+CREATE TRIGGER IF NOT EXISTS bump_block_version
+AFTER UPDATE OF content ON blocks
+WHEN NEW.content IS NOT OLD.content
+    BEGIN
+        UPDATE blocks
+        SET version = OLD.version + 1
+        WHERE id = NEW.id;
+    END;
+
+CREATE TABLE IF NOT EXISTS shares (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    note_id INTEGER NOT NULL REFERENCES notes (id),
+    token TEXT NOT NULL UNIQUE,
+    password_hash TEXT,
+    expires_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS shares_note_id ON shares (note_id);
+
+CREATE TABLE IF NOT EXISTS collaborators (
+    note_id INTEGER NOT NULL REFERENCES notes (id),
+    user_id INTEGER NOT NULL REFERENCES users (id),
+    role TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (note_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS collaborators_user_id ON collaborators (user_id);
+
+-- Who can see each note: its owner, and everyone it is shared with
+CREATE VIEW IF NOT EXISTS note_access AS
+SELECT id AS note_id, owner_id AS user_id, 'owner' AS role FROM notes
+UNION ALL
+SELECT note_id, user_id, role FROM collaborators;
+
+-- Sealed like block contents, with the note's key when it is encrypted
+CREATE TABLE IF NOT EXISTS comments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    note_id INTEGER NOT NULL REFERENCES notes (id),
+    user_id INTEGER NOT NULL REFERENCES users (id),
+    content TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS comments_note_id ON comments (note_id);
+
 CREATE TABLE IF NOT EXISTS notes_archive (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     created_at DATETIME NOT NULL,
     modified_at DATETIME NOT NULL,
     archived_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-    title TEXT NOT NULL
+    title TEXT NOT NULL,
+    owner_id INTEGER REFERENCES users (id),
+    key_salt TEXT,
+    key_check TEXT
 );
+CREATE INDEX IF NOT EXISTS notes_archive_owner_id ON notes_archive (owner_id);
 CREATE TABLE IF NOT EXISTS blocks_archive (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     sort_order INTEGER NOT NULL,
     content TEXT NOT NULL,
     note_id INTEGER NOT NULL,
+    type TEXT NOT NULL DEFAULT 'text',
+    parent_id INTEGER REFERENCES blocks_archive (id),
+    collapsed BOOLEAN NOT NULL DEFAULT FALSE,
+    checked BOOLEAN NOT NULL DEFAULT FALSE,
+    attachment TEXT REFERENCES attachments (hash),
+    language TEXT NOT NULL DEFAULT '',
     FOREIGN KEY (note_id) REFERENCES notes_archive (id)
 );
 
+-- The data key titles, block contents and attachments are sealed with,
+-- when the database is encrypted at rest, itself sealed under the store
+-- key. files_sealed is whether attachments are sealed with it yet.
+CREATE TABLE IF NOT EXISTS store_key (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    data_key TEXT NOT NULL,
+    files_sealed BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+-- Every change made to the tables above, appended by triggers and never
+-- updated or deleted. user_id is who made it and owner_id whose data it
+-- changed. Titles and contents are kept as stored, so they stay sealed
+-- and encrypted as they were.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    user_id INTEGER,
+    owner_id INTEGER,
+    action TEXT NOT NULL,
+    entity TEXT NOT NULL,
+    entity_id INTEGER NOT NULL,
+    note_id INTEGER,
+    field TEXT NOT NULL DEFAULT '',
+    before TEXT,
+    after TEXT,
+    -- Whether before and after are sealed with the note's passphrase
+    encrypted BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE INDEX IF NOT EXISTS audit_log_note_id ON audit_log (note_id);
+CREATE INDEX IF NOT EXISTS audit_log_owner_id ON audit_log (owner_id);
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_update
+BEFORE UPDATE ON audit_log
+WHEN auditing()
+    BEGIN
+        SELECT RAISE(ABORT, 'audit_log is append-only');
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_log_no_delete
+BEFORE DELETE ON audit_log
+    BEGIN
+        SELECT RAISE(ABORT, 'audit_log is append-only');
+    END;
+
+CREATE TRIGGER IF NOT EXISTS audit_create_note
+AFTER INSERT ON notes
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, after)
+        VALUES (audit_user(), NEW.owner_id, audit_action('create'), 'note', NEW.id, NEW.id, 'title', NEW.title);
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_delete_note
+AFTER DELETE ON notes
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before)
+        VALUES (audit_user(), OLD.owner_id, audit_action('delete'), 'note', OLD.id, OLD.id, 'title', OLD.title);
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_update_note_title
+AFTER UPDATE OF title ON notes
+WHEN auditing() AND NEW.title IS NOT OLD.title
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before, after)
+        VALUES (audit_user(), NEW.owner_id, audit_action('update'), 'note', NEW.id, NEW.id, 'title', OLD.title, NEW.title);
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_update_note_owner
+AFTER UPDATE OF owner_id ON notes
+WHEN NEW.owner_id IS NOT OLD.owner_id
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before, after)
+        VALUES (audit_user(), NEW.owner_id, audit_action('update'), 'note', NEW.id, NEW.id, 'owner_id', OLD.owner_id, NEW.owner_id);
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_update_note_hide_completed
+AFTER UPDATE OF hide_completed ON notes
+WHEN NEW.hide_completed IS NOT OLD.hide_completed
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before, after)
+        VALUES (
+            audit_user(), NEW.owner_id, audit_action('update'), 'note', NEW.id, NEW.id, 'hide_completed',
+            CASE WHEN OLD.hide_completed THEN 'true' ELSE 'false' END,
+            CASE WHEN NEW.hide_completed THEN 'true' ELSE 'false' END
+        );
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_update_note_encrypted
+AFTER UPDATE OF key_salt ON notes
+WHEN (NEW.key_salt IS NULL) IS NOT (OLD.key_salt IS NULL)
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before, after)
+        VALUES (
+            audit_user(), NEW.owner_id, audit_action('update'), 'note', NEW.id, NEW.id, 'encrypted',
+            CASE WHEN OLD.key_salt IS NULL THEN 'false' ELSE 'true' END,
+            CASE WHEN NEW.key_salt IS NULL THEN 'false' ELSE 'true' END
+        );
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_delete_archived_note
+AFTER DELETE ON notes_archive
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, field, before)
+        VALUES (audit_user(), OLD.owner_id, audit_action('delete'), 'archived_note', OLD.id, 'title', OLD.title);
+    END;
+
+CREATE TRIGGER IF NOT EXISTS audit_create_block
+AFTER INSERT ON blocks
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, after, encrypted)
+        SELECT
+            audit_user(), owner_id, audit_action('create'),
+            'block', NEW.id, NEW.note_id, 'content', NEW.content, key_salt IS NOT NULL
+        FROM notes
+        WHERE id = NEW.note_id;
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_delete_block
+AFTER DELETE ON blocks
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before, encrypted)
+        SELECT
+            audit_user(), owner_id, audit_action('delete'),
+            'block', OLD.id, OLD.note_id, 'content', OLD.content, key_salt IS NOT NULL
+        FROM notes
+        WHERE id = OLD.note_id;
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_update_block_content
+AFTER UPDATE OF content ON blocks
+WHEN auditing() AND NEW.content IS NOT OLD.content
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before, after, encrypted)
+        SELECT
+            audit_user(), owner_id, audit_action('update'),
+            'block', NEW.id, NEW.note_id, 'content', OLD.content, NEW.content, key_salt IS NOT NULL
+        FROM notes
+        WHERE id = NEW.note_id;
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_update_block_type
+AFTER UPDATE OF type ON blocks
+WHEN NEW.type IS NOT OLD.type
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before, after)
+        VALUES (
+            audit_user(), (SELECT owner_id FROM notes WHERE id = NEW.note_id), audit_action('update'),
+            'block', NEW.id, NEW.note_id, 'type', OLD.type, NEW.type
+        );
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_update_block_language
+AFTER UPDATE OF language ON blocks
+WHEN NEW.language IS NOT OLD.language
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before, after)
+        VALUES (
+            audit_user(), (SELECT owner_id FROM notes WHERE id = NEW.note_id), audit_action('update'),
+            'block', NEW.id, NEW.note_id, 'language', OLD.language, NEW.language
+        );
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_update_block_checked
+AFTER UPDATE OF checked ON blocks
+WHEN NEW.checked IS NOT OLD.checked
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before, after)
+        VALUES (
+            audit_user(), (SELECT owner_id FROM notes WHERE id = NEW.note_id), audit_action('update'),
+            'block', NEW.id, NEW.note_id, 'checked',
+            CASE WHEN OLD.checked THEN 'true' ELSE 'false' END,
+            CASE WHEN NEW.checked THEN 'true' ELSE 'false' END
+        );
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_update_block_collapsed
+AFTER UPDATE OF collapsed ON blocks
+WHEN NEW.collapsed IS NOT OLD.collapsed
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before, after)
+        VALUES (
+            audit_user(), (SELECT owner_id FROM notes WHERE id = NEW.note_id), audit_action('update'),
+            'block', NEW.id, NEW.note_id, 'collapsed',
+            CASE WHEN OLD.collapsed THEN 'true' ELSE 'false' END,
+            CASE WHEN NEW.collapsed THEN 'true' ELSE 'false' END
+        );
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_move_block
+AFTER UPDATE OF note_id, parent_id, sort_order ON blocks
+WHEN (NEW.note_id, NEW.parent_id, NEW.sort_order) IS NOT (OLD.note_id, OLD.parent_id, OLD.sort_order)
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before, after)
+        VALUES (
+            audit_user(), (SELECT owner_id FROM notes WHERE id = NEW.note_id), audit_action('move'),
+            'block', NEW.id, NEW.note_id, 'position',
+            json_object('note_id', OLD.note_id, 'parent_id', OLD.parent_id, 'sort_order', OLD.sort_order),
+            json_object('note_id', NEW.note_id, 'parent_id', NEW.parent_id, 'sort_order', NEW.sort_order)
+        );
+    END;
+
+CREATE TRIGGER IF NOT EXISTS audit_create_share
+AFTER INSERT ON shares
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, after)
+        VALUES (
+            audit_user(), (SELECT owner_id FROM notes WHERE id = NEW.note_id), audit_action('create'),
+            'share', NEW.id, NEW.note_id,
+            json_object('expires_at', NEW.expires_at, 'password', json(CASE WHEN NEW.password_hash IS NULL THEN 'false' ELSE 'true' END))
+        );
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_delete_share
+AFTER DELETE ON shares
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, before)
+        VALUES (
+            audit_user(), (SELECT owner_id FROM notes WHERE id = OLD.note_id), audit_action('delete'),
+            'share', OLD.id, OLD.note_id,
+            json_object('expires_at', OLD.expires_at, 'password', json(CASE WHEN OLD.password_hash IS NULL THEN 'false' ELSE 'true' END))
+        );
+    END;
+
+CREATE TRIGGER IF NOT EXISTS audit_create_collaborator
+AFTER INSERT ON collaborators
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, after)
+        VALUES (
+            audit_user(), (SELECT owner_id FROM notes WHERE id = NEW.note_id), audit_action('create'),
+            'collaborator', NEW.user_id, NEW.note_id, 'role', NEW.role
+        );
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_update_collaborator
+AFTER UPDATE OF role ON collaborators
+WHEN NEW.role IS NOT OLD.role
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before, after)
+        VALUES (
+            audit_user(), (SELECT owner_id FROM notes WHERE id = NEW.note_id), audit_action('update'),
+            'collaborator', NEW.user_id, NEW.note_id, 'role', OLD.role, NEW.role
+        );
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_delete_collaborator
+AFTER DELETE ON collaborators
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before)
+        VALUES (
+            audit_user(), (SELECT owner_id FROM notes WHERE id = OLD.note_id), audit_action('delete'),
+            'collaborator', OLD.user_id, OLD.note_id, 'role', OLD.role
+        );
+    END;
+
+CREATE TRIGGER IF NOT EXISTS audit_create_token
+AFTER INSERT ON api_tokens
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, after)
+        VALUES (
+            audit_user(), NEW.user_id, audit_action('create'), 'token', NEW.id,
+            json_object('name', NEW.name, 'scope', NEW.scope)
+        );
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_delete_token
+AFTER DELETE ON api_tokens
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, before)
+        VALUES (
+            audit_user(), OLD.user_id, audit_action('delete'), 'token', OLD.id,
+            json_object('name', OLD.name, 'scope', OLD.scope)
+        );
+    END;
+
+CREATE TRIGGER IF NOT EXISTS audit_create_comment
+AFTER INSERT ON comments
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, after, encrypted)
+        SELECT
+            audit_user(), owner_id, audit_action('create'),
+            'comment', NEW.id, NEW.note_id, 'content', NEW.content, key_salt IS NOT NULL
+        FROM notes
+        WHERE id = NEW.note_id;
+    END;
+CREATE TRIGGER IF NOT EXISTS audit_delete_comment
+AFTER DELETE ON comments
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, note_id, field, before, encrypted)
+        SELECT
+            audit_user(), owner_id, audit_action('delete'),
+            'comment', OLD.id, OLD.note_id, 'content', OLD.content, key_salt IS NOT NULL
+        FROM notes
+        WHERE id = OLD.note_id;
+    END;
+
+CREATE TRIGGER IF NOT EXISTS audit_create_user
+AFTER INSERT ON users
+    BEGIN
+        INSERT INTO audit_log (user_id, owner_id, action, entity, entity_id, field, after)
+        VALUES (audit_user(), NEW.id, audit_action('create'), 'user', NEW.id, 'username', NEW.username);
+    END;
+
+-- Seed a demo account, which owns every note below
+-- (username demo, password gonote-demo)
+
+INSERT INTO users (username, password_hash) VALUES
+('demo', '$2a$10$8NpLFu5FaoD7u2R87ej.guNFUHVI0ysDHfpPEniODTVoAXlAwUfKO');
+
 -- Seed notes and blocks data
 
 -- Insert 20 notes with varying titles
@@ -269,4 +708,7 @@ INSERT INTO blocks_archive (sort_order, content, note_id) VALUES
 (1, 'Post-launch analysis indicates that user engagement has significantly improved.', 5),
 (2, 'Some bugs have been reported by early users; need to address them quickly.', 5),
 (3, 'The feature usage statistics are being collected for future enhancements.', 5),
-(4, 'Customer feedback survey results show high satisfaction with new features.', 5);
\ No newline at end of file
+(4, 'Customer feedback survey results show high satisfaction with new features.', 5);
+
+UPDATE notes SET owner_id = 1;
+UPDATE notes_archive SET owner_id = 1;
@@ -3,7 +3,11 @@ module github.com/jadenrose/go-note
 go 1.23.4
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/labstack/echo/v4 v4.13.2
+	github.com/labstack/gommon v0.4.2
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.32.0
 	modernc.org/sqlite v1.34.2
 )
 
@@ -11,15 +15,12 @@ require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
-	github.com/labstack/gommon v0.4.2 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/ncruces/go-strftime v0.1.9 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.2 // indirect
-	golang.org/x/crypto v0.31.0 // indirect
-	golang.org/x/net v0.32.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 	golang.org/x/time v0.8.0 // indirect
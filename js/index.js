@@ -4,6 +4,21 @@ const POST = 'post';
 const PUT = 'put';
 
 htmx.on('htmx:beforeSwap', (e) => {
+	// Error fragments are retargeted to #errors by the server
+	if (e.detail.xhr.getResponseHeader('X-Error-Fragment')) {
+		e.detail.shouldSwap = true;
+		e.detail.isError = false;
+		return;
+	}
+
+	// An edit made on an out-of-date version comes back as a conflict to
+	// settle in its editor's place
+	if (e.detail.xhr.status === 409) {
+		e.detail.shouldSwap = true;
+		e.detail.isError = false;
+		return;
+	}
+
 	if (e.detail.xhr.status === 422) {
 		switch (e.detail.requestConfig.verb) {
 			// On semantic error, replace with original
@@ -47,6 +62,824 @@ htmx.on('htmx:load', (e) => {
 	}
 });
 
+// Drag and drop blocks to reorder them. The block is moved in the DOM
+// while dragging and where it ends up, after the sibling above it or
+// first under its parent, is sent to the server on drop.
+let draggedBlock = null;
+
+document.addEventListener('dragstart', (e) => {
+	const container = e.target.closest?.('.block-container');
+	if (!container) {
+		return;
+	}
+
+	draggedBlock = container;
+	container.classList.add('dragging');
+	e.dataTransfer.effectAllowed = 'move';
+});
+
+document.addEventListener('dragover', (e) => {
+	const over = e.target.closest?.('.block-container');
+	// A block can't be dropped among its own children
+	if (!draggedBlock || !over || draggedBlock.contains(over)) {
+		return;
+	}
+
+	e.preventDefault();
+	const rect = over.getBoundingClientRect();
+	const after = e.clientY > rect.top + rect.height / 2;
+	over.parentNode.insertBefore(
+		draggedBlock,
+		after ? over.nextSibling : over,
+	);
+});
+
+document.addEventListener('drop', (e) => {
+	if (draggedBlock) {
+		e.preventDefault();
+	}
+});
+
+document.addEventListener('dragend', () => {
+	if (!draggedBlock) {
+		return;
+	}
+
+	const blockId = draggedBlock.dataset.blockId;
+	const previous = previousBlock(draggedBlock);
+	const parent = draggedBlock.parentNode.closest('.block-container');
+	draggedBlock.classList.remove('dragging');
+	draggedBlock = null;
+
+	const placement = previous
+		? `after_block_id=${previous.dataset.blockId}`
+		: `position=0&parent_id=${parent?.dataset.blockId ?? 0}`;
+	htmx.ajax('PUT', `/blocks/${blockId}/move?${placement}`, {
+		target: '#blocks',
+		swap: 'outerHTML',
+	});
+});
+
+const previousBlock = (container) => {
+	let sibling = container.previousElementSibling;
+	while (sibling && !sibling.matches('.block-container')) {
+		sibling = sibling.previousElementSibling;
+	}
+	return sibling;
+};
+
+// Enter inside a block editor splits the block at the caret and
+// Backspace at its start merges it into the block above. Tab and
+// Shift+Tab indent and outdent it. The editor is marked as replaced so
+// its own save on blur does not follow. Code blocks are edited in a
+// textarea, where these keys keep their usual meaning and Tab indents
+// the code instead.
+let pendingCaret = null;
+
+const openBlockEditor = (blockId, caret) => {
+	const block = document.getElementById(`block-${blockId}`);
+	if (!block) {
+		return;
+	}
+
+	pendingCaret = { blockId, caret };
+	htmx.trigger(block, 'click');
+};
+
+document.addEventListener(
+	'keydown',
+	(e) => {
+		const editor = e.target;
+		if (!editor.matches?.('.block-editor[data-block-id]')) {
+			return;
+		}
+
+		if (editor.matches('textarea')) {
+			if (e.key === 'Tab' && !e.shiftKey && !e.ctrlKey && !e.metaKey) {
+				e.preventDefault();
+				editor.setRangeText(
+					'\t',
+					editor.selectionStart,
+					editor.selectionEnd,
+					'end',
+				);
+			}
+			return;
+		}
+
+		if (e.key === 'Tab' && !e.ctrlKey && !e.metaKey) {
+			e.preventDefault();
+			e.stopPropagation();
+			const blockId = editor.dataset.blockId;
+			const container = document.getElementById(
+				`block-container-${blockId}`,
+			);
+			const action = e.shiftKey ? 'outdent' : 'indent';
+			const possible = e.shiftKey
+				? container?.parentNode.closest('.block-container')
+				: container && previousBlock(container);
+			if (!possible) {
+				return;
+			}
+
+			editor.dataset.replaced = 'true';
+			const caret = editor.selectionStart;
+			htmx.ajax('PUT', `/blocks/${blockId}`, {
+				swap: 'none',
+				values: { content: editor.value, version: editor.dataset.version },
+			})
+				.then(() =>
+					htmx.ajax('PUT', `/blocks/${blockId}/${action}`, {
+						target: '#blocks',
+						swap: 'outerHTML',
+					}),
+				)
+				.then(() => openBlockEditor(blockId, () => caret));
+			return;
+		}
+
+		if (
+			e.shiftKey ||
+			e.ctrlKey ||
+			e.metaKey ||
+			editor.selectionStart !== editor.selectionEnd
+		) {
+			return;
+		}
+
+		const blockId = editor.dataset.blockId;
+		const caret = editor.selectionStart;
+		const content = editor.value;
+		const containers = [
+			...document.querySelectorAll('#blocks .block-container'),
+		];
+		const index = containers.findIndex(
+			(container) => container.dataset.blockId === blockId,
+		);
+
+		if (e.key === 'Enter' && caret > 0 && caret < content.length) {
+			e.preventDefault();
+			e.stopPropagation();
+			editor.dataset.replaced = 'true';
+			// The server counts characters, not UTF-16 code units
+			const offset = [...content.slice(0, caret)].length;
+			htmx.ajax('POST', `/blocks/${blockId}/split`, {
+				target: '#blocks',
+				swap: 'outerHTML',
+				values: { content, offset, version: editor.dataset.version },
+			}).then(() => {
+				const split = document.getElementById(
+					`block-container-${blockId}`,
+				)?.nextElementSibling;
+				if (split?.dataset.blockId) {
+					openBlockEditor(split.dataset.blockId, () => 0);
+				}
+			});
+			return;
+		}
+
+		if (e.key === 'Backspace' && caret === 0 && index > 0) {
+			e.preventDefault();
+			e.stopPropagation();
+			editor.dataset.replaced = 'true';
+			const previousId = containers[index - 1].dataset.blockId;
+			const appended = content.trim();
+			htmx.ajax('POST', `/blocks/${blockId}/merge`, {
+				target: '#blocks',
+				swap: 'outerHTML',
+				values: { content, version: editor.dataset.version },
+			}).then(() => {
+				openBlockEditor(previousId, (value) =>
+					appended ? value.length - appended.length - 1 : value.length,
+				);
+			});
+		}
+	},
+	true,
+);
+
+htmx.on('htmx:beforeRequest', (e) => {
+	if (e.detail.elt.dataset?.replaced) {
+		e.preventDefault();
+	}
+});
+
+htmx.on('htmx:afterSettle', () => {
+	const editor = document.getElementById('block-editor');
+	if (!pendingCaret || editor?.dataset.blockId !== pendingCaret.blockId) {
+		return;
+	}
+
+	const caret = pendingCaret.caret(editor.value);
+	pendingCaret = null;
+	editor.focus();
+	editor.setSelectionRange(caret, caret);
+});
+
+// Select blocks with ctrl/cmd-click (toggle) and shift-click (range).
+// The selected ids are kept as block_id inputs in #block-selection so
+// its bulk actions can include them.
+let selectionAnchor = null;
+
+const selectedBlocks = () => [
+	...document.querySelectorAll('#blocks .block-container.selected'),
+];
+
+const syncBlockSelection = () => {
+	const form = document.getElementById('block-selection');
+	if (!form) {
+		return;
+	}
+
+	const blocks = selectedBlocks();
+	for (const input of form.querySelectorAll('input[name="block_id"]')) {
+		input.remove();
+	}
+	for (const block of blocks) {
+		const input = document.createElement('input');
+		input.type = 'hidden';
+		input.name = 'block_id';
+		input.value = block.dataset.blockId;
+		form.append(input);
+	}
+
+	form.hidden = blocks.length === 0;
+	document.getElementById('block-selection-count').textContent =
+		`${blocks.length} selected`;
+};
+
+const clearBlockSelection = () => {
+	for (const block of selectedBlocks()) {
+		block.classList.remove('selected');
+	}
+	selectionAnchor = null;
+	document.getElementById('block-selection')?.reset();
+	syncBlockSelection();
+};
+
+document.addEventListener(
+	'click',
+	(e) => {
+		const container = e.target.closest?.('#blocks .block-container');
+		if (!container || !(e.shiftKey || e.ctrlKey || e.metaKey)) {
+			return;
+		}
+
+		// Keep the click from opening the block editor
+		e.preventDefault();
+		e.stopPropagation();
+
+		if (e.shiftKey && selectionAnchor?.isConnected) {
+			const containers = [
+				...document.querySelectorAll('#blocks .block-container'),
+			];
+			const from = containers.indexOf(selectionAnchor);
+			const to = containers.indexOf(container);
+			for (const block of containers.slice(
+				Math.min(from, to),
+				Math.max(from, to) + 1,
+			)) {
+				block.classList.add('selected');
+			}
+		} else {
+			container.classList.toggle('selected');
+			selectionAnchor = container;
+		}
+		syncBlockSelection();
+	},
+	true,
+);
+
+document.addEventListener('keydown', (e) => {
+	if (e.key === 'Escape' && selectedBlocks().length > 0) {
+		clearBlockSelection();
+	}
+});
+
+// Bulk actions end the selection; swaps may also remove selected blocks
+htmx.on('htmx:afterRequest', (e) => {
+	if (
+		e.detail.successful &&
+		e.detail.requestConfig.verb !== 'get' &&
+		e.detail.elt.closest?.('#block-selection')
+	) {
+		clearBlockSelection();
+	}
+});
+htmx.on('htmx:afterSettle', syncBlockSelection);
+
+// Copies the raw source of the code block holding button
+const copyCode = (button) => {
+	const code = button.closest('.block--code').querySelector('code');
+	navigator.clipboard.writeText(code.textContent).then(() => {
+		button.textContent = 'copied';
+		setTimeout(() => (button.textContent = 'copy'), 1500);
+	});
+};
+
+// Files dropped or pasted into a note are uploaded through
+// #attachment-upload, landing after the block they were dropped on or
+// pasted into.
+const uploadAttachments = (files, afterBlockId) => {
+	const form = document.getElementById('attachment-upload');
+	if (!form || files.length === 0) {
+		return;
+	}
+
+	const transfer = new DataTransfer();
+	for (const file of files) {
+		transfer.items.add(file);
+	}
+	form.elements.file.files = transfer.files;
+	form.elements.after_block_id.value = afterBlockId ?? '';
+	htmx.trigger(form, 'submit');
+};
+
+document.addEventListener('dragover', (e) => {
+	if (
+		!draggedBlock &&
+		e.dataTransfer.types.includes('Files') &&
+		e.target.closest?.('#main-container')
+	) {
+		e.preventDefault();
+	}
+});
+
+document.addEventListener('drop', (e) => {
+	if (
+		draggedBlock ||
+		e.dataTransfer.files.length === 0 ||
+		!e.target.closest?.('#main-container')
+	) {
+		return;
+	}
+
+	e.preventDefault();
+	uploadAttachments(
+		e.dataTransfer.files,
+		e.target.closest('.block-container')?.dataset.blockId,
+	);
+});
+
+document.addEventListener('paste', (e) => {
+	const files = e.clipboardData?.files;
+	if (!files?.length || !document.getElementById('attachment-upload')) {
+		return;
+	}
+
+	e.preventDefault();
+	uploadAttachments(
+		files,
+		document.activeElement?.closest?.('.block-container')?.dataset.blockId,
+	);
+});
+
+// Changes made in other tabs, by this user or their collaborators,
+// arrive as server-sent events, which the elements showing them reload
+// on with hx-trigger="sse:<type>". Requests name the tab the page was
+// served to, so the server does not echo its own changes back.
+const tabId = () => document.body.dataset.tab;
+
+htmx.on('htmx:configRequest', (e) => {
+	e.detail.headers['GoNote-Tab'] = tabId();
+	// A block edited live is saved as it is typed; its save on blur only
+	// closes the editor
+	if (
+		e.detail.verb === PUT &&
+		live.rev !== null &&
+		e.detail.path === `/blocks/${live.blockId}`
+	) {
+		e.detail.parameters.live = 'true';
+	}
+});
+
+const editingNote = () =>
+	document.querySelector(
+		'#main-container #block-editor, #title-editor, #main-container .edit-conflict',
+	);
+
+// A note being edited is reloaded once the editor closes, rather than
+// from under it
+let staleNote = null;
+
+htmx.on('htmx:beforeRequest', (e) => {
+	if (!e.detail.elt.matches?.('.live-note') || !editingNote()) {
+		return;
+	}
+
+	e.preventDefault();
+	staleNote = e.detail.elt;
+});
+
+htmx.on('htmx:afterSettle', () => {
+	if (!staleNote || editingNote()) {
+		return;
+	}
+
+	const live = staleNote;
+	staleNote = null;
+	if (live.isConnected) {
+		htmx.trigger(live, 'refresh');
+	}
+});
+
+// The open note was archived or unshared elsewhere
+htmx.on('htmx:beforeSwap', (e) => {
+	if (
+		e.detail.requestConfig.elt.matches?.('.live-note') &&
+		e.detail.xhr.status === 404
+	) {
+		e.detail.shouldSwap = false;
+		window.location.assign('/');
+	}
+});
+
+// Blocks are edited together over a WebSocket on the open note. Edits
+// go out as operations, as in ot.js: runs of characters to retain (n),
+// delete (-n) or insert (a string). Each is made on a revision of the
+// block; the server brings it past the edits others made meanwhile and
+// this tab brings theirs past its own, until the server acknowledges
+// them.
+const live = {
+	socket: null,
+	noteId: null,
+	blockId: null,
+	// The revision the editor is at, once the server sent the block
+	rev: null,
+	// The editor's value as last seen
+	value: '',
+	// The edit awaiting acknowledgement and those made since
+	sent: null,
+	queue: [],
+	editors: [],
+};
+
+const retain = (op, n) => {
+	if (n === 0) {
+		return;
+	}
+	const last = op.length - 1;
+	if (typeof op[last] === 'number' && op[last] > 0) {
+		op[last] += n;
+	} else {
+		op.push(n);
+	}
+};
+
+const remove = (op, n) => {
+	if (n === 0) {
+		return;
+	}
+	const last = op.length - 1;
+	if (typeof op[last] === 'number' && op[last] < 0) {
+		op[last] -= n;
+	} else {
+		op.push(-n);
+	}
+};
+
+// Inserts go ahead of a delete at the same place, as on the server
+const insert = (op, s) => {
+	if (!s) {
+		return;
+	}
+	const last = op.length - 1;
+	if (typeof op[last] === 'string') {
+		op[last] += s;
+	} else if (typeof op[last] === 'number' && op[last] < 0) {
+		if (typeof op[last - 1] === 'string') {
+			op[last - 1] += s;
+		} else {
+			op.splice(last, 0, s);
+		}
+	} else {
+		op.push(s);
+	}
+};
+
+const applyOp = (text, op) => {
+	let at = 0;
+	let edited = '';
+	for (const part of op) {
+		if (typeof part === 'string') {
+			edited += part;
+		} else if (part > 0) {
+			edited += text.slice(at, at + part);
+			at += part;
+		} else {
+			at -= part;
+		}
+	}
+	return edited;
+};
+
+// Rewrites concurrent edits a and b so that a then b' equals b then a'.
+// Where both insert at the same place, a's insert goes first.
+const transformOps = (a, b) => {
+	const aPrime = [];
+	const bPrime = [];
+	let i = 0;
+	let j = 0;
+	let pa = a[i++];
+	let pb = b[j++];
+	while (pa !== undefined || pb !== undefined) {
+		if (typeof pa === 'string') {
+			insert(aPrime, pa);
+			retain(bPrime, pa.length);
+			pa = a[i++];
+			continue;
+		}
+		if (typeof pb === 'string') {
+			retain(aPrime, pb.length);
+			insert(bPrime, pb);
+			pb = b[j++];
+			continue;
+		}
+		if (pa === undefined || pb === undefined) {
+			throw new Error('The edits do not fit the same block');
+		}
+
+		const n = Math.min(Math.abs(pa), Math.abs(pb));
+		if (pa > 0 && pb > 0) {
+			retain(aPrime, n);
+			retain(bPrime, n);
+		} else if (pa < 0 && pb > 0) {
+			remove(aPrime, n);
+		} else if (pa > 0 && pb < 0) {
+			remove(bPrime, n);
+		}
+		pa = pa > 0 ? pa - n : pa + n;
+		pb = pb > 0 ? pb - n : pb + n;
+		if (pa === 0) {
+			pa = a[i++];
+		}
+		if (pb === 0) {
+			pb = b[j++];
+		}
+	}
+	return [aPrime, bPrime];
+};
+
+const isLowSurrogate = (text, i) => /[\uDC00-\uDFFF]/.test(text.charAt(i));
+
+// The edit turning before into after, as one change between the parts
+// they share at either end. Surrogate pairs are kept whole.
+const diffOp = (before, after) => {
+	let start = 0;
+	while (
+		start < before.length &&
+		start < after.length &&
+		before[start] === after[start]
+	) {
+		start++;
+	}
+	let end = 0;
+	while (
+		end < before.length - start &&
+		end < after.length - start &&
+		before[before.length - 1 - end] === after[after.length - 1 - end]
+	) {
+		end++;
+	}
+	if (
+		start > 0 &&
+		(isLowSurrogate(before, start) || isLowSurrogate(after, start))
+	) {
+		start--;
+	}
+	if (
+		end > 0 &&
+		(isLowSurrogate(before, before.length - end) ||
+			isLowSurrogate(after, after.length - end))
+	) {
+		end--;
+	}
+
+	const op = [];
+	retain(op, start);
+	remove(op, before.length - start - end);
+	insert(op, after.slice(start, after.length - end));
+	retain(op, end);
+	return op;
+};
+
+// Where a caret ends up after op. Text inserted right at it goes after.
+const transformCaret = (caret, op) => {
+	let at = 0;
+	let moved = caret;
+	for (const part of op) {
+		if (at >= caret) {
+			break;
+		}
+		if (typeof part === 'string') {
+			moved += part.length;
+		} else if (part > 0) {
+			at += part;
+		} else {
+			moved -= Math.min(-part, caret - at);
+			at -= part;
+		}
+	}
+	return moved;
+};
+
+const liveSend = (msg) => {
+	if (live.socket?.readyState === WebSocket.OPEN) {
+		live.socket.send(JSON.stringify(msg));
+	}
+};
+
+const liveEditor = () =>
+	document.querySelector(`#block-editor[data-block-id="${live.blockId}"]`);
+
+const flushLive = () => {
+	if (live.sent || !live.queue.length) {
+		return;
+	}
+
+	live.sent = live.queue.shift();
+	liveSend({
+		type: 'op',
+		block_id: Number(live.blockId),
+		rev: live.rev,
+		op: live.sent,
+	});
+};
+
+const focusLive = () => {
+	live.rev = null;
+	live.sent = null;
+	live.queue = [];
+	if (live.blockId) {
+		liveSend({ type: 'focus', block_id: Number(live.blockId) });
+	}
+};
+
+// Marks the blocks others are editing
+const showEditors = () => {
+	for (const block of document.querySelectorAll(
+		'.block-container[data-editing]',
+	)) {
+		delete block.dataset.editing;
+	}
+	for (const editor of live.editors) {
+		const block = document.getElementById(
+			`block-container-${editor.block_id}`,
+		);
+		if (block) {
+			block.dataset.editing = block.dataset.editing
+				? `${block.dataset.editing}, ${editor.username}`
+				: editor.username;
+		}
+	}
+};
+
+const showLiveError = (msg) => {
+	const status = document.createElement('span');
+	status.className = 'loud';
+	status.textContent = msg.status;
+	const error = document.createElement('div');
+	error.className = 'error';
+	error.role = 'alert';
+	error.append(status, ` ${msg.error}`);
+	error.addEventListener('click', () => error.remove());
+	setTimeout(() => error.remove(), 5000);
+	document.getElementById('errors')?.append(error);
+};
+
+const receiveLive = (msg) => {
+	if (msg.type === 'presence') {
+		live.editors = msg.editors ?? [];
+		showEditors();
+		return;
+	}
+	if (msg.type === 'error') {
+		showLiveError(msg);
+		// A rejected edit leaves this tab out of step; start over
+		if (String(msg.block_id) === live.blockId && live.rev !== null) {
+			focusLive();
+		}
+		return;
+	}
+	if (String(msg.block_id) !== live.blockId) {
+		return;
+	}
+
+	const editor = liveEditor();
+	switch (msg.type) {
+		case 'doc': {
+			live.rev = msg.rev;
+			live.sent = null;
+			live.queue = [];
+			live.value = msg.content ?? '';
+			if (editor && editor.value !== live.value) {
+				const caret = Math.min(editor.selectionStart, live.value.length);
+				editor.value = live.value;
+				editor.setSelectionRange(caret, caret);
+			}
+			break;
+		}
+		case 'ack': {
+			live.rev = msg.rev;
+			live.sent = null;
+			flushLive();
+			break;
+		}
+		case 'op': {
+			let op = msg.op;
+			if (live.sent) {
+				[live.sent, op] = transformOps(live.sent, op);
+			}
+			live.queue = live.queue.map((queued) => {
+				const [transformed, rest] = transformOps(queued, op);
+				op = rest;
+				return transformed;
+			});
+			live.rev = msg.rev;
+			live.value = applyOp(live.value, op);
+			if (editor) {
+				const start = transformCaret(editor.selectionStart, op);
+				const end = transformCaret(editor.selectionEnd, op);
+				editor.value = live.value;
+				editor.setSelectionRange(start, end);
+			}
+			break;
+		}
+	}
+};
+
+const connectLive = (noteId) => {
+	const previous = live.socket;
+	live.socket = null;
+	live.noteId = noteId;
+	live.editors = [];
+	previous?.close();
+	if (!noteId) {
+		return;
+	}
+
+	const scheme = location.protocol === 'https:' ? 'wss' : 'ws';
+	const socket = new WebSocket(
+		`${scheme}://${location.host}/notes/${noteId}/live?tab=${tabId()}`,
+	);
+	live.socket = socket;
+	socket.addEventListener('open', focusLive);
+	socket.addEventListener('message', (e) => receiveLive(JSON.parse(e.data)));
+	socket.addEventListener('close', () => {
+		if (live.socket !== socket) {
+			return;
+		}
+		live.socket = null;
+		live.rev = null;
+		setTimeout(() => {
+			if (live.noteId === noteId && !live.socket) {
+				connectLive(noteId);
+			}
+		}, 2000);
+	});
+};
+
+// Follows the open note and block editor after every swap
+const syncLive = () => {
+	const noteId =
+		document.querySelector('#main-container .live-note')?.dataset.noteId ??
+		null;
+	if (noteId !== live.noteId) {
+		connectLive(noteId);
+	}
+
+	const blockId =
+		document.querySelector('#block-editor[data-block-id]')?.dataset
+			.blockId ?? null;
+	if (blockId !== live.blockId) {
+		if (live.blockId) {
+			liveSend({ type: 'blur' });
+		}
+		live.blockId = blockId;
+		live.value = liveEditor()?.value ?? '';
+		focusLive();
+	}
+	showEditors();
+};
+
+htmx.on('htmx:afterSettle', syncLive);
+document.addEventListener('DOMContentLoaded', syncLive);
+
+document.addEventListener('input', (e) => {
+	const editor = e.target;
+	if (
+		!editor.matches?.('#block-editor[data-block-id]') ||
+		editor.dataset.blockId !== live.blockId ||
+		live.rev === null
+	) {
+		return;
+	}
+
+	live.queue.push(diffOp(live.value, editor.value));
+	live.value = editor.value;
+	flushLive();
+});
+
 window.onload = () => {
 	const input = document.getElementById('search-term');
 	document.addEventListener('keydown', (e) => {